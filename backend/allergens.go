@@ -0,0 +1,716 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// An ingredient, and in the end a recipe, either contains an allergen, may
+// contain it or is free from it.
+const (
+	allergenContains   = "contains"
+	allergenMayContain = "may_contain"
+	allergenFreeFrom   = "free_from"
+)
+
+var allergenStatuses = []string{allergenContains, allergenMayContain, allergenFreeFrom}
+
+// AllergenRule maps an ingredient term to an allergen. A rule also matches
+// everything below its term in the ingredient taxonomy, and when several
+// rules match one ingredient the one with the longest term decides, so
+// "coconut milk" can be free from dairy although "milk" contains it.
+type AllergenRule struct {
+	ID       int    `json:"id"`
+	Term     string `json:"term"`
+	Allergen string `json:"allergen"`
+	Status   string `json:"status"`
+}
+
+// AllergenReport is the classification of a recipe. Sources lists the
+// ingredients behind every allergen the recipe contains or may contain, and
+// Overrides the statuses that were set by hand.
+type AllergenReport struct {
+	Contains   []string            `json:"contains"`
+	MayContain []string            `json:"mayContain"`
+	FreeFrom   []string            `json:"freeFrom"`
+	Diets      []string            `json:"diets"`
+	Sources    map[string][]string `json:"sources,omitempty"`
+	Overrides  map[string]string   `json:"overrides,omitempty"`
+}
+
+// dietAllergens lists what a recipe has to be free from to suit a diet. Meat
+// and honey are not allergens but are classified the same way.
+var dietAllergens = map[string][]string{
+	"vegetarian":  {"meat", "fish", "shellfish"},
+	"pescatarian": {"meat"},
+	"vegan":       {"meat", "fish", "shellfish", "dairy", "egg", "honey"},
+	"gluten-free": {"gluten"},
+	"dairy-free":  {"dairy"},
+	"nut-free":    {"nuts", "peanuts"},
+}
+
+// defaultAllergenRules is seeded into an empty allergen_rules table as term,
+// allergen, status triples.
+var defaultAllergenRules = [][3]string{
+	{"flour", "gluten", allergenContains},
+	{"wheat", "gluten", allergenContains},
+	{"bread", "gluten", allergenContains},
+	{"breadcrumbs", "gluten", allergenContains},
+	{"panko", "gluten", allergenContains},
+	{"pasta", "gluten", allergenContains},
+	{"spaghetti", "gluten", allergenContains},
+	{"noodles", "gluten", allergenContains},
+	{"couscous", "gluten", allergenContains},
+	{"bulgur", "gluten", allergenContains},
+	{"barley", "gluten", allergenContains},
+	{"rye", "gluten", allergenContains},
+	{"semolina", "gluten", allergenContains},
+	{"spelt", "gluten", allergenContains},
+	{"seitan", "gluten", allergenContains},
+	{"pastry", "gluten", allergenContains},
+	{"tortilla", "gluten", allergenContains},
+	{"soy sauce", "gluten", allergenContains},
+	{"beer", "gluten", allergenContains},
+	{"malt", "gluten", allergenContains},
+	{"oats", "gluten", allergenMayContain},
+	{"stock cube", "gluten", allergenMayContain},
+	{"gluten free", "gluten", allergenFreeFrom},
+	{"rice noodles", "gluten", allergenFreeFrom},
+	{"rice flour", "gluten", allergenFreeFrom},
+	{"almond flour", "gluten", allergenFreeFrom},
+	{"coconut flour", "gluten", allergenFreeFrom},
+	{"buckwheat", "gluten", allergenFreeFrom},
+	{"corn tortilla", "gluten", allergenFreeFrom},
+	{"tamari", "gluten", allergenFreeFrom},
+
+	{"dairy", "dairy", allergenContains},
+	{"milk", "dairy", allergenContains},
+	{"butter", "dairy", allergenContains},
+	{"cream", "dairy", allergenContains},
+	{"cheese", "dairy", allergenContains},
+	{"yoghurt", "dairy", allergenContains},
+	{"yogurt", "dairy", allergenContains},
+	{"ghee", "dairy", allergenContains},
+	{"whey", "dairy", allergenContains},
+	{"creme fraiche", "dairy", allergenContains},
+	{"paneer", "dairy", allergenContains},
+	{"custard", "dairy", allergenContains},
+	{"chocolate", "dairy", allergenMayContain},
+	{"dairy free", "dairy", allergenFreeFrom},
+	{"vegan butter", "dairy", allergenFreeFrom},
+	{"vegan cheese", "dairy", allergenFreeFrom},
+	{"cream of tartar", "dairy", allergenFreeFrom},
+	{"coconut milk", "dairy", allergenFreeFrom},
+	{"coconut cream", "dairy", allergenFreeFrom},
+	{"coconut yogurt", "dairy", allergenFreeFrom},
+	{"almond milk", "dairy", allergenFreeFrom},
+	{"oat milk", "dairy", allergenFreeFrom},
+	{"soy milk", "dairy", allergenFreeFrom},
+	{"rice milk", "dairy", allergenFreeFrom},
+	{"peanut butter", "dairy", allergenFreeFrom},
+	{"sunflower seed butter", "dairy", allergenFreeFrom},
+	{"cocoa butter", "dairy", allergenFreeFrom},
+
+	{"egg", "egg", allergenContains},
+	{"mayonnaise", "egg", allergenContains},
+	{"aioli", "egg", allergenContains},
+	{"meringue", "egg", allergenContains},
+	{"egg noodles", "egg", allergenContains},
+	{"fresh pasta", "egg", allergenContains},
+	{"vegan mayonnaise", "egg", allergenFreeFrom},
+
+	{"nuts", "nuts", allergenContains},
+	{"almond", "nuts", allergenContains},
+	{"walnut", "nuts", allergenContains},
+	{"cashew", "nuts", allergenContains},
+	{"pecan", "nuts", allergenContains},
+	{"hazelnut", "nuts", allergenContains},
+	{"pistachio", "nuts", allergenContains},
+	{"macadamia", "nuts", allergenContains},
+	{"brazil nut", "nuts", allergenContains},
+	{"pine nut", "nuts", allergenContains},
+	{"marzipan", "nuts", allergenContains},
+	{"praline", "nuts", allergenContains},
+	{"pesto", "nuts", allergenContains},
+	{"chocolate", "nuts", allergenMayContain},
+	{"granola", "nuts", allergenMayContain},
+	{"muesli", "nuts", allergenMayContain},
+	{"peanut", "nuts", allergenFreeFrom},
+
+	{"peanut", "peanuts", allergenContains},
+	{"groundnut", "peanuts", allergenContains},
+	{"satay", "peanuts", allergenContains},
+
+	{"fish", "fish", allergenContains},
+	{"anchovy", "fish", allergenContains},
+	{"sardine", "fish", allergenContains},
+	{"mackerel", "fish", allergenContains},
+	{"trout", "fish", allergenContains},
+	{"haddock", "fish", allergenContains},
+	{"fish sauce", "fish", allergenContains},
+	{"worcestershire sauce", "fish", allergenContains},
+
+	{"shellfish", "shellfish", allergenContains},
+	{"lobster", "shellfish", allergenContains},
+	{"clam", "shellfish", allergenContains},
+	{"oyster", "shellfish", allergenContains},
+	{"scallop", "shellfish", allergenContains},
+	{"squid", "shellfish", allergenContains},
+	{"oyster sauce", "shellfish", allergenContains},
+	{"oyster mushroom", "shellfish", allergenFreeFrom},
+
+	{"soy", "soy", allergenContains},
+	{"soya", "soy", allergenContains},
+	{"tofu", "soy", allergenContains},
+	{"tempeh", "soy", allergenContains},
+	{"edamame", "soy", allergenContains},
+	{"miso", "soy", allergenContains},
+	{"tamari", "soy", allergenContains},
+
+	{"sesame", "sesame", allergenContains},
+	{"tahini", "sesame", allergenContains},
+	{"hummus", "sesame", allergenContains},
+
+	{"meat", "meat", allergenContains},
+	{"gelatine", "meat", allergenContains},
+	{"gelatin", "meat", allergenContains},
+	{"lard", "meat", allergenContains},
+	{"suet", "meat", allergenContains},
+	{"stock cube", "meat", allergenMayContain},
+	{"vegetarian sausage", "meat", allergenFreeFrom},
+	{"vegan sausage", "meat", allergenFreeFrom},
+	{"vegetarian mince", "meat", allergenFreeFrom},
+	{"meat free", "meat", allergenFreeFrom},
+
+	{"honey", "honey", allergenContains},
+}
+
+func registerAllergenRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/allergens", getAllergens).Methods("GET")
+	api.HandleFunc("/allergen-rules", getAllergenRulesHandler).Methods("GET")
+	api.HandleFunc("/allergen-rules", requireAdmin(createAllergenRule)).Methods("POST")
+	api.HandleFunc("/allergen-rules/{id}", requireAdmin(updateAllergenRule)).Methods("PATCH")
+	api.HandleFunc("/allergen-rules/{id}", requireAdmin(deleteAllergenRule)).Methods("DELETE")
+
+	api.HandleFunc("/recipes/{id}/allergens", getRecipeAllergens).Methods("GET")
+	api.HandleFunc("/recipes/{id}/allergens/{allergen}", setAllergenOverride).Methods("PUT")
+	api.HandleFunc("/recipes/{id}/allergens/{allergen}", deleteAllergenOverride).Methods("DELETE")
+}
+
+// seedAllergenRules fills an empty allergen_rules table with defaultAllergenRules.
+func seedAllergenRules() error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM allergen_rules").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	for _, rule := range defaultAllergenRules {
+		_, err := db.Exec("INSERT INTO allergen_rules(term, allergen, status) VALUES(?,?,?)", normalizeIngredientName(rule[0]), rule[1], rule[2])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compiledAllergenRule is a rule for one term, either its own or one below
+// it in the taxonomy. Own terms win a tie against taxonomy terms.
+type compiledAllergenRule struct {
+	term     string
+	allergen string
+	status   string
+	score    int
+}
+
+var allergenRules struct {
+	sync.Mutex
+	rules     []compiledAllergenRule
+	allergens []string
+}
+
+// invalidateAllergenRules makes the next classification reload the rules,
+// after the rules or the taxonomy changed.
+func invalidateAllergenRules() {
+	allergenRules.Lock()
+	allergenRules.rules = nil
+	allergenRules.Unlock()
+}
+
+// loadAllergenRules returns the rules expanded through the taxonomy, and the
+// names of every allergen they know.
+func loadAllergenRules() ([]compiledAllergenRule, []string) {
+	allergenRules.Lock()
+	defer allergenRules.Unlock()
+
+	if allergenRules.rules != nil {
+		return allergenRules.rules, allergenRules.allergens
+	}
+
+	rules, err := getAllergenRules()
+	if err != nil {
+		fmt.Println("Error loading allergen rules:", err)
+		return nil, nil
+	}
+
+	compiled := []compiledAllergenRule{}
+	var allergens []string
+	for _, rule := range rules {
+		for i, term := range expandIngredientTerms([]string{rule.Term}) {
+			score := len(term) * 2
+			if i == 0 {
+				score++
+			}
+			compiled = append(compiled, compiledAllergenRule{term, rule.Allergen, rule.Status, score})
+		}
+		if !slices.Contains(allergens, rule.Allergen) {
+			allergens = append(allergens, rule.Allergen)
+		}
+	}
+	sort.Strings(allergens)
+
+	allergenRules.rules = compiled
+	allergenRules.allergens = allergens
+	return compiled, allergens
+}
+
+func getAllergenRules() ([]AllergenRule, error) {
+	rows, err := db.Query("SELECT id, term, allergen, status FROM allergen_rules ORDER BY allergen, term")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []AllergenRule{}
+	for rows.Next() {
+		var rule AllergenRule
+		if err := rows.Scan(&rule.ID, &rule.Term, &rule.Allergen, &rule.Status); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func getAllergenOverrides(recipeId int) map[string]string {
+	overrides := map[string]string{}
+
+	rows, err := db.Query("SELECT allergen, status FROM recipe_allergen_overrides WHERE recipe_id = ?", recipeId)
+	if err != nil {
+		return overrides
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var allergen, status string
+		if rows.Scan(&allergen, &status) == nil {
+			overrides[allergen] = status
+		}
+	}
+	return overrides
+}
+
+// classifyIngredient returns the status of every allergen the ingredient
+// matches a rule of.
+func classifyIngredient(name string, rules []compiledAllergenRule) map[string]string {
+	name = normalizeIngredientName(name)
+
+	best := map[string]compiledAllergenRule{}
+	for _, rule := range rules {
+		if nameContainsTerm(name, rule.term) && rule.score > best[rule.allergen].score {
+			best[rule.allergen] = rule
+		}
+	}
+
+	statuses := map[string]string{}
+	for allergen, rule := range best {
+		statuses[allergen] = rule.status
+	}
+	return statuses
+}
+
+// classifyRecipe works out which allergens the ingredients contain, may
+// contain or are free from, then applies the overrides of the recipe. A
+// sub-recipe adds the allergens of its own classification, and one that
+// cannot be resolved may contain anything.
+func classifyRecipe(recipeId int, ingredients []Ingredient) *AllergenReport {
+	rules, allergens := loadAllergenRules()
+	statuses, sources, overrides := classifyIngredients(recipeId, ingredients, rules, allergens, map[int]bool{recipeId: true})
+
+	report := &AllergenReport{
+		Contains:   []string{},
+		MayContain: []string{},
+		FreeFrom:   []string{},
+		Diets:      []string{},
+		Sources:    sources,
+		Overrides:  overrides,
+	}
+	for _, allergen := range allergens {
+		switch statuses[allergen] {
+		case allergenContains:
+			report.Contains = append(report.Contains, allergen)
+		case allergenMayContain:
+			report.MayContain = append(report.MayContain, allergen)
+		default:
+			report.FreeFrom = append(report.FreeFrom, allergen)
+		}
+	}
+
+	for diet, excluded := range dietAllergens {
+		if report.isFreeFrom(excluded) {
+			report.Diets = append(report.Diets, diet)
+		}
+	}
+	sort.Strings(report.Diets)
+
+	return report
+}
+
+// classifyIngredients returns the allergen statuses of the ingredients with
+// the overrides of the recipe applied, the ingredients behind them and the
+// overrides. path holds the recipes being classified, as in
+// expandIngredients.
+func classifyIngredients(recipeId int, ingredients []Ingredient, rules []compiledAllergenRule, allergens []string, path map[int]bool) (map[string]string, map[string][]string, map[string]string) {
+	statuses := map[string]string{}
+	sources := map[string][]string{}
+	mark := func(allergen string, status string, source string) {
+		switch {
+		case status == allergenContains:
+			statuses[allergen] = allergenContains
+		case status == allergenMayContain && statuses[allergen] != allergenContains:
+			statuses[allergen] = allergenMayContain
+		default:
+			return
+		}
+		if !slices.Contains(sources[allergen], source) {
+			sources[allergen] = append(sources[allergen], source)
+		}
+	}
+
+	for _, ingredient := range ingredients {
+		for allergen, status := range classifyIngredient(ingredient.Name, rules) {
+			mark(allergen, status, ingredient.Name)
+		}
+
+		subRecipeId := ingredient.SubRecipeID
+		if subRecipeId == nil {
+			continue
+		}
+		if path[*subRecipeId] || len(path) >= maxSubRecipeDepth || !recipeExists(*subRecipeId) {
+			for _, allergen := range allergens {
+				mark(allergen, allergenMayContain, ingredient.Name)
+			}
+			continue
+		}
+
+		path[*subRecipeId] = true
+		subStatuses, _, _ := classifyIngredients(*subRecipeId, getRecipeIngredients(*subRecipeId, ""), rules, allergens, path)
+		delete(path, *subRecipeId)
+		for allergen, status := range subStatuses {
+			mark(allergen, status, ingredient.Name)
+		}
+	}
+
+	overrides := getAllergenOverrides(recipeId)
+	for allergen, status := range overrides {
+		statuses[allergen] = status
+		if status == allergenFreeFrom {
+			delete(sources, allergen)
+		}
+	}
+	return statuses, sources, overrides
+}
+
+func (report *AllergenReport) isFreeFrom(allergens []string) bool {
+	for _, allergen := range allergens {
+		if !slices.Contains(report.FreeFrom, allergen) {
+			return false
+		}
+	}
+	return true
+}
+
+// allergenFilter holds the diet and exclude query parameters. A recipe that
+// may contain an excluded allergen is left out, as it is not safe.
+type allergenFilter struct {
+	diets   []string
+	exclude []string
+}
+
+func parseAllergenFilter(queryParams map[string][]string) (*allergenFilter, error) {
+	var filter allergenFilter
+
+	for _, diet := range splitList(strings.Join(queryParams["diet"], ",")) {
+		if _, ok := dietAllergens[diet]; !ok {
+			return nil, fmt.Errorf("%w: unknown diet %q", errInvalidQuery, diet)
+		}
+		filter.diets = append(filter.diets, diet)
+	}
+
+	exclude := splitList(strings.Join(queryParams["exclude"], ","))
+	if len(exclude) > 0 {
+		_, allergens := loadAllergenRules()
+		for _, allergen := range exclude {
+			if !slices.Contains(allergens, allergen) {
+				return nil, fmt.Errorf("%w: unknown allergen %q", errInvalidQuery, allergen)
+			}
+		}
+		filter.exclude = exclude
+	}
+
+	if len(filter.diets) == 0 && len(filter.exclude) == 0 {
+		return nil, nil
+	}
+	return &filter, nil
+}
+
+func (filter *allergenFilter) matches(report *AllergenReport) bool {
+	for _, diet := range filter.diets {
+		if !slices.Contains(report.Diets, diet) {
+			return false
+		}
+	}
+	return report.isFreeFrom(filter.exclude)
+}
+
+func filterRecipesByAllergens(recipes []Recipe, filter *allergenFilter) []Recipe {
+	var filtered []Recipe
+	for _, recipe := range recipes {
+		if recipe.Allergens != nil && filter.matches(recipe.Allergens) {
+			filtered = append(filtered, recipe)
+		}
+	}
+	return filtered
+}
+
+// splitList splits a comma separated parameter into lowercase, trimmed values.
+func splitList(value string) []string {
+	var values []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(strings.ToLower(part)); part != "" {
+			values = append(values, part)
+		}
+	}
+	return values
+}
+
+// getAllergens lists the allergens the rules know and the diets with what
+// they exclude.
+func getAllergens(w http.ResponseWriter, r *http.Request) {
+	_, allergens := loadAllergenRules()
+	if allergens == nil {
+		allergens = []string{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"allergens": allergens,
+		"diets":     dietAllergens,
+	})
+}
+
+func getAllergenRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := getAllergenRules()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if allergen := r.URL.Query().Get("allergen"); allergen != "" {
+		filtered := []AllergenRule{}
+		for _, rule := range rules {
+			if rule.Allergen == allergen {
+				filtered = append(filtered, rule)
+			}
+		}
+		rules = filtered
+	}
+
+	writeJSON(w, http.StatusOK, rules)
+}
+
+func validateAllergenRule(rule *AllergenRule) string {
+	rule.Term = normalizeIngredientName(rule.Term)
+	rule.Allergen = strings.TrimSpace(strings.ToLower(rule.Allergen))
+	switch {
+	case rule.Term == "":
+		return "Term is required"
+	case rule.Allergen == "":
+		return "Allergen is required"
+	case !slices.Contains(allergenStatuses, rule.Status):
+		return fmt.Sprintf("Status must be one of %s", strings.Join(allergenStatuses, ", "))
+	}
+	return ""
+}
+
+func getAllergenRuleById(id int) *AllergenRule {
+	var rule AllergenRule
+	err := db.QueryRow("SELECT id, term, allergen, status FROM allergen_rules WHERE id = ?", id).Scan(&rule.ID, &rule.Term, &rule.Allergen, &rule.Status)
+	if err != nil {
+		return nil
+	}
+	return &rule
+}
+
+func createAllergenRule(w http.ResponseWriter, r *http.Request) {
+	var rule AllergenRule
+	if !decodeBody(w, r, &rule) {
+		return
+	}
+	if message := validateAllergenRule(&rule); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("INSERT INTO allergen_rules(term, allergen, status) VALUES(?,?,?)", rule.Term, rule.Allergen, rule.Status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	invalidateAllergenRules()
+
+	id, _ := result.LastInsertId()
+	writeJSON(w, http.StatusCreated, getAllergenRuleById(int(id)))
+}
+
+func updateAllergenRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	rule := getAllergenRuleById(id)
+	if rule == nil {
+		http.Error(w, "Allergen rule not found", http.StatusNotFound)
+		return
+	}
+
+	var patch struct {
+		Term     *string `json:"term"`
+		Allergen *string `json:"allergen"`
+		Status   *string `json:"status"`
+	}
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	if patch.Term != nil {
+		rule.Term = *patch.Term
+	}
+	if patch.Allergen != nil {
+		rule.Allergen = *patch.Allergen
+	}
+	if patch.Status != nil {
+		rule.Status = *patch.Status
+	}
+	if message := validateAllergenRule(rule); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec("UPDATE allergen_rules SET term = ?, allergen = ?, status = ? WHERE id = ?", rule.Term, rule.Allergen, rule.Status, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	invalidateAllergenRules()
+
+	writeJSON(w, http.StatusOK, getAllergenRuleById(id))
+}
+
+func deleteAllergenRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM allergen_rules WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Allergen rule not found", http.StatusNotFound)
+		return
+	}
+	invalidateAllergenRules()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getRecipeAllergens(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recipe.Allergens)
+}
+
+// setAllergenOverride fixes the status of one allergen for the recipe, for
+// when the rules get it wrong, e.g. oats that are certified gluten free.
+func setAllergenOverride(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	allergen := strings.ToLower(mux.Vars(r)["allergen"])
+	if _, allergens := loadAllergenRules(); !slices.Contains(allergens, allergen) {
+		http.Error(w, fmt.Sprintf("Unknown allergen %q", allergen), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Status string `json:"status"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if !slices.Contains(allergenStatuses, req.Status) {
+		http.Error(w, fmt.Sprintf("Status must be one of %s", strings.Join(allergenStatuses, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO recipe_allergen_overrides(recipe_id, allergen, status) VALUES(?,?,?)
+		ON CONFLICT(recipe_id, allergen) DO UPDATE SET status = excluded.status
+	`, recipe.ID, allergen, req.Status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recipeChanged(recipe.ID, eventAllergensUpdated)
+
+	writeJSON(w, http.StatusOK, classifyRecipe(recipe.ID, recipe.Ingredients))
+}
+
+func deleteAllergenOverride(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM recipe_allergen_overrides WHERE recipe_id = ? AND allergen = ?", recipe.ID, strings.ToLower(mux.Vars(r)["allergen"]))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Override not found", http.StatusNotFound)
+		return
+	}
+	recipeChanged(recipe.ID, eventAllergensUpdated)
+
+	w.WriteHeader(http.StatusNoContent)
+}
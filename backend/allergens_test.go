@@ -0,0 +1,79 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSubRecipeAllergens(t *testing.T) {
+	openSchemaDB(t)
+	if err := seedAllergenRules(); err != nil {
+		t.Fatal(err)
+	}
+	invalidateAllergenRules()
+	t.Cleanup(invalidateAllergenRules)
+
+	userId := mustExec(t, "INSERT INTO users(username, password_hash) VALUES('cook', '')")
+	doughId := mustExec(t, "INSERT INTO recipes(name, owner_id) VALUES('Pizza dough', ?)", userId)
+	mustExec(t, "INSERT INTO ingredients(name, measurement, value, sortOrder, recipe_id) VALUES('flour', 'g', 500, 1, ?)", doughId)
+	pizzaId := mustExec(t, "INSERT INTO recipes(name, owner_id) VALUES('Margherita', ?)", userId)
+	baseId := mustExec(t, "INSERT INTO ingredients(name, measurement, value, sortOrder, recipe_id) VALUES('base', '', 1, 1, ?)", pizzaId)
+	mustExec(t, "INSERT INTO ingredients(name, measurement, value, sortOrder, recipe_id) VALUES('tomatoes', 'g', 200, 2, ?)", pizzaId)
+	mustExec(t, "INSERT INTO ingredient_recipes(ingredient_id, recipe_id) VALUES(?, ?)", baseId, doughId)
+
+	report := classifyRecipe(pizzaId, getRecipeIngredients(pizzaId, ""))
+	if !slices.Contains(report.Contains, "gluten") || slices.Contains(report.Diets, "gluten-free") {
+		t.Fatalf("a pizza on a flour dough = %+v, want it to contain gluten", report)
+	}
+	if !slices.Equal(report.Sources["gluten"], []string{"base"}) {
+		t.Errorf("gluten sources = %v, want the sub-recipe ingredient", report.Sources["gluten"])
+	}
+
+	mustExec(t, "DELETE FROM recipes WHERE id = ?", doughId)
+	report = classifyRecipe(pizzaId, getRecipeIngredients(pizzaId, ""))
+	if len(report.FreeFrom) != 0 || len(report.Diets) != 0 {
+		t.Errorf("a pizza on a missing dough = %+v, want it to maybe contain everything", report)
+	}
+}
+
+func TestTaxonomyAllergens(t *testing.T) {
+	openSchemaDB(t)
+	for _, seed := range []func() error{seedTaxonomy, seedAllergenRules} {
+		if err := seed(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	invalidateAllergenRules()
+	t.Cleanup(invalidateAllergenRules)
+
+	report := classifyRecipe(0, []Ingredient{{Name: "peanuts"}, {Name: "octopus"}})
+	if slices.Contains(report.Contains, "nuts") || !slices.Contains(report.Contains, "peanuts") {
+		t.Errorf("peanuts = %+v, want peanuts but not nuts", report)
+	}
+	if !slices.Contains(report.Contains, "shellfish") || !slices.Equal(report.Sources["shellfish"], []string{"octopus"}) {
+		t.Errorf("octopus = %+v, want shellfish through the molluscs", report)
+	}
+}
+
+func TestMoveTaxonomyNodes(t *testing.T) {
+	openSchemaDB(t)
+	nuts := mustExec(t, "INSERT INTO ingredient_taxonomy(name) VALUES('nuts')")
+	mustExec(t, "INSERT INTO ingredient_taxonomy(name) VALUES('legumes')")
+	seafood := mustExec(t, "INSERT INTO ingredient_taxonomy(name) VALUES('seafood')")
+	shellfish := mustExec(t, "INSERT INTO ingredient_taxonomy(name, parent_id) VALUES('shellfish', ?)", seafood)
+	mustExec(t, "INSERT INTO ingredient_taxonomy(name, parent_id) VALUES('peanuts', ?)", nuts)
+	mustExec(t, "INSERT INTO ingredient_taxonomy(name, parent_id) VALUES('mussels', ?)", shellfish)
+	mustExec(t, "INSERT INTO ingredient_taxonomy(name, parent_id) VALUES('squid', ?)", seafood)
+
+	if err := runMigration("move", moveTaxonomyNodes); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"peanuts": "legumes", "mussels": "molluscs", "molluscs": "shellfish", "squid": "molluscs"} {
+		var parent string
+		db.QueryRow("SELECT p.name FROM ingredient_taxonomy n JOIN ingredient_taxonomy p ON p.id = n.parent_id WHERE n.name = ?", name).Scan(&parent)
+		if parent != want {
+			t.Errorf("%s is under %q, want %s", name, parent, want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiTokenPrefix tells API tokens apart from session tokens, and makes them
+// easy to spot in scripts and config files.
+const apiTokenPrefix = "rme_"
+
+const (
+	scopeRecipesRead   = "recipes:read"
+	scopeRecipesWrite  = "recipes:write"
+	scopeShoppingWrite = "shopping:write"
+	scopeAdmin         = "admin"
+)
+
+var allScopes = []string{scopeRecipesRead, scopeRecipesWrite, scopeShoppingWrite, scopeAdmin}
+
+type ApiToken struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Token      string   `json:"token,omitempty"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"createdAt"`
+	LastUsedAt *string  `json:"lastUsedAt"`
+	ExpiresAt  *string  `json:"expiresAt"`
+	RevokedAt  *string  `json:"revokedAt"`
+}
+
+func registerApiTokenRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/tokens", sessionOnly(getApiTokens)).Methods("GET")
+	api.HandleFunc("/tokens", sessionOnly(createApiToken)).Methods("POST")
+	api.HandleFunc("/tokens/{id}", sessionOnly(revokeApiToken)).Methods("DELETE")
+}
+
+// sessionOnly rejects requests made with an API token, so a leaked token
+// cannot mint new tokens or change the password.
+func sessionOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if user := currentUser(r); user == nil || user.apiTokenId != 0 {
+			http.Error(w, "This endpoint requires a login session", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// userScopes are the scopes a user's session gets: everything, except admin
+// for users who are not admins.
+func userScopes(user *User) []string {
+	var scopes []string
+	for _, scope := range allScopes {
+		if scope != scopeAdmin || user.IsAdmin {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+func (user *User) hasScope(scope string) bool {
+	return slices.Contains(user.scopes, scope)
+}
+
+// getApiTokenUser resolves an API token to its user, limited to the token's
+// scopes, and records when it was last used.
+func getApiTokenUser(token string) *User {
+	now := time.Now().Format("2006-01-02 15:04:05")
+
+	row := db.QueryRow(`
+		SELECT t.id, t.scopes, u.id, u.username, u.isAdmin, u.createdAt FROM api_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = ? AND t.revokedAt IS NULL AND (t.expiresAt IS NULL OR t.expiresAt > ?)
+	`, hashToken(token), now)
+
+	var user User
+	var scopes string
+	if err := row.Scan(&user.apiTokenId, &scopes, &user.ID, &user.Username, &user.IsAdmin, &user.CreatedAt); err != nil {
+		return nil
+	}
+
+	for _, scope := range strings.Split(scopes, ",") {
+		if slices.Contains(userScopes(&user), scope) {
+			user.scopes = append(user.scopes, scope)
+		}
+	}
+
+	_, err := db.Exec("UPDATE api_tokens SET lastUsedAt = ? WHERE id = ?", now, user.apiTokenId)
+	if err != nil {
+		fmt.Println("Error updating token:", err)
+	}
+
+	return &user
+}
+
+const apiTokenColumns = "id, name, scopes, createdAt, lastUsedAt, expiresAt, revokedAt"
+
+func scanApiToken(row interface{ Scan(...any) error }, token *ApiToken) error {
+	var scopes string
+	err := row.Scan(&token.ID, &token.Name, &scopes, &token.CreatedAt, &token.LastUsedAt, &token.ExpiresAt, &token.RevokedAt)
+	token.Scopes = strings.Split(scopes, ",")
+	return err
+}
+
+func getApiTokens(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = ? ORDER BY id DESC", currentUser(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tokens := []ApiToken{}
+	for rows.Next() {
+		var token ApiToken
+		scanApiToken(rows, &token)
+		tokens = append(tokens, token)
+	}
+
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// createApiToken mints a token limited to the requested scopes. The token is
+// only returned in this response; the database keeps its hash.
+func createApiToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expiresInDays"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	user := currentUser(r)
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, fmt.Sprintf("At least one scope is required, one of %s", strings.Join(allScopes, ", ")), http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(allScopes, scope) {
+			http.Error(w, fmt.Sprintf("Unknown scope %q", scope), http.StatusBadRequest)
+			return
+		}
+		if !user.hasScope(scope) {
+			http.Error(w, fmt.Sprintf("You cannot grant the %s scope", scope), http.StatusForbidden)
+			return
+		}
+	}
+	if req.ExpiresInDays < 0 {
+		http.Error(w, "expiresInDays must be positive", http.StatusBadRequest)
+		return
+	}
+
+	token := apiTokenPrefix + generateToken()
+	now := time.Now()
+
+	var expiresAt *string
+	if req.ExpiresInDays > 0 {
+		value := now.AddDate(0, 0, req.ExpiresInDays).Format("2006-01-02 15:04:05")
+		expiresAt = &value
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO api_tokens(user_id, name, token_hash, scopes, createdAt, expiresAt) VALUES(?,?,?,?,?,?)
+	`, user.ID, req.Name, hashToken(token), strings.Join(req.Scopes, ","), now.Format("2006-01-02 15:04:05"), expiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tokenId, _ := result.LastInsertId()
+
+	var created ApiToken
+	if err := scanApiToken(db.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE id = ?", tokenId), &created); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	created.Token = token
+
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func revokeApiToken(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE api_tokens SET revokedAt = ? WHERE id = ? AND user_id = ? AND revokedAt IS NULL
+	`, time.Now().Format("2006-01-02 15:04:05"), id, currentUser(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,1142 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// registerV1Routes mounts the versioned API. Resources are plural nouns and
+// children are nested under the recipe they belong to, so every path means
+// the same thing regardless of the HTTP method.
+func registerV1Routes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+
+	// Recipe routes
+	api.HandleFunc("/recipes", v1ListRecipes).Methods("GET")
+	api.HandleFunc("/recipes", v1CreateRecipe).Methods("POST")
+	api.HandleFunc("/recipes/order", v1ReorderRecipes).Methods("PUT")
+	api.HandleFunc("/recipes/{id}", v1GetRecipe).Methods("GET")
+	api.HandleFunc("/recipes/{id}", v1ReplaceRecipe).Methods("PUT")
+	api.HandleFunc("/recipes/{id}", v1PatchRecipe).Methods("PATCH")
+	api.HandleFunc("/recipes/{id}", v1DeleteRecipe).Methods("DELETE")
+
+	// Portion routes
+	api.HandleFunc("/portions", getPortions).Methods("GET")
+	api.HandleFunc("/recipes/{id}/portion", v1GetPortion).Methods("GET")
+	api.HandleFunc("/recipes/{id}/portion", v1ReplacePortion).Methods("PUT")
+	api.HandleFunc("/recipes/{id}/portion", v1PatchPortion).Methods("PATCH")
+	api.HandleFunc("/recipes/{id}/portion", v1DeletePortion).Methods("DELETE")
+
+	// Ingredient routes
+	api.HandleFunc("/ingredients", getIngredients).Methods("GET")
+	api.HandleFunc("/recipes/{id}/ingredients", v1ListIngredients).Methods("GET")
+	api.HandleFunc("/recipes/{id}/ingredients", v1ReplaceIngredients).Methods("PUT")
+	api.HandleFunc("/recipes/{id}/ingredients", v1CreateIngredient).Methods("POST")
+	api.HandleFunc("/recipes/{id}/ingredients/{ingredientId}", v1GetIngredient).Methods("GET")
+	api.HandleFunc("/recipes/{id}/ingredients/{ingredientId}", v1PatchIngredient).Methods("PATCH")
+	api.HandleFunc("/recipes/{id}/ingredients/{ingredientId}", v1DeleteIngredient).Methods("DELETE")
+
+	// Method routes
+	api.HandleFunc("/recipes/{id}/methods", v1ListMethods).Methods("GET")
+	api.HandleFunc("/recipes/{id}/methods", v1ReplaceMethods).Methods("PUT")
+	api.HandleFunc("/recipes/{id}/methods", v1CreateMethod).Methods("POST")
+	api.HandleFunc("/recipes/{id}/methods/{methodId}", v1GetMethod).Methods("GET")
+	api.HandleFunc("/recipes/{id}/methods/{methodId}", v1PatchMethod).Methods("PATCH")
+	api.HandleFunc("/recipes/{id}/methods/{methodId}", v1DeleteMethod).Methods("DELETE")
+
+	// Image routes
+	api.HandleFunc("/images", getImages).Methods("GET")
+	api.HandleFunc("/recipes/{id}/image", v1GetImage).Methods("GET")
+	api.HandleFunc("/recipes/{id}/image", v1ReplaceImage).Methods("PUT")
+	api.HandleFunc("/recipes/{id}/image", v1DeleteImage).Methods("DELETE")
+
+	// Divider routes
+	api.HandleFunc("/recipes/{id}/dividers", v1ListDividers).Methods("GET")
+	api.HandleFunc("/recipes/{id}/dividers", v1CreateDivider).Methods("POST")
+	api.HandleFunc("/recipes/{id}/dividers/{dividerId}", v1GetDivider).Methods("GET")
+	api.HandleFunc("/recipes/{id}/dividers/{dividerId}", v1PatchDivider).Methods("PATCH")
+	api.HandleFunc("/recipes/{id}/dividers/{dividerId}", v1DeleteDivider).Methods("DELETE")
+	api.HandleFunc("/recipes/{id}/dividers/{dividerId}/ingredients", v1AddDividerIngredients).Methods("POST")
+	api.HandleFunc("/recipes/{id}/dividers/{dividerId}/methods", v1AddDividerMethods).Methods("POST")
+}
+
+// deprecated wraps a pre-v1 handler so the first call of the route is logged
+// along with the route that replaces it. The response is left untouched apart
+// from the Deprecation and Link headers, so existing app builds keep working.
+// The successor names the path variables of the old route; the Link header
+// is left out when it needs one the old route doesn't have.
+func deprecated(successor string, handler http.HandlerFunc) http.HandlerFunc {
+	var logged sync.Once
+	return func(w http.ResponseWriter, r *http.Request) {
+		logged.Do(func() {
+			route := r.URL.Path
+			if current := mux.CurrentRoute(r); current != nil {
+				route, _ = current.GetPathTemplate()
+			}
+			log.Printf("Deprecated route %s %s called, use %s instead", r.Method, route, successor)
+		})
+		w.Header().Set("Deprecation", "true")
+		if link := successorPath(successor, mux.Vars(r)); link != "" {
+			w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", link))
+		}
+		handler(w, r)
+	}
+}
+
+// successorPath fills the variables of a route template, or returns "" when
+// one of them is missing.
+func successorPath(template string, vars map[string]string) string {
+	for name, value := range vars {
+		template = strings.ReplaceAll(template, "{"+name+"}", url.PathEscape(value))
+	}
+	if strings.Contains(template, "{") {
+		return ""
+	}
+	return template
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// pathID parses a numeric path variable, writing a 400 response when it is
+// missing or malformed.
+func pathID(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)[name])
+	if err != nil || id <= 0 {
+		http.Error(w, fmt.Sprintf("Invalid %s parameter", name), http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// pathRecipe loads the recipe named by the {id} path variable, writing a 404
+// response when it does not exist or belongs to another user.
+func pathRecipe(w http.ResponseWriter, r *http.Request) (Recipe, bool) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return Recipe{}, false
+	}
+
+	recipe := getOwnedRecipe(id, currentUser(r).ID)
+	if recipe.ID == 0 {
+		http.Error(w, "Recipe not found", http.StatusNotFound)
+		return Recipe{}, false
+	}
+	return recipe, true
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func v1ListRecipes(w http.ResponseWriter, r *http.Request) {
+	recipes, err := listRecipes(currentUser(r).ID, r.URL.Query())
+	if errors.Is(err, errInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if recipes == nil {
+		recipes = []Recipe{}
+	}
+
+	writeJSON(w, http.StatusOK, recipes)
+}
+
+func v1CreateRecipe(w http.ResponseWriter, r *http.Request) {
+	var recipe Recipe
+	if !decodeBody(w, r, &recipe) {
+		return
+	}
+
+	if err := validateRecipeTags(currentUser(r).ID, recipe); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateEquipment(recipe.Equipment); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	recipeId, err := saveRecipe(currentUser(r).ID, 0, recipe)
+	if err != nil {
+		http.Error(w, err.Error(), recipeErrorStatus(err))
+		return
+	}
+
+	publishRecipeEvent(recipeId, eventRecipeCreated)
+	writeJSON(w, http.StatusCreated, withDuplicates(recipeId))
+}
+
+func v1ReorderRecipes(w http.ResponseWriter, r *http.Request) {
+	var passedRecipes []Recipe
+	if !decodeBody(w, r, &passedRecipes) {
+		return
+	}
+
+	if err := saveRecipeOrder(currentUser(r).ID, passedRecipes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	v1ListRecipes(w, r)
+}
+
+func v1GetRecipe(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	if r.URL.Query().Get("expand") == "true" {
+		expandRecipe(&recipe)
+	}
+	writeJSON(w, http.StatusOK, recipe)
+}
+
+func v1ReplaceRecipe(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var passed Recipe
+	if !decodeBody(w, r, &passed) {
+		return
+	}
+
+	if err := validateRecipeTags(recipe.OwnerID, passed); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateEquipment(passed.Equipment); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := saveRecipe(recipe.OwnerID, recipe.ID, passed); err != nil {
+		http.Error(w, err.Error(), recipeErrorStatus(err))
+		return
+	}
+
+	publishRecipeEvent(recipe.ID, eventRecipeUpdated)
+	writeJSON(w, http.StatusOK, getRecipeById(recipe.ID))
+}
+
+// saveRecipe inserts the recipe of the owner when id is 0, or updates it, and
+// sets the tags and equipment passed along with it, all in one transaction.
+func saveRecipe(ownerId int, id int, recipe Recipe) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	if id == 0 {
+		id, err = insertRecipe(tx, ownerId, recipe)
+	} else {
+		err = saveRecipeDetails(tx, id, recipe)
+	}
+	if err == nil {
+		err = applyRecipeTags(tx, id, ownerId, recipe)
+	}
+	if err == nil {
+		err = applyRecipeEquipment(tx, id, recipe)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// recipeErrorStatus is the response status for an error of saveRecipe.
+func recipeErrorStatus(err error) int {
+	if errors.Is(err, errInvalidTags) {
+		return http.StatusBadRequest
+	}
+	return equipmentErrorStatus(err)
+}
+
+type recipePatch struct {
+	Name *string `json:"name"`
+	Url  *string `json:"url"`
+	Type *string `json:"type"`
+}
+
+func v1PatchRecipe(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var patch recipePatch
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	if patch.Name != nil {
+		recipe.Name = *patch.Name
+	}
+	if patch.Url != nil {
+		recipe.Url = *patch.Url
+	}
+	if patch.Type != nil {
+		recipe.Type = *patch.Type
+	}
+
+	if err := saveRecipeDetails(db, recipe.ID, recipe); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	publishRecipeEvent(recipe.ID, eventRecipeUpdated)
+	writeJSON(w, http.StatusOK, getRecipeById(recipe.ID))
+}
+
+func v1DeleteRecipe(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	if !checkRecipeReferences(w, r, recipe.ID) {
+		return
+	}
+
+	if err := removeRecipe(recipe.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func v1GetPortion(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	if recipe.Portion == nil {
+		http.Error(w, "Portion not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recipe.Portion)
+}
+
+func v1ReplacePortion(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var portion Portion
+	if !decodeBody(w, r, &portion) {
+		return
+	}
+
+	if err := savePortion(recipe.ID, portion); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeChanged(recipe.ID, eventPortionUpdated)
+
+	writeJSON(w, http.StatusOK, getRecipePortion(recipe.ID))
+}
+
+type portionPatch struct {
+	Value       *float32 `json:"value"`
+	Measurement *string  `json:"measurement"`
+}
+
+func v1PatchPortion(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var patch portionPatch
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	portion := Portion{RecipeID: recipe.ID}
+	if recipe.Portion != nil {
+		portion = *recipe.Portion
+	}
+	if patch.Value != nil {
+		portion.Value = *patch.Value
+	}
+	if patch.Measurement != nil {
+		portion.Measurement = *patch.Measurement
+	}
+
+	if err := savePortion(recipe.ID, portion); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeChanged(recipe.ID, eventPortionUpdated)
+
+	writeJSON(w, http.StatusOK, getRecipePortion(recipe.ID))
+}
+
+func v1DeletePortion(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM portions WHERE recipe_id = ?", recipe.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeChanged(recipe.ID, eventPortionDeleted)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func v1ListIngredients(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recipe.Ingredients)
+}
+
+func v1ReplaceIngredients(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var passedIngredients []Ingredient
+	if !decodeBody(w, r, &passedIngredients) {
+		return
+	}
+	if !checkIngredientLinks(w, recipe, passedIngredients) {
+		return
+	}
+
+	if err := saveIngredients(recipe.ID, passedIngredients); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeSaved(recipe.ID)
+	recipeChanged(recipe.ID, eventIngredientUpdated)
+
+	writeJSON(w, http.StatusOK, getRecipeIngredients(recipe.ID, ""))
+}
+
+func v1CreateIngredient(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var passedIngredient Ingredient
+	if !decodeBody(w, r, &passedIngredient) {
+		return
+	}
+	passedIngredient.ID = 0
+	if !checkIngredientLinks(w, recipe, []Ingredient{passedIngredient}) {
+		return
+	}
+
+	ingredientId, err := saveIngredient(recipe.ID, passedIngredient)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if passedIngredient.SubRecipeID != nil {
+		if err := linkSubRecipe(db, ingredientId, *passedIngredient.SubRecipeID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if passedIngredient.DividerID != nil {
+		if err := moveToDivider(ingredientSections, []int{ingredientId}, *passedIngredient.DividerID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if passedIngredient.CatalogID != nil {
+		passedIngredient.ID = ingredientId
+		passedIngredient.RecipeID = recipe.ID
+		if err := setIngredientCatalog(db, passedIngredient, *passedIngredient.CatalogID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	recipeSaved(recipe.ID)
+	recipeChanged(recipe.ID, eventIngredientCreated)
+
+	writeJSON(w, http.StatusCreated, getIngredientById(ingredientId))
+}
+
+// pathIngredient loads the {ingredientId} ingredient, writing a 404 response
+// unless it belongs to the recipe.
+func pathIngredient(w http.ResponseWriter, r *http.Request, recipe Recipe) (*Ingredient, bool) {
+	ingredientId, ok := pathID(w, r, "ingredientId")
+	if !ok {
+		return nil, false
+	}
+
+	ingredient := getIngredientById(ingredientId)
+	if ingredient == nil || ingredient.RecipeID != recipe.ID {
+		http.Error(w, "Ingredient not found", http.StatusNotFound)
+		return nil, false
+	}
+	return ingredient, true
+}
+
+func v1GetIngredient(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	ingredient, ok := pathIngredient(w, r, recipe)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ingredient)
+}
+
+// ingredientPatch keeps sub_recipe_id raw so that null (unlink) can be told
+// apart from leaving it out.
+type ingredientPatch struct {
+	Name        *string         `json:"name"`
+	Measurement *string         `json:"measurement"`
+	Value       *float32        `json:"value"`
+	SortOrder   *int            `json:"sortOrder"`
+	SubRecipeID json.RawMessage `json:"sub_recipe_id"`
+	DividerID   *int            `json:"divider_id"`
+	CatalogID   *int            `json:"catalog_id"`
+}
+
+// v1PatchIngredient checks every field of the patch before it writes any, and
+// then writes them in one transaction.
+func v1PatchIngredient(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	ingredient, ok := pathIngredient(w, r, recipe)
+	if !ok {
+		return
+	}
+
+	var patch ingredientPatch
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+	if patch.CatalogID != nil && !checkCatalogEntry(w, *patch.CatalogID) {
+		return
+	}
+	if patch.DividerID != nil && !checkRecipeDivider(w, recipe, *patch.DividerID) {
+		return
+	}
+	// subRecipeId stays nil when the patch leaves the sub-recipe alone, and is
+	// 0 when it is null
+	var subRecipeId *int
+	if len(patch.SubRecipeID) > 0 {
+		if json.Unmarshal(patch.SubRecipeID, &subRecipeId) != nil {
+			http.Error(w, "Invalid sub_recipe_id", http.StatusBadRequest)
+			return
+		}
+		if subRecipeId == nil {
+			subRecipeId = new(int)
+		}
+		if err := validateSubRecipe(recipe.ID, recipe.OwnerID, *subRecipeId); err != nil {
+			http.Error(w, err.Error(), subRecipeErrorStatus(err))
+			return
+		}
+	}
+
+	if patch.Name != nil {
+		ingredient.Name = *patch.Name
+	}
+	if patch.Measurement != nil {
+		ingredient.Measurement = *patch.Measurement
+	}
+	if patch.Value != nil {
+		ingredient.Value = *patch.Value
+	}
+	if patch.SortOrder != nil {
+		ingredient.SortOrder = *patch.SortOrder
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := patchIngredientTx(tx, *ingredient, patch, subRecipeId); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeSaved(recipe.ID)
+	recipeChanged(recipe.ID, eventIngredientUpdated)
+
+	writeJSON(w, http.StatusOK, getIngredientById(ingredient.ID))
+}
+
+// patchIngredientTx writes the patched ingredient and the links the patch
+// changes within tx. A nil subRecipeId leaves the sub-recipe as it is, and 0
+// unlinks it.
+func patchIngredientTx(tx *sql.Tx, ingredient Ingredient, patch ingredientPatch, subRecipeId *int) error {
+	_, err := tx.Exec("UPDATE ingredients SET name = ?, measurement = ?, value = ?, sortOrder = ? WHERE id = ?", ingredient.Name, ingredient.Measurement, ingredient.Value, ingredient.SortOrder, ingredient.ID)
+	if err != nil {
+		return err
+	}
+	if subRecipeId != nil {
+		if err := linkSubRecipe(tx, ingredient.ID, *subRecipeId); err != nil {
+			return err
+		}
+	}
+	if patch.DividerID != nil {
+		if err := ingredientSections.move(tx, ingredient.ID, *patch.DividerID); err != nil {
+			return err
+		}
+	}
+	if patch.CatalogID != nil {
+		if err := setIngredientCatalog(tx, ingredient, *patch.CatalogID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func v1DeleteIngredient(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	ingredient, ok := pathIngredient(w, r, recipe)
+	if !ok {
+		return
+	}
+
+	if err := removeIngredient(ingredient.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeSaved(recipe.ID)
+	recipeChanged(recipe.ID, eventIngredientDeleted)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func v1ListMethods(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recipe.Methods)
+}
+
+func v1ReplaceMethods(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var passedMethods []Method
+	if !decodeBody(w, r, &passedMethods) {
+		return
+	}
+
+	if err := saveMethods(recipe.ID, passedMethods); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeSaved(recipe.ID)
+	recipeChanged(recipe.ID, eventMethodUpdated)
+
+	writeJSON(w, http.StatusOK, getRecipeMethods(recipe.ID))
+}
+
+func v1CreateMethod(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var passedMethod Method
+	if !decodeBody(w, r, &passedMethod) {
+		return
+	}
+	passedMethod.ID = 0
+
+	if passedMethod.DividerID != nil && !checkRecipeDivider(w, recipe, *passedMethod.DividerID) {
+		return
+	}
+
+	methodId, err := saveMethod(recipe.ID, passedMethod)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if passedMethod.DividerID != nil {
+		if err := moveToDivider(methodSections, []int{methodId}, *passedMethod.DividerID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	recipeSaved(recipe.ID)
+	recipeChanged(recipe.ID, eventMethodCreated)
+
+	writeJSON(w, http.StatusCreated, findRecipeMethod(recipe.ID, methodId))
+}
+
+// findRecipeMethod returns the method with its linked ingredients, or nil
+// when the recipe has no such method.
+func findRecipeMethod(recipeId int, methodId int) *Method {
+	for _, method := range getRecipeMethods(recipeId) {
+		if method.ID == methodId {
+			return &method
+		}
+	}
+	return nil
+}
+
+// pathMethod loads the {methodId} method, writing a 404 response unless it
+// belongs to the recipe.
+func pathMethod(w http.ResponseWriter, r *http.Request, recipe Recipe) (*Method, bool) {
+	methodId, ok := pathID(w, r, "methodId")
+	if !ok {
+		return nil, false
+	}
+
+	method := findRecipeMethod(recipe.ID, methodId)
+	if method == nil {
+		http.Error(w, "Method not found", http.StatusNotFound)
+		return nil, false
+	}
+	return method, true
+}
+
+func v1GetMethod(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	method, ok := pathMethod(w, r, recipe)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, method)
+}
+
+type methodPatch struct {
+	Value       *string       `json:"value"`
+	SortOrder   *int          `json:"sortOrder"`
+	Ingredients *[]Ingredient `json:"ingredients"`
+	DividerID   *int          `json:"divider_id"`
+}
+
+func v1PatchMethod(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	method, ok := pathMethod(w, r, recipe)
+	if !ok {
+		return
+	}
+
+	var patch methodPatch
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	oldValue := method.Value
+	if patch.Value != nil {
+		method.Value = *patch.Value
+	}
+	if patch.SortOrder != nil {
+		method.SortOrder = *patch.SortOrder
+	}
+	if patch.DividerID != nil && !checkRecipeDivider(w, recipe, *patch.DividerID) {
+		return
+	}
+
+	_, err := db.Exec("UPDATE methods SET value = ?, sortOrder = ? WHERE id = ?", method.Value, method.SortOrder, method.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := updateMethodDurations(method.ID, oldValue, method.Value); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if patch.Ingredients != nil {
+		if err := setMethodIngredients(method.ID, *patch.Ingredients); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if patch.DividerID != nil {
+		if err := moveToDivider(methodSections, []int{method.ID}, *patch.DividerID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	recipeSaved(recipe.ID)
+	recipeChanged(recipe.ID, eventMethodUpdated)
+
+	writeJSON(w, http.StatusOK, findRecipeMethod(recipe.ID, method.ID))
+}
+
+func v1DeleteMethod(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	method, ok := pathMethod(w, r, recipe)
+	if !ok {
+		return
+	}
+
+	if err := removeMethod(method.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeSaved(recipe.ID)
+	recipeChanged(recipe.ID, eventMethodDeleted)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func v1GetImage(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	if recipe.Image == nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recipe.Image)
+}
+
+func v1ReplaceImage(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	imgBytes, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := saveImage(imgBytes, recipe.ID, recipe.Image != nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeChanged(recipe.ID, eventImageUpdated)
+
+	writeJSON(w, http.StatusOK, getRecipeImage(recipe.ID))
+}
+
+func v1DeleteImage(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM images WHERE recipe_id = ?", recipe.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeChanged(recipe.ID, eventImageDeleted)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func v1ListDividers(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	dividers := recipe.Dividers
+	if dividers == nil {
+		dividers = []Divider{}
+	}
+
+	writeJSON(w, http.StatusOK, dividers)
+}
+
+func v1CreateDivider(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var passedDivider Divider
+	if !decodeBody(w, r, &passedDivider) {
+		return
+	}
+	passedDivider.ID = 0
+
+	dividerId, err := saveDivider(recipe.ID, passedDivider)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeChanged(recipe.ID, eventDividerCreated)
+
+	writeJSON(w, http.StatusCreated, findRecipeDivider(recipe.ID, dividerId))
+}
+
+// findRecipeDivider returns the divider with its ingredients and methods, or
+// nil when the recipe has no such divider.
+func findRecipeDivider(recipeId int, dividerId int) *Divider {
+	for _, divider := range getRecipeDividers(recipeId) {
+		if divider.ID == dividerId {
+			return &divider
+		}
+	}
+	return nil
+}
+
+// pathDivider loads the {dividerId} divider, writing a 404 response unless it
+// belongs to the recipe.
+func pathDivider(w http.ResponseWriter, r *http.Request, recipe Recipe) (*Divider, bool) {
+	dividerId, ok := pathID(w, r, "dividerId")
+	if !ok {
+		return nil, false
+	}
+
+	divider := findRecipeDivider(recipe.ID, dividerId)
+	if divider == nil {
+		http.Error(w, "Divider not found", http.StatusNotFound)
+		return nil, false
+	}
+	return divider, true
+}
+
+func v1GetDivider(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	divider, ok := pathDivider(w, r, recipe)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, divider)
+}
+
+type dividerPatch struct {
+	Title     *string `json:"title"`
+	SortOrder *int    `json:"sortOrder"`
+}
+
+func v1PatchDivider(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	divider, ok := pathDivider(w, r, recipe)
+	if !ok {
+		return
+	}
+
+	var patch dividerPatch
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	if patch.Title != nil {
+		divider.Title = *patch.Title
+	}
+	if patch.SortOrder != nil {
+		divider.SortOrder = *patch.SortOrder
+	}
+
+	_, err := db.Exec("UPDATE dividers SET title = ?, sortOrder = ? WHERE id = ?", divider.Title, divider.SortOrder, divider.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeChanged(recipe.ID, eventDividerUpdated)
+
+	writeJSON(w, http.StatusOK, findRecipeDivider(recipe.ID, divider.ID))
+}
+
+func v1DeleteDivider(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	divider, ok := pathDivider(w, r, recipe)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := removeDivider(tx, recipe.ID, divider.ID); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeChanged(recipe.ID, eventDividerDeleted)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func v1AddDividerIngredients(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	divider, ok := pathDivider(w, r, recipe)
+	if !ok {
+		return
+	}
+
+	var ingredients []Ingredient
+	if !decodeBody(w, r, &ingredients) {
+		return
+	}
+
+	for _, ingredient := range ingredients {
+		if ingredient.ID == 0 {
+			continue
+		}
+		if existing := getIngredientById(ingredient.ID); existing == nil || existing.RecipeID != recipe.ID {
+			http.Error(w, fmt.Sprintf("Ingredient %d not found", ingredient.ID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := addDividerIngredients(recipe.ID, divider.ID, ingredients); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeSaved(recipe.ID)
+	recipeChanged(recipe.ID, eventDividerUpdated)
+
+	writeJSON(w, http.StatusOK, findRecipeDivider(recipe.ID, divider.ID))
+}
+
+func v1AddDividerMethods(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	divider, ok := pathDivider(w, r, recipe)
+	if !ok {
+		return
+	}
+
+	var methodIds []int
+	if !decodeBody(w, r, &methodIds) {
+		return
+	}
+
+	for _, methodId := range methodIds {
+		method := getMethodById(methodId)
+		if method == nil || method.RecipeID != recipe.ID {
+			http.Error(w, fmt.Sprintf("Method %d not found", methodId), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := addDividerMethods(divider.ID, methodIds); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeChanged(recipe.ID, eventDividerUpdated)
+
+	writeJSON(w, http.StatusOK, findRecipeDivider(recipe.ID, divider.ID))
+}
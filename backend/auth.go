@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type User struct {
+	ID        int    `json:"id"`
+	Username  string `json:"username"`
+	IsAdmin   bool   `json:"isAdmin"`
+	CreatedAt string `json:"createdAt"`
+
+	// scopes the request was authenticated with and, for API tokens, the
+	// token ID. Both are only set on the user attached by authMiddleware.
+	scopes     []string
+	apiTokenId int
+}
+
+type contextKey int
+
+const userContextKey contextKey = iota
+
+const sessionCookieName = "recipeme_session"
+
+const sessionLifetime = 30 * 24 * time.Hour
+
+// publicRoutes are the path templates that can be called without logging in.
+var publicRoutes = map[string]bool{
+	"/api/v1/auth/login": true,
+	// share links carry their own token, a random value looked up by its hash
+	"/s/{token}": true,
+}
+
+func registerAuthRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/auth/login", login).Methods("POST")
+	api.HandleFunc("/auth/logout", logout).Methods("POST")
+	api.HandleFunc("/auth/me", getCurrentUser).Methods("GET")
+	api.HandleFunc("/auth/password", sessionOnly(changePassword)).Methods("PUT")
+
+	api.HandleFunc("/users", requireAdmin(getUsers)).Methods("GET")
+	api.HandleFunc("/users", requireAdmin(createUser)).Methods("POST")
+	api.HandleFunc("/users/{id}", requireAdmin(updateUser)).Methods("PATCH")
+	api.HandleFunc("/users/{id}", requireAdmin(deleteUser)).Methods("DELETE")
+}
+
+// currentUser returns the user attached by authMiddleware. It is only nil on
+// public routes.
+func currentUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey).(*User)
+	return user
+}
+
+// routeScope is the scope a route needs to be read and to be written.
+type routeScope struct {
+	read, write string
+}
+
+// routeScopes are the path templates that need other scopes than
+// recipes:read for reads and recipes:write for everything else. Admin routes
+// also need an admin account, see requireAdmin.
+var routeScopes = map[string]routeScope{
+	"/api/v1/users":               {scopeAdmin, scopeAdmin},
+	"/api/v1/users/{id}":          {scopeAdmin, scopeAdmin},
+	"/api/v1/allergen-rules":      {scopeRecipesRead, scopeAdmin},
+	"/api/v1/allergen-rules/{id}": {scopeRecipesRead, scopeAdmin},
+	"/api/v1/catalog":             {scopeRecipesRead, scopeAdmin},
+	"/api/v1/catalog/merge":       {scopeRecipesRead, scopeAdmin},
+	"/api/v1/catalog/{id}":        {scopeRecipesRead, scopeAdmin},
+	"/api/v1/equipment":           {scopeRecipesRead, scopeAdmin},
+	"/api/v1/equipment/{id}":      {scopeRecipesRead, scopeAdmin},
+	"/api/v1/taxonomy":            {scopeRecipesRead, scopeAdmin},
+	"/api/v1/taxonomy/{id}":       {scopeRecipesRead, scopeAdmin},
+	"/api/v1/prices":              {scopeRecipesRead, scopeShoppingWrite},
+	"/api/v1/prices/{id}":         {scopeRecipesRead, scopeShoppingWrite},
+}
+
+// requiredScope returns the scope the request needs, by its route.
+func requiredScope(r *http.Request, template string) string {
+	scope, ok := routeScopes[template]
+	if !ok {
+		scope = routeScope{scopeRecipesRead, scopeRecipesWrite}
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return scope.read
+	}
+	return scope.write
+}
+
+// authMiddleware resolves the session or API token of the request to a user
+// and rejects the request when there is none, unless the route is public.
+// The user also needs the scope of the route, see requiredScope.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var template string
+		if route := mux.CurrentRoute(r); route != nil {
+			template, _ = route.GetPathTemplate()
+		}
+		if publicRoutes[template] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := requestToken(r)
+		if token == "" {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		var user *User
+		if strings.HasPrefix(token, apiTokenPrefix) {
+			user = getApiTokenUser(token)
+		} else {
+			user = getSessionUser(token)
+		}
+		if user == nil {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+
+		if scope := requiredScope(r, template); !user.hasScope(scope) {
+			http.Error(w, fmt.Sprintf("Token is missing the %s scope", scope), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	})
+}
+
+// requestToken reads the bearer token from the Authorization header, falling
+// back to the session cookie set by login.
+func requestToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user == nil || !user.IsAdmin || !user.hasScope(scopeAdmin) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateToken() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func getSessionUser(token string) *User {
+	row := db.QueryRow(`
+		SELECT u.id, u.username, u.isAdmin, u.createdAt FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expiresAt > ?
+	`, hashToken(token), time.Now().Format("2006-01-02 15:04:05"))
+
+	var user User
+	if err := row.Scan(&user.ID, &user.Username, &user.IsAdmin, &user.CreatedAt); err != nil {
+		return nil
+	}
+	user.scopes = userScopes(&user)
+
+	return &user
+}
+
+func getUserById(id int) *User {
+	row := db.QueryRow(`
+		SELECT id, username, isAdmin, createdAt FROM users WHERE id = ?
+	`, id)
+
+	var user User
+	if err := row.Scan(&user.ID, &user.Username, &user.IsAdmin, &user.CreatedAt); err != nil {
+		return nil
+	}
+
+	return &user
+}
+
+func insertUser(username string, password string, isAdmin bool) (int, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || len(password) < 8 {
+		return 0, errors.New("username is required and password must be at least 8 characters")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO users(username, password_hash, isAdmin, createdAt) VALUES(?,?,?,?)
+	`, username, string(hash), isAdmin, time.Now().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return 0, err
+	}
+
+	userId, _ := result.LastInsertId()
+	return int(userId), nil
+}
+
+func setUserPassword(userId int, password string) error {
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", string(hash), userId)
+	return err
+}
+
+func checkUserPassword(userId int, password string) bool {
+	var hash string
+	if err := db.QueryRow("SELECT password_hash FROM users WHERE id = ?", userId).Scan(&hash); err != nil {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// bootstrapAdmin creates the first admin account when the users table is
+// empty and hands it every recipe created before accounts existed. The
+// credentials come from RECIPEME_ADMIN_USERNAME and RECIPEME_ADMIN_PASSWORD;
+// without a password a random one is generated and printed once.
+func bootstrapAdmin() error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	username := os.Getenv("RECIPEME_ADMIN_USERNAME")
+	if username == "" {
+		username = "admin"
+	}
+
+	password := os.Getenv("RECIPEME_ADMIN_PASSWORD")
+	generated := password == ""
+	if generated {
+		password = generateToken()[:16]
+	}
+
+	adminId, err := insertUser(username, password, true)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE recipes SET owner_id = ? WHERE owner_id IS NULL", adminId)
+	if err != nil {
+		return err
+	}
+
+	if generated {
+		log.Printf("Created admin user %q with password %q, change it with PUT /api/v1/auth/password", username, password)
+	} else {
+		log.Printf("Created admin user %q", username)
+	}
+
+	return nil
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	var userId int
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", req.Username).Scan(&userId)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == sql.ErrNoRows || !checkUserPassword(userId, req.Password) {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	token := generateToken()
+	now := time.Now()
+	expiresAt := now.Add(sessionLifetime)
+
+	_, err = db.Exec(`
+		INSERT INTO sessions(user_id, token_hash, createdAt, expiresAt) VALUES(?,?,?,?)
+	`, userId, hashToken(token), now.Format("2006-01-02 15:04:05"), expiresAt.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"token":     token,
+		"expiresAt": expiresAt.Format("2006-01-02 15:04:05"),
+		"user":      getUserById(userId),
+	})
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	_, err := db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(requestToken(r)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getCurrentUser(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentUser(r))
+}
+
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	user := currentUser(r)
+	if !checkUserPassword(user.ID, req.CurrentPassword) {
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	}
+
+	if err := setUserPassword(user.ID, req.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Log out every other device that used the old password
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id = ? AND token_hash != ?", user.ID, hashToken(requestToken(r)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getUsers(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT id, username, isAdmin, createdAt FROM users ORDER BY id")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		rows.Scan(&user.ID, &user.Username, &user.IsAdmin, &user.CreatedAt)
+		users = append(users, user)
+	}
+
+	writeJSON(w, http.StatusOK, users)
+}
+
+func createUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		IsAdmin  bool   `json:"isAdmin"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	userId, err := insertUser(req.Username, req.Password, req.IsAdmin)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, getUserById(userId))
+}
+
+func updateUser(w http.ResponseWriter, r *http.Request) {
+	userId, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	user := getUserById(userId)
+	if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Password *string `json:"password"`
+		IsAdmin  *bool   `json:"isAdmin"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	if req.Password != nil {
+		if err := setUserPassword(userId, *req.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM sessions WHERE user_id = ?", userId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if req.IsAdmin != nil {
+		if !*req.IsAdmin && user.IsAdmin && countAdmins() <= 1 {
+			http.Error(w, "Cannot remove the last admin", http.StatusConflict)
+			return
+		}
+		if _, err := db.Exec("UPDATE users SET isAdmin = ? WHERE id = ?", *req.IsAdmin, userId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, getUserById(userId))
+}
+
+func countAdmins() int {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM users WHERE isAdmin = 1").Scan(&count)
+	return count
+}
+
+// deleteUser removes the account, its sessions, webhooks and every recipe it owns.
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	userId, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	user := getUserById(userId)
+	if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if user.IsAdmin && countAdmins() <= 1 {
+		http.Error(w, "Cannot delete the last admin", http.StatusConflict)
+		return
+	}
+
+	if err := removeUser(userId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userDeletes remove everything a user owns but their recipes, children
+// before parents. Foreign keys are not enforced, so nothing cascades. Notes
+// the user left stay on the recipes without an author.
+var userDeletes = []string{
+	"DELETE FROM sessions WHERE user_id = ?",
+	"DELETE FROM api_tokens WHERE user_id = ?",
+	"DELETE FROM shares WHERE created_by = ?",
+	"DELETE FROM recipe_tags WHERE tag_id IN (SELECT id FROM tags WHERE owner_id = ?)",
+	"DELETE FROM tags WHERE owner_id = ?",
+	"DELETE FROM collection_recipes WHERE collection_id IN (SELECT id FROM collections WHERE owner_id = ?)",
+	"DELETE FROM collections WHERE owner_id = ?",
+	"DELETE FROM nutrition_mappings WHERE owner_id = ?",
+	"DELETE FROM cook_log_photos WHERE cook_log_id IN (SELECT id FROM cook_log WHERE user_id = ?)",
+	"DELETE FROM cook_log WHERE user_id = ?",
+	"DELETE FROM cooking_session_ingredients WHERE session_id IN (SELECT id FROM cooking_sessions WHERE user_id = ?)",
+	"DELETE FROM cooking_session_timers WHERE session_id IN (SELECT id FROM cooking_sessions WHERE user_id = ?)",
+	"DELETE FROM cooking_sessions WHERE user_id = ?",
+	"DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE owner_id = ?)",
+	"DELETE FROM webhooks WHERE owner_id = ?",
+	"DELETE FROM substitution_lines WHERE substitution_id IN (SELECT id FROM substitutions WHERE owner_id = ?)",
+	"DELETE FROM substitutions WHERE owner_id = ?",
+	"DELETE FROM ingredient_prices WHERE owner_id = ?",
+	"UPDATE recipe_notes SET author_id = NULL WHERE author_id = ?",
+	"DELETE FROM users WHERE id = ?",
+}
+
+// removeUser deletes the user, their recipes and what they own in one
+// transaction. The recipes' deletions are published once it is committed.
+func removeUser(userId int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	notifies, err := removeUserTx(tx, userId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, notify := range notifies {
+		notify()
+	}
+	return nil
+}
+
+func removeUserTx(tx *sql.Tx, userId int) ([]func(), error) {
+	rows, err := tx.Query("SELECT id FROM recipes WHERE owner_id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	var recipeIds []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		recipeIds = append(recipeIds, id)
+	}
+	rows.Close()
+
+	var notifies []func()
+	for _, recipeId := range recipeIds {
+		notify, err := removeRecipeTx(tx, recipeId)
+		if err != nil {
+			return nil, fmt.Errorf("deleting recipe %d: %w", recipeId, err)
+		}
+		notifies = append(notifies, notify)
+	}
+
+	for _, statement := range userDeletes {
+		if _, err := tx.Exec(statement, userId); err != nil {
+			return nil, err
+		}
+	}
+	return notifies, nil
+}
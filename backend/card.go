@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// cardTemplate is a layout of a recipe card image.
+type cardTemplate struct {
+	width, height int
+	draw          func(dst *image.RGBA, card recipeCard)
+}
+
+// cardTemplates are the layouts a card can be drawn with: classic puts the
+// cover beside the text, overlay puts the text over the cover, and square
+// puts it under the cover.
+var cardTemplates = map[string]cardTemplate{
+	"classic": {1200, 630, drawClassicCard},
+	"overlay": {1200, 630, drawOverlayCard},
+	"square":  {1080, 1080, drawSquareCard},
+}
+
+const defaultCardTemplate = "classic"
+
+var (
+	cardBackground = color.RGBA{0xfb, 0xf7, 0xf0, 0xff}
+	cardInk        = color.RGBA{0x2b, 0x2b, 0x2b, 0xff}
+	cardAccent     = color.RGBA{0xc0, 0x56, 0x2f, 0xff}
+	cardWhite      = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// recipeCard is what a card shows of a recipe.
+type recipeCard struct {
+	name        string
+	meta        string
+	cover       image.Image
+	ingredients []string
+}
+
+// cardCacheSize is how many rendered cards are kept in memory.
+const cardCacheSize = 256
+
+type cardCacheKey struct {
+	recipeId int
+	template string
+}
+
+// cachedCard is a rendered card, valid while the recipe is unchanged.
+type cachedCard struct {
+	lastEditedAt string
+	version      int
+	data         []byte
+}
+
+var recipeCards struct {
+	sync.Mutex
+	cards map[cardCacheKey]cachedCard
+}
+
+func registerCardRoutes(router *mux.Router) {
+	router.HandleFunc("/recipe/{id}/card.png", getRecipeCard).Methods("GET")
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/recipes/{id}/card.png", getRecipeCard).Methods("GET")
+}
+
+// getRecipeCard renders the recipe as an image to share, with the layout
+// named by ?template=. Cards are cached until the recipe is edited.
+func getRecipeCard(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	name := r.URL.Query().Get("template")
+	if name == "" {
+		name = defaultCardTemplate
+	}
+	template, ok := cardTemplates[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("template must be one of %s", cardTemplateNames()), http.StatusBadRequest)
+		return
+	}
+
+	etag := fmt.Sprintf(`"card-%d-%s-%d"`, recipe.ID, name, recipe.Version)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if edited, err := time.ParseInLocation("2006-01-02 15:04:05", recipe.LastEditedAt, time.Local); err == nil {
+		w.Header().Set("Last-Modified", edited.UTC().Format(http.TimeFormat))
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data, err := recipeCardPNG(recipe, name, template)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, exportFilename(recipe.Name, "recipe", "png")))
+	w.Write(data)
+}
+
+// recipeCardPNG returns the cached card of the recipe, rendering it again
+// when the recipe was edited since. When the cache is full an arbitrary
+// card makes room.
+func recipeCardPNG(recipe Recipe, name string, template cardTemplate) ([]byte, error) {
+	key := cardCacheKey{recipe.ID, name}
+
+	recipeCards.Lock()
+	cached, ok := recipeCards.cards[key]
+	recipeCards.Unlock()
+	if ok && cached.lastEditedAt == recipe.LastEditedAt && cached.version == recipe.Version {
+		return cached.data, nil
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, template.width, template.height))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{cardBackground}, image.Point{}, draw.Src)
+	template.draw(dst, newRecipeCard(recipe))
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, dst); err != nil {
+		return nil, err
+	}
+
+	recipeCards.Lock()
+	if recipeCards.cards == nil {
+		recipeCards.cards = map[cardCacheKey]cachedCard{}
+	}
+	if _, ok := recipeCards.cards[key]; !ok && len(recipeCards.cards) >= cardCacheSize {
+		for evicted := range recipeCards.cards {
+			delete(recipeCards.cards, evicted)
+			break
+		}
+	}
+	recipeCards.cards[key] = cachedCard{recipe.LastEditedAt, recipe.Version, encoded.Bytes()}
+	recipeCards.Unlock()
+
+	return encoded.Bytes(), nil
+}
+
+func newRecipeCard(recipe Recipe) recipeCard {
+	card := recipeCard{name: recipe.Name, meta: recipeMeta(recipe)}
+	if recipe.Image != nil && recipe.Image.Url != "" {
+		if data, err := base64.StdEncoding.DecodeString(recipe.Image.Url); err == nil {
+			card.cover, _, _ = image.Decode(bytes.NewReader(data))
+		}
+	}
+	for _, ingredient := range recipe.Ingredients {
+		card.ingredients = append(card.ingredients, ingredientLine(ingredient))
+	}
+	return card
+}
+
+// drawClassicCard puts the cover on the left and the name, meta line and
+// ingredients on the right.
+func drawClassicCard(dst *image.RGBA, card recipeCard) {
+	bounds := dst.Bounds()
+	cover := image.Rect(0, 0, bounds.Dx()*9/20, bounds.Dy())
+	drawCardCover(dst, cover, card)
+
+	x, width := cover.Max.X+48, bounds.Max.X-cover.Max.X-96
+	y := 56
+	if card.meta != "" {
+		for _, line := range wrapCardText(card.meta, 3, width, 2) {
+			drawCardText(dst, x, y, 3, cardAccent, line)
+			y += cardLineHeight(3)
+		}
+		y += 12
+	}
+	for _, line := range wrapCardText(card.name, 6, width, 3) {
+		drawCardText(dst, x, y, 6, cardInk, line)
+		y += cardLineHeight(6)
+	}
+	y += 16
+	fillCardRect(dst, image.Rect(x, y, x+64, y+4), cardAccent)
+	y += 28
+
+	drawCardIngredients(dst, x, y, width, bounds.Max.Y-48, card.ingredients)
+}
+
+// drawOverlayCard fills the card with the cover and puts the name, meta
+// line and ingredients on a shade at its foot.
+func drawOverlayCard(dst *image.RGBA, card recipeCard) {
+	bounds := dst.Bounds()
+	drawCardCover(dst, bounds, card)
+	shadeCard(dst, bounds.Dy()*3/10, bounds.Max.Y, 0.85)
+
+	x, width := 56, bounds.Dx()-112
+	summary := strings.Join(card.ingredients, ", ")
+	summaryLines := wrapCardText(summary, 3, width, 2)
+	nameLines := wrapCardText(card.name, 7, width, 2)
+
+	y := bounds.Max.Y - 56 - len(summaryLines)*cardLineHeight(3)
+	for i, line := range summaryLines {
+		drawCardText(dst, x, y+i*cardLineHeight(3), 3, color.RGBA{0xee, 0xee, 0xee, 0xff}, line)
+	}
+	y -= 20 + len(nameLines)*cardLineHeight(7)
+	for i, line := range nameLines {
+		drawCardText(dst, x, y+i*cardLineHeight(7), 7, cardWhite, line)
+	}
+	if card.meta != "" {
+		y -= cardLineHeight(3) + 8
+		drawCardText(dst, x, y, 3, color.RGBA{0xf3, 0xb8, 0x9c, 0xff}, truncateCardText(card.meta, 3, width))
+	}
+}
+
+// drawSquareCard puts the cover on top and the name, meta line and
+// ingredients in two columns below it.
+func drawSquareCard(dst *image.RGBA, card recipeCard) {
+	bounds := dst.Bounds()
+	cover := image.Rect(0, 0, bounds.Dx(), bounds.Dy()*11/20)
+	drawCardCover(dst, cover, card)
+
+	x, width := 60, bounds.Dx()-120
+	y := cover.Max.Y + 44
+	for _, line := range wrapCardText(card.name, 7, width, 2) {
+		drawCardText(dst, x, y, 7, cardInk, line)
+		y += cardLineHeight(7)
+	}
+	if card.meta != "" {
+		y += 4
+		drawCardText(dst, x, y, 3, cardAccent, truncateCardText(card.meta, 3, width))
+		y += cardLineHeight(3)
+	}
+	y += 24
+
+	column := (width - 40) / 2
+	rows := max(0, (bounds.Max.Y-60-y)/cardLineHeight(3))
+	ingredients := card.ingredients
+	if len(ingredients) > rows*2 && rows > 0 {
+		ingredients = append(slices.Clone(ingredients[:rows*2-1]), fmt.Sprintf("and %d more", len(card.ingredients)-rows*2+1))
+	}
+	for i, ingredient := range ingredients {
+		left := x
+		if i >= rows {
+			left += column + 40
+		}
+		drawCardText(dst, left, y+(i%max(rows, 1))*cardLineHeight(3), 3, cardInk, truncateCardText("• "+ingredient, 3, column))
+	}
+}
+
+// drawCardIngredients lists the ingredients from y down to bottom, ending
+// with how many more there are when they do not all fit.
+func drawCardIngredients(dst *image.RGBA, x, y, width, bottom int, ingredients []string) {
+	rows := max(0, (bottom-y)/cardLineHeight(3))
+	if len(ingredients) > rows && rows > 0 {
+		ingredients = append(slices.Clone(ingredients[:rows-1]), fmt.Sprintf("and %d more", len(ingredients)-rows+1))
+	}
+	for i, ingredient := range ingredients {
+		if i >= rows {
+			break
+		}
+		drawCardText(dst, x, y+i*cardLineHeight(3), 3, cardInk, truncateCardText("• "+ingredient, 3, width))
+	}
+}
+
+// drawCardCover fills rect with the cover, cropped to its shape. A recipe
+// without a cover gets its initial on the accent colour instead.
+func drawCardCover(dst *image.RGBA, rect image.Rectangle, card recipeCard) {
+	if card.cover == nil {
+		fillCardRect(dst, rect, cardAccent)
+		initial := strings.ToUpper(string([]rune(cardText(strings.TrimSpace(card.name)) + "?")[:1]))
+		size := rect.Dy() / 24
+		drawCardText(dst, rect.Min.X+(rect.Dx()-cardTextWidth(initial, size))/2, rect.Min.Y+(rect.Dy()-7*size)/2, size,
+			color.RGBA{0xff, 0xff, 0xff, 0x60}, initial)
+		return
+	}
+
+	src := card.cover.Bounds()
+	// the part of the cover with the shape of rect, centred
+	crop := src
+	if src.Dx()*rect.Dy() > src.Dy()*rect.Dx() {
+		width := src.Dy() * rect.Dx() / rect.Dy()
+		crop.Min.X += (src.Dx() - width) / 2
+		crop.Max.X = crop.Min.X + width
+	} else {
+		height := src.Dx() * rect.Dy() / rect.Dx()
+		crop.Min.Y += (src.Dy() - height) / 2
+		crop.Max.Y = crop.Min.Y + height
+	}
+
+	// every pixel is the average of the cover pixels it covers
+	for y := 0; y < rect.Dy(); y++ {
+		y0 := crop.Min.Y + y*crop.Dy()/rect.Dy()
+		y1 := max(y0+1, crop.Min.Y+(y+1)*crop.Dy()/rect.Dy())
+		for x := 0; x < rect.Dx(); x++ {
+			x0 := crop.Min.X + x*crop.Dx()/rect.Dx()
+			x1 := max(x0+1, crop.Min.X+(x+1)*crop.Dx()/rect.Dx())
+			var r, g, b, count uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := card.cover.At(sx, sy).RGBA()
+					r += pr + (0xffff-pa)*uint32(cardBackground.R)/0xff
+					g += pg + (0xffff-pa)*uint32(cardBackground.G)/0xff
+					b += pb + (0xffff-pa)*uint32(cardBackground.B)/0xff
+					count++
+				}
+			}
+			dst.SetRGBA(rect.Min.X+x, rect.Min.Y+y, color.RGBA{uint8(r / count >> 8), uint8(g / count >> 8), uint8(b / count >> 8), 0xff})
+		}
+	}
+}
+
+func fillCardRect(dst *image.RGBA, rect image.Rectangle, c color.RGBA) {
+	draw.Draw(dst, rect, &image.Uniform{c}, image.Point{}, draw.Src)
+}
+
+// shadeCard darkens the rows from top to bottom, from not at all to
+// opacity, so light text stays readable on any cover.
+func shadeCard(dst *image.RGBA, top, bottom int, opacity float64) {
+	for y := top; y < bottom; y++ {
+		alpha := opacity * float64(y-top) / float64(bottom-top)
+		for x := dst.Rect.Min.X; x < dst.Rect.Max.X; x++ {
+			blendPixel(dst, x, y, color.RGBA{0, 0, 0, 0xff}, alpha)
+		}
+	}
+}
+
+// cardTemplateNames lists the templates in order, for error messages.
+func cardTemplateNames() string {
+	names := make([]string, 0, len(cardTemplates))
+	for name := range cardTemplates {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
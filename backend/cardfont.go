@@ -0,0 +1,330 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"sync"
+)
+
+// The card font is a bitmap font of 5 by 9 cells: capitals and digits fill
+// the top 7 rows, and the last 2 rows hold descenders. Each row is a byte
+// with the leftmost cell in bit 4. Glyphs are smoothed and anti-aliased
+// when drawn, so they scale to any size without a font rasterizer.
+const (
+	cardGlyphWidth  = 5
+	cardGlyphHeight = 9
+
+	// cardGlyphDetail is how many times finer than a cell the smoothed
+	// glyphs are.
+	cardGlyphDetail = 4
+)
+
+var cardGlyphs = map[rune][cardGlyphHeight]uint8{
+	' ':  {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	'!':  {0x04, 0x04, 0x04, 0x04, 0x04, 0x00, 0x04, 0x00, 0x00},
+	'"':  {0x0a, 0x0a, 0x0a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	'#':  {0x0a, 0x0a, 0x1f, 0x0a, 0x1f, 0x0a, 0x0a, 0x00, 0x00},
+	'$':  {0x04, 0x0f, 0x14, 0x0e, 0x05, 0x1e, 0x04, 0x00, 0x00},
+	'%':  {0x18, 0x19, 0x02, 0x04, 0x08, 0x13, 0x03, 0x00, 0x00},
+	'&':  {0x0c, 0x12, 0x14, 0x08, 0x15, 0x12, 0x0d, 0x00, 0x00},
+	'\'': {0x04, 0x04, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	'(':  {0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02, 0x00, 0x00},
+	')':  {0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08, 0x00, 0x00},
+	'*':  {0x00, 0x04, 0x15, 0x0e, 0x15, 0x04, 0x00, 0x00, 0x00},
+	'+':  {0x00, 0x04, 0x04, 0x1f, 0x04, 0x04, 0x00, 0x00, 0x00},
+	',':  {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x04, 0x08, 0x00},
+	'-':  {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00, 0x00, 0x00},
+	'.':  {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c, 0x00, 0x00},
+	'/':  {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00, 0x00, 0x00},
+	'0':  {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e, 0x00, 0x00},
+	'1':  {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e, 0x00, 0x00},
+	'2':  {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f, 0x00, 0x00},
+	'3':  {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e, 0x00, 0x00},
+	'4':  {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02, 0x00, 0x00},
+	'5':  {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e, 0x00, 0x00},
+	'6':  {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e, 0x00, 0x00},
+	'7':  {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08, 0x00, 0x00},
+	'8':  {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e, 0x00, 0x00},
+	'9':  {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c, 0x00, 0x00},
+	':':  {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00, 0x00, 0x00},
+	';':  {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x04, 0x08, 0x00, 0x00},
+	'<':  {0x02, 0x04, 0x08, 0x10, 0x08, 0x04, 0x02, 0x00, 0x00},
+	'=':  {0x00, 0x00, 0x1f, 0x00, 0x1f, 0x00, 0x00, 0x00, 0x00},
+	'>':  {0x08, 0x04, 0x02, 0x01, 0x02, 0x04, 0x08, 0x00, 0x00},
+	'?':  {0x0e, 0x11, 0x01, 0x02, 0x04, 0x00, 0x04, 0x00, 0x00},
+	'@':  {0x0e, 0x11, 0x01, 0x0d, 0x15, 0x15, 0x0e, 0x00, 0x00},
+	'A':  {0x0e, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11, 0x00, 0x00},
+	'B':  {0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e, 0x00, 0x00},
+	'C':  {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e, 0x00, 0x00},
+	'D':  {0x1e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x1e, 0x00, 0x00},
+	'E':  {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f, 0x00, 0x00},
+	'F':  {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10, 0x00, 0x00},
+	'G':  {0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f, 0x00, 0x00},
+	'H':  {0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11, 0x00, 0x00},
+	'I':  {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e, 0x00, 0x00},
+	'J':  {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c, 0x00, 0x00},
+	'K':  {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11, 0x00, 0x00},
+	'L':  {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f, 0x00, 0x00},
+	'M':  {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11, 0x00, 0x00},
+	'N':  {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11, 0x00, 0x00},
+	'O':  {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e, 0x00, 0x00},
+	'P':  {0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10, 0x00, 0x00},
+	'Q':  {0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d, 0x00, 0x00},
+	'R':  {0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11, 0x00, 0x00},
+	'S':  {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e, 0x00, 0x00},
+	'T':  {0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04, 0x00, 0x00},
+	'U':  {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e, 0x00, 0x00},
+	'V':  {0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04, 0x00, 0x00},
+	'W':  {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a, 0x00, 0x00},
+	'X':  {0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11, 0x00, 0x00},
+	'Y':  {0x11, 0x11, 0x0a, 0x04, 0x04, 0x04, 0x04, 0x00, 0x00},
+	'Z':  {0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f, 0x00, 0x00},
+	'[':  {0x0e, 0x08, 0x08, 0x08, 0x08, 0x08, 0x0e, 0x00, 0x00},
+	'\\': {0x00, 0x10, 0x08, 0x04, 0x02, 0x01, 0x00, 0x00, 0x00},
+	']':  {0x0e, 0x02, 0x02, 0x02, 0x02, 0x02, 0x0e, 0x00, 0x00},
+	'^':  {0x04, 0x0a, 0x11, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	'_':  {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1f, 0x00},
+	'`':  {0x08, 0x04, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	'a':  {0x00, 0x00, 0x0e, 0x01, 0x0f, 0x11, 0x0f, 0x00, 0x00},
+	'b':  {0x10, 0x10, 0x16, 0x19, 0x11, 0x11, 0x1e, 0x00, 0x00},
+	'c':  {0x00, 0x00, 0x0e, 0x10, 0x10, 0x11, 0x0e, 0x00, 0x00},
+	'd':  {0x01, 0x01, 0x0d, 0x13, 0x11, 0x11, 0x0f, 0x00, 0x00},
+	'e':  {0x00, 0x00, 0x0e, 0x11, 0x1f, 0x10, 0x0e, 0x00, 0x00},
+	'f':  {0x06, 0x09, 0x08, 0x1c, 0x08, 0x08, 0x08, 0x00, 0x00},
+	'g':  {0x00, 0x00, 0x0f, 0x11, 0x11, 0x11, 0x0f, 0x01, 0x0e},
+	'h':  {0x10, 0x10, 0x16, 0x19, 0x11, 0x11, 0x11, 0x00, 0x00},
+	'i':  {0x04, 0x00, 0x0c, 0x04, 0x04, 0x04, 0x0e, 0x00, 0x00},
+	'j':  {0x02, 0x00, 0x06, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c},
+	'k':  {0x10, 0x10, 0x12, 0x14, 0x18, 0x14, 0x12, 0x00, 0x00},
+	'l':  {0x0c, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e, 0x00, 0x00},
+	'm':  {0x00, 0x00, 0x1a, 0x15, 0x15, 0x15, 0x15, 0x00, 0x00},
+	'n':  {0x00, 0x00, 0x16, 0x19, 0x11, 0x11, 0x11, 0x00, 0x00},
+	'o':  {0x00, 0x00, 0x0e, 0x11, 0x11, 0x11, 0x0e, 0x00, 0x00},
+	'p':  {0x00, 0x00, 0x1e, 0x11, 0x11, 0x11, 0x1e, 0x10, 0x10},
+	'q':  {0x00, 0x00, 0x0f, 0x11, 0x11, 0x11, 0x0f, 0x01, 0x01},
+	'r':  {0x00, 0x00, 0x16, 0x19, 0x10, 0x10, 0x10, 0x00, 0x00},
+	's':  {0x00, 0x00, 0x0e, 0x10, 0x0e, 0x01, 0x1e, 0x00, 0x00},
+	't':  {0x08, 0x08, 0x1c, 0x08, 0x08, 0x09, 0x06, 0x00, 0x00},
+	'u':  {0x00, 0x00, 0x11, 0x11, 0x11, 0x13, 0x0d, 0x00, 0x00},
+	'v':  {0x00, 0x00, 0x11, 0x11, 0x11, 0x0a, 0x04, 0x00, 0x00},
+	'w':  {0x00, 0x00, 0x11, 0x11, 0x15, 0x15, 0x0a, 0x00, 0x00},
+	'x':  {0x00, 0x00, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x00, 0x00},
+	'y':  {0x00, 0x00, 0x11, 0x11, 0x11, 0x11, 0x0f, 0x01, 0x0e},
+	'z':  {0x00, 0x00, 0x1f, 0x02, 0x04, 0x08, 0x1f, 0x00, 0x00},
+	'{':  {0x02, 0x04, 0x04, 0x08, 0x04, 0x04, 0x02, 0x00, 0x00},
+	'|':  {0x04, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04, 0x00, 0x00},
+	'}':  {0x08, 0x04, 0x04, 0x02, 0x04, 0x04, 0x08, 0x00, 0x00},
+	'~':  {0x00, 0x00, 0x08, 0x15, 0x02, 0x00, 0x00, 0x00, 0x00},
+	'•':  {0x00, 0x00, 0x00, 0x0e, 0x0e, 0x0e, 0x00, 0x00, 0x00},
+	'·':  {0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00},
+	'°':  {0x0c, 0x12, 0x12, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x00},
+}
+
+// cardFolds spells characters the card font lacks with ones it has.
+var cardFolds = map[rune]string{
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "A", 'Å': "A", 'Æ': "AE", 'Ç': "C",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I",
+	'Ñ': "N", 'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "O", 'Ø': "O", 'Œ': "OE",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "U", 'Ý': "Y", 'Ÿ': "Y",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'æ': "ae", 'ç': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'ñ': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'œ': "oe",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ý': "y", 'ÿ': "y", 'ß': "ss",
+	'‘': "'", '’': "'", '“': "\"", '”': "\"", '–': "-", '—': "-", '…': "...",
+	'¼': "1/4", '½': "1/2", '¾': "3/4", '⅓': "1/3", '⅔': "2/3",
+	'\t': " ", '\n': " ", '\r': " ",
+}
+
+// cardText spells text in the card font, with a question mark for what it
+// cannot show.
+func cardText(text string) string {
+	var spelled strings.Builder
+	for _, r := range text {
+		if _, ok := cardGlyphs[r]; ok {
+			spelled.WriteRune(r)
+		} else if fold, ok := cardFolds[r]; ok {
+			spelled.WriteString(fold)
+		} else {
+			spelled.WriteRune('?')
+		}
+	}
+	return spelled.String()
+}
+
+var smoothCardGlyphs struct {
+	sync.Mutex
+	glyphs map[rune][][]bool
+}
+
+// smoothCardGlyph returns the glyph at cardGlyphDetail times its size, with
+// its diagonals rounded off by Scale2x.
+func smoothCardGlyph(r rune) [][]bool {
+	smoothCardGlyphs.Lock()
+	defer smoothCardGlyphs.Unlock()
+
+	if glyph, ok := smoothCardGlyphs.glyphs[r]; ok {
+		return glyph
+	}
+	if smoothCardGlyphs.glyphs == nil {
+		smoothCardGlyphs.glyphs = map[rune][][]bool{}
+	}
+
+	rows := cardGlyphs[r]
+	glyph := make([][]bool, cardGlyphHeight)
+	for y, row := range rows {
+		glyph[y] = make([]bool, cardGlyphWidth)
+		for x := range glyph[y] {
+			glyph[y][x] = row&(1<<(cardGlyphWidth-1-x)) != 0
+		}
+	}
+	for size := 1; size < cardGlyphDetail; size *= 2 {
+		glyph = scale2x(glyph)
+	}
+
+	smoothCardGlyphs.glyphs[r] = glyph
+	return glyph
+}
+
+// scale2x doubles a bitmap, filling in the corners of diagonal steps.
+func scale2x(src [][]bool) [][]bool {
+	height, width := len(src), len(src[0])
+	at := func(x, y int) bool {
+		if x < 0 || y < 0 || x >= width || y >= height {
+			return false
+		}
+		return src[y][x]
+	}
+
+	dst := make([][]bool, height*2)
+	for y := range dst {
+		dst[y] = make([]bool, width*2)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := src[y][x]
+			up, right, left, down := at(x, y-1), at(x+1, y), at(x-1, y), at(x, y+1)
+			e0, e1, e2, e3 := p, p, p, p
+			if left == up && left != down && up != right {
+				e0 = up
+			}
+			if up == right && up != left && right != down {
+				e1 = right
+			}
+			if down == left && down != right && left != up {
+				e2 = left
+			}
+			if right == down && right != up && down != left {
+				e3 = down
+			}
+			dst[y*2][x*2], dst[y*2][x*2+1], dst[y*2+1][x*2], dst[y*2+1][x*2+1] = e0, e1, e2, e3
+		}
+	}
+	return dst
+}
+
+// cardTextWidth is the width in pixels of text drawn with cells of size
+// pixels, leaving out the spacing after the last glyph.
+func cardTextWidth(text string, size int) int {
+	count := len([]rune(cardText(text)))
+	if count == 0 {
+		return 0
+	}
+	return (count*(cardGlyphWidth+1) - 1) * size
+}
+
+// cardLineHeight is the distance between the tops of two lines of text.
+func cardLineHeight(size int) int {
+	return (cardGlyphHeight + 2) * size
+}
+
+// drawCardText draws text with its top left corner at x, y and cells of
+// size pixels. Every pixel is covered by as much of the glyph as falls in
+// it, sampled on a 4 by 4 grid.
+func drawCardText(dst *image.RGBA, x, y int, size int, c color.RGBA, text string) {
+	const samples = 4
+	detail := cardGlyphDetail
+	for _, r := range cardText(text) {
+		glyph := smoothCardGlyph(r)
+		for py := 0; py < cardGlyphHeight*size; py++ {
+			for px := 0; px < cardGlyphWidth*size; px++ {
+				covered := 0
+				for sy := 0; sy < samples; sy++ {
+					gy := (py*samples + sy) * detail / (size * samples)
+					for sx := 0; sx < samples; sx++ {
+						gx := (px*samples + sx) * detail / (size * samples)
+						if glyph[gy][gx] {
+							covered++
+						}
+					}
+				}
+				if covered > 0 {
+					blendPixel(dst, x+px, y+py, c, float64(covered)/(samples*samples))
+				}
+			}
+		}
+		x += (cardGlyphWidth + 1) * size
+	}
+}
+
+// blendPixel paints c over the pixel with the given opacity.
+func blendPixel(dst *image.RGBA, x, y int, c color.RGBA, opacity float64) {
+	if !(image.Point{x, y}.In(dst.Rect)) {
+		return
+	}
+	i := dst.PixOffset(x, y)
+	alpha := opacity * float64(c.A) / 255
+	for channel, value := range []uint8{c.R, c.G, c.B} {
+		dst.Pix[i+channel] = uint8(float64(dst.Pix[i+channel])*(1-alpha) + float64(value)*alpha + 0.5)
+	}
+	dst.Pix[i+3] = 255
+}
+
+// wrapCardText breaks text into at most maxLines lines no wider than
+// width, ending the last one with an ellipsis when text is left over.
+func wrapCardText(text string, size int, width int, maxLines int) []string {
+	var lines []string
+	line := ""
+	words := strings.Fields(cardText(text))
+	for i, word := range words {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if cardTextWidth(candidate, size) <= width {
+			line = candidate
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		line = word
+		if len(lines) == maxLines {
+			last := lines[maxLines-1]
+			if i < len(words) {
+				last = truncateCardText(last+" "+strings.Join(words[i:], " "), size, width)
+			}
+			lines[maxLines-1] = last
+			return lines
+		}
+		if cardTextWidth(line, size) > width {
+			line = truncateCardText(line, size, width)
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// truncateCardText shortens text with "..." until it fits in width.
+func truncateCardText(text string, size int, width int) string {
+	if cardTextWidth(text, size) <= width {
+		return text
+	}
+	runes := []rune(cardText(text))
+	for len(runes) > 0 && cardTextWidth(string(runes)+"...", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return strings.TrimSpace(string(runes)) + "..."
+}
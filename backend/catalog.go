@@ -0,0 +1,831 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CatalogEntry is the canonical form of an ingredient. Recipe ingredients are
+// linked to the entry one of whose aliases equals their normalized name, so
+// "spring onions", "scallion" and "green onion" all end up in "spring onion".
+// Density is in g/ml.
+type CatalogEntry struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Aliases     []string `json:"aliases"`
+	Aisle       string   `json:"aisle"`
+	DefaultUnit string   `json:"defaultUnit"`
+	Density     *float64 `json:"density"`
+	UsageCount  int      `json:"usageCount"`
+}
+
+// aisleByTaxonomy is the grocery aisle of the ingredients below each root of
+// the default taxonomy.
+var aisleByTaxonomy = map[string]string{
+	"dairy":      "dairy",
+	"eggs":       "dairy",
+	"meat":       "meat",
+	"seafood":    "fish",
+	"vegetables": "produce",
+	"fruit":      "produce",
+	"herbs":      "produce",
+	"legumes":    "pantry",
+	"grains":     "pantry",
+	"nuts":       "baking",
+	"sweeteners": "baking",
+	"spices":     "spices",
+	"oils":       "oils and condiments",
+}
+
+var errCatalogAlias = errors.New("alias belongs to another entry")
+
+const catalogColumns = "id, name, aisle, defaultUnit, density"
+
+func registerCatalogRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/catalog", getCatalog).Methods("GET")
+	api.HandleFunc("/catalog", requireAdmin(createCatalogEntry)).Methods("POST")
+	api.HandleFunc("/catalog/merge", requireAdmin(mergeCatalogEntries)).Methods("POST")
+	api.HandleFunc("/catalog/{id}", getCatalogEntryHandler).Methods("GET")
+	api.HandleFunc("/catalog/{id}", requireAdmin(updateCatalogEntry)).Methods("PATCH")
+	api.HandleFunc("/catalog/{id}", requireAdmin(deleteCatalogEntry)).Methods("DELETE")
+}
+
+// catalogStandInsMigration is the migrations entry of dropCatalogStandIns.
+const catalogStandInsMigration = "drop catalog stand-ins"
+
+// seedIngredientCatalog fills an empty catalogue with the foods of the
+// nutrition table, their aliases but the stand-ins, and density.
+func seedIngredientCatalog() error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM ingredient_catalog").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return runMigration(catalogStandInsMigration, dropCatalogStandIns)
+	}
+
+	nodes, err := getTaxonomyNodes()
+	if err != nil {
+		return err
+	}
+	depth := taxonomyDepths(nodes)
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	for _, food := range foods {
+		unit := "g"
+		if _, ok := food.Portions["piece"]; ok {
+			unit = "piece"
+		}
+		var density any
+		if food.Density > 0 {
+			density = food.Density
+		}
+
+		result, err := db.Exec(`
+			INSERT OR IGNORE INTO ingredient_catalog(name, aisle, defaultUnit, density, createdAt, lastEditedAt) VALUES(?,?,?,?,?,?)
+		`, food.Name, catalogAisle(nodes, depth, food.Name), unit, density, now, now)
+		if err != nil {
+			return err
+		}
+		if added, _ := result.RowsAffected(); added == 0 {
+			continue
+		}
+		id, _ := result.LastInsertId()
+		for _, alias := range append([]string{food.Name}, food.Aliases...) {
+			if slices.Contains(food.StandIns, alias) {
+				continue
+			}
+			if _, err := db.Exec("INSERT OR IGNORE INTO ingredient_catalog_aliases(alias, catalog_id) VALUES(?,?)", normalizeIngredientName(alias), id); err != nil {
+				return err
+			}
+		}
+	}
+
+	// a new catalogue has no stand-ins to drop
+	return runMigration(catalogStandInsMigration, func(tx *sql.Tx) error { return nil })
+}
+
+// dropCatalogStandIns removes the stand-ins of the foods from a catalogue
+// seeded when they were still taken for aliases, unless the entry has been
+// renamed since. Ingredients linked by one are unlinked, for
+// linkAllIngredients to link again. It runs once, so an alias an admin adds
+// back later stays.
+func dropCatalogStandIns(tx *sql.Tx) error {
+	for _, food := range foods {
+		for _, standIn := range food.StandIns {
+			_, err := tx.Exec(`
+				DELETE FROM ingredient_catalog_aliases
+				WHERE alias = ? AND catalog_id = (SELECT id FROM ingredient_catalog WHERE name = ?)
+			`, normalizeIngredientName(standIn), food.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := tx.Exec(`
+		DELETE FROM ingredient_catalog_links
+		WHERE manual = 0 AND name NOT IN (SELECT alias FROM ingredient_catalog_aliases WHERE catalog_id = ingredient_catalog_links.catalog_id)
+	`)
+	return err
+}
+
+// catalogAisle is the aisle of the taxonomy root above the most specific node
+// the name matches, or "" when it matches none.
+func catalogAisle(nodes []TaxonomyNode, depth map[int]int, name string) string {
+	id := matchTaxonomyNode(nodes, depth, normalizeIngredientName(name))
+	if id == 0 {
+		return ""
+	}
+
+	byId := map[int]TaxonomyNode{}
+	for _, node := range nodes {
+		byId[node.ID] = node
+	}
+	node := byId[id]
+	for i := 0; node.ParentID != nil && i < len(nodes); i++ {
+		node = byId[*node.ParentID]
+	}
+	return aisleByTaxonomy[node.Name]
+}
+
+// resolveCatalogId returns the entry whose alias is the normalized name, or 0
+// for a name the catalogue does not know. Unknown names stay unlinked rather
+// than being added, as the catalogue is shared by every user.
+func resolveCatalogId(name string) (int, error) {
+	normalized := normalizeIngredientName(name)
+	if normalized == "" {
+		return 0, nil
+	}
+
+	var id int
+	err := db.QueryRow("SELECT catalog_id FROM ingredient_catalog_aliases WHERE alias = ?", normalized).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// linkRecipeIngredients links the recipe's ingredients to the catalogue.
+// Ingredients that are unlinked, new or were renamed since they were linked
+// are resolved again, unless they were linked by hand.
+func linkRecipeIngredients(recipeId int) error {
+	rows, err := db.Query(`
+		SELECT i.id, i.name, l.catalog_id IS NOT NULL, COALESCE(l.name, ''), COALESCE(l.manual, 0)
+		FROM ingredients i
+		LEFT JOIN ingredient_catalog_links l ON l.ingredient_id = i.id
+		WHERE i.recipe_id = ?
+	`, recipeId)
+	if err != nil {
+		return err
+	}
+
+	type pending struct {
+		id   int
+		name string
+	}
+	var stale []pending
+	for rows.Next() {
+		var id int
+		var name, linkedName string
+		var linked, manual bool
+		if err := rows.Scan(&id, &name, &linked, &linkedName, &manual); err != nil {
+			rows.Close()
+			return err
+		}
+		if normalized := normalizeIngredientName(name); !linked || (!manual && linkedName != normalized) {
+			stale = append(stale, pending{id, normalized})
+		}
+	}
+	rows.Close()
+
+	for _, ingredient := range stale {
+		catalogId, err := resolveCatalogId(ingredient.name)
+		if err != nil {
+			return err
+		}
+		if catalogId == 0 {
+			_, err = db.Exec("DELETE FROM ingredient_catalog_links WHERE ingredient_id = ?", ingredient.id)
+		} else {
+			_, err = db.Exec(`
+				INSERT INTO ingredient_catalog_links(ingredient_id, catalog_id, name, manual) VALUES(?,?,?,0)
+				ON CONFLICT(ingredient_id) DO UPDATE SET catalog_id = excluded.catalog_id, name = excluded.name, manual = 0
+			`, ingredient.id, catalogId, ingredient.name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkAllIngredients links the ingredients that are not linked yet: those
+// saved before the catalogue existed, and those whose name the catalogue did
+// not know.
+func linkAllIngredients() error {
+	rows, err := db.Query(`
+		SELECT DISTINCT recipe_id FROM ingredients
+		WHERE id NOT IN (SELECT ingredient_id FROM ingredient_catalog_links)
+	`)
+	if err != nil {
+		return err
+	}
+
+	var recipeIds []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			recipeIds = append(recipeIds, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range recipeIds {
+		if err := linkRecipeIngredients(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setIngredientCatalog links the ingredient to the entry by hand, so renaming
+// the ingredient keeps the link. catalogId 0 goes back to linking by name:
+// the link is dropped, for recipeSaved to link the ingredient again.
+func setIngredientCatalog(e execer, ingredient Ingredient, catalogId int) error {
+	if catalogId == 0 {
+		_, err := e.Exec("DELETE FROM ingredient_catalog_links WHERE ingredient_id = ?", ingredient.ID)
+		return err
+	}
+
+	_, err := e.Exec(`
+		INSERT INTO ingredient_catalog_links(ingredient_id, catalog_id, name, manual) VALUES(?,?,?,1)
+		ON CONFLICT(ingredient_id) DO UPDATE SET catalog_id = excluded.catalog_id, name = excluded.name, manual = 1
+	`, ingredient.ID, catalogId, normalizeIngredientName(ingredient.Name))
+	return err
+}
+
+// checkCatalogEntry writes a 400 response unless catalogId is 0 or an entry
+// of the catalogue.
+func checkCatalogEntry(w http.ResponseWriter, catalogId int) bool {
+	if catalogId == 0 {
+		return true
+	}
+	var count int
+	if db.QueryRow("SELECT COUNT(*) FROM ingredient_catalog WHERE id = ?", catalogId).Scan(&count) == nil && count > 0 {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("Catalogue entry %d not found", catalogId), http.StatusBadRequest)
+	return false
+}
+
+// loadIngredientCatalogIds sets CatalogID on the linked ingredients.
+func loadIngredientCatalogIds(ingredients []Ingredient) {
+	if len(ingredients) == 0 {
+		return
+	}
+
+	ids := make([]string, len(ingredients))
+	for i, ingredient := range ingredients {
+		ids[i] = fmt.Sprint(ingredient.ID)
+	}
+	rows, err := db.Query("SELECT ingredient_id, catalog_id FROM ingredient_catalog_links WHERE ingredient_id IN (" + strings.Join(ids, ", ") + ")")
+	if err != nil {
+		fmt.Println("Error loading catalogue links:", err)
+		return
+	}
+	defer rows.Close()
+
+	links := map[int]int{}
+	for rows.Next() {
+		var ingredientId, catalogId int
+		if rows.Scan(&ingredientId, &catalogId) == nil {
+			links[ingredientId] = catalogId
+		}
+	}
+	for i := range ingredients {
+		if catalogId, ok := links[ingredients[i].ID]; ok {
+			ingredients[i].CatalogID = &catalogId
+		}
+	}
+}
+
+// ingredientDensity is the density in g/ml of the ingredient's catalogue
+// entry, or else of the food of the same name, and 0 when neither is known.
+func ingredientDensity(ingredient Ingredient) float64 {
+	if ingredient.CatalogID != nil {
+		var density sql.NullFloat64
+		err := db.QueryRow("SELECT density FROM ingredient_catalog WHERE id = ?", *ingredient.CatalogID).Scan(&density)
+		if err == nil && density.Valid {
+			return density.Float64
+		}
+	}
+	if food := findFood(ingredient.Name); food != nil {
+		return food.Density
+	}
+	return 0
+}
+
+// getCatalogEntries returns the entries with their aliases and how many of
+// the owner's recipes use each of them.
+func getCatalogEntries(ownerId int) ([]CatalogEntry, error) {
+	rows, err := db.Query("SELECT " + catalogColumns + " FROM ingredient_catalog ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []CatalogEntry{}
+	index := map[int]int{}
+	for rows.Next() {
+		var entry CatalogEntry
+		var density sql.NullFloat64
+		if err := rows.Scan(&entry.ID, &entry.Name, &entry.Aisle, &entry.DefaultUnit, &density); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if density.Valid {
+			entry.Density = &density.Float64
+		}
+		entry.Aliases = []string{}
+		index[entry.ID] = len(entries)
+		entries = append(entries, entry)
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT alias, catalog_id FROM ingredient_catalog_aliases ORDER BY alias")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var alias string
+		var id int
+		if rows.Scan(&alias, &id) == nil {
+			if i, ok := index[id]; ok {
+				entries[i].Aliases = append(entries[i].Aliases, alias)
+			}
+		}
+	}
+	rows.Close()
+
+	rows, err = db.Query(`
+		SELECT l.catalog_id, COUNT(DISTINCT i.recipe_id) FROM ingredient_catalog_links l
+		JOIN ingredients i ON i.id = l.ingredient_id
+		JOIN recipes r ON r.id = i.recipe_id
+		WHERE r.owner_id = ?
+		GROUP BY l.catalog_id
+	`, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, count int
+		if rows.Scan(&id, &count) == nil {
+			if i, ok := index[id]; ok {
+				entries[i].UsageCount = count
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+func getCatalogEntry(id int, ownerId int) *CatalogEntry {
+	entries, err := getCatalogEntries(ownerId)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.ID == id {
+			return &entry
+		}
+	}
+	return nil
+}
+
+// catalogEntryMatches reports whether the entry's name or one of its aliases
+// contains one of the normalized terms.
+func catalogEntryMatches(entry CatalogEntry, terms []string) bool {
+	for _, name := range append([]string{normalizeIngredientName(entry.Name)}, entry.Aliases...) {
+		for _, term := range terms {
+			if nameContainsTerm(name, term) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterCatalogEntries applies the ?ingredient= (with ?expand=true) and
+// ?aisle= filters.
+func filterCatalogEntries(entries []CatalogEntry, r *http.Request) []CatalogEntry {
+	queryParams := r.URL.Query()
+	terms := splitIngredientTerms(queryParams.Get("ingredient"))
+	if len(terms) > 0 && queryParams.Get("expand") == "true" {
+		terms = expandIngredientTerms(terms)
+	}
+	aisle := strings.ToLower(strings.TrimSpace(queryParams.Get("aisle")))
+
+	filtered := []CatalogEntry{}
+	for _, entry := range entries {
+		if len(terms) > 0 && !catalogEntryMatches(entry, terms) {
+			continue
+		}
+		if aisle != "" && entry.Aisle != aisle {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered
+}
+
+func getCatalog(w http.ResponseWriter, r *http.Request) {
+	entries, err := getCatalogEntries(currentUser(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, filterCatalogEntries(entries, r))
+}
+
+func getCatalogEntryHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	entry := getCatalogEntry(id, currentUser(r).ID)
+	if entry == nil {
+		http.Error(w, "Catalogue entry not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// saveCatalogAliases replaces the aliases of the entry inside tx. The
+// normalized name of the entry is always one of them. Ingredients linked by a
+// removed alias are unlinked.
+func saveCatalogAliases(tx *sql.Tx, entry CatalogEntry) error {
+	aliases := []string{normalizeIngredientName(entry.Name)}
+	for _, alias := range entry.Aliases {
+		if alias = normalizeIngredientName(alias); alias != "" && !slices.Contains(aliases, alias) {
+			aliases = append(aliases, alias)
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM ingredient_catalog_aliases WHERE catalog_id = ?", entry.ID); err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		var owner int
+		err := tx.QueryRow("SELECT catalog_id FROM ingredient_catalog_aliases WHERE alias = ?", alias).Scan(&owner)
+		if err == nil {
+			return fmt.Errorf("%w: %q is an alias of entry %d", errCatalogAlias, alias, owner)
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO ingredient_catalog_aliases(alias, catalog_id) VALUES(?,?)", alias, entry.ID); err != nil {
+			return err
+		}
+	}
+
+	// ingredients linked by an alias that was removed are unlinked, to be
+	// linked again by name with linkAllIngredients
+	_, err := tx.Exec(`
+		DELETE FROM ingredient_catalog_links
+		WHERE catalog_id = ? AND manual = 0 AND name NOT IN (SELECT alias FROM ingredient_catalog_aliases WHERE catalog_id = ?)
+	`, entry.ID, entry.ID)
+	return err
+}
+
+// saveCatalogEntry inserts the entry when it has no ID, or updates it, and
+// replaces its aliases, all in one transaction.
+func saveCatalogEntry(entry CatalogEntry) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	if entry.ID == 0 {
+		result, err := tx.Exec(`
+			INSERT INTO ingredient_catalog(name, aisle, defaultUnit, density, createdAt, lastEditedAt) VALUES(?,?,?,?,?,?)
+		`, entry.Name, entry.Aisle, entry.DefaultUnit, entry.Density, now, now)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		id, _ := result.LastInsertId()
+		entry.ID = int(id)
+	} else {
+		_, err := tx.Exec(`
+			UPDATE ingredient_catalog SET name = ?, aisle = ?, defaultUnit = ?, density = ?, lastEditedAt = ? WHERE id = ?
+		`, entry.Name, entry.Aisle, entry.DefaultUnit, entry.Density, now, entry.ID)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if err := saveCatalogAliases(tx, entry); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return entry.ID, tx.Commit()
+}
+
+// validateCatalogEntry tidies the entry up and returns what is wrong with it.
+func validateCatalogEntry(entry *CatalogEntry) string {
+	entry.Name = strings.TrimSpace(strings.ToLower(entry.Name))
+	entry.Aisle = strings.TrimSpace(strings.ToLower(entry.Aisle))
+	entry.DefaultUnit = strings.TrimSpace(entry.DefaultUnit)
+	if normalizeIngredientName(entry.Name) == "" {
+		return "Name is required"
+	}
+	if entry.Density != nil && *entry.Density <= 0 {
+		entry.Density = nil
+	}
+	return ""
+}
+
+func createCatalogEntry(w http.ResponseWriter, r *http.Request) {
+	var entry CatalogEntry
+	if !decodeBody(w, r, &entry) {
+		return
+	}
+	entry.ID = 0
+	if message := validateCatalogEntry(&entry); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	id, err := saveCatalogEntry(entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err := linkAllIngredients(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, getCatalogEntry(id, currentUser(r).ID))
+}
+
+// updateCatalogEntry changes the fields present in the body. aliases replaces
+// the whole list, and a density of 0 clears it.
+func updateCatalogEntry(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	entry := getCatalogEntry(id, currentUser(r).ID)
+	if entry == nil {
+		http.Error(w, "Catalogue entry not found", http.StatusNotFound)
+		return
+	}
+
+	var patch struct {
+		Name        *string   `json:"name"`
+		Aliases     *[]string `json:"aliases"`
+		Aisle       *string   `json:"aisle"`
+		DefaultUnit *string   `json:"defaultUnit"`
+		Density     *float64  `json:"density"`
+	}
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	if patch.Name != nil {
+		// the old name keeps pointing here
+		entry.Aliases = append(entry.Aliases, entry.Name)
+		entry.Name = *patch.Name
+	}
+	if patch.Aliases != nil {
+		entry.Aliases = *patch.Aliases
+	}
+	if patch.Aisle != nil {
+		entry.Aisle = *patch.Aisle
+	}
+	if patch.DefaultUnit != nil {
+		entry.DefaultUnit = *patch.DefaultUnit
+	}
+	if patch.Density != nil {
+		entry.Density = patch.Density
+	}
+	if message := validateCatalogEntry(entry); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := saveCatalogEntry(*entry); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err := linkAllIngredients(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, getCatalogEntry(id, currentUser(r).ID))
+}
+
+// deleteCatalogEntry removes an entry no ingredient is linked to. Entries in
+// use have to be merged into another one instead.
+func deleteCatalogEntry(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	if getCatalogEntry(id, currentUser(r).ID) == nil {
+		http.Error(w, "Catalogue entry not found", http.StatusNotFound)
+		return
+	}
+
+	var links int
+	if err := db.QueryRow("SELECT COUNT(*) FROM ingredient_catalog_links WHERE catalog_id = ?", id).Scan(&links); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if links > 0 {
+		http.Error(w, fmt.Sprintf("%d ingredients are linked to the entry, merge it into another one instead", links), http.StatusConflict)
+		return
+	}
+
+	for _, table := range []string{"ingredient_catalog_aliases WHERE catalog_id", "ingredient_catalog WHERE id"} {
+		if _, err := db.Exec("DELETE FROM "+table+" = ?", id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mergeCatalogEntries moves the aliases and ingredients of the "merge" entry
+// to the "keep" entry and deletes it. Aisle, default unit and density are
+// taken from the merged entry where the kept one has none.
+func mergeCatalogEntries(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Keep  int `json:"keep"`
+		Merge int `json:"merge"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if req.Keep == req.Merge {
+		http.Error(w, "keep and merge must be two different entries", http.StatusBadRequest)
+		return
+	}
+
+	ownerId := currentUser(r).ID
+	keep := getCatalogEntry(req.Keep, ownerId)
+	merge := getCatalogEntry(req.Merge, ownerId)
+	if keep == nil || merge == nil {
+		http.Error(w, "Catalogue entry not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := mergeCatalogEntriesTx(tx, *keep, *merge); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, getCatalogEntry(keep.ID, ownerId))
+}
+
+func mergeCatalogEntriesTx(tx *sql.Tx, keep CatalogEntry, merge CatalogEntry) error {
+	if keep.Aisle == "" {
+		keep.Aisle = merge.Aisle
+	}
+	if keep.DefaultUnit == "" {
+		keep.DefaultUnit = merge.DefaultUnit
+	}
+	if keep.Density == nil {
+		keep.Density = merge.Density
+	}
+
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{"UPDATE ingredient_catalog_aliases SET catalog_id = ? WHERE catalog_id = ?", []any{keep.ID, merge.ID}},
+		{"UPDATE ingredient_catalog_links SET catalog_id = ? WHERE catalog_id = ?", []any{keep.ID, merge.ID}},
+		{"UPDATE ingredient_catalog SET aisle = ?, defaultUnit = ?, density = ?, lastEditedAt = ? WHERE id = ?", []any{keep.Aisle, keep.DefaultUnit, keep.Density, time.Now().Format("2006-01-02 15:04:05"), keep.ID}},
+		{"DELETE FROM ingredient_catalog WHERE id = ?", []any{merge.ID}},
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getUnlinkedIngredients returns the names of the owner's ingredients that
+// are not in the catalogue as entries with id 0, with how many of the
+// owner's recipes use each.
+func getUnlinkedIngredients(ownerId int) ([]CatalogEntry, error) {
+	rows, err := db.Query(`
+		SELECT i.name, i.recipe_id FROM ingredients i
+		JOIN recipes r ON r.id = i.recipe_id
+		WHERE r.owner_id = ? AND i.id NOT IN (SELECT ingredient_id FROM ingredient_catalog_links)
+	`, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipes := map[string]map[int]bool{}
+	for rows.Next() {
+		var name string
+		var recipeId int
+		if rows.Scan(&name, &recipeId) != nil {
+			continue
+		}
+		if name = normalizeIngredientName(name); name == "" {
+			continue
+		}
+		if recipes[name] == nil {
+			recipes[name] = map[int]bool{}
+		}
+		recipes[name][recipeId] = true
+	}
+
+	var entries []CatalogEntry
+	for name, ids := range recipes {
+		entries = append(entries, CatalogEntry{Name: name, Aliases: []string{}, UsageCount: len(ids)})
+	}
+	return entries, nil
+}
+
+// getIngredients lists the distinct catalogue entries the user's recipes use,
+// with how many recipes use each, and the names of their ingredients the
+// catalogue does not know. grouped=true files their names under the taxonomy
+// tree instead.
+func getIngredients(w http.ResponseWriter, r *http.Request) {
+	entries, err := getCatalogEntries(currentUser(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	unlinked, err := getUnlinkedIngredients(currentUser(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	used := []CatalogEntry{}
+	for _, entry := range filterCatalogEntries(append(entries, unlinked...), r) {
+		if entry.UsageCount > 0 {
+			used = append(used, entry)
+		}
+	}
+	sort.SliceStable(used, func(i, j int) bool {
+		return used[i].Name < used[j].Name
+	})
+
+	if r.URL.Query().Get("grouped") == "true" {
+		names := make([]string, len(used))
+		for i, entry := range used {
+			names[i] = entry.Name
+		}
+		sort.Strings(names)
+		tree, err := groupIngredientNames(names)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, tree)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, used)
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Collection is a named, hand-ordered set of recipes such as "Christmas" or
+// "Weeknight dinners". A recipe can be in any number of collections.
+type Collection struct {
+	ID           int     `json:"id"`
+	OwnerID      int     `json:"owner_id"`
+	Name         string  `json:"name"`
+	Description  string  `json:"description"`
+	Cover        *string `json:"cover"`
+	RecipeCount  int     `json:"recipeCount"`
+	RecipeIDs    []int   `json:"recipe_ids"`
+	CreatedAt    string  `json:"createdAt"`
+	LastEditedAt string  `json:"lastEditedAt"`
+}
+
+// CollectionExport is a collection together with its recipes in order.
+type CollectionExport struct {
+	Collection Collection `json:"collection"`
+	Recipes    []Recipe   `json:"recipes"`
+}
+
+var collectionTemplate = template.Must(template.New("collection.html").Funcs(templateFuncs).ParseFS(templateFiles, "templates/collection.html", "templates/recipe.html"))
+
+type collectionPage struct {
+	Collection Collection
+	CoverURL   template.URL
+	Recipes    []sharePage
+}
+
+func registerCollectionRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/collections", getCollections).Methods("GET")
+	api.HandleFunc("/collections", createCollection).Methods("POST")
+	api.HandleFunc("/collections/{id}", getCollection).Methods("GET")
+	api.HandleFunc("/collections/{id}", updateCollection).Methods("PATCH")
+	api.HandleFunc("/collections/{id}", deleteCollection).Methods("DELETE")
+	api.HandleFunc("/collections/{id}/cover", updateCollectionCover).Methods("PUT")
+	api.HandleFunc("/collections/{id}/cover", deleteCollectionCover).Methods("DELETE")
+	api.HandleFunc("/collections/{id}/recipes", getCollectionRecipesHandler).Methods("GET")
+	api.HandleFunc("/collections/{id}/recipes", addCollectionRecipe).Methods("POST")
+	api.HandleFunc("/collections/{id}/recipes", reorderCollectionRecipes).Methods("PUT")
+	api.HandleFunc("/collections/{id}/recipes/{recipeId}", removeCollectionRecipe).Methods("DELETE")
+	api.HandleFunc("/collections/{id}/shares", createCollectionShare).Methods("POST")
+	api.HandleFunc("/collections/{id}/shares", getCollectionShares).Methods("GET")
+	api.HandleFunc("/collections/{id}/export", exportCollection).Methods("GET")
+}
+
+const collectionColumns = `c.id, c.owner_id, c.name, c.description, c.cover, c.createdAt, c.lastEditedAt,
+	(SELECT COUNT(*) FROM collection_recipes cr WHERE cr.collection_id = c.id)`
+
+func scanCollection(row interface{ Scan(...any) error }, collection *Collection) error {
+	return row.Scan(&collection.ID, &collection.OwnerID, &collection.Name, &collection.Description, &collection.Cover,
+		&collection.CreatedAt, &collection.LastEditedAt, &collection.RecipeCount)
+}
+
+func getCollectionRecipeIds(collectionId int) []int {
+	ids := []int{}
+
+	rows, err := db.Query("SELECT recipe_id FROM collection_recipes WHERE collection_id = ? ORDER BY sortOrder", collectionId)
+	if err != nil {
+		fmt.Println("Error getting collection recipes:", err)
+		return ids
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func getCollectionById(id int) *Collection {
+	var collection Collection
+	err := scanCollection(db.QueryRow("SELECT "+collectionColumns+" FROM collections c WHERE c.id = ?", id), &collection)
+	if err != nil {
+		return nil
+	}
+	collection.RecipeIDs = getCollectionRecipeIds(collection.ID)
+	return &collection
+}
+
+// getOwnedCollection returns the collection when it belongs to the user.
+func getOwnedCollection(id int, ownerId int) *Collection {
+	collection := getCollectionById(id)
+	if collection == nil || collection.OwnerID != ownerId {
+		return nil
+	}
+	return collection
+}
+
+func pathCollection(w http.ResponseWriter, r *http.Request) (*Collection, bool) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return nil, false
+	}
+
+	collection := getOwnedCollection(id, currentUser(r).ID)
+	if collection == nil {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return nil, false
+	}
+	return collection, true
+}
+
+// getCollectionRecipes loads the recipes of the collection in its order.
+func getCollectionRecipes(collectionId int) []Recipe {
+	recipes := []Recipe{}
+	for _, id := range getCollectionRecipeIds(collectionId) {
+		if recipe := getRecipeById(id); recipe.ID != 0 {
+			recipes = append(recipes, recipe)
+		}
+	}
+	return recipes
+}
+
+// collectionRecipeFilter validates the collection query parameter of the
+// recipe list and returns the collection id, or 0 when there is none.
+func collectionRecipeFilter(ownerId int, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.Atoi(value)
+	if err != nil || getOwnedCollection(id, ownerId) == nil {
+		return 0, fmt.Errorf("%w: unknown collection %q", errInvalidQuery, value)
+	}
+	return id, nil
+}
+
+func touchCollection(id int) {
+	_, err := db.Exec("UPDATE collections SET lastEditedAt = ? WHERE id = ?", time.Now().Format("2006-01-02 15:04:05"), id)
+	if err != nil {
+		fmt.Println("Error updating collection:", err)
+	}
+}
+
+// addRecipesToCollection appends the recipes to the end of the collection,
+// skipping those already in it. Every recipe must belong to the owner.
+func addRecipesToCollection(collectionId int, ownerId int, recipeIds []int) error {
+	for _, recipeId := range recipeIds {
+		if getOwnedRecipe(recipeId, ownerId).ID == 0 {
+			return fmt.Errorf("recipe %d not found", recipeId)
+		}
+	}
+
+	for _, recipeId := range recipeIds {
+		_, err := db.Exec(`
+			INSERT OR IGNORE INTO collection_recipes(collection_id, recipe_id, sortOrder)
+			VALUES(?, ?, (SELECT COALESCE(MAX(sortOrder), 0) + 1 FROM collection_recipes WHERE collection_id = ?))
+		`, collectionId, recipeId, collectionId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getCollections(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT "+collectionColumns+" FROM collections c WHERE c.owner_id = ? ORDER BY c.name", currentUser(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	collections := []Collection{}
+	for rows.Next() {
+		var collection Collection
+		if err := scanCollection(rows, &collection); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		collections = append(collections, collection)
+	}
+	rows.Close()
+
+	for i := range collections {
+		collections[i].RecipeIDs = getCollectionRecipeIds(collections[i].ID)
+	}
+
+	writeJSON(w, http.StatusOK, collections)
+}
+
+func getCollection(w http.ResponseWriter, r *http.Request) {
+	collection, ok := pathCollection(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, collection)
+}
+
+// createCollection adds a collection, optionally filled with recipe_ids in
+// the order given.
+func createCollection(w http.ResponseWriter, r *http.Request) {
+	var req Collection
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	ownerId := currentUser(r).ID
+	for _, recipeId := range req.RecipeIDs {
+		if getOwnedRecipe(recipeId, ownerId).ID == 0 {
+			http.Error(w, fmt.Sprintf("Recipe %d not found", recipeId), http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	result, err := db.Exec(`
+		INSERT INTO collections(owner_id, name, description, createdAt, lastEditedAt) VALUES(?,?,?,?,?)
+	`, ownerId, req.Name, strings.TrimSpace(req.Description), now, now)
+	if err != nil {
+		http.Error(w, "A collection with this name already exists", http.StatusConflict)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	if err := addRecipesToCollection(int(id), ownerId, req.RecipeIDs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, getOwnedCollection(int(id), ownerId))
+}
+
+func updateCollection(w http.ResponseWriter, r *http.Request) {
+	collection, ok := pathCollection(w, r)
+	if !ok {
+		return
+	}
+
+	var patch struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	if patch.Name != nil {
+		collection.Name = strings.TrimSpace(*patch.Name)
+		if collection.Name == "" {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
+	}
+	if patch.Description != nil {
+		collection.Description = strings.TrimSpace(*patch.Description)
+	}
+
+	_, err := db.Exec("UPDATE collections SET name = ?, description = ?, lastEditedAt = ? WHERE id = ?",
+		collection.Name, collection.Description, time.Now().Format("2006-01-02 15:04:05"), collection.ID)
+	if err != nil {
+		http.Error(w, "A collection with this name already exists", http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, getOwnedCollection(collection.ID, currentUser(r).ID))
+}
+
+// deleteCollection removes the collection and its share links. The recipes
+// in it are left alone.
+func deleteCollection(w http.ResponseWriter, r *http.Request) {
+	collection, ok := pathCollection(w, r)
+	if !ok {
+		return
+	}
+
+	for _, query := range []string{
+		"DELETE FROM collection_recipes WHERE collection_id = ?",
+		"DELETE FROM shares WHERE collection_id = ?",
+		"DELETE FROM collections WHERE id = ?",
+	} {
+		if _, err := db.Exec(query, collection.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateCollectionCover replaces the cover with the uploaded "image" file.
+func updateCollectionCover(w http.ResponseWriter, r *http.Request) {
+	collection, ok := pathCollection(w, r)
+	if !ok {
+		return
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(http.DetectContentType(data), "image/") {
+		http.Error(w, "Cover must be an image", http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec("UPDATE collections SET cover = ?, lastEditedAt = ? WHERE id = ?",
+		base64.StdEncoding.EncodeToString(data), time.Now().Format("2006-01-02 15:04:05"), collection.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, getOwnedCollection(collection.ID, currentUser(r).ID))
+}
+
+func deleteCollectionCover(w http.ResponseWriter, r *http.Request) {
+	collection, ok := pathCollection(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec("UPDATE collections SET cover = NULL, lastEditedAt = ? WHERE id = ?",
+		time.Now().Format("2006-01-02 15:04:05"), collection.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getCollectionRecipesHandler(w http.ResponseWriter, r *http.Request) {
+	collection, ok := pathCollection(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, getCollectionRecipes(collection.ID))
+}
+
+// addCollectionRecipe appends the recipe passed as "recipe_id" to the end of
+// the collection. Adding a recipe that is already in it changes nothing.
+func addCollectionRecipe(w http.ResponseWriter, r *http.Request) {
+	collection, ok := pathCollection(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		RecipeID int `json:"recipe_id"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	if err := addRecipesToCollection(collection.ID, currentUser(r).ID, []int{req.RecipeID}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	touchCollection(collection.ID)
+
+	writeJSON(w, http.StatusCreated, getOwnedCollection(collection.ID, currentUser(r).ID))
+}
+
+// reorderCollectionRecipes takes the recipes of the collection in their new
+// order, like PUT /recipes does for the recipe list. Recipes that are not in
+// the collection are ignored and those left out keep their relative order
+// after the ones passed.
+func reorderCollectionRecipes(w http.ResponseWriter, r *http.Request) {
+	collection, ok := pathCollection(w, r)
+	if !ok {
+		return
+	}
+
+	var passedRecipes []Recipe
+	if !decodeBody(w, r, &passedRecipes) {
+		return
+	}
+
+	members := map[int]bool{}
+	for _, id := range collection.RecipeIDs {
+		members[id] = true
+	}
+
+	var order []int
+	placed := map[int]bool{}
+	for _, recipe := range passedRecipes {
+		if members[recipe.ID] && !placed[recipe.ID] {
+			order = append(order, recipe.ID)
+			placed[recipe.ID] = true
+		}
+	}
+	for _, id := range collection.RecipeIDs {
+		if !placed[id] {
+			order = append(order, id)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for index, recipeId := range order {
+		_, err := tx.Exec("UPDATE collection_recipes SET sortOrder = ? WHERE collection_id = ? AND recipe_id = ?",
+			index+1, collection.ID, recipeId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	touchCollection(collection.ID)
+
+	writeJSON(w, http.StatusOK, getOwnedCollection(collection.ID, currentUser(r).ID))
+}
+
+func removeCollectionRecipe(w http.ResponseWriter, r *http.Request) {
+	collection, ok := pathCollection(w, r)
+	if !ok {
+		return
+	}
+
+	recipeId, ok := pathID(w, r, "recipeId")
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM collection_recipes WHERE collection_id = ? AND recipe_id = ?", collection.ID, recipeId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Recipe not found in this collection", http.StatusNotFound)
+		return
+	}
+	touchCollection(collection.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createCollectionShare mints a link to the whole collection. Like recipe
+// links it shows the current state, so recipes added later appear too.
+func createCollectionShare(w http.ResponseWriter, r *http.Request) {
+	collection, ok := pathCollection(w, r)
+	if !ok {
+		return
+	}
+	insertShare(w, r, "collection_id", collection.ID)
+}
+
+func getCollectionShares(w http.ResponseWriter, r *http.Request) {
+	collection, ok := pathCollection(w, r)
+	if !ok {
+		return
+	}
+
+	shares, err := queryShares("SELECT "+shareColumns+" FROM shares WHERE collection_id = ? ORDER BY id DESC", collection.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, shares)
+}
+
+func newCollectionPage(collection Collection) collectionPage {
+	page := collectionPage{Collection: collection}
+	if collection.Cover != nil {
+		page.CoverURL = imageDataURL(&Image{Url: *collection.Cover})
+	}
+	for _, recipe := range getCollectionRecipes(collection.ID) {
+		page.Recipes = append(page.Recipes, newSharePage(recipe))
+	}
+	return page
+}
+
+var unsafeFilenameCharacters = regexp.MustCompile(`[^a-z0-9]+`)
+
+func collectionFilename(collection Collection, ext string) string {
+	return exportFilename(collection.Name, "collection", ext)
+}
+
+// exportFilename turns a name into a safe download filename, using fallback
+// when nothing of the name is left.
+func exportFilename(name string, fallback string, ext string) string {
+	name = strings.Trim(unsafeFilenameCharacters.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if name == "" {
+		name = fallback
+	}
+	return name + "." + ext
+}
+
+// exportCollection downloads the collection with all of its recipes as one
+// JSON file, with format=html as a single printable page, or with
+// format=pdf as a printed cookbook.
+func exportCollection(w http.ResponseWriter, r *http.Request) {
+	collection, ok := pathCollection(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, collectionFilename(*collection, "json")))
+		writeJSON(w, http.StatusOK, CollectionExport{
+			Collection: *collection,
+			Recipes:    getCollectionRecipes(collection.ID),
+		})
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, collectionFilename(*collection, "html")))
+		if err := collectionTemplate.Execute(w, newCollectionPage(*collection)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "pdf":
+		writePDF(w, printCookbook(collection.Name, getCollectionRecipes(collection.ID)), fmt.Sprintf(`attachment; filename="%s"`, collectionFilename(*collection, "pdf")))
+	default:
+		http.Error(w, "format must be json, html or pdf", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,749 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CookingSession follows someone cooking a recipe: the step they are on, the
+// ingredients they have checked off, the servings they scaled to and their
+// timers. Every device of the user sees and updates the same session.
+type CookingSession struct {
+	ID                 int            `json:"id"`
+	RecipeID           int            `json:"recipe_id"`
+	UserID             int            `json:"user_id"`
+	CurrentMethodID    *int           `json:"currentMethodId"`
+	Servings           *float32       `json:"servings"`
+	Scale              *float32       `json:"scale"`
+	CheckedIngredients []int          `json:"checkedIngredients"`
+	Timers             []SessionTimer `json:"timers"`
+	Version            int            `json:"version"`
+	StartedAt          string         `json:"startedAt"`
+	LastActivityAt     string         `json:"lastActivityAt"`
+	EndedAt            *string        `json:"endedAt"`
+}
+
+// SessionTimer counts down Seconds. ElapsedSeconds holds the time it ran
+// before it was last paused and StartedAt is set while it runs.
+type SessionTimer struct {
+	ID               int     `json:"id"`
+	MethodID         *int    `json:"method_id"`
+	Label            string  `json:"label"`
+	Seconds          int     `json:"seconds"`
+	ElapsedSeconds   int     `json:"elapsedSeconds"`
+	StartedAt        *string `json:"startedAt"`
+	RemainingSeconds int     `json:"remainingSeconds"`
+	Running          bool    `json:"running"`
+	Done             bool    `json:"done"`
+}
+
+// cookingSessionIdle is how long a session lives without any change. Running
+// timers keep it alive until they are done.
+const cookingSessionIdle = 2 * time.Hour
+
+// cookingSessionHeartbeat keeps idle event streams from being closed by
+// proxies.
+const cookingSessionHeartbeat = 15 * time.Second
+
+func registerCookingSessionRoutes(router *mux.Router) {
+	router.HandleFunc("/recipe/{id}/session", startCookingSession).Methods("POST")
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/recipes/{id}/session", startCookingSession).Methods("POST")
+	api.HandleFunc("/recipes/{id}/session", getRecipeCookingSession).Methods("GET")
+	api.HandleFunc("/sessions", getCookingSessions).Methods("GET")
+	api.HandleFunc("/sessions/{id}", getCookingSession).Methods("GET")
+	api.HandleFunc("/sessions/{id}", updateCookingSession).Methods("PATCH")
+	api.HandleFunc("/sessions/{id}", endCookingSession).Methods("DELETE")
+	api.HandleFunc("/sessions/{id}/events", streamCookingSession).Methods("GET")
+	api.HandleFunc("/sessions/{id}/ingredients/{ingredientId}", checkSessionIngredient).Methods("PUT")
+	api.HandleFunc("/sessions/{id}/ingredients/{ingredientId}", uncheckSessionIngredient).Methods("DELETE")
+	api.HandleFunc("/sessions/{id}/timers", addSessionTimer).Methods("POST")
+	api.HandleFunc("/sessions/{id}/timers/{timerId}", updateSessionTimer).Methods("PATCH")
+	api.HandleFunc("/sessions/{id}/timers/{timerId}", deleteSessionTimer).Methods("DELETE")
+}
+
+// cookingSessionEvents passes every change of a cooking session to the
+// streams following it. Streams start with the whole session, so no history
+// is kept for reconnecting ones.
+var cookingSessionEvents = newEventHub(0, cookingSessionHeartbeat)
+
+// cookingSessionFilter matches the events of the session.
+func cookingSessionFilter(sessionId int) func(Event) bool {
+	return func(event Event) bool {
+		return event.Session != nil && event.Session.ID == sessionId
+	}
+}
+
+// notifyCookingSession sends the current state of the session to every
+// stream following it.
+func notifyCookingSession(session *CookingSession) {
+	cookingSessionEvents.publish(Event{Type: "session.updated", Resource: "session", RecipeID: session.RecipeID, Session: session})
+}
+
+const cookingSessionColumns = "id, recipe_id, user_id, currentMethodId, servings, version, startedAt, lastActivityAt, endedAt"
+
+func scanCookingSession(row interface{ Scan(...any) error }, session *CookingSession) error {
+	return row.Scan(&session.ID, &session.RecipeID, &session.UserID, &session.CurrentMethodID, &session.Servings,
+		&session.Version, &session.StartedAt, &session.LastActivityAt, &session.EndedAt)
+}
+
+func queryCookingSessions(query string, args ...any) ([]CookingSession, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []CookingSession{}
+	for rows.Next() {
+		var session CookingSession
+		if err := scanCookingSession(rows, &session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	rows.Close()
+
+	for i := range sessions {
+		loadCookingSessionDetails(&sessions[i])
+	}
+	return sessions, nil
+}
+
+func loadCookingSessionDetails(session *CookingSession) {
+	session.CheckedIngredients = []int{}
+	rows, err := db.Query("SELECT ingredient_id FROM cooking_session_ingredients WHERE session_id = ? ORDER BY ingredient_id", session.ID)
+	if err == nil {
+		for rows.Next() {
+			var id int
+			if rows.Scan(&id) == nil {
+				session.CheckedIngredients = append(session.CheckedIngredients, id)
+			}
+		}
+		rows.Close()
+	}
+
+	session.Timers = getSessionTimers(session.ID)
+
+	if session.Servings != nil {
+		if portion := getRecipePortion(session.RecipeID); portion != nil && portion.Value > 0 {
+			scale := *session.Servings / portion.Value
+			session.Scale = &scale
+		}
+	}
+}
+
+func getSessionTimers(sessionId int) []SessionTimer {
+	timers := []SessionTimer{}
+
+	rows, err := db.Query(`
+		SELECT id, method_id, label, seconds, elapsedSeconds, startedAt FROM cooking_session_timers
+		WHERE session_id = ? ORDER BY id
+	`, sessionId)
+	if err != nil {
+		fmt.Println("Error getting session timers:", err)
+		return timers
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	for rows.Next() {
+		var timer SessionTimer
+		if rows.Scan(&timer.ID, &timer.MethodID, &timer.Label, &timer.Seconds, &timer.ElapsedSeconds, &timer.StartedAt) == nil {
+			timer.RemainingSeconds = timer.Seconds - timerElapsed(timer, now)
+			if timer.RemainingSeconds <= 0 {
+				timer.RemainingSeconds = 0
+				timer.Done = true
+			}
+			timer.Running = timer.StartedAt != nil && !timer.Done
+			timers = append(timers, timer)
+		}
+	}
+	return timers
+}
+
+// timerElapsed is how many seconds the timer has run in total by now.
+func timerElapsed(timer SessionTimer, now time.Time) int {
+	elapsed := timer.ElapsedSeconds
+	if timer.StartedAt != nil {
+		if startedAt, err := time.ParseInLocation("2006-01-02 15:04:05", *timer.StartedAt, time.Local); err == nil {
+			elapsed += int(now.Sub(startedAt).Seconds())
+		}
+	}
+	return elapsed
+}
+
+func getCookingSessionById(id int) *CookingSession {
+	sessions, err := queryCookingSessions("SELECT "+cookingSessionColumns+" FROM cooking_sessions WHERE id = ?", id)
+	if err != nil || len(sessions) == 0 {
+		return nil
+	}
+	return &sessions[0]
+}
+
+// getActiveCookingSession returns the session of the user that is still
+// going for the recipe, or nil.
+func getActiveCookingSession(recipeId int, userId int) *CookingSession {
+	sessions, err := queryCookingSessions(`
+		SELECT `+cookingSessionColumns+` FROM cooking_sessions
+		WHERE recipe_id = ? AND user_id = ? AND endedAt IS NULL
+		ORDER BY id DESC LIMIT 1
+	`, recipeId, userId)
+	if err != nil || len(sessions) == 0 {
+		return nil
+	}
+	return &sessions[0]
+}
+
+func pathCookingSession(w http.ResponseWriter, r *http.Request) (*CookingSession, bool) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return nil, false
+	}
+
+	session := getCookingSessionById(id)
+	if session == nil || session.UserID != currentUser(r).ID {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return nil, false
+	}
+	return session, true
+}
+
+// pathActiveCookingSession is pathCookingSession for changes, which are
+// refused once the session has ended.
+func pathActiveCookingSession(w http.ResponseWriter, r *http.Request) (*CookingSession, bool) {
+	session, ok := pathCookingSession(w, r)
+	if !ok {
+		return nil, false
+	}
+	if session.EndedAt != nil {
+		http.Error(w, "Session has ended", http.StatusConflict)
+		return nil, false
+	}
+	return session, true
+}
+
+// touchCookingSession records a change: it bumps the version, counts as
+// activity and pushes the new state to the other devices.
+func touchCookingSession(w http.ResponseWriter, sessionId int, status int) {
+	_, err := db.Exec("UPDATE cooking_sessions SET version = version + 1, lastActivityAt = ? WHERE id = ?",
+		time.Now().Format("2006-01-02 15:04:05"), sessionId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the session is gone when its recipe was deleted in the meantime
+	sessions, err := queryCookingSessions("SELECT "+cookingSessionColumns+" FROM cooking_sessions WHERE id = ?", sessionId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(sessions) == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	session := &sessions[0]
+	notifyCookingSession(session)
+	writeJSON(w, status, session)
+}
+
+// recipeHasChild tells whether the row of the table belongs to the recipe.
+func recipeHasChild(table string, id int, recipeId int) bool {
+	var exists int
+	err := db.QueryRow("SELECT 1 FROM "+table+" WHERE id = ? AND recipe_id = ?", id, recipeId).Scan(&exists)
+	return err == nil
+}
+
+// startCookingSession starts cooking the recipe, or joins the session that is
+// already going for it. The body may set the servings to cook.
+func startCookingSession(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Servings *float32 `json:"servings"`
+	}
+	if r.ContentLength != 0 && !decodeBody(w, r, &req) {
+		return
+	}
+	if req.Servings != nil && *req.Servings <= 0 {
+		http.Error(w, "servings must be positive", http.StatusBadRequest)
+		return
+	}
+
+	userId := currentUser(r).ID
+	servings := req.Servings
+	if servings == nil && recipe.Portion != nil && recipe.Portion.Value > 0 {
+		servings = &recipe.Portion.Value
+	}
+
+	var currentMethodId *int
+	if len(recipe.Methods) > 0 {
+		currentMethodId = &recipe.Methods[0].ID
+	}
+
+	// the cooking_sessions_active index allows one session going per recipe
+	// and user, so a device starting at the same time as another joins it
+	now := time.Now().Format("2006-01-02 15:04:05")
+	result, err := db.Exec(`
+		INSERT INTO cooking_sessions(recipe_id, user_id, currentMethodId, servings, version, startedAt, lastActivityAt)
+		VALUES(?,?,?,?,1,?,?) ON CONFLICT DO NOTHING
+	`, recipe.ID, userId, currentMethodId, servings, now, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if added, _ := result.RowsAffected(); added == 0 {
+		writeJSON(w, http.StatusOK, getActiveCookingSession(recipe.ID, userId))
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	writeJSON(w, http.StatusCreated, getCookingSessionById(int(id)))
+}
+
+func getRecipeCookingSession(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	session := getActiveCookingSession(recipe.ID, currentUser(r).ID)
+	if session == nil {
+		http.Error(w, "No session is going for this recipe", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+// getCookingSessions lists the sessions of the user that are still going, so
+// a second device can find the one to follow.
+func getCookingSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := queryCookingSessions(`
+		SELECT `+cookingSessionColumns+` FROM cooking_sessions
+		WHERE user_id = ? AND endedAt IS NULL ORDER BY lastActivityAt DESC
+	`, currentUser(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func getCookingSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := pathCookingSession(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+// updateCookingSession moves to another step, rescales or replaces the
+// checked ingredients.
+func updateCookingSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := pathActiveCookingSession(w, r)
+	if !ok {
+		return
+	}
+
+	var patch struct {
+		CurrentMethodID    *int     `json:"currentMethodId"`
+		Servings           *float32 `json:"servings"`
+		CheckedIngredients *[]int   `json:"checkedIngredients"`
+	}
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	if patch.CurrentMethodID != nil {
+		if !recipeHasChild("methods", *patch.CurrentMethodID, session.RecipeID) {
+			http.Error(w, "currentMethodId is not a method of this recipe", http.StatusBadRequest)
+			return
+		}
+		session.CurrentMethodID = patch.CurrentMethodID
+	}
+	if patch.Servings != nil {
+		if *patch.Servings <= 0 {
+			http.Error(w, "servings must be positive", http.StatusBadRequest)
+			return
+		}
+		session.Servings = patch.Servings
+	}
+	if patch.CheckedIngredients != nil {
+		for _, ingredientId := range *patch.CheckedIngredients {
+			if !recipeHasChild("ingredients", ingredientId, session.RecipeID) {
+				http.Error(w, fmt.Sprintf("Ingredient %d is not in this recipe", ingredientId), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	_, err := db.Exec("UPDATE cooking_sessions SET currentMethodId = ?, servings = ? WHERE id = ?",
+		session.CurrentMethodID, session.Servings, session.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if patch.CheckedIngredients != nil {
+		if _, err := db.Exec("DELETE FROM cooking_session_ingredients WHERE session_id = ?", session.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, ingredientId := range *patch.CheckedIngredients {
+			_, err := db.Exec("INSERT OR IGNORE INTO cooking_session_ingredients(session_id, ingredient_id) VALUES(?,?)", session.ID, ingredientId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	touchCookingSession(w, session.ID, http.StatusOK)
+}
+
+// checkSessionIngredient ticks off one ingredient. Unlike replacing the whole
+// list it cannot undo a tick made on another device at the same time.
+func checkSessionIngredient(w http.ResponseWriter, r *http.Request) {
+	session, ok := pathActiveCookingSession(w, r)
+	if !ok {
+		return
+	}
+
+	ingredientId, ok := pathID(w, r, "ingredientId")
+	if !ok {
+		return
+	}
+	if !recipeHasChild("ingredients", ingredientId, session.RecipeID) {
+		http.Error(w, "Ingredient not found", http.StatusNotFound)
+		return
+	}
+
+	_, err := db.Exec("INSERT OR IGNORE INTO cooking_session_ingredients(session_id, ingredient_id) VALUES(?,?)", session.ID, ingredientId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	touchCookingSession(w, session.ID, http.StatusOK)
+}
+
+func uncheckSessionIngredient(w http.ResponseWriter, r *http.Request) {
+	session, ok := pathActiveCookingSession(w, r)
+	if !ok {
+		return
+	}
+
+	ingredientId, ok := pathID(w, r, "ingredientId")
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM cooking_session_ingredients WHERE session_id = ? AND ingredient_id = ?", session.ID, ingredientId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	touchCookingSession(w, session.ID, http.StatusOK)
+}
+
+// addSessionTimer starts a timer. It takes seconds and a label, or the id of
+// a method duration to time, which fills in both.
+func addSessionTimer(w http.ResponseWriter, r *http.Request) {
+	session, ok := pathActiveCookingSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		MethodID   *int   `json:"method_id"`
+		DurationID *int   `json:"duration_id"`
+		Label      string `json:"label"`
+		Seconds    int    `json:"seconds"`
+		Paused     bool   `json:"paused"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	if req.DurationID != nil {
+		var methodId, maxSeconds int
+		var text string
+		err := db.QueryRow(`
+			SELECT d.method_id, d.maxSeconds, d.text FROM method_durations d
+			JOIN methods m ON m.id = d.method_id
+			WHERE d.id = ? AND m.recipe_id = ?
+		`, *req.DurationID, session.RecipeID).Scan(&methodId, &maxSeconds, &text)
+		if err != nil {
+			http.Error(w, "duration_id is not a duration of this recipe", http.StatusBadRequest)
+			return
+		}
+		req.MethodID = &methodId
+		if req.Seconds == 0 {
+			req.Seconds = maxSeconds
+		}
+		if req.Label == "" {
+			req.Label = text
+		}
+	}
+
+	if req.Seconds <= 0 {
+		http.Error(w, "seconds must be positive", http.StatusBadRequest)
+		return
+	}
+	if req.MethodID != nil && !recipeHasChild("methods", *req.MethodID, session.RecipeID) {
+		http.Error(w, "method_id is not a method of this recipe", http.StatusBadRequest)
+		return
+	}
+
+	var startedAt *string
+	if !req.Paused {
+		now := time.Now().Format("2006-01-02 15:04:05")
+		startedAt = &now
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO cooking_session_timers(session_id, method_id, label, seconds, elapsedSeconds, startedAt) VALUES(?,?,?,?,0,?)
+	`, session.ID, req.MethodID, strings.TrimSpace(req.Label), req.Seconds, startedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	touchCookingSession(w, session.ID, http.StatusCreated)
+}
+
+// updateSessionTimer pauses or resumes a timer with "running", changes its
+// length with "seconds" or renames it.
+func updateSessionTimer(w http.ResponseWriter, r *http.Request) {
+	session, ok := pathActiveCookingSession(w, r)
+	if !ok {
+		return
+	}
+
+	timerId, ok := pathID(w, r, "timerId")
+	if !ok {
+		return
+	}
+
+	var timer *SessionTimer
+	for i := range session.Timers {
+		if session.Timers[i].ID == timerId {
+			timer = &session.Timers[i]
+		}
+	}
+	if timer == nil {
+		http.Error(w, "Timer not found", http.StatusNotFound)
+		return
+	}
+
+	var patch struct {
+		Running *bool   `json:"running"`
+		Seconds *int    `json:"seconds"`
+		Label   *string `json:"label"`
+	}
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	now := time.Now()
+	if patch.Running != nil && *patch.Running != (timer.StartedAt != nil) {
+		if *patch.Running {
+			started := now.Format("2006-01-02 15:04:05")
+			timer.StartedAt = &started
+		} else {
+			timer.ElapsedSeconds = timerElapsed(*timer, now)
+			timer.StartedAt = nil
+		}
+	}
+	if patch.Seconds != nil {
+		if *patch.Seconds <= 0 {
+			http.Error(w, "seconds must be positive", http.StatusBadRequest)
+			return
+		}
+		timer.Seconds = *patch.Seconds
+	}
+	if patch.Label != nil {
+		timer.Label = strings.TrimSpace(*patch.Label)
+	}
+
+	_, err := db.Exec("UPDATE cooking_session_timers SET label = ?, seconds = ?, elapsedSeconds = ?, startedAt = ? WHERE id = ?",
+		timer.Label, timer.Seconds, timer.ElapsedSeconds, timer.StartedAt, timer.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	touchCookingSession(w, session.ID, http.StatusOK)
+}
+
+func deleteSessionTimer(w http.ResponseWriter, r *http.Request) {
+	session, ok := pathActiveCookingSession(w, r)
+	if !ok {
+		return
+	}
+
+	timerId, ok := pathID(w, r, "timerId")
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM cooking_session_timers WHERE id = ? AND session_id = ?", timerId, session.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Timer not found", http.StatusNotFound)
+		return
+	}
+
+	touchCookingSession(w, session.ID, http.StatusOK)
+}
+
+func endCookingSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := pathActiveCookingSession(w, r)
+	if !ok {
+		return
+	}
+
+	if err := finishCookingSession(session.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishCookingSession ends the session and tells the devices following it.
+func finishCookingSession(id int) error {
+	_, err := db.Exec("UPDATE cooking_sessions SET endedAt = ?, version = version + 1 WHERE id = ? AND endedAt IS NULL",
+		time.Now().Format("2006-01-02 15:04:05"), id)
+	if err != nil {
+		return err
+	}
+
+	if session := getCookingSessionById(id); session != nil {
+		notifyCookingSession(session)
+	}
+	return nil
+}
+
+// streamCookingSession pushes the session to the client as Server-Sent Events:
+// a "session" event with the full state right away and after every change,
+// and a last one once the session has ended.
+func streamCookingSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := pathCookingSession(w, r)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	subscriber, _, _ := cookingSessionEvents.subscribe(cookingSessionFilter(session.ID), 0)
+	defer cookingSessionEvents.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	writeCookingSession(w, session)
+	flusher.Flush()
+	if session.EndedAt != nil {
+		return
+	}
+
+	cookingSessionEvents.stream(w, r, subscriber, func(event Event) bool {
+		writeCookingSession(w, event.Session)
+		return event.Session.EndedAt == nil
+	})
+}
+
+func writeCookingSession(w http.ResponseWriter, session *CookingSession) {
+	data, _ := json.Marshal(session)
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", data)
+}
+
+// cookingSessionDeadline is when the session ends if nothing else happens:
+// a while after the last change or after its last running timer is done.
+func cookingSessionDeadline(session CookingSession) time.Time {
+	last, _ := time.ParseInLocation("2006-01-02 15:04:05", session.LastActivityAt, time.Local)
+	for _, timer := range session.Timers {
+		if timer.Running {
+			if done := time.Now().Add(time.Duration(timer.RemainingSeconds) * time.Second); done.After(last) {
+				last = done
+			}
+		}
+	}
+	return last.Add(cookingSessionIdle)
+}
+
+// expireCookingSessions ends the sessions that have been left alone. It runs
+// in the background for as long as the server does.
+func expireCookingSessions() {
+	for range time.Tick(time.Minute) {
+		sessions, err := queryCookingSessions("SELECT " + cookingSessionColumns + " FROM cooking_sessions WHERE endedAt IS NULL")
+		if err != nil {
+			fmt.Println("Error expiring cooking sessions:", err)
+			continue
+		}
+
+		for _, session := range sessions {
+			if time.Now().After(cookingSessionDeadline(session)) {
+				if err := finishCookingSession(session.ID); err != nil {
+					fmt.Println("Error expiring cooking session:", err)
+				}
+			}
+		}
+	}
+}
+
+// removeCookingSessionsTx deletes the sessions of a deleted recipe. It returns
+// those that were still going, ended, for the devices following them to be
+// told once the deletion is committed.
+func removeCookingSessionsTx(tx *sql.Tx, recipeId int) ([]CookingSession, error) {
+	rows, err := tx.Query("SELECT "+cookingSessionColumns+" FROM cooking_sessions WHERE recipe_id = ? AND endedAt IS NULL", recipeId)
+	if err != nil {
+		return nil, err
+	}
+	var ended []CookingSession
+	now := time.Now().Format("2006-01-02 15:04:05")
+	for rows.Next() {
+		var session CookingSession
+		if err := scanCookingSession(rows, &session); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		session.CheckedIngredients, session.Timers = []int{}, []SessionTimer{}
+		session.EndedAt = &now
+		session.Version++
+		ended = append(ended, session)
+	}
+	rows.Close()
+
+	for _, table := range []string{"cooking_session_ingredients", "cooking_session_timers"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE session_id IN (SELECT id FROM cooking_sessions WHERE recipe_id = ?)", recipeId); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM cooking_sessions WHERE recipe_id = ?", recipeId)
+	return ended, err
+}
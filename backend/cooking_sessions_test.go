@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestStartCookingSessionTwiceAtOnce(t *testing.T) {
+	openSchemaDB(t)
+	userId := mustExec(t, "INSERT INTO users(username, password_hash) VALUES('cook', '')")
+	recipeId := mustExec(t, "INSERT INTO recipes(name, url, createdAt, lastEditedAt, type, sortOrder, owner_id) VALUES('Pancakes', '', '', '', '', 0, ?)", userId)
+
+	router := mux.NewRouter()
+	registerCookingSessionRoutes(router)
+
+	const devices = 4
+	ids := make([]int, devices)
+	var wg sync.WaitGroup
+	for i := range devices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request := httptest.NewRequest("POST", fmt.Sprintf("/api/v1/recipes/%d/session", recipeId), nil)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request.WithContext(context.WithValue(request.Context(), userContextKey, &User{ID: userId})))
+
+			var session CookingSession
+			json.NewDecoder(recorder.Body).Decode(&session)
+			ids[i] = session.ID
+		}()
+	}
+	wg.Wait()
+
+	var active int
+	db.QueryRow("SELECT COUNT(*) FROM cooking_sessions WHERE endedAt IS NULL").Scan(&active)
+	if active != 1 {
+		t.Fatalf("%d sessions are going, want one", active)
+	}
+	for _, id := range ids {
+		if id != ids[0] || id == 0 {
+			t.Fatalf("the devices got sessions %v, want all the same", ids)
+		}
+	}
+}
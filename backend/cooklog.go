@@ -0,0 +1,556 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CookLog records one time a recipe was cooked. Servings and rating are
+// optional; a rating is one to five stars.
+type CookLog struct {
+	ID        int         `json:"id"`
+	RecipeID  int         `json:"recipe_id"`
+	UserID    int         `json:"user_id"`
+	CookedAt  string      `json:"cookedAt"`
+	Servings  *float32    `json:"servings"`
+	Rating    *int        `json:"rating"`
+	Notes     string      `json:"notes"`
+	Photos    []CookPhoto `json:"photos"`
+	CreatedAt string      `json:"createdAt"`
+}
+
+// CookPhoto is stored base64 encoded in Url, like recipe images.
+type CookPhoto struct {
+	ID        int    `json:"id"`
+	Url       string `json:"url"`
+	Filename  string `json:"filename"`
+	CookLogID int    `json:"cook_log_id"`
+}
+
+// CookingStats summarises the cook log of a recipe.
+type CookingStats struct {
+	TimesCooked   int      `json:"timesCooked"`
+	LastCooked    *string  `json:"lastCooked"`
+	AverageRating *float64 `json:"averageRating"`
+}
+
+// cookLogRequest is the body of a new or patched entry. Photos are base64
+// encoded images; multipart requests send them as "photo" files instead.
+type cookLogRequest struct {
+	CookedAt *string  `json:"cookedAt"`
+	Servings *float32 `json:"servings"`
+	Rating   *int     `json:"rating"`
+	Notes    *string  `json:"notes"`
+	Photos   []string `json:"photos"`
+}
+
+func registerCookLogRoutes(router *mux.Router) {
+	router.HandleFunc("/recipe/{id}/cooked", markCooked).Methods("POST")
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/recipes/{id}/cooked", markCooked).Methods("POST")
+	api.HandleFunc("/recipes/{id}/cooked", getRecipeCookLog).Methods("GET")
+	api.HandleFunc("/cooked", getCookLog).Methods("GET")
+	api.HandleFunc("/cooked/{id}", getCookLogEntry).Methods("GET")
+	api.HandleFunc("/cooked/{id}", updateCookLogEntry).Methods("PATCH")
+	api.HandleFunc("/cooked/{id}", deleteCookLogEntry).Methods("DELETE")
+	api.HandleFunc("/cooked/{id}/photos", addCookPhotos).Methods("POST")
+	api.HandleFunc("/cooked/{id}/photos/{photoId}", deleteCookPhoto).Methods("DELETE")
+}
+
+func getCookingStats(recipeId int) CookingStats {
+	var stats CookingStats
+	err := db.QueryRow(`
+		SELECT COUNT(*), MAX(cookedAt), AVG(rating) FROM cook_log WHERE recipe_id = ?
+	`, recipeId).Scan(&stats.TimesCooked, &stats.LastCooked, &stats.AverageRating)
+	if err != nil {
+		fmt.Println("Error getting cooking stats:", err)
+	}
+	if stats.AverageRating != nil {
+		rounded := float64(int(*stats.AverageRating*10+0.5)) / 10
+		stats.AverageRating = &rounded
+	}
+	return stats
+}
+
+const cookLogColumns = "id, recipe_id, user_id, cookedAt, servings, rating, notes, createdAt"
+
+func scanCookLog(row interface{ Scan(...any) error }, entry *CookLog) error {
+	return row.Scan(&entry.ID, &entry.RecipeID, &entry.UserID, &entry.CookedAt, &entry.Servings, &entry.Rating, &entry.Notes, &entry.CreatedAt)
+}
+
+func queryCookLog(query string, args ...any) ([]CookLog, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []CookLog{}
+	for rows.Next() {
+		var entry CookLog
+		if err := scanCookLog(rows, &entry); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+
+	for i := range entries {
+		entries[i].Photos = getCookPhotos(entries[i].ID)
+	}
+	return entries, nil
+}
+
+func getCookPhotos(cookLogId int) []CookPhoto {
+	photos := []CookPhoto{}
+
+	rows, err := db.Query("SELECT id, url, filename, cook_log_id FROM cook_log_photos WHERE cook_log_id = ? ORDER BY id", cookLogId)
+	if err != nil {
+		return photos
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var photo CookPhoto
+		if rows.Scan(&photo.ID, &photo.Url, &photo.Filename, &photo.CookLogID) == nil {
+			photos = append(photos, photo)
+		}
+	}
+	return photos
+}
+
+// getOwnedCookLog returns the entry when it was logged by the user.
+func getOwnedCookLog(id int, userId int) *CookLog {
+	entries, err := queryCookLog("SELECT "+cookLogColumns+" FROM cook_log WHERE id = ? AND user_id = ?", id, userId)
+	if err != nil || len(entries) == 0 {
+		return nil
+	}
+	return &entries[0]
+}
+
+func pathCookLog(w http.ResponseWriter, r *http.Request) (*CookLog, bool) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return nil, false
+	}
+
+	entry := getOwnedCookLog(id, currentUser(r).ID)
+	if entry == nil {
+		http.Error(w, "Cook log entry not found", http.StatusNotFound)
+		return nil, false
+	}
+	return entry, true
+}
+
+// cookPhotoExtensions are the file extensions of the photo types a cook log
+// takes, by their sniffed content type.
+var cookPhotoExtensions = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpg",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+	"image/bmp":  "bmp",
+}
+
+// readCookLogRequest reads a JSON body, or a multipart form with the same
+// fields and "photo" files.
+func readCookLogRequest(w http.ResponseWriter, r *http.Request) (cookLogRequest, [][]byte, bool) {
+	var req cookLogRequest
+	var photos [][]byte
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if r.ContentLength != 0 && !decodeBody(w, r, &req) {
+			return req, nil, false
+		}
+		for _, encoded := range req.Photos {
+			data, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				http.Error(w, "Photos must be base64 encoded", http.StatusBadRequest)
+				return req, nil, false
+			}
+			photos = append(photos, data)
+		}
+		return req, photos, checkCookPhotos(w, photos)
+	}
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return req, nil, false
+	}
+
+	if value, ok := r.MultipartForm.Value["cookedAt"]; ok {
+		req.CookedAt = &value[0]
+	}
+	if value, ok := r.MultipartForm.Value["notes"]; ok {
+		req.Notes = &value[0]
+	}
+	if value, ok := r.MultipartForm.Value["servings"]; ok {
+		servings, err := strconv.ParseFloat(value[0], 32)
+		if err != nil {
+			http.Error(w, "Invalid servings", http.StatusBadRequest)
+			return req, nil, false
+		}
+		servings32 := float32(servings)
+		req.Servings = &servings32
+	}
+	if value, ok := r.MultipartForm.Value["rating"]; ok {
+		rating, err := strconv.Atoi(value[0])
+		if err != nil {
+			http.Error(w, "Invalid rating", http.StatusBadRequest)
+			return req, nil, false
+		}
+		req.Rating = &rating
+	}
+
+	for _, header := range r.MultipartForm.File["photo"] {
+		file, err := header.Open()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return req, nil, false
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return req, nil, false
+		}
+		photos = append(photos, data)
+	}
+
+	return req, photos, checkCookPhotos(w, photos)
+}
+
+// checkCookPhotos writes a 400 response unless every photo is an image of
+// one of the cookPhotoExtensions types.
+func checkCookPhotos(w http.ResponseWriter, photos [][]byte) bool {
+	for _, data := range photos {
+		if _, ok := cookPhotoExtensions[http.DetectContentType(data)]; !ok {
+			http.Error(w, "Photos must be PNG, JPEG, GIF, WebP or BMP images", http.StatusBadRequest)
+			return false
+		}
+	}
+	return true
+}
+
+// validateCookLogRequest checks the fields that are set and normalises the
+// date to YYYY-MM-DD.
+func validateCookLogRequest(req *cookLogRequest) string {
+	if req.CookedAt != nil {
+		cookedAt := strings.TrimSpace(*req.CookedAt)
+		date, err := time.Parse("2006-01-02", cookedAt)
+		if err != nil {
+			date, err = time.Parse("2006-01-02 15:04:05", cookedAt)
+		}
+		if err != nil {
+			return "cookedAt must be a date like 2024-05-31"
+		}
+		cookedAt = date.Format("2006-01-02")
+		req.CookedAt = &cookedAt
+	}
+	if req.Rating != nil && (*req.Rating < 1 || *req.Rating > 5) {
+		return "Rating must be between 1 and 5"
+	}
+	if req.Servings != nil && *req.Servings <= 0 {
+		return "Servings must be positive"
+	}
+	return ""
+}
+
+// saveCookPhotos stores the photos, named after their sniffed type, which
+// readCookLogRequest has already checked.
+func saveCookPhotos(e execer, cookLogId int, photos [][]byte) error {
+	for _, data := range photos {
+		extension := cookPhotoExtensions[http.DetectContentType(data)]
+		_, err := e.Exec("INSERT INTO cook_log_photos(cook_log_id, url, filename) VALUES(?,?,?)",
+			cookLogId, base64.StdEncoding.EncodeToString(data), generateRandomFilename(extension),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markCooked logs that the recipe was cooked, today unless cookedAt says
+// otherwise.
+func markCooked(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	req, photos, ok := readCookLogRequest(w, r)
+	if !ok {
+		return
+	}
+	if message := validateCookLogRequest(&req); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	cookedAt := now.Format("2006-01-02")
+	if req.CookedAt != nil {
+		cookedAt = *req.CookedAt
+	}
+	notes := ""
+	if req.Notes != nil {
+		notes = *req.Notes
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO cook_log(recipe_id, user_id, cookedAt, servings, rating, notes, createdAt) VALUES(?,?,?,?,?,?,?)
+	`, recipe.ID, currentUser(r).ID, cookedAt, req.Servings, req.Rating, notes, now.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	if err := saveCookPhotos(tx, int(id), photos); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, getOwnedCookLog(int(id), currentUser(r).ID))
+}
+
+func getRecipeCookLog(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	entries, err := queryCookLog("SELECT "+cookLogColumns+" FROM cook_log WHERE recipe_id = ? ORDER BY cookedAt DESC, id DESC", recipe.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// getCookLog lists everything the user cooked, newest first. from and to
+// limit it to a date range and limit to the most recent entries.
+func getCookLog(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+
+	query := "SELECT " + cookLogColumns + " FROM cook_log WHERE user_id = ?"
+	args := []any{currentUser(r).ID}
+
+	for _, bound := range []struct{ param, operator string }{{"from", ">="}, {"to", "<="}} {
+		value := queryParams.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			http.Error(w, fmt.Sprintf("%s must be a date like 2024-05-31", bound.param), http.StatusBadRequest)
+			return
+		}
+		query += fmt.Sprintf(" AND cookedAt %s ?", bound.operator)
+		args = append(args, value)
+	}
+
+	query += " ORDER BY cookedAt DESC, id DESC"
+
+	if value := queryParams.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	entries, err := queryCookLog(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func getCookLogEntry(w http.ResponseWriter, r *http.Request) {
+	entry, ok := pathCookLog(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// updateCookLogEntry changes the fields present in the body. Photos are
+// added to the ones already there.
+func updateCookLogEntry(w http.ResponseWriter, r *http.Request) {
+	entry, ok := pathCookLog(w, r)
+	if !ok {
+		return
+	}
+
+	req, photos, ok := readCookLogRequest(w, r)
+	if !ok {
+		return
+	}
+	if message := validateCookLogRequest(&req); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	if req.CookedAt != nil {
+		entry.CookedAt = *req.CookedAt
+	}
+	if req.Servings != nil {
+		entry.Servings = req.Servings
+	}
+	if req.Rating != nil {
+		entry.Rating = req.Rating
+	}
+	if req.Notes != nil {
+		entry.Notes = *req.Notes
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE cook_log SET cookedAt = ?, servings = ?, rating = ?, notes = ? WHERE id = ?
+	`, entry.CookedAt, entry.Servings, entry.Rating, entry.Notes, entry.ID)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := saveCookPhotos(tx, entry.ID, photos); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, getOwnedCookLog(entry.ID, currentUser(r).ID))
+}
+
+func deleteCookLogEntry(w http.ResponseWriter, r *http.Request) {
+	entry, ok := pathCookLog(w, r)
+	if !ok {
+		return
+	}
+
+	if err := removeCookLog("id", entry.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeCookLog deletes the entries, and their photos, whose column equals
+// the value. It is used with id and recipe_id.
+func removeCookLog(column string, value int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := removeCookLogTx(tx, column, value); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func removeCookLogTx(tx *sql.Tx, column string, value int) error {
+	_, err := tx.Exec("DELETE FROM cook_log_photos WHERE cook_log_id IN (SELECT id FROM cook_log WHERE "+column+" = ?)", value)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM cook_log WHERE "+column+" = ?", value)
+	}
+	return err
+}
+
+func addCookPhotos(w http.ResponseWriter, r *http.Request) {
+	entry, ok := pathCookLog(w, r)
+	if !ok {
+		return
+	}
+
+	_, photos, ok := readCookLogRequest(w, r)
+	if !ok {
+		return
+	}
+	if len(photos) == 0 {
+		http.Error(w, "No photos were sent", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := saveCookPhotos(tx, entry.ID, photos); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, getCookPhotos(entry.ID))
+}
+
+func deleteCookPhoto(w http.ResponseWriter, r *http.Request) {
+	entry, ok := pathCookLog(w, r)
+	if !ok {
+		return
+	}
+
+	photoId, ok := pathID(w, r, "photoId")
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM cook_log_photos WHERE id = ? AND cook_log_id = ?", photoId, entry.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
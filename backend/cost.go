@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// IngredientPrice is what the user paid for a quantity of an ingredient, e.g.
+// 2.49 for 500 g butter. Prices are kept as a history, and the one with the
+// latest date is the current price.
+type IngredientPrice struct {
+	ID         int     `json:"id"`
+	Ingredient string  `json:"ingredient"`
+	Price      float64 `json:"price"`
+	Quantity   float64 `json:"quantity"`
+	Unit       string  `json:"unit"`
+	Store      string  `json:"store"`
+	Date       string  `json:"date"`
+}
+
+// RecipeCost sums up what a recipe costs. PerServing divides the total by the
+// portion value and is missing when the recipe has no portion. Unpriced lists
+// the ingredients left out of the total.
+type RecipeCost struct {
+	Total      float64  `json:"total"`
+	PerServing *float64 `json:"perServing"`
+	Unpriced   []string `json:"unpriced"`
+
+	// priced is the number of ingredients with a cost
+	priced int
+}
+
+// CostReport is the cost of every ingredient of a recipe. Ingredients without
+// a price, or whose quantity cannot be converted to the unit of their price,
+// are listed in Unpriced with the reason.
+type CostReport struct {
+	RecipeID    int                  `json:"recipe_id"`
+	Total       float64              `json:"total"`
+	Servings    float32              `json:"servings"`
+	PerServing  *float64             `json:"perServing"`
+	Ingredients []IngredientCost     `json:"ingredients"`
+	Unpriced    []UnpricedIngredient `json:"unpriced"`
+}
+
+// IngredientCost is the cost of one ingredient and the price it was worked
+// out from. Ingredients that are sub-recipes cost what their share of the
+// sub-recipe costs.
+type IngredientCost struct {
+	IngredientID int              `json:"ingredient_id"`
+	Name         string           `json:"name"`
+	Cost         float64          `json:"cost"`
+	Price        *IngredientPrice `json:"price,omitempty"`
+	SubRecipeID  *int             `json:"sub_recipe_id,omitempty"`
+}
+
+type UnpricedIngredient struct {
+	IngredientID int    `json:"ingredient_id"`
+	Name         string `json:"name"`
+	Reason       string `json:"reason"`
+}
+
+func registerCostRoutes(router *mux.Router) {
+	router.HandleFunc("/recipe/{id}/cost", getRecipeCost).Methods("GET")
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/recipes/{id}/cost", getRecipeCost).Methods("GET")
+	api.HandleFunc("/prices", getPricesHandler).Methods("GET")
+	api.HandleFunc("/prices", createPrice).Methods("POST")
+	api.HandleFunc("/prices/{id}", deletePrice).Methods("DELETE")
+}
+
+// getPrices returns the owner's prices, newest first for every ingredient.
+func getPrices(ownerId int) ([]IngredientPrice, error) {
+	rows, err := db.Query(`
+		SELECT id, ingredient, price, quantity, unit, store, date FROM ingredient_prices
+		WHERE owner_id = ? ORDER BY ingredient, date DESC, id DESC
+	`, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := []IngredientPrice{}
+	for rows.Next() {
+		var price IngredientPrice
+		if err := rows.Scan(&price.ID, &price.Ingredient, &price.Price, &price.Quantity, &price.Unit, &price.Store, &price.Date); err != nil {
+			return nil, err
+		}
+		prices = append(prices, price)
+	}
+	return prices, nil
+}
+
+// currentPrices keeps the latest price of every ingredient, by ingredient.
+func currentPrices(prices []IngredientPrice) map[string]IngredientPrice {
+	current := map[string]IngredientPrice{}
+	for _, price := range prices {
+		if _, ok := current[price.Ingredient]; !ok {
+			current[price.Ingredient] = price
+		}
+	}
+	return current
+}
+
+// priceBook is what pricing recipes takes, loaded once for all the recipes
+// of a request: the owner's current prices by ingredient, and the priced
+// aliases of every catalogue entry in alphabetical order.
+type priceBook struct {
+	prices  map[string]IngredientPrice
+	aliases map[int][]string
+}
+
+func loadPriceBook(ownerId int) priceBook {
+	book := priceBook{prices: map[string]IngredientPrice{}, aliases: map[int][]string{}}
+
+	prices, err := getPrices(ownerId)
+	if err != nil {
+		fmt.Println("Error loading prices:", err)
+		return book
+	}
+	book.prices = currentPrices(prices)
+
+	rows, err := db.Query(`
+		SELECT alias, catalog_id FROM ingredient_catalog_aliases
+		WHERE alias IN (SELECT ingredient FROM ingredient_prices WHERE owner_id = ?)
+		ORDER BY alias
+	`, ownerId)
+	if err != nil {
+		fmt.Println("Error loading catalogue aliases:", err)
+		return book
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var alias string
+		var catalogId int
+		if rows.Scan(&alias, &catalogId) == nil {
+			book.aliases[catalogId] = append(book.aliases[catalogId], alias)
+		}
+	}
+	return book
+}
+
+// findPrice returns the price of the ingredient's name, or else of one of the
+// aliases of its catalogue entry, so a price for "spring onion" also covers
+// "scallions".
+func (book priceBook) findPrice(ingredient Ingredient) *IngredientPrice {
+	if price, ok := book.prices[normalizeIngredientName(ingredient.Name)]; ok {
+		return &price
+	}
+	if ingredient.CatalogID == nil {
+		return nil
+	}
+
+	for _, alias := range book.aliases[*ingredient.CatalogID] {
+		if price, ok := book.prices[alias]; ok {
+			return &price
+		}
+	}
+	return nil
+}
+
+// ingredientCost converts the quantity of the ingredient to the unit of the
+// price and returns what it costs, or why it cannot. Pieces priced by weight
+// go through the weight of one piece of the food.
+func ingredientCost(ingredient Ingredient, price IngredientPrice) (float64, string) {
+	if ingredient.Value <= 0 {
+		return 0, "no quantity"
+	}
+
+	amount, ok := convertUnit(float64(ingredient.Value), ingredient.Measurement, price.Unit, ingredientDensity(ingredient))
+	if !ok {
+		if food := findFood(ingredient.Name); food != nil {
+			if grams, reason := ingredientGrams(ingredient, food); reason == "" {
+				amount, ok = convertUnit(grams, "g", price.Unit, food.Density)
+			}
+		}
+	}
+	if !ok {
+		return 0, fmt.Sprintf("cannot convert %s to %s", formatAmount(float64(ingredient.Value), ingredient.Measurement, ""), formatAmount(price.Quantity, price.Unit, ""))
+	}
+
+	return amount * price.Price / price.Quantity, ""
+}
+
+// costIngredients works out the cost of every ingredient. path holds the
+// recipes being costed, as in expandIngredients.
+func costIngredients(ingredients []Ingredient, book priceBook, path map[int]bool) ([]IngredientCost, []UnpricedIngredient, float64) {
+	costs := []IngredientCost{}
+	unpriced := []UnpricedIngredient{}
+	total := 0.0
+
+	for _, ingredient := range ingredients {
+		skip := func(reason string) {
+			unpriced = append(unpriced, UnpricedIngredient{
+				IngredientID: ingredient.ID,
+				Name:         ingredient.Name,
+				Reason:       reason,
+			})
+		}
+
+		if price := book.findPrice(ingredient); price != nil {
+			cost, reason := ingredientCost(ingredient, *price)
+			if reason != "" {
+				skip(reason)
+				continue
+			}
+			total += cost
+			costs = append(costs, IngredientCost{
+				IngredientID: ingredient.ID,
+				Name:         ingredient.Name,
+				Cost:         roundTo(cost, 100),
+				Price:        price,
+			})
+			continue
+		}
+
+		subRecipeId := ingredient.SubRecipeID
+		if subRecipeId == nil {
+			skip("no price")
+			continue
+		}
+		if path[*subRecipeId] || len(path) >= maxSubRecipeDepth || !recipeExists(*subRecipeId) {
+			skip("the sub-recipe cannot be resolved")
+			continue
+		}
+
+		path[*subRecipeId] = true
+		_, subUnpriced, subTotal := costIngredients(getRecipeIngredients(*subRecipeId, ""), book, path)
+		delete(path, *subRecipeId)
+		if len(subUnpriced) > 0 {
+			skip(fmt.Sprintf("%d ingredients of the sub-recipe have no price", len(subUnpriced)))
+			continue
+		}
+
+		scale, _ := subRecipeScale(ingredient, getRecipePortion(*subRecipeId))
+		total += subTotal * scale
+		costs = append(costs, IngredientCost{
+			IngredientID: ingredient.ID,
+			Name:         ingredient.Name,
+			Cost:         roundTo(subTotal*scale, 100),
+			SubRecipeID:  subRecipeId,
+		})
+	}
+
+	return costs, unpriced, total
+}
+
+// estimateCost prices the recipe with the owner's current prices, as loaded
+// by loadPriceBook.
+func estimateCost(book priceBook, recipe Recipe) CostReport {
+	costs, unpriced, total := costIngredients(recipe.Ingredients, book, map[int]bool{recipe.ID: true})
+	report := CostReport{
+		RecipeID:    recipe.ID,
+		Total:       roundTo(total, 100),
+		Ingredients: costs,
+		Unpriced:    unpriced,
+	}
+	if recipe.Portion != nil && recipe.Portion.Value > 0 {
+		report.Servings = recipe.Portion.Value
+		perServing := roundTo(total/float64(recipe.Portion.Value), 100)
+		report.PerServing = &perServing
+	}
+	return report
+}
+
+// summary is the short form of the report shown on every recipe.
+func (report CostReport) summary() RecipeCost {
+	cost := RecipeCost{
+		Total:      report.Total,
+		PerServing: report.PerServing,
+		Unpriced:   []string{},
+		priced:     len(report.Ingredients),
+	}
+	for _, ingredient := range report.Unpriced {
+		cost.Unpriced = append(cost.Unpriced, ingredient.Name)
+	}
+	return cost
+}
+
+// servingCost is the cost of one serving, of the whole recipe when it has no
+// portion. It is false for a recipe with ingredients none of which has a
+// price.
+func (cost RecipeCost) servingCost() (float64, bool) {
+	if cost.priced == 0 && len(cost.Unpriced) > 0 {
+		return 0, false
+	}
+	if cost.PerServing != nil {
+		return *cost.PerServing, true
+	}
+	return cost.Total, true
+}
+
+func parseMaxCostPerServing(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	maxCost, err := strconv.ParseFloat(value, 64)
+	if err != nil || maxCost <= 0 {
+		return 0, fmt.Errorf("%w: maxCostPerServing must be a positive number", errInvalidQuery)
+	}
+	return maxCost, nil
+}
+
+// filterRecipesByCost keeps the recipes whose serving costs at most maxCost.
+// Recipes with an ingredient without a price, or with no priced ingredient at
+// all, are left out as they cannot be judged.
+func filterRecipesByCost(recipes []Recipe, maxCost float64) []Recipe {
+	var filtered []Recipe
+	for _, recipe := range recipes {
+		if len(recipe.Cost.Unpriced) > 0 || recipe.Cost.priced == 0 {
+			continue
+		}
+		if cost, ok := recipe.Cost.servingCost(); ok && cost <= maxCost {
+			filtered = append(filtered, recipe)
+		}
+	}
+	return filtered
+}
+
+// sortRecipesByCost orders the recipes by the cost of a serving. Recipes
+// without any price come last.
+func sortRecipesByCost(recipes []Recipe, sortDirection string) []Recipe {
+	isAscending := sortDirection == "asc"
+	sort.SliceStable(recipes, func(i, j int) bool {
+		a, aOk := recipes[i].Cost.servingCost()
+		b, bOk := recipes[j].Cost.servingCost()
+		if aOk != bOk {
+			return aOk
+		}
+		if isAscending {
+			return a < b
+		}
+		return a > b
+	})
+
+	return recipes
+}
+
+func getRecipeCost(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, estimateCost(loadPriceBook(recipe.OwnerID), recipe))
+}
+
+// getPricesHandler lists the current price of every ingredient, or with
+// ?history=true every price recorded. ?ingredient= narrows it down to the
+// ingredients containing one of the terms.
+func getPricesHandler(w http.ResponseWriter, r *http.Request) {
+	prices, err := getPrices(currentUser(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, filterPrices(prices, r.URL.Query()))
+}
+
+func filterPrices(prices []IngredientPrice, queryParams url.Values) []IngredientPrice {
+	terms := splitIngredientTerms(queryParams.Get("ingredient"))
+	history := queryParams.Get("history") == "true"
+
+	filtered := []IngredientPrice{}
+	for i, price := range prices {
+		if !history && i > 0 && prices[i-1].Ingredient == price.Ingredient {
+			continue
+		}
+		matches := len(terms) == 0
+		for _, term := range terms {
+			if nameContainsTerm(price.Ingredient, term) {
+				matches = true
+			}
+		}
+		if matches {
+			filtered = append(filtered, price)
+		}
+	}
+	return filtered
+}
+
+// validatePrice tidies the price up and returns what is wrong with it. The
+// quantity defaults to 1 and the date to today.
+func validatePrice(price *IngredientPrice) string {
+	price.Ingredient = normalizeIngredientName(price.Ingredient)
+	price.Unit = strings.TrimSpace(price.Unit)
+	price.Store = strings.TrimSpace(price.Store)
+	if price.Quantity == 0 {
+		price.Quantity = 1
+	}
+	if price.Date == "" {
+		price.Date = time.Now().Format("2006-01-02")
+	}
+
+	switch {
+	case price.Ingredient == "":
+		return "Ingredient is required"
+	case price.Price < 0:
+		return "Price must not be negative"
+	case price.Quantity < 0:
+		return "Quantity must not be negative"
+	}
+	if _, err := time.Parse("2006-01-02", price.Date); err != nil {
+		return "Date must be YYYY-MM-DD"
+	}
+	return ""
+}
+
+// createPrice records a price. Older prices of the ingredient are kept as its
+// history.
+func createPrice(w http.ResponseWriter, r *http.Request) {
+	var price IngredientPrice
+	if !decodeBody(w, r, &price) {
+		return
+	}
+	if message := validatePrice(&price); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO ingredient_prices(owner_id, ingredient, price, quantity, unit, store, date, createdAt) VALUES(?,?,?,?,?,?,?,?)
+	`, currentUser(r).ID, price.Ingredient, price.Price, price.Quantity, price.Unit, price.Store, price.Date, time.Now().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	price.ID = int(id)
+	writeJSON(w, http.StatusCreated, price)
+}
+
+func deletePrice(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM ingredient_prices WHERE id = ? AND owner_id = ?", id, currentUser(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Price not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
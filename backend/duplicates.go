@@ -0,0 +1,765 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// DuplicateMatch is a recipe that looks like a copy of another one. Score is
+// between 0 and 1.
+type DuplicateMatch struct {
+	RecipeID int     `json:"recipe_id"`
+	Name     string  `json:"name"`
+	Score    float64 `json:"score"`
+}
+
+// DuplicateCluster is a group of recipes that look like copies of each
+// other, with the pairs that tie them together.
+type DuplicateCluster struct {
+	Recipes []DuplicateMatch `json:"recipes"`
+	Pairs   []DuplicatePair  `json:"pairs"`
+}
+
+type DuplicatePair struct {
+	RecipeID    int     `json:"recipe_id"`
+	DuplicateID int     `json:"duplicate_id"`
+	Score       float64 `json:"score"`
+}
+
+// duplicateThreshold is the score from which two recipes are reported as
+// likely duplicates.
+const duplicateThreshold = 0.6
+
+// The score weighs the name, the ingredients and the method text. Only the
+// parts both recipes have count, so a recipe that was just created with a
+// name is compared on the name alone.
+const (
+	duplicateNameWeight       = 0.3
+	duplicateIngredientWeight = 0.45
+	duplicateMethodWeight     = 0.25
+)
+
+const (
+	// minHashBands of minHashRows each make up a signature. Two recipes whose
+	// features overlap by about half share a band and are compared in full.
+	minHashBands = 16
+	minHashRows  = 4
+)
+
+// recipeFeatures are the normalized sets a recipe is compared on.
+type recipeFeatures struct {
+	id          int
+	name        string
+	nameWords   map[string]bool
+	ingredients map[string]bool
+	shingles    map[string]bool
+}
+
+func registerDuplicateRoutes(router *mux.Router) {
+	router.HandleFunc("/recipes/duplicates", getDuplicateClusters).Methods("GET")
+	router.HandleFunc("/recipes/merge", mergeRecipesHandler).Methods("POST")
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/recipes/duplicates", getDuplicateClusters).Methods("GET")
+	api.HandleFunc("/recipes/merge", mergeRecipesHandler).Methods("POST")
+	api.HandleFunc("/recipes/{id}/duplicates", getRecipeDuplicates).Methods("GET")
+}
+
+func wordSet(text string) map[string]bool {
+	set := map[string]bool{}
+	for _, word := range strings.Fields(normalizeIngredientName(text)) {
+		set[word] = true
+	}
+	return set
+}
+
+// methodShingles are the runs of three words in the method text, which keep
+// some of the word order that a bag of words loses.
+func methodShingles(methods []string) map[string]bool {
+	var words []string
+	for _, method := range methods {
+		words = append(words, strings.Fields(normalizeIngredientName(method))...)
+	}
+
+	set := map[string]bool{}
+	if len(words) > 0 && len(words) < 3 {
+		set[strings.Join(words, " ")] = true
+	}
+	for i := 0; i+3 <= len(words); i++ {
+		set[strings.Join(words[i:i+3], " ")] = true
+	}
+	return set
+}
+
+// loadRecipeFeatures reads the names, ingredients and methods of the owner's
+// recipes, in order of id.
+func loadRecipeFeatures(ownerId int) ([]*recipeFeatures, error) {
+	rows, err := db.Query("SELECT id, name FROM recipes WHERE owner_id = ? ORDER BY id", ownerId)
+	if err != nil {
+		return nil, err
+	}
+	var recipes []*recipeFeatures
+	byId := map[int]*recipeFeatures{}
+	for rows.Next() {
+		var features recipeFeatures
+		var name sql.NullString
+		if rows.Scan(&features.id, &name) == nil {
+			features.name = name.String
+			features.nameWords = wordSet(name.String)
+			features.ingredients = map[string]bool{}
+			recipes = append(recipes, &features)
+			byId[features.id] = &features
+		}
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT i.recipe_id, i.name FROM ingredients i JOIN recipes r ON r.id = i.recipe_id WHERE r.owner_id = ?", ownerId)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var recipeId int
+		var name sql.NullString
+		if rows.Scan(&recipeId, &name) == nil && byId[recipeId] != nil {
+			if key := normalizeIngredientName(name.String); key != "" {
+				byId[recipeId].ingredients[key] = true
+			}
+		}
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT m.recipe_id, m.value FROM methods m JOIN recipes r ON r.id = m.recipe_id WHERE r.owner_id = ? ORDER BY m.recipe_id, m.sortOrder", ownerId)
+	if err != nil {
+		return nil, err
+	}
+	methods := map[int][]string{}
+	for rows.Next() {
+		var recipeId int
+		var value sql.NullString
+		if rows.Scan(&recipeId, &value) == nil {
+			methods[recipeId] = append(methods[recipeId], value.String)
+		}
+	}
+	rows.Close()
+
+	for _, features := range recipes {
+		features.shingles = methodShingles(methods[features.id])
+	}
+	return recipes, nil
+}
+
+func jaccard(a map[string]bool, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for key := range a {
+		if b[key] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// duplicateScore is the weighted Jaccard similarity of the parts of the two
+// recipes that both have.
+func duplicateScore(a *recipeFeatures, b *recipeFeatures) float64 {
+	var score, weight float64
+	parts := []struct {
+		a, b   map[string]bool
+		weight float64
+	}{
+		{a.nameWords, b.nameWords, duplicateNameWeight},
+		{a.ingredients, b.ingredients, duplicateIngredientWeight},
+		{a.shingles, b.shingles, duplicateMethodWeight},
+	}
+	for _, part := range parts {
+		if len(part.a) == 0 || len(part.b) == 0 {
+			continue
+		}
+		score += part.weight * jaccard(part.a, part.b)
+		weight += part.weight
+	}
+	if weight == 0 {
+		return 0
+	}
+	return math.Round(score/weight*100) / 100
+}
+
+// minHashSignature estimates the Jaccard similarity of all the features of a
+// recipe: two signatures agree in a row about as often as the sets overlap.
+func minHashSignature(features *recipeFeatures) []uint64 {
+	signature := make([]uint64, minHashBands*minHashRows)
+	for i := range signature {
+		signature[i] = math.MaxUint64
+	}
+
+	add := func(prefix string, set map[string]bool) {
+		for key := range set {
+			hash := fnv.New64a()
+			hash.Write([]byte(prefix + key))
+			value := hash.Sum64()
+			for i := range signature {
+				if mixed := mixHash(value ^ uint64(i)*0x9e3779b97f4a7c15); mixed < signature[i] {
+					signature[i] = mixed
+				}
+			}
+		}
+	}
+	add("n:", features.nameWords)
+	add("i:", features.ingredients)
+	add("m:", features.shingles)
+	return signature
+}
+
+// mixHash is the splitmix64 finalizer, spreading one hash into many.
+func mixHash(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// candidatePairs returns the pairs of recipes that share a band of their
+// MinHash signatures, so that not every pair has to be scored.
+func candidatePairs(recipes []*recipeFeatures) [][2]int {
+	buckets := map[string][]int{}
+	for index, features := range recipes {
+		signature := minHashSignature(features)
+		for band := 0; band < minHashBands; band++ {
+			key := fmt.Sprint(band, signature[band*minHashRows:(band+1)*minHashRows])
+			buckets[key] = append(buckets[key], index)
+		}
+	}
+
+	seen := map[[2]int]bool{}
+	var pairs [][2]int
+	for _, indexes := range buckets {
+		for i := 0; i < len(indexes); i++ {
+			for j := i + 1; j < len(indexes); j++ {
+				pair := [2]int{indexes[i], indexes[j]}
+				if !seen[pair] {
+					seen[pair] = true
+					pairs = append(pairs, pair)
+				}
+			}
+		}
+	}
+	return pairs
+}
+
+// findDuplicates scores the recipe against every other recipe of the owner
+// and returns those from the threshold, best first.
+func findDuplicates(ownerId int, recipeId int, threshold float64) ([]DuplicateMatch, error) {
+	recipes, err := loadRecipeFeatures(ownerId)
+	if err != nil {
+		return nil, err
+	}
+
+	var recipe *recipeFeatures
+	for _, features := range recipes {
+		if features.id == recipeId {
+			recipe = features
+		}
+	}
+
+	matches := []DuplicateMatch{}
+	if recipe == nil {
+		return matches, nil
+	}
+	for _, other := range recipes {
+		if other.id == recipeId {
+			continue
+		}
+		if score := duplicateScore(recipe, other); score >= threshold {
+			matches = append(matches, DuplicateMatch{RecipeID: other.id, Name: other.name, Score: score})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	return matches, nil
+}
+
+// findDuplicateClusters groups the owner's recipes that look alike. Two
+// recipes end up in the same cluster when a chain of likely duplicates
+// links them.
+func findDuplicateClusters(ownerId int, threshold float64) ([]DuplicateCluster, error) {
+	recipes, err := loadRecipeFeatures(ownerId)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := make([]int, len(recipes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	// pairs[i] ties recipes[members[i]] to its duplicate
+	var pairs []DuplicatePair
+	var members []int
+	for _, candidate := range candidatePairs(recipes) {
+		a, b := recipes[candidate[0]], recipes[candidate[1]]
+		score := duplicateScore(a, b)
+		if score < threshold {
+			continue
+		}
+		pair := DuplicatePair{RecipeID: min(a.id, b.id), DuplicateID: max(a.id, b.id), Score: score}
+		pairs = append(pairs, pair)
+		members = append(members, candidate[0])
+		parent[find(candidate[0])] = find(candidate[1])
+	}
+
+	byRoot := map[int]*DuplicateCluster{}
+	var roots []int
+	for i, pair := range pairs {
+		root := find(members[i])
+		if byRoot[root] == nil {
+			byRoot[root] = &DuplicateCluster{Recipes: []DuplicateMatch{}}
+			roots = append(roots, root)
+		}
+		byRoot[root].Pairs = append(byRoot[root].Pairs, pair)
+	}
+	for index, features := range recipes {
+		if cluster := byRoot[find(index)]; cluster != nil {
+			cluster.Recipes = append(cluster.Recipes, DuplicateMatch{RecipeID: features.id, Name: features.name})
+		}
+	}
+
+	clusters := []DuplicateCluster{}
+	for _, root := range roots {
+		cluster := byRoot[root]
+		best := map[int]float64{}
+		for _, pair := range cluster.Pairs {
+			best[pair.RecipeID] = max(best[pair.RecipeID], pair.Score)
+			best[pair.DuplicateID] = max(best[pair.DuplicateID], pair.Score)
+		}
+		for i := range cluster.Recipes {
+			cluster.Recipes[i].Score = best[cluster.Recipes[i].RecipeID]
+		}
+		sort.SliceStable(cluster.Pairs, func(i, j int) bool {
+			if cluster.Pairs[i].Score != cluster.Pairs[j].Score {
+				return cluster.Pairs[i].Score > cluster.Pairs[j].Score
+			}
+			return cluster.Pairs[i].RecipeID < cluster.Pairs[j].RecipeID
+		})
+		clusters = append(clusters, *cluster)
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		if len(clusters[i].Recipes) != len(clusters[j].Recipes) {
+			return len(clusters[i].Recipes) > len(clusters[j].Recipes)
+		}
+		if clusters[i].Pairs[0].Score != clusters[j].Pairs[0].Score {
+			return clusters[i].Pairs[0].Score > clusters[j].Pairs[0].Score
+		}
+		return clusters[i].Recipes[0].RecipeID < clusters[j].Recipes[0].RecipeID
+	})
+	return clusters, nil
+}
+
+// parseDuplicateThreshold reads ?threshold=, a score between 0 and 1.
+func parseDuplicateThreshold(w http.ResponseWriter, r *http.Request) (float64, bool) {
+	value := r.URL.Query().Get("threshold")
+	if value == "" {
+		return duplicateThreshold, true
+	}
+	threshold, err := strconv.ParseFloat(value, 64)
+	if err != nil || threshold <= 0 || threshold > 1 {
+		http.Error(w, "threshold must be a number above 0 and up to 1", http.StatusBadRequest)
+		return 0, false
+	}
+	return threshold, true
+}
+
+func getDuplicateClusters(w http.ResponseWriter, r *http.Request) {
+	threshold, ok := parseDuplicateThreshold(w, r)
+	if !ok {
+		return
+	}
+
+	clusters, err := findDuplicateClusters(currentUser(r).ID, threshold)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, clusters)
+}
+
+func getRecipeDuplicates(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+	threshold, ok := parseDuplicateThreshold(w, r)
+	if !ok {
+		return
+	}
+
+	matches, err := findDuplicates(recipe.OwnerID, recipe.ID, threshold)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, matches)
+}
+
+// withDuplicates returns the newly created recipe with the recipes it looks
+// like, as a warning for the client.
+func withDuplicates(recipeId int) Recipe {
+	recipe := getRecipeById(recipeId)
+	matches, err := findDuplicates(recipe.OwnerID, recipe.ID, duplicateThreshold)
+	if err != nil {
+		fmt.Println("Error finding duplicates:", err)
+	}
+	recipe.Duplicates = matches
+	return recipe
+}
+
+// mergeRecipesHandler merges the "merge" recipe into the "keep" recipe and
+// deletes it.
+func mergeRecipesHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Keep  int `json:"keep"`
+		Merge int `json:"merge"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if req.Keep == req.Merge {
+		http.Error(w, "keep and merge must be two different recipes", http.StatusBadRequest)
+		return
+	}
+
+	ownerId := currentUser(r).ID
+	keep := getOwnedRecipe(req.Keep, ownerId)
+	merge := getOwnedRecipe(req.Merge, ownerId)
+	if keep.ID == 0 || merge.ID == 0 {
+		http.Error(w, "Recipe not found", http.StatusNotFound)
+		return
+	}
+
+	notify, err := mergeRecipes(keep, merge)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	notify()
+
+	recipeSaved(keep.ID)
+	recipeChanged(keep.ID, eventRecipeUpdated)
+	writeJSON(w, http.StatusOK, getRecipeById(keep.ID))
+}
+
+// mergeRecipes moves what the kept recipe is missing over from the other
+// one: the ingredients it does not have yet, the better of the two images,
+// the portion and url when it has none, and the methods when it has none.
+// Dividers are matched by title and methods by text, and the links between
+// them and the ingredients are carried over. Tags, collections, the cook
+// log and variants follow the kept recipe. The merged recipe is deleted in
+// the same transaction; the returned notify publishes its deletion and is to
+// be called once it is committed.
+func mergeRecipes(keep Recipe, merge Recipe) (notify func(), err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mergeRecipesTx(tx, keep, merge); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	notify, err = removeRecipeTx(tx, merge.ID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return notify, nil
+}
+
+// mergedIngredientDeletes and mergedMethodDeletes remove an ingredient or a
+// method of the merged recipe that keep already has, with its links.
+var (
+	mergedIngredientDeletes = []string{
+		"DELETE FROM divider_ingredients WHERE ingredient_id = ?",
+		"DELETE FROM method_ingredients WHERE ingredient_id = ?",
+		"DELETE FROM ingredient_catalog_links WHERE ingredient_id = ?",
+		"DELETE FROM ingredient_recipes WHERE ingredient_id = ?",
+		"DELETE FROM ingredients WHERE id = ?",
+	}
+	mergedMethodDeletes = []string{
+		"DELETE FROM divider_methods WHERE method_id = ?",
+		"DELETE FROM method_ingredients WHERE method_id = ?",
+		"DELETE FROM method_durations WHERE method_id = ?",
+		"DELETE FROM methods WHERE id = ?",
+	}
+)
+
+func mergeRecipesTx(tx *sql.Tx, keep Recipe, merge Recipe) error {
+	// ingredientIds and methodIds map the merged recipe's rows to the rows
+	// they end up as; rows that are dropped are left out.
+	ingredientIds := map[int]int{}
+	existing := map[string]int{}
+	for _, ingredient := range keep.Ingredients {
+		existing[normalizeIngredientName(ingredient.Name)] = ingredient.ID
+	}
+	sortOrder := len(keep.Ingredients)
+	for _, ingredient := range merge.Ingredients {
+		if id, ok := existing[normalizeIngredientName(ingredient.Name)]; ok {
+			ingredientIds[ingredient.ID] = id
+			continue
+		}
+		sortOrder++
+		if _, err := tx.Exec("UPDATE ingredients SET recipe_id = ?, sortOrder = ? WHERE id = ?", keep.ID, sortOrder, ingredient.ID); err != nil {
+			return err
+		}
+		ingredientIds[ingredient.ID] = ingredient.ID
+		existing[normalizeIngredientName(ingredient.Name)] = ingredient.ID
+	}
+
+	methodIds := map[int]int{}
+	moveMethods := len(keep.Methods) == 0
+	steps := map[string]int{}
+	for _, method := range keep.Methods {
+		steps[strings.TrimSpace(method.Value)] = method.ID
+	}
+	for _, method := range merge.Methods {
+		if moveMethods {
+			if _, err := tx.Exec("UPDATE methods SET recipe_id = ? WHERE id = ?", keep.ID, method.ID); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("DELETE FROM method_ingredients WHERE method_id = ?", method.ID); err != nil {
+				return err
+			}
+			methodIds[method.ID] = method.ID
+		} else if id, ok := steps[strings.TrimSpace(method.Value)]; ok {
+			methodIds[method.ID] = id
+		}
+	}
+	for _, method := range merge.Methods {
+		target, ok := methodIds[method.ID]
+		if !ok {
+			continue
+		}
+		for _, ingredient := range method.Ingredients {
+			if id, ok := ingredientIds[ingredient.ID]; ok {
+				if _, err := tx.Exec("INSERT OR IGNORE INTO method_ingredients(method_id, ingredient_id) VALUES(?,?)", target, id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	titles := map[string]int{}
+	for _, divider := range keep.Dividers {
+		titles[strings.ToLower(strings.TrimSpace(divider.Title))] = divider.ID
+	}
+	dividerOrder := len(keep.Dividers)
+	for _, divider := range merge.Dividers {
+		target, ok := titles[strings.ToLower(strings.TrimSpace(divider.Title))]
+		if !ok {
+			dividerOrder++
+			if _, err := tx.Exec("UPDATE dividers SET recipe_id = ?, sortOrder = ? WHERE id = ?", keep.ID, dividerOrder, divider.ID); err != nil {
+				return err
+			}
+			for _, table := range []string{"divider_ingredients", "divider_methods"} {
+				if _, err := tx.Exec("DELETE FROM "+table+" WHERE divider_id = ?", divider.ID); err != nil {
+					return err
+				}
+			}
+			target = divider.ID
+		}
+
+		// a moved row is still in the merged recipe's divider and follows it
+		// to the matching one; rows of keep stay in their own dividers
+		for _, ingredient := range divider.Ingredients {
+			if id, ok := ingredientIds[ingredient.ID]; ok {
+				_, err := tx.Exec(`
+					INSERT INTO divider_ingredients(ingredient_id, divider_id) VALUES(?,?)
+					ON CONFLICT(ingredient_id) DO UPDATE SET divider_id = excluded.divider_id
+					WHERE divider_ingredients.divider_id NOT IN (SELECT id FROM dividers WHERE recipe_id = ?)
+				`, id, target, keep.ID)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, method := range divider.Methods {
+			if id, ok := methodIds[method.ID]; ok {
+				_, err := tx.Exec(`
+					INSERT INTO divider_methods(method_id, divider_id) VALUES(?,?)
+					ON CONFLICT(method_id) DO UPDATE SET divider_id = excluded.divider_id
+					WHERE divider_methods.divider_id NOT IN (SELECT id FROM dividers WHERE recipe_id = ?)
+				`, id, target, keep.ID)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// the rows keep already had are deleted rather than left behind on the
+	// merged recipe
+	for _, ingredient := range merge.Ingredients {
+		if ingredientIds[ingredient.ID] == ingredient.ID {
+			continue
+		}
+		for _, statement := range mergedIngredientDeletes {
+			if _, err := tx.Exec(statement, ingredient.ID); err != nil {
+				return err
+			}
+		}
+	}
+	for _, method := range merge.Methods {
+		if methodIds[method.ID] == method.ID {
+			continue
+		}
+		for _, statement := range mergedMethodDeletes {
+			if _, err := tx.Exec(statement, method.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if merge.Image != nil && (keep.Image == nil || imageArea(merge.Image.Url) > imageArea(keep.Image.Url)) {
+		if keep.Image != nil {
+			if _, err := tx.Exec("DELETE FROM images WHERE recipe_id = ?", keep.ID); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("UPDATE images SET recipe_id = ? WHERE id = ?", keep.ID, merge.Image.ID); err != nil {
+			return err
+		}
+	}
+	if keep.Portion == nil && merge.Portion != nil {
+		if _, err := tx.Exec("UPDATE portions SET recipe_id = ? WHERE id = ?", keep.ID, merge.Portion.ID); err != nil {
+			return err
+		}
+	}
+	if keep.Url == "" && merge.Url != "" {
+		if _, err := tx.Exec("UPDATE recipes SET url = ? WHERE id = ?", merge.Url, keep.ID); err != nil {
+			return err
+		}
+	}
+
+	// ingredients that used the merged recipe use keep from now on
+	users, err := subRecipeLinks(tx, `
+		SELECT ir.ingredient_id, i.recipe_id FROM ingredient_recipes ir
+		JOIN ingredients i ON i.id = ir.ingredient_id
+		WHERE ir.recipe_id = ?
+	`, merge.ID)
+	if err != nil {
+		return err
+	}
+
+	statements := []string{
+		"INSERT OR IGNORE INTO recipe_tags(recipe_id, tag_id) SELECT ?, tag_id FROM recipe_tags WHERE recipe_id = ?",
+		"INSERT OR IGNORE INTO recipe_allergen_overrides(recipe_id, allergen, status) SELECT ?, allergen, status FROM recipe_allergen_overrides WHERE recipe_id = ?",
+		"INSERT OR IGNORE INTO recipe_equipment(recipe_id, equipment_id, source) SELECT ?, equipment_id, source FROM recipe_equipment WHERE recipe_id = ?",
+		"INSERT OR IGNORE INTO collection_recipes(collection_id, recipe_id, sortOrder) SELECT collection_id, ?, sortOrder FROM collection_recipes WHERE recipe_id = ?",
+		"UPDATE cook_log SET recipe_id = ? WHERE recipe_id = ?",
+		"UPDATE recipe_notes SET recipe_id = ? WHERE recipe_id = ?",
+		"UPDATE recipes SET parent_recipe_id = ? WHERE parent_recipe_id = ?",
+		"UPDATE ingredient_recipes SET recipe_id = ? WHERE recipe_id = ?",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, keep.ID, merge.ID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE recipes SET parent_recipe_id = NULL WHERE id = ? AND parent_recipe_id = ?", keep.ID, keep.ID); err != nil {
+		return err
+	}
+
+	// links that would make keep use itself are dropped, like the write
+	// paths refuse them: those of recipes keep uses, keep itself included,
+	// and those moved over to recipes that use keep
+	for _, link := range users {
+		if usesRecipe(tx, keep.ID, link.recipeId, map[int]bool{}) {
+			if _, err := tx.Exec("DELETE FROM ingredient_recipes WHERE ingredient_id = ?", link.ingredientId); err != nil {
+				return err
+			}
+		}
+	}
+	used, err := subRecipeLinks(tx, `
+		SELECT ir.ingredient_id, ir.recipe_id FROM ingredient_recipes ir
+		JOIN ingredients i ON i.id = ir.ingredient_id
+		WHERE i.recipe_id = ?
+	`, keep.ID)
+	if err != nil {
+		return err
+	}
+	for _, link := range used {
+		if usesRecipe(tx, link.recipeId, keep.ID, map[int]bool{}) {
+			if _, err := tx.Exec("DELETE FROM ingredient_recipes WHERE ingredient_id = ?", link.ingredientId); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type subRecipeLink struct {
+	ingredientId int
+	recipeId     int
+}
+
+// subRecipeLinks reads pairs of an ingredient and a recipe within tx.
+func subRecipeLinks(tx *sql.Tx, query string, args ...any) ([]subRecipeLink, error) {
+	rows, err := tx.Query(query+" ORDER BY ir.ingredient_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []subRecipeLink
+	for rows.Next() {
+		var link subRecipeLink
+		if err := rows.Scan(&link.ingredientId, &link.recipeId); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// imageArea is the size in pixels of a base64 image, or its length in bytes
+// when it cannot be decoded, so the better of two images can be kept.
+func imageArea(encoded string) int {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return len(encoded)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return len(data)
+	}
+	return config.Width * config.Height
+}
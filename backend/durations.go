@@ -0,0 +1,522 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// MethodDuration is a time mentioned in a method step, e.g. "20–25 minutes".
+// Ranges keep both ends; a single time has MaxSeconds equal to Seconds.
+type MethodDuration struct {
+	ID         int    `json:"id"`
+	Seconds    int    `json:"seconds"`
+	MaxSeconds int    `json:"maxSeconds"`
+	Kind       string `json:"kind"`
+	Text       string `json:"text"`
+}
+
+// RecipeTimes are worked out from the durations of the methods, in minutes,
+// using the upper end of ranges. Total also counts resting time.
+type RecipeTimes struct {
+	PrepTime  int `json:"prepTime"`
+	CookTime  int `json:"cookTime"`
+	TotalTime int `json:"totalTime"`
+}
+
+const (
+	durationKindPrep = "prep"
+	durationKindCook = "cook"
+	durationKindRest = "rest"
+)
+
+var durationKinds = []string{durationKindPrep, durationKindCook, durationKindRest}
+
+func registerDurationRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/recipes/{id}/methods/{methodId}/durations", replaceMethodDurations).Methods("PUT")
+	api.HandleFunc("/recipes/{id}/methods/{methodId}/durations", resetMethodDurations).Methods("DELETE")
+	api.HandleFunc("/durations/parse", parseDurationsHandler).Methods("GET")
+}
+
+const durationNumber = `\d+\s*[½¼¾⅓⅔]|\d+(?:[.,]\d+)?(?:\s+\d/\d)?|\d/\d|[½¼¾⅓⅔]|half\s+an?|an?|one|two|three|four|five|six|seven|eight|nine|ten|eleven|twelve|fifteen|twenty|thirty|forty-five|forty|sixty|ninety`
+
+var (
+	// durationPattern matches one amount of time such as "20 minutes",
+	// "20-25 min", "1½ hours", "an hour and a half" or "10m".
+	durationPattern = regexp.MustCompile(`(?i)(` + durationNumber + `)(?:\s*(?:-|–|—|to|or)\s*(` + durationNumber + `))?(?:\s*(days?|hours?|hrs?|minutes?|mins?|seconds?|secs?)\b|(h|m|s)\b)(\s+and\s+a\s+half)?`)
+	// compactDurationPattern matches hours and minutes written together, "1h10".
+	compactDurationPattern = regexp.MustCompile(`(?i)\b(\d+)h(\d{1,2})(?:m(?:ins?)?)?\b`)
+	overnightPattern       = regexp.MustCompile(`(?i)\bovernight\b`)
+	// durationJoinPattern is what may stand between the parts of "1 hr 10 min".
+	durationJoinPattern = regexp.MustCompile(`(?i)^\s*(?:,|and)?\s*$`)
+	// durationRangePattern joins "20 minutes to 25 minutes" into one range.
+	durationRangePattern = regexp.MustCompile(`(?i)^\s*(?:-|–|—|to|or)\s*$`)
+	sentenceEndPattern   = regexp.MustCompile(`[.;!?]\s`)
+	// sentenceStartPattern is what may come before a time that opens its
+	// sentence, as in "For about 10 minutes, simmer".
+	sentenceStartPattern = regexp.MustCompile(`(?i)^\s*(?:for|in|after|over)?\s*(?:about|around|roughly|approximately)?\s*$`)
+
+	cookVerbPattern = regexp.MustCompile(`(?i)\b(bak(?:e|es|ed|ing)|roast\w*|simmer\w*|boil\w*|fr(?:y|ies|ied|ying)|saut[eé]\w*|sear\w*|grill\w*|broil\w*|toast\w*|cook\w*|brais\w*|stew\w*|steam\w*|poach\w*|blanch\w*|microwav\w*|heat\w*|carameli[sz]\w*|reduc\w*|brown\w*|smok\w*|griddl\w*|oven)\b`)
+	restVerbPattern = regexp.MustCompile(`(?i)\b(rest\w*|chill\w*|refrigerat\w*|fridge|freez\w*|froze\w*|marinat\w*|soak\w*|ris(?:e|es|ing|en)|rose|prov(?:e|es|ed|ing)|proof\w*|cool\w*|set|sets|setting|stand\w*|steep\w*|infus\w*|overnight|leave|leaving|left)\b`)
+)
+
+var durationWords = map[string]float64{
+	"a": 1, "an": 1, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6,
+	"seven": 7, "eight": 8, "nine": 9, "ten": 10, "eleven": 11, "twelve": 12,
+	"fifteen": 15, "twenty": 20, "thirty": 30, "forty": 40, "forty-five": 45,
+	"sixty": 60, "ninety": 90,
+}
+
+var durationFractions = map[rune]float64{'½': 0.5, '¼': 0.25, '¾': 0.75, '⅓': 1.0 / 3, '⅔': 2.0 / 3}
+
+var durationUnitSeconds = map[string]float64{
+	"day": 86400, "days": 86400,
+	"hour": 3600, "hours": 3600, "hr": 3600, "hrs": 3600, "h": 3600,
+	"minute": 60, "minutes": 60, "min": 60, "mins": 60, "m": 60,
+	"second": 1, "seconds": 1, "sec": 1, "secs": 1, "s": 1,
+}
+
+// overnightSeconds is what "leave overnight" counts for.
+const overnightSeconds = 8 * 3600
+
+// parseDurationNumber reads a number of durationNumber, returning false for
+// anything it cannot make sense of.
+func parseDurationNumber(text string) (float64, bool) {
+	text = strings.ToLower(strings.Join(strings.Fields(text), " "))
+	if strings.HasPrefix(text, "half") {
+		return 0.5, true
+	}
+	if value, ok := durationWords[text]; ok {
+		return value, true
+	}
+
+	var total float64
+	for _, part := range strings.Fields(text) {
+		if last, size := utf8.DecodeLastRuneInString(part); durationFractions[last] != 0 {
+			total += durationFractions[last]
+			part = part[:len(part)-size]
+			if part == "" {
+				continue
+			}
+		}
+		if numerator, denominator, ok := strings.Cut(part, "/"); ok {
+			n, err1 := strconv.ParseFloat(numerator, 64)
+			d, err2 := strconv.ParseFloat(denominator, 64)
+			if err1 != nil || err2 != nil || d == 0 {
+				return 0, false
+			}
+			total += n / d
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.ReplaceAll(part, ",", "."), 64)
+		if err != nil {
+			return 0, false
+		}
+		total += value
+	}
+	return total, true
+}
+
+type durationMatch struct {
+	start, end   int
+	seconds, max float64
+	unitSeconds  float64
+	combinable   bool
+}
+
+// findDurations returns every amount of time in the text in order, before
+// joining compound and ranged times.
+func findDurations(text string) []durationMatch {
+	var matches []durationMatch
+
+	for _, m := range durationPattern.FindAllStringSubmatchIndex(text, -1) {
+		// the number must start a word, so "often minutes" is not ten minutes
+		if m[0] > 0 {
+			if previous, _ := utf8.DecodeLastRuneInString(text[:m[0]]); unicode.IsLetter(previous) || unicode.IsDigit(previous) {
+				continue
+			}
+		}
+
+		unit := ""
+		if m[6] >= 0 {
+			unit = text[m[6]:m[7]]
+		} else {
+			// a bare h, m or s only counts straight after digits, or "as"
+			// would be a second
+			if !unicode.IsDigit(rune(text[m[8]-1])) {
+				continue
+			}
+			unit = text[m[8]:m[9]]
+		}
+		unitSeconds := durationUnitSeconds[strings.ToLower(unit)]
+
+		value, ok := parseDurationNumber(text[m[2]:m[3]])
+		if !ok {
+			continue
+		}
+		maxValue := value
+		if m[4] >= 0 {
+			if maxValue, ok = parseDurationNumber(text[m[4]:m[5]]); !ok || maxValue < value {
+				continue
+			}
+		}
+		if m[10] >= 0 {
+			value += 0.5
+			maxValue += 0.5
+		}
+
+		matches = append(matches, durationMatch{
+			start: m[0], end: m[1],
+			seconds: value * unitSeconds, max: maxValue * unitSeconds,
+			unitSeconds: unitSeconds,
+			combinable:  m[4] < 0,
+		})
+	}
+
+	for _, m := range compactDurationPattern.FindAllStringSubmatchIndex(text, -1) {
+		hours, _ := strconv.Atoi(text[m[2]:m[3]])
+		minutes, _ := strconv.Atoi(text[m[4]:m[5]])
+		seconds := float64(hours*3600 + minutes*60)
+		matches = append(matches, durationMatch{start: m[0], end: m[1], seconds: seconds, max: seconds, unitSeconds: 60})
+	}
+
+	for _, m := range overnightPattern.FindAllStringIndex(text, -1) {
+		matches = append(matches, durationMatch{start: m[0], end: m[1], seconds: overnightSeconds, max: overnightSeconds, unitSeconds: 3600})
+	}
+
+	slices.SortFunc(matches, func(a, b durationMatch) int { return a.start - b.start })
+
+	// drop matches that overlap an earlier one, like the "10m" inside "1h10m"
+	var kept []durationMatch
+	for _, match := range matches {
+		if len(kept) > 0 && match.start < kept[len(kept)-1].end {
+			continue
+		}
+		kept = append(kept, match)
+	}
+	return kept
+}
+
+// parseMethodDurations finds the times in a method step. "1 hr 10 min" is one
+// duration and so is "20 to 25 minutes". Each duration is classed as cook,
+// rest or prep time by the verb before it, e.g. "bake", "chill" or "whisk".
+func parseMethodDurations(text string) []MethodDuration {
+	matches := findDurations(text)
+
+	var joined []durationMatch
+	for _, match := range matches {
+		if len(joined) > 0 {
+			last := &joined[len(joined)-1]
+			gap := text[last.end:match.start]
+
+			if last.combinable && match.unitSeconds < last.unitSeconds && durationJoinPattern.MatchString(gap) {
+				last.seconds += match.seconds
+				last.max += match.max
+				last.end = match.end
+				last.unitSeconds = match.unitSeconds
+				last.combinable = match.combinable
+				continue
+			}
+			if last.seconds == last.max && match.seconds == match.max && match.seconds > last.seconds && durationRangePattern.MatchString(gap) {
+				last.max = match.seconds
+				last.end = match.end
+				last.combinable = false
+				continue
+			}
+		}
+		joined = append(joined, match)
+	}
+
+	durations := []MethodDuration{}
+	previousEnd := 0
+	for _, match := range joined {
+		durations = append(durations, MethodDuration{
+			Seconds:    int(math.Round(match.seconds)),
+			MaxSeconds: int(math.Round(match.max)),
+			Kind:       durationKind(text, previousEnd, match.start),
+			Text:       strings.TrimSpace(text[match.start:match.end]),
+		})
+		previousEnd = match.end
+	}
+	return durations
+}
+
+// durationKind looks for the closest cooking or resting verb before the time,
+// staying within its sentence and after the previous time. A time opening its
+// sentence, as in "for 10 minutes, simmer", looks at the rest of the sentence
+// instead. Anything else is prep time.
+func durationKind(text string, from int, to int) string {
+	before := text[from:to]
+	if ends := sentenceEndPattern.FindAllStringIndex(before, -1); len(ends) > 0 {
+		before = before[ends[len(ends)-1][1]:]
+	}
+	if kind := lastVerbKind(before); kind != "" {
+		return kind
+	}
+
+	if !sentenceStartPattern.MatchString(before) {
+		return durationKindPrep
+	}
+	after := text[to:]
+	if end := sentenceEndPattern.FindStringIndex(after); end != nil {
+		after = after[:end[0]]
+	}
+	if kind := lastVerbKind(after); kind != "" {
+		return kind
+	}
+	return durationKindPrep
+}
+
+func lastVerbKind(text string) string {
+	cookAt, restAt := -1, -1
+	if matches := cookVerbPattern.FindAllStringIndex(text, -1); len(matches) > 0 {
+		cookAt = matches[len(matches)-1][0]
+	}
+	if matches := restVerbPattern.FindAllStringIndex(text, -1); len(matches) > 0 {
+		restAt = matches[len(matches)-1][0]
+	}
+
+	switch {
+	case cookAt < 0 && restAt < 0:
+		return ""
+	case cookAt > restAt:
+		return durationKindCook
+	default:
+		return durationKindRest
+	}
+}
+
+// recipeTimes adds up the durations of the methods.
+func recipeTimes(methods []Method) RecipeTimes {
+	var prep, cook, total int
+	for _, method := range methods {
+		for _, duration := range method.Durations {
+			switch duration.Kind {
+			case durationKindPrep:
+				prep += duration.MaxSeconds
+			case durationKindCook:
+				cook += duration.MaxSeconds
+			}
+			total += duration.MaxSeconds
+		}
+	}
+
+	minutes := func(seconds int) int {
+		return (seconds + 59) / 60
+	}
+	return RecipeTimes{PrepTime: minutes(prep), CookTime: minutes(cook), TotalTime: minutes(total)}
+}
+
+func getMethodDurations(methodId int) []MethodDuration {
+	durations := []MethodDuration{}
+
+	rows, err := db.Query(`
+		SELECT id, seconds, maxSeconds, kind, text FROM method_durations
+		WHERE method_id = ? ORDER BY sortOrder
+	`, methodId)
+	if err != nil {
+		fmt.Println("Error getting method durations:", err)
+		return durations
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var duration MethodDuration
+		if rows.Scan(&duration.ID, &duration.Seconds, &duration.MaxSeconds, &duration.Kind, &duration.Text) == nil {
+			durations = append(durations, duration)
+		}
+	}
+	return durations
+}
+
+func setMethodDurations(methodId int, durations []MethodDuration) error {
+	if _, err := db.Exec("DELETE FROM method_durations WHERE method_id = ?", methodId); err != nil {
+		return err
+	}
+
+	for index, duration := range durations {
+		_, err := db.Exec(`
+			INSERT INTO method_durations(method_id, seconds, maxSeconds, kind, text, sortOrder) VALUES(?,?,?,?,?,?)
+		`, methodId, duration.Seconds, duration.MaxSeconds, duration.Kind, duration.Text, index+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateMethodDurations parses the durations again when the text of a method
+// changed. Durations edited by hand are kept until the text is edited.
+func updateMethodDurations(methodId int, oldValue string, newValue string) error {
+	if oldValue == newValue {
+		return nil
+	}
+	return setMethodDurations(methodId, parseMethodDurations(newValue))
+}
+
+// parseAllMethodDurations fills in the durations of the methods written
+// before they were parsed. It only runs while no durations are stored, so
+// it does not undo edits.
+func parseAllMethodDurations() error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM method_durations").Scan(&count); err != nil || count > 0 {
+		return err
+	}
+
+	rows, err := db.Query("SELECT id, value FROM methods")
+	if err != nil {
+		return err
+	}
+
+	methods := map[int]string{}
+	for rows.Next() {
+		var id int
+		var value string
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		methods[id] = value
+	}
+	rows.Close()
+
+	for id, value := range methods {
+		if err := updateMethodDurations(id, "", value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMaxTotalTime reads the maxTotalTime filter in minutes, 0 when unset.
+func parseMaxTotalTime(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	minutes, err := strconv.Atoi(value)
+	if err != nil || minutes <= 0 {
+		return 0, fmt.Errorf("%w: maxTotalTime must be a positive number of minutes", errInvalidQuery)
+	}
+	return minutes, nil
+}
+
+// filterRecipesByTotalTime keeps the recipes that are ready within the given
+// minutes. Recipes without any times are left out as they cannot be judged.
+func filterRecipesByTotalTime(recipes []Recipe, maxMinutes int) []Recipe {
+	var filtered []Recipe
+	for _, recipe := range recipes {
+		if recipe.Times.TotalTime > 0 && recipe.Times.TotalTime <= maxMinutes {
+			filtered = append(filtered, recipe)
+		}
+	}
+	return filtered
+}
+
+// validateDurations checks durations passed by a client, parsing those that
+// only have a text and completing what is left out.
+func validateDurations(methodValue string, durations []MethodDuration) ([]MethodDuration, string) {
+	for i := range durations {
+		duration := &durations[i]
+		duration.Text = strings.TrimSpace(duration.Text)
+
+		if duration.Seconds == 0 && duration.Text != "" {
+			parsed := parseMethodDurations(duration.Text)
+			if len(parsed) != 1 {
+				return nil, fmt.Sprintf("%q is not a duration", duration.Text)
+			}
+			duration.Seconds, duration.MaxSeconds = parsed[0].Seconds, parsed[0].MaxSeconds
+		}
+		if duration.Seconds <= 0 {
+			return nil, "seconds must be positive"
+		}
+		if duration.MaxSeconds == 0 {
+			duration.MaxSeconds = duration.Seconds
+		}
+		if duration.MaxSeconds < duration.Seconds {
+			return nil, "maxSeconds must not be less than seconds"
+		}
+
+		if duration.Kind == "" {
+			duration.Kind = durationKindPrep
+			if at := strings.Index(methodValue, duration.Text); duration.Text != "" && at >= 0 {
+				duration.Kind = durationKind(methodValue, 0, at)
+			} else if kind := lastVerbKind(methodValue); kind != "" {
+				duration.Kind = kind
+			}
+		}
+		if !slices.Contains(durationKinds, duration.Kind) {
+			return nil, fmt.Sprintf("Kind must be one of %s", strings.Join(durationKinds, ", "))
+		}
+	}
+	return durations, ""
+}
+
+// replaceMethodDurations sets the durations of a method by hand. A duration
+// can be given as seconds or as text like "1 hr 10 min".
+func replaceMethodDurations(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	method, ok := pathMethod(w, r, recipe)
+	if !ok {
+		return
+	}
+
+	var durations []MethodDuration
+	if !decodeBody(w, r, &durations) {
+		return
+	}
+
+	durations, message := validateDurations(method.Value, durations)
+	if message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	if err := setMethodDurations(method.ID, durations); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recipeChanged(recipe.ID, eventMethodUpdated)
+
+	writeJSON(w, http.StatusOK, getMethodById(method.ID))
+}
+
+// resetMethodDurations drops edited durations and parses the text again.
+func resetMethodDurations(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	method, ok := pathMethod(w, r, recipe)
+	if !ok {
+		return
+	}
+
+	if err := setMethodDurations(method.ID, parseMethodDurations(method.Value)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recipeChanged(recipe.ID, eventMethodUpdated)
+
+	writeJSON(w, http.StatusOK, getMethodById(method.ID))
+}
+
+// parseDurationsHandler shows what would be parsed from ?text=, for editors
+// that highlight times while typing.
+func parseDurationsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, parseMethodDurations(r.URL.Query().Get("text")))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseMethodDurations(t *testing.T) {
+	tests := []struct {
+		text string
+		want []MethodDuration
+	}{
+		{"Simmer for 20–25 minutes.", []MethodDuration{{Seconds: 1200, MaxSeconds: 1500, Kind: durationKindCook, Text: "20–25 minutes"}}},
+		{"Bake 1 hr 10 min until golden.", []MethodDuration{{Seconds: 4200, MaxSeconds: 4200, Kind: durationKindCook, Text: "1 hr 10 min"}}},
+		{"Bake 1h10 at 180C.", []MethodDuration{{Seconds: 4200, MaxSeconds: 4200, Kind: durationKindCook, Text: "1h10"}}},
+		{"Boil for 20 minutes to 25 minutes.", []MethodDuration{{Seconds: 1200, MaxSeconds: 1500, Kind: durationKindCook, Text: "20 minutes to 25 minutes"}}},
+		{"Roast for an hour and a half.", []MethodDuration{{Seconds: 5400, MaxSeconds: 5400, Kind: durationKindCook, Text: "an hour and a half"}}},
+		{"Let the dough rise for 1½ hours.", []MethodDuration{{Seconds: 5400, MaxSeconds: 5400, Kind: durationKindRest, Text: "1½ hours"}}},
+		{"Fry 30 secs a side.", []MethodDuration{{Seconds: 30, MaxSeconds: 30, Kind: durationKindCook, Text: "30 secs"}}},
+		{"Cook 10m.", []MethodDuration{{Seconds: 600, MaxSeconds: 600, Kind: durationKindCook, Text: "10m"}}},
+		{"Marinate overnight.", []MethodDuration{{Seconds: overnightSeconds, MaxSeconds: overnightSeconds, Kind: durationKindRest, Text: "overnight"}}},
+		{"For about ten minutes, simmer gently.", []MethodDuration{{Seconds: 600, MaxSeconds: 600, Kind: durationKindCook, Text: "ten minutes"}}},
+		{"Whisk for 2 minutes, then chill for 30 minutes.", []MethodDuration{
+			{Seconds: 120, MaxSeconds: 120, Kind: durationKindPrep, Text: "2 minutes"},
+			{Seconds: 1800, MaxSeconds: 1800, Kind: durationKindRest, Text: "30 minutes"},
+		}},
+		{"Bake. Whisk the cream for 3 minutes.", []MethodDuration{{Seconds: 180, MaxSeconds: 180, Kind: durationKindPrep, Text: "3 minutes"}}},
+
+		// not a time
+		{"Add 500 ml of stock.", []MethodDuration{}},
+		{"Stir often minutes apart.", []MethodDuration{}},
+		{"Season as needed.", []MethodDuration{}},
+		{"Beat in 2 eggs, 1 at a time.", []MethodDuration{}},
+		{"Simmer for 25–20 minutes.", []MethodDuration{}},
+		{"", []MethodDuration{}},
+	}
+
+	for _, test := range tests {
+		if got := parseMethodDurations(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseMethodDurations(%q) = %+v, want %+v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestRecipeTimes(t *testing.T) {
+	methods := []Method{
+		{Durations: []MethodDuration{{Seconds: 300, MaxSeconds: 600, Kind: durationKindPrep}}},
+		{Durations: []MethodDuration{{Seconds: 1200, MaxSeconds: 1500, Kind: durationKindCook}, {Seconds: 30, MaxSeconds: 30, Kind: durationKindCook}}},
+		{Durations: []MethodDuration{{Seconds: 3600, MaxSeconds: 3600, Kind: durationKindRest}}},
+		{},
+	}
+
+	want := RecipeTimes{PrepTime: 10, CookTime: 26, TotalTime: 96}
+	if got := recipeTimes(methods); got != want {
+		t.Errorf("recipeTimes = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseMaxTotalTime(t *testing.T) {
+	if minutes, err := parseMaxTotalTime("45"); minutes != 45 || err != nil {
+		t.Errorf("parseMaxTotalTime(45) = %d, %v", minutes, err)
+	}
+	if minutes, err := parseMaxTotalTime(""); minutes != 0 || err != nil {
+		t.Errorf("parseMaxTotalTime() = %d, %v", minutes, err)
+	}
+	for _, value := range []string{"0", "-5", "half"} {
+		if _, err := parseMaxTotalTime(value); !errors.Is(err, errInvalidQuery) {
+			t.Errorf("parseMaxTotalTime(%q) = %v, want errInvalidQuery", value, err)
+		}
+	}
+}
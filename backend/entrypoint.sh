@@ -84,6 +84,328 @@ if [ ! -f /root/database/database.db ]; then
 EOF
 fi
 
+# Add a column to an existing table unless it is already there
+add_column_if_missing() {
+    if [ "$(sqlite3 /root/database/database.db "SELECT COUNT(*) FROM pragma_table_info('$1') WHERE name = '$2';")" = "0" ]; then
+        echo "Adding column '$2' to table '$1'..."
+        sqlite3 /root/database/database.db "ALTER TABLE $1 ADD COLUMN $2 $3;"
+    fi
+}
+
+# Tables added after the first release, created on existing databases too
+sqlite3 /root/database/database.db <<EOF
+    CREATE TABLE IF NOT EXISTS users (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        username TEXT NOT NULL UNIQUE,
+        password_hash TEXT NOT NULL,
+        isAdmin INTEGER NOT NULL DEFAULT 0,
+        createdAt TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS sessions (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER NOT NULL,
+        token_hash TEXT NOT NULL UNIQUE,
+        createdAt TEXT,
+        expiresAt TEXT,
+        FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS api_tokens (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        token_hash TEXT NOT NULL UNIQUE,
+        scopes TEXT NOT NULL,
+        createdAt TEXT,
+        lastUsedAt TEXT,
+        expiresAt TEXT,
+        revokedAt TEXT,
+        FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS ingredient_taxonomy (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL UNIQUE,
+        parent_id INTEGER,
+        FOREIGN KEY (parent_id) REFERENCES ingredient_taxonomy(id) ON DELETE SET NULL
+    );
+
+    CREATE TABLE IF NOT EXISTS shares (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        recipe_id INTEGER,
+        token_hash TEXT NOT NULL UNIQUE,
+        created_by INTEGER NOT NULL,
+        createdAt TEXT,
+        expiresAt TEXT,
+        revokedAt TEXT,
+        FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE,
+        FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS tags (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        owner_id INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        kind TEXT NOT NULL,
+        UNIQUE (owner_id, kind, name),
+        FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS recipe_tags (
+        recipe_id INTEGER NOT NULL,
+        tag_id INTEGER NOT NULL,
+        PRIMARY KEY (recipe_id, tag_id),
+        FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE,
+        FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS allergen_rules (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        term TEXT NOT NULL,
+        allergen TEXT NOT NULL,
+        status TEXT NOT NULL,
+        UNIQUE (term, allergen)
+    );
+
+    CREATE TABLE IF NOT EXISTS recipe_allergen_overrides (
+        recipe_id INTEGER NOT NULL,
+        allergen TEXT NOT NULL,
+        status TEXT NOT NULL,
+        PRIMARY KEY (recipe_id, allergen),
+        FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS nutrition_mappings (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        owner_id INTEGER NOT NULL,
+        ingredient TEXT NOT NULL,
+        food TEXT NOT NULL,
+        UNIQUE (owner_id, ingredient),
+        FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS cook_log (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        recipe_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        cookedAt TEXT NOT NULL,
+        servings REAL,
+        rating INTEGER,
+        notes TEXT NOT NULL DEFAULT '',
+        createdAt TEXT,
+        FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE,
+        FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS cook_log_photos (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        cook_log_id INTEGER NOT NULL,
+        url TEXT,
+        filename TEXT,
+        FOREIGN KEY (cook_log_id) REFERENCES cook_log(id) ON DELETE CASCADE
+    );
+    CREATE TABLE IF NOT EXISTS collections (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        owner_id INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        description TEXT NOT NULL DEFAULT '',
+        cover TEXT,
+        createdAt TEXT,
+        lastEditedAt TEXT,
+        UNIQUE (owner_id, name),
+        FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+    CREATE TABLE IF NOT EXISTS collection_recipes (
+        collection_id INTEGER NOT NULL,
+        recipe_id INTEGER NOT NULL,
+        sortOrder INTEGER NOT NULL,
+        PRIMARY KEY (collection_id, recipe_id),
+        FOREIGN KEY (collection_id) REFERENCES collections(id) ON DELETE CASCADE,
+        FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE
+    );
+    CREATE TABLE IF NOT EXISTS method_durations (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        method_id INTEGER NOT NULL,
+        seconds INTEGER NOT NULL,
+        maxSeconds INTEGER NOT NULL,
+        kind TEXT NOT NULL,
+        text TEXT NOT NULL DEFAULT '',
+        sortOrder INTEGER NOT NULL,
+        FOREIGN KEY (method_id) REFERENCES methods(id) ON DELETE CASCADE
+    );
+    CREATE TABLE IF NOT EXISTS cooking_sessions (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        recipe_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        currentMethodId INTEGER,
+        servings REAL,
+        version INTEGER NOT NULL DEFAULT 1,
+        startedAt TEXT NOT NULL,
+        lastActivityAt TEXT NOT NULL,
+        endedAt TEXT,
+        FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE,
+        FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+    UPDATE cooking_sessions SET endedAt = lastActivityAt WHERE endedAt IS NULL AND id NOT IN (SELECT MAX(id) FROM cooking_sessions WHERE endedAt IS NULL GROUP BY recipe_id, user_id);
+    CREATE UNIQUE INDEX IF NOT EXISTS cooking_sessions_active ON cooking_sessions(recipe_id, user_id) WHERE endedAt IS NULL;
+    CREATE TABLE IF NOT EXISTS cooking_session_ingredients (
+        session_id INTEGER NOT NULL,
+        ingredient_id INTEGER NOT NULL,
+        PRIMARY KEY (session_id, ingredient_id),
+        FOREIGN KEY (session_id) REFERENCES cooking_sessions(id) ON DELETE CASCADE
+    );
+    CREATE TABLE IF NOT EXISTS cooking_session_timers (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        session_id INTEGER NOT NULL,
+        method_id INTEGER,
+        label TEXT NOT NULL DEFAULT '',
+        seconds INTEGER NOT NULL,
+        elapsedSeconds INTEGER NOT NULL DEFAULT 0,
+        startedAt TEXT,
+        FOREIGN KEY (session_id) REFERENCES cooking_sessions(id) ON DELETE CASCADE
+    );
+    CREATE TABLE IF NOT EXISTS webhooks (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        owner_id INTEGER NOT NULL,
+        url TEXT NOT NULL,
+        events TEXT NOT NULL,
+        secret TEXT NOT NULL,
+        active INTEGER NOT NULL DEFAULT 1,
+        createdAt TEXT NOT NULL,
+        lastEditedAt TEXT NOT NULL,
+        FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+    CREATE TABLE IF NOT EXISTS webhook_deliveries (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        webhook_id INTEGER NOT NULL,
+        event TEXT NOT NULL,
+        recipe_id INTEGER NOT NULL,
+        payload TEXT NOT NULL,
+        status TEXT NOT NULL DEFAULT 'pending',
+        attempts INTEGER NOT NULL DEFAULT 0,
+        nextAttemptAt TEXT,
+        lastAttemptAt TEXT,
+        responseStatus INTEGER,
+        error TEXT,
+        replayOf INTEGER,
+        createdAt TEXT NOT NULL,
+        deliveredAt TEXT,
+        FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries(status, nextAttemptAt);
+    CREATE TABLE IF NOT EXISTS ingredient_recipes (
+        ingredient_id INTEGER PRIMARY KEY,
+        recipe_id INTEGER NOT NULL,
+        FOREIGN KEY (ingredient_id) REFERENCES ingredients(id) ON DELETE CASCADE,
+        FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS ingredient_recipes_recipe ON ingredient_recipes(recipe_id);
+    DELETE FROM divider_ingredients WHERE rowid NOT IN (SELECT MAX(rowid) FROM divider_ingredients GROUP BY ingredient_id);
+    CREATE UNIQUE INDEX IF NOT EXISTS divider_ingredients_ingredient ON divider_ingredients(ingredient_id);
+    DELETE FROM divider_methods WHERE rowid NOT IN (SELECT MAX(rowid) FROM divider_methods GROUP BY method_id);
+    CREATE UNIQUE INDEX IF NOT EXISTS divider_methods_method ON divider_methods(method_id);
+    CREATE TABLE IF NOT EXISTS ingredient_catalog (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL UNIQUE,
+        aisle TEXT NOT NULL DEFAULT '',
+        defaultUnit TEXT NOT NULL DEFAULT '',
+        density REAL,
+        createdAt TEXT,
+        lastEditedAt TEXT
+    );
+    CREATE TABLE IF NOT EXISTS ingredient_catalog_aliases (
+        alias TEXT PRIMARY KEY,
+        catalog_id INTEGER NOT NULL,
+        FOREIGN KEY (catalog_id) REFERENCES ingredient_catalog(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS ingredient_catalog_aliases_catalog ON ingredient_catalog_aliases(catalog_id);
+    CREATE TABLE IF NOT EXISTS ingredient_catalog_links (
+        ingredient_id INTEGER PRIMARY KEY,
+        catalog_id INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        manual INTEGER NOT NULL DEFAULT 0,
+        FOREIGN KEY (ingredient_id) REFERENCES ingredients(id) ON DELETE CASCADE,
+        FOREIGN KEY (catalog_id) REFERENCES ingredient_catalog(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS ingredient_catalog_links_catalog ON ingredient_catalog_links(catalog_id);
+    CREATE TABLE IF NOT EXISTS migrations (
+        name TEXT PRIMARY KEY,
+        ranAt TEXT
+    );
+    CREATE TABLE IF NOT EXISTS substitutions (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        owner_id INTEGER,
+        ingredient TEXT NOT NULL,
+        value REAL NOT NULL,
+        measurement TEXT NOT NULL DEFAULT '',
+        note TEXT NOT NULL DEFAULT '',
+        createdAt TEXT,
+        lastEditedAt TEXT,
+        FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS substitutions_ingredient ON substitutions(ingredient);
+    CREATE TABLE IF NOT EXISTS substitution_lines (
+        substitution_id INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        value REAL NOT NULL,
+        measurement TEXT NOT NULL DEFAULT '',
+        sortOrder INTEGER NOT NULL,
+        FOREIGN KEY (substitution_id) REFERENCES substitutions(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS substitution_lines_substitution ON substitution_lines(substitution_id, sortOrder);
+    CREATE TABLE IF NOT EXISTS ingredient_prices (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        owner_id INTEGER NOT NULL,
+        ingredient TEXT NOT NULL,
+        price REAL NOT NULL,
+        quantity REAL NOT NULL,
+        unit TEXT NOT NULL DEFAULT '',
+        store TEXT NOT NULL DEFAULT '',
+        date TEXT NOT NULL,
+        createdAt TEXT,
+        FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS ingredient_prices_ingredient ON ingredient_prices(owner_id, ingredient, date);
+    CREATE TABLE IF NOT EXISTS equipment (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL UNIQUE
+    );
+    CREATE TABLE IF NOT EXISTS equipment_keywords (
+        equipment_id INTEGER NOT NULL,
+        keyword TEXT NOT NULL,
+        PRIMARY KEY (equipment_id, keyword),
+        FOREIGN KEY (equipment_id) REFERENCES equipment(id) ON DELETE CASCADE
+    );
+    CREATE TABLE IF NOT EXISTS recipe_equipment (
+        recipe_id INTEGER NOT NULL,
+        equipment_id INTEGER NOT NULL,
+        source TEXT NOT NULL DEFAULT 'manual',
+        PRIMARY KEY (recipe_id, equipment_id),
+        FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE,
+        FOREIGN KEY (equipment_id) REFERENCES equipment(id) ON DELETE CASCADE
+    );
+    CREATE TABLE IF NOT EXISTS recipe_notes (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        recipe_id INTEGER NOT NULL,
+        author_id INTEGER,
+        text TEXT NOT NULL,
+        ingredient_id INTEGER,
+        method_id INTEGER,
+        anchor TEXT NOT NULL DEFAULT '',
+        createdAt TEXT,
+        lastEditedAt TEXT,
+        FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE,
+        FOREIGN KEY (author_id) REFERENCES users(id)
+    );
+    CREATE INDEX IF NOT EXISTS recipe_notes_recipe ON recipe_notes(recipe_id);
+EOF
+
+add_column_if_missing recipes owner_id "INTEGER REFERENCES users(id)"
+add_column_if_missing shares collection_id "INTEGER REFERENCES collections(id)"
+add_column_if_missing recipes version "INTEGER NOT NULL DEFAULT 1"
+add_column_if_missing recipes parent_recipe_id "INTEGER REFERENCES recipes(id)"
+
 
 # Check if custom command is provided to modify tables
 if [ "$#" -eq 3 ]; then
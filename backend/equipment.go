@@ -0,0 +1,652 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Equipment is an entry of the equipment catalogue. A method whose text
+// contains one of the keywords needs the equipment.
+type Equipment struct {
+	ID       int      `json:"id"`
+	Name     string   `json:"name"`
+	Keywords []string `json:"keywords"`
+}
+
+// RecipeEquipment is a piece of equipment a recipe needs. Detected is set
+// when it was found in the method text rather than added by hand.
+type RecipeEquipment struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Detected bool   `json:"detected"`
+}
+
+// A recipe_equipment row is added by hand, detected from the methods, or
+// removed by hand so that detection does not bring it back.
+const (
+	equipmentManual   = "manual"
+	equipmentDetected = "detected"
+	equipmentExcluded = "excluded"
+)
+
+var errInvalidEquipment = errors.New("invalid equipment")
+
+// defaultEquipment is seeded into an empty equipment table as name and
+// keywords. Keywords are matched as whole words, longest first, so "dutch
+// oven" does not also count as an oven.
+var defaultEquipment = []Equipment{
+	{Name: "oven", Keywords: []string{"oven", "bake", "baked", "baking", "roast", "roasted", "preheat", "broil", "broiled"}},
+	{Name: "stove", Keywords: []string{"stove", "stovetop", "hob", "saucepan", "frying pan", "skillet", "simmer", "fry", "fried"}},
+	{Name: "microwave", Keywords: []string{"microwave", "microwaved"}},
+	{Name: "stand mixer", Keywords: []string{"stand mixer", "dough hook", "paddle attachment"}},
+	{Name: "hand mixer", Keywords: []string{"hand mixer", "electric whisk", "electric mixer", "electric beater"}},
+	{Name: "blender", Keywords: []string{"blender", "liquidise", "liquidize"}},
+	{Name: "immersion blender", Keywords: []string{"immersion blender", "stick blender", "hand blender"}},
+	{Name: "food processor", Keywords: []string{"food processor"}},
+	{Name: "pressure cooker", Keywords: []string{"pressure cooker", "instant pot"}},
+	{Name: "slow cooker", Keywords: []string{"slow cooker", "crockpot", "crock pot"}},
+	{Name: "air fryer", Keywords: []string{"air fryer", "air fry"}},
+	{Name: "deep fryer", Keywords: []string{"deep fryer", "deep fry", "deep fried"}},
+	{Name: "grill", Keywords: []string{"grill", "grilled", "barbecue", "bbq"}},
+	{Name: "wok", Keywords: []string{"wok", "stir fry"}},
+	{Name: "dutch oven", Keywords: []string{"dutch oven", "casserole dish"}},
+	{Name: "cake tin", Keywords: []string{"cake tin", "cake pan", "springform"}},
+	{Name: "loaf tin", Keywords: []string{"loaf tin", "loaf pan"}},
+	{Name: "muffin tin", Keywords: []string{"muffin tin", "muffin tray", "cupcake tray"}},
+	{Name: "baking tray", Keywords: []string{"baking tray", "baking sheet", "sheet pan"}},
+	{Name: "rolling pin", Keywords: []string{"rolling pin", "roll out"}},
+	{Name: "piping bag", Keywords: []string{"piping bag", "piping nozzle"}},
+	{Name: "whisk", Keywords: []string{"whisk", "whisked"}},
+	{Name: "sieve", Keywords: []string{"sieve", "sift", "sifted", "strainer"}},
+	{Name: "grater", Keywords: []string{"grater", "grate", "grated", "zest"}},
+	{Name: "mortar and pestle", Keywords: []string{"mortar", "pestle"}},
+	{Name: "mandoline", Keywords: []string{"mandoline", "mandolin"}},
+	{Name: "thermometer", Keywords: []string{"thermometer"}},
+	{Name: "pasta machine", Keywords: []string{"pasta machine", "pasta roller"}},
+	{Name: "ice cream maker", Keywords: []string{"ice cream maker", "churn"}},
+	{Name: "sous vide", Keywords: []string{"sous vide", "immersion circulator"}},
+}
+
+func registerEquipmentRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/equipment", getEquipmentHandler).Methods("GET")
+	api.HandleFunc("/equipment", requireAdmin(createEquipment)).Methods("POST")
+	api.HandleFunc("/equipment/{id}", requireAdmin(updateEquipment)).Methods("PATCH")
+	api.HandleFunc("/equipment/{id}", requireAdmin(deleteEquipment)).Methods("DELETE")
+
+	api.HandleFunc("/recipes/{id}/equipment", getRecipeEquipmentHandler).Methods("GET")
+	api.HandleFunc("/recipes/{id}/equipment", replaceRecipeEquipment).Methods("PUT")
+	api.HandleFunc("/recipes/{id}/equipment", addRecipeEquipment).Methods("POST")
+	api.HandleFunc("/recipes/{id}/equipment/{equipmentId}", removeRecipeEquipment).Methods("DELETE")
+}
+
+// seedEquipment fills an empty equipment table with defaultEquipment.
+func seedEquipment() error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM equipment").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	for _, equipment := range defaultEquipment {
+		if _, err := saveEquipment(equipment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getEquipment() ([]Equipment, error) {
+	rows, err := db.Query("SELECT id, name FROM equipment ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+
+	equipment := []Equipment{}
+	index := map[int]int{}
+	for rows.Next() {
+		var entry Equipment
+		if err := rows.Scan(&entry.ID, &entry.Name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entry.Keywords = []string{}
+		index[entry.ID] = len(equipment)
+		equipment = append(equipment, entry)
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT equipment_id, keyword FROM equipment_keywords ORDER BY keyword")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var keyword string
+		if rows.Scan(&id, &keyword) == nil {
+			if i, ok := index[id]; ok {
+				equipment[i].Keywords = append(equipment[i].Keywords, keyword)
+			}
+		}
+	}
+
+	return equipment, nil
+}
+
+func getEquipmentById(id int) *Equipment {
+	equipment, err := getEquipment()
+	if err != nil {
+		return nil
+	}
+	for _, entry := range equipment {
+		if entry.ID == id {
+			return &entry
+		}
+	}
+	return nil
+}
+
+// getRecipeEquipment returns what the recipe needs, leaving out equipment
+// that was removed by hand.
+func getRecipeEquipment(recipeId int) []RecipeEquipment {
+	equipment := []RecipeEquipment{}
+
+	rows, err := db.Query(`
+		SELECT e.id, e.name, re.source = ? FROM recipe_equipment re
+		JOIN equipment e ON e.id = re.equipment_id
+		WHERE re.recipe_id = ? AND re.source != ?
+		ORDER BY e.name
+	`, equipmentDetected, recipeId, equipmentExcluded)
+	if err != nil {
+		return equipment
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry RecipeEquipment
+		if rows.Scan(&entry.ID, &entry.Name, &entry.Detected) == nil {
+			equipment = append(equipment, entry)
+		}
+	}
+	return equipment
+}
+
+// detectEquipment returns the ids of the equipment the methods mention.
+// Longer keywords are matched first and take their words out of the text.
+func detectEquipment(methods []Method, equipment []Equipment) []int {
+	type keyword struct {
+		term        string
+		equipmentId int
+	}
+	var keywords []keyword
+	for _, entry := range equipment {
+		for _, term := range entry.Keywords {
+			keywords = append(keywords, keyword{term, entry.ID})
+		}
+	}
+	sort.SliceStable(keywords, func(i, j int) bool {
+		return len(keywords[i].term) > len(keywords[j].term)
+	})
+
+	var ids []int
+	for _, method := range methods {
+		text := " " + normalizeIngredientName(method.Value) + " "
+		for _, keyword := range keywords {
+			if !strings.Contains(text, " "+keyword.term+" ") {
+				continue
+			}
+			text = strings.ReplaceAll(text, " "+keyword.term+" ", " | ")
+			if !slices.Contains(ids, keyword.equipmentId) {
+				ids = append(ids, keyword.equipmentId)
+			}
+		}
+	}
+	return ids
+}
+
+// detectRecipeEquipment brings the detected equipment of the recipe in line
+// with its methods. Equipment added or removed by hand is left alone.
+func detectRecipeEquipment(recipeId int) error {
+	equipment, err := getEquipment()
+	if err != nil {
+		return err
+	}
+	detected := detectEquipment(getRecipeMethods(recipeId), equipment)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT equipment_id FROM recipe_equipment WHERE recipe_id = ? AND source = ?", recipeId, equipmentDetected)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var stale []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil && !slices.Contains(detected, id) {
+			stale = append(stale, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range stale {
+		if _, err := tx.Exec("DELETE FROM recipe_equipment WHERE recipe_id = ? AND equipment_id = ?", recipeId, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, id := range detected {
+		_, err := tx.Exec("INSERT OR IGNORE INTO recipe_equipment(recipe_id, equipment_id, source) VALUES(?,?,?)", recipeId, id, equipmentDetected)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// detectAllEquipment runs the detection on every recipe, for recipes saved
+// before the catalogue existed or changed.
+func detectAllEquipment() error {
+	rows, err := db.Query("SELECT id FROM recipes")
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := detectRecipeEquipment(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateEquipment checks equipment passed by id exists and equipment
+// passed by name has one, without adding anything to the catalogue.
+func validateEquipment(equipment []RecipeEquipment) error {
+	for _, entry := range equipment {
+		if entry.ID != 0 {
+			if getEquipmentById(entry.ID) == nil {
+				return fmt.Errorf("%w: equipment %d not found", errInvalidEquipment, entry.ID)
+			}
+			continue
+		}
+
+		if normalizeIngredientName(entry.Name) == "" {
+			return fmt.Errorf("%w: equipment name is required", errInvalidEquipment)
+		}
+	}
+	return nil
+}
+
+// resolveEquipment turns equipment passed by id, or by name, into ids.
+// Equipment passed by a name the catalogue does not know is added to it,
+// once all the equipment is valid.
+func resolveEquipment(tx *sql.Tx, equipment []RecipeEquipment) ([]int, error) {
+	if err := validateEquipment(equipment); err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, entry := range equipment {
+		if entry.ID != 0 {
+			ids = append(ids, entry.ID)
+			continue
+		}
+
+		name := normalizeIngredientName(entry.Name)
+		var id int
+		err := tx.QueryRow("SELECT id FROM equipment WHERE name = ?", name).Scan(&id)
+		if err == sql.ErrNoRows {
+			id, err = saveEquipmentTx(tx, Equipment{Name: name})
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// setRecipeEquipmentTx makes the listed equipment the equipment of the recipe.
+// Everything else is excluded, so detection does not add it back.
+func setRecipeEquipmentTx(tx *sql.Tx, recipeId int, equipmentIds []int) error {
+	if _, err := tx.Exec("UPDATE recipe_equipment SET source = ? WHERE recipe_id = ?", equipmentExcluded, recipeId); err != nil {
+		return err
+	}
+	for _, id := range equipmentIds {
+		if err := addEquipmentTx(tx, recipeId, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addEquipmentTx puts the equipment on the recipe by hand inside tx.
+func addEquipmentTx(tx *sql.Tx, recipeId int, equipmentId int) error {
+	_, err := tx.Exec(`
+		INSERT INTO recipe_equipment(recipe_id, equipment_id, source) VALUES(?,?,?)
+		ON CONFLICT(recipe_id, equipment_id) DO UPDATE SET source = excluded.source
+	`, recipeId, equipmentId, equipmentManual)
+	return err
+}
+
+// applyRecipeEquipment sets the equipment passed along with a whole recipe.
+// A recipe passed without equipment keeps its equipment.
+func applyRecipeEquipment(tx *sql.Tx, recipeId int, recipe Recipe) error {
+	if recipe.Equipment == nil {
+		return nil
+	}
+
+	ids, err := resolveEquipment(tx, recipe.Equipment)
+	if err != nil {
+		return err
+	}
+	return setRecipeEquipmentTx(tx, recipeId, ids)
+}
+
+// filterRecipesByEquipment keeps the recipes that need nothing but the
+// equipment at hand.
+func filterRecipesByEquipment(recipes []Recipe, available []string) []Recipe {
+	var filtered []Recipe
+outer:
+	for _, recipe := range recipes {
+		for _, equipment := range recipe.Equipment {
+			if !slices.Contains(available, equipment.Name) {
+				continue outer
+			}
+		}
+		filtered = append(filtered, recipe)
+	}
+	return filtered
+}
+
+// saveEquipment inserts the entry when it has no ID, or updates it, and
+// replaces its keywords. The name is always one of the keywords.
+func saveEquipment(equipment Equipment) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := saveEquipmentTx(tx, equipment)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func saveEquipmentTx(tx *sql.Tx, equipment Equipment) (int, error) {
+	if equipment.ID == 0 {
+		result, err := tx.Exec("INSERT INTO equipment(name) VALUES(?)", equipment.Name)
+		if err != nil {
+			return 0, err
+		}
+		id, _ := result.LastInsertId()
+		equipment.ID = int(id)
+	} else if _, err := tx.Exec("UPDATE equipment SET name = ? WHERE id = ?", equipment.Name, equipment.ID); err != nil {
+		return 0, err
+	}
+
+	keywords := []string{equipment.Name}
+	for _, keyword := range equipment.Keywords {
+		if keyword = normalizeIngredientName(keyword); keyword != "" && !slices.Contains(keywords, keyword) {
+			keywords = append(keywords, keyword)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM equipment_keywords WHERE equipment_id = ?", equipment.ID); err != nil {
+		return 0, err
+	}
+	for _, keyword := range keywords {
+		if _, err := tx.Exec("INSERT INTO equipment_keywords(equipment_id, keyword) VALUES(?,?)", equipment.ID, keyword); err != nil {
+			return 0, err
+		}
+	}
+
+	return equipment.ID, nil
+}
+
+func getEquipmentHandler(w http.ResponseWriter, r *http.Request) {
+	equipment, err := getEquipment()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, equipment)
+}
+
+func createEquipment(w http.ResponseWriter, r *http.Request) {
+	var equipment Equipment
+	if !decodeBody(w, r, &equipment) {
+		return
+	}
+	equipment.ID = 0
+	equipment.Name = normalizeIngredientName(equipment.Name)
+	if equipment.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	id, err := saveEquipment(equipment)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err := detectAllEquipment(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, getEquipmentById(id))
+}
+
+// updateEquipment changes the fields present in the body. keywords replaces
+// the whole list, and every recipe is checked again.
+func updateEquipment(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	equipment := getEquipmentById(id)
+	if equipment == nil {
+		http.Error(w, "Equipment not found", http.StatusNotFound)
+		return
+	}
+
+	var patch struct {
+		Name     *string   `json:"name"`
+		Keywords *[]string `json:"keywords"`
+	}
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	if patch.Name != nil {
+		equipment.Name = normalizeIngredientName(*patch.Name)
+		if equipment.Name == "" {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
+	}
+	if patch.Keywords != nil {
+		equipment.Keywords = *patch.Keywords
+	}
+
+	if _, err := saveEquipment(*equipment); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err := detectAllEquipment(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, getEquipmentById(id))
+}
+
+// deleteEquipment removes the entry from the catalogue and from every recipe.
+func deleteEquipment(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	if getEquipmentById(id) == nil {
+		http.Error(w, "Equipment not found", http.StatusNotFound)
+		return
+	}
+
+	for _, table := range []string{"recipe_equipment WHERE equipment_id", "equipment_keywords WHERE equipment_id", "equipment WHERE id"} {
+		if _, err := db.Exec("DELETE FROM "+table+" = ?", id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getRecipeEquipmentHandler(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recipe.Equipment)
+}
+
+// replaceRecipeEquipment sets the equipment of the recipe to the passed list.
+// Each entry is given by id or by name.
+func replaceRecipeEquipment(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var equipment []RecipeEquipment
+	if !decodeBody(w, r, &equipment) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ids, err := resolveEquipment(tx, equipment)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), equipmentErrorStatus(err))
+		return
+	}
+	if err := setRecipeEquipmentTx(tx, recipe.ID, ids); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recipeChanged(recipe.ID, eventEquipmentUpdated)
+
+	writeJSON(w, http.StatusOK, getRecipeEquipment(recipe.ID))
+}
+
+func addRecipeEquipment(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var equipment RecipeEquipment
+	if !decodeBody(w, r, &equipment) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ids, err := resolveEquipment(tx, []RecipeEquipment{equipment})
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), equipmentErrorStatus(err))
+		return
+	}
+	if err := addEquipmentTx(tx, recipe.ID, ids[0]); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recipeChanged(recipe.ID, eventEquipmentUpdated)
+
+	writeJSON(w, http.StatusCreated, getRecipeEquipment(recipe.ID))
+}
+
+// removeRecipeEquipment takes the equipment off the recipe. It stays
+// excluded so the next detection does not add it back.
+func removeRecipeEquipment(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	equipmentId, ok := pathID(w, r, "equipmentId")
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE recipe_equipment SET source = ? WHERE recipe_id = ? AND equipment_id = ? AND source != ?
+	`, equipmentExcluded, recipe.ID, equipmentId, equipmentExcluded)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Equipment not found on this recipe", http.StatusNotFound)
+		return
+	}
+	recipeChanged(recipe.ID, eventEquipmentUpdated)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func equipmentErrorStatus(err error) int {
+	if errors.Is(err, errInvalidEquipment) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Event tells the other devices of a user that one of their recipes changed.
+// Type is "<resource>.<change>", e.g. "ingredient.created", and Version is the
+// version of the recipe after the change. Events of a cooking session carry
+// the whole session instead.
+type Event struct {
+	ID       int64           `json:"id"`
+	Type     string          `json:"type"`
+	Resource string          `json:"resource"`
+	RecipeID int             `json:"recipe_id,omitempty"`
+	Version  int             `json:"version,omitempty"`
+	Session  *CookingSession `json:"session,omitempty"`
+	Time     string          `json:"time"`
+	ownerId  int
+}
+
+const (
+	eventRecipeCreated     = "recipe.created"
+	eventRecipeUpdated     = "recipe.updated"
+	eventRecipeDeleted     = "recipe.deleted"
+	eventRecipeReordered   = "recipe.reordered"
+	eventPortionUpdated    = "portion.updated"
+	eventPortionDeleted    = "portion.deleted"
+	eventIngredientCreated = "ingredient.created"
+	eventIngredientUpdated = "ingredient.updated"
+	eventIngredientDeleted = "ingredient.deleted"
+	eventMethodCreated     = "method.created"
+	eventMethodUpdated     = "method.updated"
+	eventMethodDeleted     = "method.deleted"
+	eventImageUpdated      = "image.updated"
+	eventImageDeleted      = "image.deleted"
+	eventDividerCreated    = "divider.created"
+	eventDividerUpdated    = "divider.updated"
+	eventDividerDeleted    = "divider.deleted"
+	eventTagsUpdated       = "tag.updated"
+	eventAllergensUpdated  = "allergen.updated"
+	eventEquipmentUpdated  = "equipment.updated"
+	eventNoteCreated       = "note.created"
+	eventNoteUpdated       = "note.updated"
+	eventNoteDeleted       = "note.deleted"
+)
+
+// eventResources are the resources a stream can be filtered by.
+var eventResources = []string{"recipe", "portion", "ingredient", "method", "image", "divider", "tag", "allergen", "equipment", "note"}
+
+const (
+	// eventHistorySize is how many past events are kept for clients that
+	// reconnect with a Last-Event-ID.
+	eventHistorySize = 256
+	// eventBufferSize is how many events a stream may fall behind before it
+	// is dropped and told to reload.
+	eventBufferSize = 64
+	// eventHeartbeat keeps idle streams from being closed by proxies.
+	eventHeartbeat = 15 * time.Second
+)
+
+// eventHub passes events from the handlers that change something to the
+// open event streams. Publishing never blocks: a stream that cannot keep up
+// is closed and the client told to reload before reconnecting. The last
+// historySize events are kept for streams that reconnect.
+type eventHub struct {
+	mu          sync.Mutex
+	nextID      int64
+	history     []Event
+	historySize int
+	subscribers map[*eventSubscriber]bool
+	heartbeat   time.Duration
+}
+
+type eventSubscriber struct {
+	wants  func(Event) bool
+	events chan Event
+}
+
+func newEventHub(historySize int, heartbeat time.Duration) *eventHub {
+	return &eventHub{historySize: historySize, subscribers: map[*eventSubscriber]bool{}, heartbeat: heartbeat}
+}
+
+var events = newEventHub(eventHistorySize, eventHeartbeat)
+
+func registerEventRoutes(router *mux.Router) {
+	router.HandleFunc("/events", events.serveEvents).Methods("GET")
+	router.HandleFunc("/api/v1/events", events.serveEvents).Methods("GET")
+}
+
+// recipeEventFilter matches the events of the user's recipes, only of the
+// given resources unless there are none.
+func recipeEventFilter(userId int, resources map[string]bool) func(Event) bool {
+	return func(event Event) bool {
+		return event.ownerId == userId && (len(resources) == 0 || resources[event.Resource])
+	}
+}
+
+// publish numbers the event and hands it to every stream that wants it.
+func (hub *eventHub) publish(event Event) Event {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.nextID++
+	event.ID = hub.nextID
+	event.Time = time.Now().Format("2006-01-02 15:04:05")
+
+	if hub.historySize > 0 {
+		hub.history = append(hub.history, event)
+		if len(hub.history) > hub.historySize {
+			hub.history = hub.history[len(hub.history)-hub.historySize:]
+		}
+	}
+
+	for subscriber := range hub.subscribers {
+		if !subscriber.wants(event) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			delete(hub.subscribers, subscriber)
+			close(subscriber.events)
+		}
+	}
+	return event
+}
+
+// subscribe opens a stream of the events it wants. missed are the events
+// after lastEventId, to be sent before those of the stream; complete is false
+// when some of them are no longer known.
+func (hub *eventHub) subscribe(wants func(Event) bool, lastEventId int64) (subscriber *eventSubscriber, missed []Event, complete bool) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	subscriber = &eventSubscriber{wants: wants, events: make(chan Event, eventBufferSize)}
+	complete = true
+
+	if lastEventId > 0 {
+		if lastEventId > hub.nextID || (lastEventId < hub.nextID && (len(hub.history) == 0 || hub.history[0].ID > lastEventId+1)) {
+			complete = false
+		} else {
+			for _, event := range hub.history {
+				if event.ID > lastEventId && wants(event) {
+					missed = append(missed, event)
+				}
+			}
+		}
+	}
+
+	hub.subscribers[subscriber] = true
+	return subscriber, missed, complete
+}
+
+func (hub *eventHub) unsubscribe(subscriber *eventSubscriber) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.subscribers[subscriber] {
+		delete(hub.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+// parseEventResources reads the resources filter, accepting plural names.
+func parseEventResources(value string) (map[string]bool, error) {
+	resources := map[string]bool{}
+	for _, name := range splitList(value) {
+		resource := strings.TrimSuffix(strings.ToLower(name), "s")
+		if !slices.Contains(eventResources, resource) {
+			return nil, fmt.Errorf("unknown resource %q, expected one of %s", name, strings.Join(eventResources, ", "))
+		}
+		resources[resource] = true
+	}
+	return resources, nil
+}
+
+// serveEvents streams the events of the user's recipes as Server-Sent Events,
+// optionally only for ?resources=recipe,ingredient. A client that reconnects
+// with Last-Event-ID gets what it missed, or a "reset" event when that is
+// not known anymore and it should reload everything.
+func (hub *eventHub) serveEvents(w http.ResponseWriter, r *http.Request) {
+	resources, err := parseEventResources(r.URL.Query().Get("resources"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastEventId, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	subscriber, missed, complete := hub.subscribe(recipeEventFilter(currentUser(r).ID, resources), lastEventId)
+	defer hub.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: 3000\n\n")
+	if !complete {
+		fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range missed {
+		writeRecipeEvent(w, event)
+	}
+	flusher.Flush()
+
+	hub.stream(w, r, subscriber, func(event Event) bool {
+		writeRecipeEvent(w, event)
+		return true
+	})
+}
+
+func writeRecipeEvent(w http.ResponseWriter, event Event) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
+
+// stream writes the events of the subscriber with send until the client goes
+// away or send returns false, with a heartbeat while there are none. A
+// subscriber dropped for falling behind gets a "reset" event, as reconnecting
+// starts afresh.
+func (hub *eventHub) stream(w http.ResponseWriter, r *http.Request, subscriber *eventSubscriber, send func(Event) bool) {
+	flusher := w.(http.Flusher)
+
+	heartbeat := time.NewTicker(hub.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-subscriber.events:
+			if !open {
+				fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			more := send(event)
+			flusher.Flush()
+			if !more {
+				return
+			}
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// recipeChanged records a change to the recipe: it bumps its version and
+// lastEditedAt and tells the other devices.
+func recipeChanged(recipeId int, eventType string) {
+	updateRecipeLastEdited(recipeId)
+	publishRecipeEvent(recipeId, eventType)
+}
+
+// publishRecipeEvent publishes an event carrying the current version of the
+// recipe.
+func publishRecipeEvent(recipeId int, eventType string) {
+	var ownerId, version int
+	err := db.QueryRow("SELECT COALESCE(owner_id, 0), version FROM recipes WHERE id = ?", recipeId).Scan(&ownerId, &version)
+	if err != nil {
+		fmt.Println("Error publishing event:", err)
+		return
+	}
+	publishEvent(Event{Type: eventType, RecipeID: recipeId, Version: version, ownerId: ownerId})
+}
+
+// publishEvent sends the event to the open streams and queues it for the
+// owner's webhooks.
+func publishEvent(event Event) {
+	event.Resource, _, _ = strings.Cut(event.Type, ".")
+	queueWebhookDeliveries(events.publish(event))
+}
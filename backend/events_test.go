@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseFrame is one event read off a stream.
+type sseFrame struct {
+	id, event, data string
+}
+
+// startEventServer serves the hub's events as user 1.
+func startEventServer(t *testing.T, hub *eventHub) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := &User{ID: 1}
+		hub.serveEvents(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// openEventStream connects to the server and waits until the stream is
+// subscribed, so nothing published afterwards is missed.
+func openEventStream(t *testing.T, hub *eventHub, url string, lastEventId string) *bufio.Reader {
+	t.Helper()
+	subscribed := subscriberCount(hub)
+
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventId != "" {
+		request.Header.Set("Last-Event-ID", lastEventId)
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", response.StatusCode)
+	}
+
+	for deadline := time.Now().Add(time.Second); subscriberCount(hub) == subscribed; {
+		if time.Now().After(deadline) {
+			t.Fatal("stream did not subscribe")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return bufio.NewReader(response.Body)
+}
+
+func subscriberCount(hub *eventHub) int {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return len(hub.subscribers)
+}
+
+// readFrame returns the next event of the stream, skipping the retry line.
+// A heartbeat comment is returned as an event named ":".
+func readFrame(t *testing.T, reader *bufio.Reader) sseFrame {
+	t.Helper()
+	var frame sseFrame
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if frame.event != "" {
+				return frame
+			}
+		case strings.HasPrefix(line, ":"):
+			frame.event = ":"
+		case strings.HasPrefix(line, "id: "):
+			frame.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			frame.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			frame.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// publishTo publishes an event of the owner's recipe 1 like publishEvent.
+func publishTo(hub *eventHub, ownerId int, eventType string) Event {
+	resource, _, _ := strings.Cut(eventType, ".")
+	return hub.publish(Event{Type: eventType, Resource: resource, RecipeID: 1, ownerId: ownerId})
+}
+
+func TestEventsHeartbeat(t *testing.T) {
+	hub := newEventHub(eventHistorySize, 10*time.Millisecond)
+	server := startEventServer(t, hub)
+	reader := openEventStream(t, hub, server.URL, "")
+
+	if frame := readFrame(t, reader); frame.event != ":" {
+		t.Fatalf("got %+v, want a heartbeat", frame)
+	}
+}
+
+func TestEventsResourcesFilter(t *testing.T) {
+	hub := newEventHub(eventHistorySize, time.Hour)
+	server := startEventServer(t, hub)
+	reader := openEventStream(t, hub, server.URL+"?resources=ingredients,methods", "")
+
+	publishTo(hub, 1, eventRecipeUpdated)
+	publishTo(hub, 2, eventIngredientCreated)
+	want := publishTo(hub, 1, eventIngredientCreated)
+	publishTo(hub, 1, eventTagsUpdated)
+	last := publishTo(hub, 1, eventMethodDeleted)
+
+	if frame := readFrame(t, reader); frame.event != eventIngredientCreated || frame.id != strconv.FormatInt(want.ID, 10) {
+		t.Fatalf("got %+v, want ingredient.created with id %d", frame, want.ID)
+	}
+	if frame := readFrame(t, reader); frame.event != eventMethodDeleted || frame.id != strconv.FormatInt(last.ID, 10) {
+		t.Fatalf("got %+v, want method.deleted with id %d", frame, last.ID)
+	}
+}
+
+func TestEventsUnknownResource(t *testing.T) {
+	hub := newEventHub(eventHistorySize, time.Hour)
+	server := startEventServer(t, hub)
+
+	response, err := http.Get(server.URL + "?resources=recipes,spoons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", response.StatusCode)
+	}
+}
+
+func TestEventsReplayAfterLastEventID(t *testing.T) {
+	hub := newEventHub(eventHistorySize, time.Hour)
+	server := startEventServer(t, hub)
+
+	publishTo(hub, 1, eventRecipeCreated)
+	publishTo(hub, 1, eventIngredientCreated)
+	publishTo(hub, 2, eventIngredientCreated)
+	publishTo(hub, 1, eventMethodCreated)
+
+	reader := openEventStream(t, hub, server.URL, "1")
+	publishTo(hub, 1, eventRecipeUpdated)
+
+	for _, want := range []sseFrame{{"2", eventIngredientCreated, ""}, {"4", eventMethodCreated, ""}, {"5", eventRecipeUpdated, ""}} {
+		if frame := readFrame(t, reader); frame.id != want.id || frame.event != want.event {
+			t.Fatalf("got %+v, want %s with id %s", frame, want.event, want.id)
+		}
+	}
+}
+
+func TestEventsResetWhenHistoryIsGone(t *testing.T) {
+	hub := newEventHub(2, time.Hour)
+	server := startEventServer(t, hub)
+
+	for range 5 {
+		publishTo(hub, 1, eventRecipeUpdated)
+	}
+
+	for _, lastEventId := range []string{"1", "9"} {
+		reader := openEventStream(t, hub, server.URL, lastEventId)
+		if frame := readFrame(t, reader); frame.event != "reset" {
+			t.Fatalf("Last-Event-ID %s: got %+v, want reset", lastEventId, frame)
+		}
+	}
+
+	// the last two are still known
+	reader := openEventStream(t, hub, server.URL, "3")
+	if frame := readFrame(t, reader); frame.event != eventRecipeUpdated || frame.id != "4" {
+		t.Fatalf("got %+v, want recipe.updated with id 4", frame)
+	}
+}
+
+func TestEventsDropSlowSubscriber(t *testing.T) {
+	hub := newEventHub(eventHistorySize, time.Hour)
+	slow, _, _ := hub.subscribe(recipeEventFilter(1, nil), 0)
+	other, _, _ := hub.subscribe(recipeEventFilter(2, nil), 0)
+
+	for range eventBufferSize + 1 {
+		publishTo(hub, 1, eventRecipeUpdated)
+	}
+
+	if _, ok := hub.subscribers[slow]; ok {
+		t.Fatal("slow subscriber is still subscribed")
+	}
+	if _, ok := hub.subscribers[other]; !ok {
+		t.Fatal("subscriber without events was dropped")
+	}
+	for range eventBufferSize {
+		<-slow.events
+	}
+	if _, open := <-slow.events; open {
+		t.Fatal("events of the slow subscriber were not closed")
+	}
+	hub.unsubscribe(slow)
+}
+
+func TestEventsDroppedStreamGetsReset(t *testing.T) {
+	hub := newEventHub(eventHistorySize, time.Hour)
+	subscriber, _, _ := hub.subscribe(recipeEventFilter(1, nil), 0)
+	for range eventBufferSize + 1 {
+		publishTo(hub, 1, eventRecipeUpdated)
+	}
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/events", nil)
+	hub.stream(recorder, request, subscriber, func(Event) bool { return true })
+
+	if body := recorder.Body.String(); !strings.HasSuffix(body, "event: reset\ndata: {}\n\n") {
+		t.Fatalf("stream ended with %q, want a reset event", body[max(0, len(body)-40):])
+	}
+}
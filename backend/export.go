@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The printable area of a page, in points.
+const (
+	printMargin = 56.0
+	printWidth  = pdfPageWidth - 2*printMargin
+	printBottom = pdfPageHeight - printMargin
+)
+
+// contentsLineHeight is the height of one recipe in the table of contents,
+// which fits contentsPerPage recipes below its heading.
+const (
+	contentsLineHeight = 22.0
+	contentsPerPage    = 30
+)
+
+func registerExportRoutes(router *mux.Router) {
+	router.HandleFunc("/export/pdf", exportPDF).Methods("GET")
+	router.HandleFunc("/export/html", exportHTML).Methods("GET")
+	router.HandleFunc("/recipe/{id}/print.pdf", printRecipePDFHandler).Methods("GET")
+	router.HandleFunc("/recipe/{id}/print.html", printRecipeHTML).Methods("GET")
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/export/pdf", exportPDF).Methods("GET")
+	api.HandleFunc("/export/html", exportHTML).Methods("GET")
+	api.HandleFunc("/recipes/{id}/print.pdf", printRecipePDFHandler).Methods("GET")
+	api.HandleFunc("/recipes/{id}/print.html", printRecipeHTML).Methods("GET")
+}
+
+// exportRecipes picks the recipes of a cookbook: those named by ids in that
+// order, or else those the recipe list returns for the same filters,
+// narrowed down to the given types.
+func exportRecipes(ownerId int, query url.Values) ([]Recipe, error) {
+	if query.Has("ids") {
+		var recipes []Recipe
+		for _, value := range splitList(query.Get("ids")) {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid recipe id %q", errInvalidQuery, value)
+			}
+			recipe := getOwnedRecipe(id, ownerId)
+			if recipe.ID == 0 {
+				return nil, fmt.Errorf("%w: recipe %d not found", errInvalidQuery, id)
+			}
+			recipes = append(recipes, recipe)
+		}
+		return recipes, nil
+	}
+
+	recipes, err := listRecipes(ownerId, query)
+	if err != nil {
+		return nil, err
+	}
+	if types := splitList(query.Get("type")); len(types) > 0 {
+		recipes = filterRecipesByType(recipes, types)
+	}
+	return recipes, nil
+}
+
+// filterRecipesByType keeps the recipes whose type or one of whose course
+// tags is one of types.
+func filterRecipesByType(recipes []Recipe, types []string) []Recipe {
+	var filtered []Recipe
+	for _, recipe := range recipes {
+		matches := slices.Contains(types, strings.ToLower(recipe.Type))
+		for _, tag := range recipe.Tags {
+			if tag.Kind == tagKindCourse && slices.Contains(types, strings.ToLower(tag.Name)) {
+				matches = true
+			}
+		}
+		if matches {
+			filtered = append(filtered, recipe)
+		}
+	}
+	return filtered
+}
+
+// exportTitle is the title passed, the name of the collection exported, or
+// a plain "Cookbook".
+func exportTitle(ownerId int, query url.Values) string {
+	if title := strings.TrimSpace(query.Get("title")); title != "" {
+		return title
+	}
+	if id, err := strconv.Atoi(query.Get("collection")); err == nil {
+		if collection := getOwnedCollection(id, ownerId); collection != nil {
+			return collection.Name
+		}
+	}
+	return "Cookbook"
+}
+
+// cookbookRecipes loads the recipes of an export, writing the error
+// response when there are none.
+func cookbookRecipes(w http.ResponseWriter, r *http.Request) ([]Recipe, bool) {
+	recipes, err := exportRecipes(currentUser(r).ID, r.URL.Query())
+	if errors.Is(err, errInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if len(recipes) == 0 {
+		http.Error(w, "No recipes to export", http.StatusNotFound)
+		return nil, false
+	}
+	return recipes, true
+}
+
+// exportPDF downloads the recipes as a printable cookbook with a title
+// page, a table of contents and every recipe starting on a new page.
+func exportPDF(w http.ResponseWriter, r *http.Request) {
+	recipes, ok := cookbookRecipes(w, r)
+	if !ok {
+		return
+	}
+	title := exportTitle(currentUser(r).ID, r.URL.Query())
+
+	writePDF(w, printCookbook(title, recipes), fmt.Sprintf(`attachment; filename="%s"`, exportFilename(title, "cookbook", "pdf")))
+}
+
+// exportHTML downloads the same cookbook as a single page, laid out like an
+// exported collection.
+func exportHTML(w http.ResponseWriter, r *http.Request) {
+	recipes, ok := cookbookRecipes(w, r)
+	if !ok {
+		return
+	}
+	title := exportTitle(currentUser(r).ID, r.URL.Query())
+
+	page := collectionPage{Collection: Collection{Name: title, Description: fmt.Sprintf("%d recipes", len(recipes))}}
+	for _, recipe := range recipes {
+		page.Recipes = append(page.Recipes, newSharePage(recipe))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename(title, "cookbook", "html")))
+	if err := collectionTemplate.Execute(w, page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// printRecipePDFHandler shows the recipe as a PDF of a single page.
+func printRecipePDFHandler(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	writePDF(w, printRecipePDF(recipe), fmt.Sprintf(`inline; filename="%s"`, exportFilename(recipe.Name, "recipe", "pdf")))
+}
+
+// printRecipeHTML shows the recipe as the page of a shared link, which
+// prints on a page of its own.
+func printRecipeHTML(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := shareTemplate.Execute(w, newSharePage(recipe)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writePDF(w http.ResponseWriter, doc *pdfDocument, disposition string) {
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", disposition)
+	if err := doc.write(w); err != nil {
+		fmt.Println("Error writing PDF:", err)
+	}
+}
+
+// printCookbook lays out a title page, the table of contents and then the
+// recipes, each starting on a new page. Every page but the title page is
+// numbered, and the contents link to the recipes.
+func printCookbook(title string, recipes []Recipe) *pdfDocument {
+	doc := &pdfDocument{title: title}
+	printer := recipePrinter{doc: doc, scale: 1, images: map[int]*pdfImage{}}
+
+	cover := doc.addPage()
+	titleStyle := textStyle{fontBold, 32, 0}
+	y := 300.0
+	for _, line := range wrapText(titleStyle, title, printWidth) {
+		cover.text((pdfPageWidth-textWidth(titleStyle, line))/2, y, titleStyle, line)
+		y += 40
+	}
+	subtitleStyle := textStyle{fontRegular, 14, 0.4}
+	for _, line := range []string{fmt.Sprintf("%d recipes", len(recipes)), time.Now().Format("January 2006")} {
+		y += 10
+		cover.text((pdfPageWidth-textWidth(subtitleStyle, line))/2, y, subtitleStyle, line)
+		y += 14
+	}
+
+	contents := make([]*pdfPage, (len(recipes)+contentsPerPage-1)/contentsPerPage)
+	for i := range contents {
+		contents[i] = doc.addPage()
+		contents[i].text(printMargin, printMargin+24, textStyle{fontBold, 24, 0}, "Contents")
+	}
+
+	starts := make([]int, len(recipes))
+	for i, recipe := range recipes {
+		starts[i] = len(doc.pages)
+		printer.printRecipe(recipe)
+	}
+
+	entryStyle := textStyle{fontRegular, 12, 0}
+	for i, recipe := range recipes {
+		page := contents[i/contentsPerPage]
+		y := printMargin + 60 + float64(i%contentsPerPage)*contentsLineHeight
+		number := strconv.Itoa(starts[i] + 1)
+		numberWidth := textWidth(entryStyle, number)
+		page.text(printMargin, y, entryStyle, truncateText(entryStyle, recipe.Name, printWidth-numberWidth-24))
+		page.text(printMargin+printWidth-numberWidth, y, entryStyle, number)
+		page.link(printMargin, y-entryStyle.size, printWidth, contentsLineHeight, starts[i])
+	}
+
+	footerStyle := textStyle{fontRegular, 9, 0.5}
+	for i, page := range doc.pages[1:] {
+		number := strconv.Itoa(i + 2)
+		page.text((pdfPageWidth-textWidth(footerStyle, number))/2, pdfPageHeight-printMargin/2, footerStyle, number)
+	}
+
+	return doc
+}
+
+// printScales are tried in turn until a recipe printed on its own fits on
+// one page. A recipe too long even at the smallest runs over.
+var printScales = []float64{1, 0.9, 0.8, 0.7, 0.6, 0.5}
+
+// printRecipePDF lays the recipe out on one page, shrinking it to fit.
+func printRecipePDF(recipe Recipe) *pdfDocument {
+	images := map[int]*pdfImage{}
+	var doc *pdfDocument
+	for _, scale := range printScales {
+		doc = &pdfDocument{title: recipe.Name}
+		printer := recipePrinter{doc: doc, scale: scale, images: images}
+		printer.printRecipe(recipe)
+		if len(doc.pages) == 1 {
+			break
+		}
+	}
+	return doc
+}
+
+// recipePrinter lays recipes out from the top of a page down, starting a
+// new page when one fills up. scale shrinks text and images alike.
+type recipePrinter struct {
+	doc    *pdfDocument
+	page   *pdfPage
+	y      float64
+	scale  float64
+	images map[int]*pdfImage
+}
+
+func (p *recipePrinter) style(font pdfFont, size float64, gray float64) textStyle {
+	return textStyle{font, size * p.scale, gray}
+}
+
+func (p *recipePrinter) newPage() {
+	p.page = p.doc.addPage()
+	p.y = printMargin
+}
+
+// space starts a new page unless height still fits below the cursor.
+func (p *recipePrinter) space(height float64) {
+	if p.y+height > printBottom && p.y > printMargin {
+		p.newPage()
+	}
+}
+
+// lines writes text wrapped to the width left after indent. A marker such
+// as a bullet or step number goes in front of the first line.
+func (p *recipePrinter) lines(style textStyle, marker string, indent float64, text string) {
+	lineHeight := style.size * 1.35
+	for i, line := range wrapText(style, text, printWidth-indent) {
+		p.space(lineHeight)
+		if i == 0 && marker != "" {
+			p.page.text(printMargin, p.y+style.size, style, marker)
+		}
+		p.page.text(printMargin+indent, p.y+style.size, style, line)
+		p.y += lineHeight
+	}
+}
+
+// heading writes a heading with a rule under it, on the next page if the
+// first line below it would not fit.
+func (p *recipePrinter) heading(text string) {
+	style := p.style(fontBold, 14, 0)
+	p.y += 10 * p.scale
+	p.space(style.size*2 + 16*p.scale)
+	p.lines(style, "", 0, text)
+	p.page.line(printMargin, p.y, printMargin+printWidth, p.y, 0.5, 0.7)
+	p.y += 6 * p.scale
+}
+
+func (p *recipePrinter) printRecipe(recipe Recipe) {
+	p.newPage()
+	p.lines(p.style(fontBold, 24, 0), "", 0, recipe.Name)
+	if meta := recipeMeta(recipe); meta != "" {
+		p.lines(p.style(fontRegular, 11, 0.4), "", 0, meta)
+	}
+	p.y += 8 * p.scale
+
+	if img := p.recipeImage(recipe); img != nil {
+		width := printWidth
+		height := width * float64(img.height) / float64(img.width)
+		if maxHeight := 220 * p.scale; height > maxHeight {
+			height = maxHeight
+			width = height * float64(img.width) / float64(img.height)
+		}
+		p.space(height)
+		p.page.image(img, printMargin+(printWidth-width)/2, p.y, width, height)
+		p.y += height + 8*p.scale
+	}
+
+	body := p.style(fontRegular, 11, 0)
+	subheading := p.style(fontBold, 12, 0.2)
+	sections := recipeSections(recipe)
+
+	if len(recipe.Ingredients) > 0 {
+		p.heading("Ingredients")
+		for _, section := range sections {
+			if len(section.Ingredients) == 0 {
+				continue
+			}
+			if section.Title != "" {
+				p.y += 4 * p.scale
+				p.lines(subheading, "", 0, section.Title)
+			}
+			for _, ingredient := range section.Ingredients {
+				p.lines(body, "•", 12*p.scale, ingredientLine(ingredient))
+			}
+		}
+	}
+
+	if len(recipe.Methods) > 0 {
+		p.heading("Method")
+		step := 1
+		for _, section := range sections {
+			if len(section.Methods) == 0 {
+				continue
+			}
+			if section.Title != "" {
+				p.y += 4 * p.scale
+				p.lines(subheading, "", 0, section.Title)
+			}
+			for _, method := range section.Methods {
+				p.lines(body, fmt.Sprintf("%d.", step), 20*p.scale, method.Value)
+				p.y += 4 * p.scale
+				step++
+			}
+		}
+	}
+
+	if recipe.Url != "" {
+		p.y += 8 * p.scale
+		p.lines(p.style(fontItalic, 9, 0.4), "", 0, "Original recipe: "+recipe.Url)
+	}
+}
+
+// recipeImage prepares the image of the recipe once, however often the
+// recipe is laid out. An image that cannot be decoded is left out.
+func (p *recipePrinter) recipeImage(recipe Recipe) *pdfImage {
+	if img, ok := p.images[recipe.ID]; ok {
+		return img
+	}
+
+	var img *pdfImage
+	if recipe.Image != nil && recipe.Image.Url != "" {
+		if data, err := base64.StdEncoding.DecodeString(recipe.Image.Url); err == nil {
+			img, _ = newPdfImage(data)
+		}
+	}
+	p.images[recipe.ID] = img
+	return img
+}
+
+// recipeMeta is the line under the name of a printed recipe: its type, what
+// it makes and how long it takes.
+func recipeMeta(recipe Recipe) string {
+	var parts []string
+	if recipe.Type != "" {
+		parts = append(parts, recipe.Type)
+	}
+	if recipe.Portion != nil && recipe.Portion.Value > 0 {
+		parts = append(parts, strings.TrimSpace("Makes "+formatQuantity(recipe.Portion.Value)+" "+recipe.Portion.Measurement))
+	}
+	if recipe.Times.TotalTime > 0 {
+		parts = append(parts, fmt.Sprintf("Ready in %d min", recipe.Times.TotalTime))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// ingredientLine is an ingredient as it is printed, like "500 g flour".
+func ingredientLine(ingredient Ingredient) string {
+	var parts []string
+	if ingredient.Value != 0 {
+		parts = append(parts, formatQuantity(ingredient.Value))
+	}
+	for _, part := range []string{ingredient.Measurement, ingredient.Name} {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -5,4 +5,5 @@ go 1.23.4
 require (
 	github.com/gorilla/mux v1.8.1
 	github.com/mattn/go-sqlite3 v1.14.24
+	golang.org/x/crypto v0.32.0
 )
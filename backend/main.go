@@ -6,10 +6,12 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
@@ -27,20 +29,26 @@ type Portion struct {
 }
 
 type Ingredient struct {
-	ID          int     `json:"id"`
-	Name        string  `json:"name"`
-	Measurement string  `json:"measurement"`
-	Value       float32 `json:"value"`
-	RecipeID    int     `json:"recipe_id"`
-	SortOrder   int     `json:"sortOrder"`
+	ID          int        `json:"id"`
+	Name        string     `json:"name"`
+	Measurement string     `json:"measurement"`
+	Value       float32    `json:"value"`
+	RecipeID    int        `json:"recipe_id"`
+	SortOrder   int        `json:"sortOrder"`
+	SubRecipeID *int       `json:"sub_recipe_id,omitempty"`
+	DividerID   *int       `json:"divider_id,omitempty"`
+	CatalogID   *int       `json:"catalog_id,omitempty"`
+	SubRecipe   *SubRecipe `json:"sub_recipe,omitempty"`
 }
 
 type Method struct {
-	ID          int          `json:"id"`
-	Value       string       `json:"value"`
-	SortOrder   int          `json:"sortOrder"`
-	RecipeID    int          `json:"recipe_id"`
-	Ingredients []Ingredient `json:"ingredients,omitempty"`
+	ID          int              `json:"id"`
+	Value       string           `json:"value"`
+	SortOrder   int              `json:"sortOrder"`
+	RecipeID    int              `json:"recipe_id"`
+	Ingredients []Ingredient     `json:"ingredients,omitempty"`
+	Durations   []MethodDuration `json:"durations"`
+	DividerID   *int             `json:"divider_id,omitempty"`
 }
 
 type Image struct {
@@ -51,18 +59,30 @@ type Image struct {
 }
 
 type Recipe struct {
-	ID           int          `json:"id"`
-	Name         string       `json:"name"`
-	Portion      *Portion     `json:"portion"`
-	Image        *Image       `json:"image"`
-	Url          string       `json:"url"`
-	Ingredients  []Ingredient `json:"ingredients"`
-	Methods      []Method     `json:"methods"`
-	CreatedAt    string       `json:"createdAt"`
-	LastEditedAt string       `json:"lastEditedAt"`
-	Type         string       `json:"type"`
-	SortOrder    int          `json:"sortOrder"`
-	Dividers     []Divider    `json:"dividers"`
+	ID             int               `json:"id"`
+	Name           string            `json:"name"`
+	Portion        *Portion          `json:"portion"`
+	Image          *Image            `json:"image"`
+	Url            string            `json:"url"`
+	Ingredients    []Ingredient      `json:"ingredients"`
+	Methods        []Method          `json:"methods"`
+	CreatedAt      string            `json:"createdAt"`
+	LastEditedAt   string            `json:"lastEditedAt"`
+	Type           string            `json:"type"`
+	SortOrder      int               `json:"sortOrder"`
+	Dividers       []Divider         `json:"dividers"`
+	Sections       []RecipeSection   `json:"sections"`
+	Tags           []Tag             `json:"tags"`
+	Equipment      []RecipeEquipment `json:"equipment"`
+	Notes          []RecipeNote      `json:"notes"`
+	Allergens      *AllergenReport   `json:"allergens"`
+	Cooking        CookingStats      `json:"cooking"`
+	Times          RecipeTimes       `json:"times"`
+	Cost           RecipeCost        `json:"cost"`
+	OwnerID        int               `json:"owner_id"`
+	Version        int               `json:"version"`
+	ParentRecipeID *int              `json:"parent_recipe_id"`
+	Duplicates     []DuplicateMatch  `json:"duplicates,omitempty"`
 }
 
 type Divider struct {
@@ -77,13 +97,65 @@ type Divider struct {
 var recipes []Recipe
 var db *sql.DB
 
+// recipeColumns lists the recipes columns in the order scanRecipe reads them.
+const recipeColumns = "id, name, url, createdAt, lastEditedAt, type, sortOrder, COALESCE(owner_id, 0), version, parent_recipe_id"
+
+func scanRecipe(row interface{ Scan(...any) error }, recipe *Recipe) error {
+	return row.Scan(
+		&recipe.ID,
+		&recipe.Name,
+		&recipe.Url,
+		&recipe.CreatedAt,
+		&recipe.LastEditedAt,
+		&recipe.Type,
+		&recipe.SortOrder,
+		&recipe.OwnerID,
+		&recipe.Version,
+		&recipe.ParentRecipeID,
+	)
+}
+
+// errInvalidQuery marks errors caused by bad query parameters rather than the database.
+var errInvalidQuery = errors.New("invalid query")
+
 func getRecipes(w http.ResponseWriter, r *http.Request) {
-	queryParams := r.URL.Query()
+	recipes, err := listRecipes(currentUser(r).ID, r.URL.Query())
+	if errors.Is(err, errInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(recipes)
+}
+
+// recipeSortKeys maps the sortKey query parameter to the column it orders by.
+// Anything not listed here is rejected so it never reaches the SQL string.
+var recipeSortKeys = map[string]string{
+	"sortOrder":    "sortOrder",
+	"name":         "name",
+	"createdAt":    "createdAt",
+	"lastEditedAt": "lastEditedAt",
+	"type":         "type",
+	"portion":      "",
+	"lastCooked":   "(SELECT MAX(cookedAt) FROM cook_log WHERE cook_log.recipe_id = recipes.id)",
+	"timesCooked":  "(SELECT COUNT(*) FROM cook_log WHERE cook_log.recipe_id = recipes.id)",
+	"rating":       "(SELECT AVG(rating) FROM cook_log WHERE cook_log.recipe_id = recipes.id)",
+	"totalTime":    "(SELECT SUM(d.maxSeconds) FROM method_durations d JOIN methods m ON m.id = d.method_id WHERE m.recipe_id = recipes.id)",
+	"cost":         "",
+}
+
+// listRecipes returns the recipes of the owner matching the search, filter and
+// sort query parameters.
+func listRecipes(ownerId int, queryParams url.Values) ([]Recipe, error) {
 	searchString := queryParams.Get("search")
 	sortKey := queryParams.Get("sortKey")
 	sortDirection := queryParams.Get("sortDirection")
 
-	if sortDirection == "" {
+	if strings.ToUpper(sortDirection) != "ASC" {
 		sortDirection = "DESC"
 	}
 
@@ -91,65 +163,121 @@ func getRecipes(w http.ResponseWriter, r *http.Request) {
 		sortKey = "sortOrder"
 	}
 
-	var rows *sql.Rows
-	var err error
-	query := "SELECT * FROM recipes"
+	sortColumn, ok := recipeSortKeys[sortKey]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown sortKey %q", errInvalidQuery, sortKey)
+	}
+
+	tagFilter, err := parseTagExpression(queryParams.Get("tags"))
+	if err != nil {
+		return nil, err
+	}
+	allergenFilter, err := parseAllergenFilter(queryParams)
+	if err != nil {
+		return nil, err
+	}
+	collectionId, err := collectionRecipeFilter(ownerId, queryParams.Get("collection"))
+	if err != nil {
+		return nil, err
+	}
+	maxTotalTime, err := parseMaxTotalTime(queryParams.Get("maxTotalTime"))
+	if err != nil {
+		return nil, err
+	}
+	maxCostPerServing, err := parseMaxCostPerServing(queryParams.Get("maxCostPerServing"))
+	if err != nil {
+		return nil, err
+	}
+
+	args := []any{ownerId}
+	query := "SELECT " + recipeColumns + " FROM recipes WHERE owner_id = ?"
 
 	if searchString != "" {
-		searchPattern := "%" + searchString + "%"
-		query += fmt.Sprintf(" WHERE recipes.name LIKE '%s'", searchPattern)
+		query += " AND recipes.name LIKE ?"
+		args = append(args, "%"+searchString+"%")
 	}
 
-	if sortKey != "" && sortKey != "portion" {
-		query += fmt.Sprintf(" ORDER BY %s %s", sortKey, sortDirection)
+	if collectionId != 0 {
+		query += " AND recipes.id IN (SELECT recipe_id FROM collection_recipes WHERE collection_id = ?)"
+		args = append(args, collectionId)
+
+		// within a collection sortOrder is the position in the collection
+		if sortKey == "sortOrder" {
+			sortColumn = fmt.Sprintf("(SELECT sortOrder FROM collection_recipes WHERE collection_id = %d AND recipe_id = recipes.id)", collectionId)
+		}
 	}
 
-	rows, err = db.Query(query)
+	if sortColumn != "" {
+		query += fmt.Sprintf(" ORDER BY %s %s NULLS LAST", sortColumn, sortDirection)
+	}
 
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
 	var recipes []Recipe
 
+	// the filters below look at all the ingredients of a recipe, not only
+	// those the search returned
+	allIngredients := map[int][]Ingredient{}
+	book := loadPriceBook(ownerId)
+
 	for rows.Next() {
 		var recipe Recipe
 		recipe.Ingredients = []Ingredient{}
 		recipe.Methods = []Method{}
 
 		// Scan the current row
-		rows.Scan(
-			&recipe.ID,
-			&recipe.Name,
-			&recipe.Url,
-			&recipe.CreatedAt,
-			&recipe.LastEditedAt,
-			&recipe.Type,
-			&recipe.SortOrder,
-		)
+		scanRecipe(rows, &recipe)
 
 		recipe.Ingredients = getRecipeIngredients(recipe.ID, searchString)
+		allIngredients[recipe.ID] = recipe.Ingredients
+		if searchString != "" {
+			allIngredients[recipe.ID] = getRecipeIngredients(recipe.ID, "")
+		}
+		recipe.Allergens = classifyRecipe(recipe.ID, allIngredients[recipe.ID])
 		recipe.Methods = getRecipeMethods(recipe.ID)
+		recipe.Times = recipeTimes(recipe.Methods)
 		recipe.Portion = getRecipePortion(recipe.ID)
 		recipe.Image = getRecipeImage(recipe.ID)
 		recipe.Dividers = getRecipeDividers(recipe.ID)
+		recipe.Sections = recipeSections(recipe)
+		recipe.Tags = getRecipeTags(recipe.ID)
+		recipe.Equipment = getRecipeEquipment(recipe.ID)
+		recipe.Notes = getRecipeNotes(recipe.ID)
+		recipe.Cooking = getCookingStats(recipe.ID)
+		priced := recipe
+		priced.Ingredients = allIngredients[recipe.ID]
+		recipe.Cost = estimateCost(book, priced).summary()
 
 		recipes = append(recipes, recipe)
 	}
+
+	expand := queryParams.Get("expand") == "true"
 	ingredientNamesString := queryParams.Get("ingredientNames")
-	if ingredientNamesString != "" {
+	if ingredientNamesString != "" && !expand {
 		ingredientNames := strings.Split(ingredientNamesString, ",")
 		lowerIngredientNames := make([]string, len(ingredientNames))
+		// the names /api/v1/ingredients returns are those of catalogue entries,
+		// which also match the ingredients stored under one of their aliases
+		catalogIds := map[int]bool{}
 		for i, name := range ingredientNames {
 			lowerIngredientNames[i] = strings.ToLower(name)
+			if catalogId, err := resolveCatalogId(name); err == nil && catalogId != 0 {
+				catalogIds[catalogId] = true
+			}
 		}
 
 		var filteredRecieps []Recipe
 	outerLoop:
 		for _, recipe := range recipes {
 			for _, ingredient := range recipe.Ingredients {
+				if ingredient.CatalogID != nil && catalogIds[*ingredient.CatalogID] {
+					filteredRecieps = append(filteredRecieps, recipe)
+					continue outerLoop
+				}
 				lowerValue := strings.ToLower(ingredient.Name)
 				for _, v := range lowerIngredientNames {
 					if v == lowerValue {
@@ -159,18 +287,50 @@ func getRecipes(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		}
-		if sortKey == "portion" {
-			json.NewEncoder(w).Encode(sortRecipesByPortion(filteredRecieps, sortDirection))
-			return
-		}
-		json.NewEncoder(w).Encode(filteredRecieps)
-	} else {
-		if sortKey == "portion" {
-			json.NewEncoder(w).Encode(sortRecipesByPortion(recipes, sortDirection))
-			return
+		recipes = filteredRecieps
+	}
+
+	// ingredient matches whole words of the ingredient names, and with
+	// expand=true also everything below the term in the ingredient taxonomy
+	ingredientTerms := splitIngredientTerms(queryParams.Get("ingredient"))
+	if expand {
+		ingredientTerms = append(ingredientTerms, splitIngredientTerms(ingredientNamesString)...)
+	}
+	if len(ingredientTerms) > 0 {
+		if expand {
+			ingredientTerms = expandIngredientTerms(ingredientTerms)
 		}
-		json.NewEncoder(w).Encode(recipes)
+		recipes = filterRecipesByIngredientTerms(recipes, allIngredients, ingredientTerms)
+	}
+
+	if tagFilter != nil {
+		recipes = filterRecipesByTags(recipes, tagFilter)
+	}
+
+	if allergenFilter != nil {
+		recipes = filterRecipesByAllergens(recipes, allergenFilter)
 	}
+
+	if maxTotalTime > 0 {
+		recipes = filterRecipesByTotalTime(recipes, maxTotalTime)
+	}
+
+	if maxCostPerServing > 0 {
+		recipes = filterRecipesByCost(recipes, maxCostPerServing)
+	}
+
+	if queryParams.Has("hasEquipment") {
+		recipes = filterRecipesByEquipment(recipes, splitIngredientTerms(queryParams.Get("hasEquipment")))
+	}
+
+	if sortKey == "portion" {
+		recipes = sortRecipesByPortion(recipes, strings.ToLower(sortDirection))
+	}
+	if sortKey == "cost" {
+		recipes = sortRecipesByCost(recipes, strings.ToLower(sortDirection))
+	}
+
+	return recipes, nil
 }
 
 func sortRecipesByPortion(recipes []Recipe, sortDirection string) []Recipe {
@@ -204,31 +364,47 @@ func getRecipe(w http.ResponseWriter, r *http.Request) {
 
 	id, _ := strconv.Atoi(idStr)
 
-	json.NewEncoder(w).Encode(getRecipeById(id))
+	recipe := getOwnedRecipe(id, currentUser(r).ID)
+	if r.URL.Query().Get("expand") == "true" {
+		expandRecipe(&recipe)
+	}
+	json.NewEncoder(w).Encode(recipe)
+}
+
+// getOwnedRecipe behaves like getRecipeById but returns an empty recipe when
+// the recipe belongs to someone else.
+func getOwnedRecipe(id int, ownerId int) Recipe {
+	recipe := getRecipeById(id)
+	if recipe.OwnerID != ownerId {
+		return Recipe{}
+	}
+	return recipe
 }
 
 func getRecipeById(id int) Recipe {
 	row := db.QueryRow(`
-		SELECT * FROM recipes WHERE id = ?
+		SELECT `+recipeColumns+` FROM recipes WHERE id = ?
 	`, id)
 
 	var recipe Recipe
 
-	row.Scan(
-		&recipe.ID,
-		&recipe.Name,
-		&recipe.Url,
-		&recipe.CreatedAt,
-		&recipe.LastEditedAt,
-		&recipe.Type,
-		&recipe.SortOrder,
-	)
+	if scanRecipe(row, &recipe) != nil {
+		return Recipe{}
+	}
 
 	recipe.Ingredients = getRecipeIngredients(id, "")
 	recipe.Methods = getRecipeMethods(id)
+	recipe.Times = recipeTimes(recipe.Methods)
 	recipe.Portion = getRecipePortion(id)
 	recipe.Image = getRecipeImage(id)
 	recipe.Dividers = getRecipeDividers(id)
+	recipe.Sections = recipeSections(recipe)
+	recipe.Tags = getRecipeTags(id)
+	recipe.Equipment = getRecipeEquipment(id)
+	recipe.Notes = getRecipeNotes(id)
+	recipe.Cooking = getCookingStats(id)
+	recipe.Allergens = classifyRecipe(id, recipe.Ingredients)
+	recipe.Cost = estimateCost(loadPriceBook(recipe.OwnerID), recipe).summary()
 
 	return recipe
 }
@@ -237,7 +413,17 @@ func createRecipe(w http.ResponseWriter, r *http.Request) {
 	var recipe Recipe
 	json.NewDecoder(r.Body).Decode(&recipe)
 
-	existingRecipes := getAllRecipes()
+	recipeId, err := insertRecipe(db, currentUser(r).ID, recipe)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	publishRecipeEvent(recipeId, eventRecipeCreated)
+	json.NewEncoder(w).Encode(withDuplicates(recipeId))
+}
+
+func insertRecipe(q dbtx, ownerId int, recipe Recipe) (int, error) {
+	existingRecipes := getAllRecipes(ownerId)
 
 	sortOrder := max(1+len(existingRecipes), 1)
 	var name = ""
@@ -255,22 +441,15 @@ func createRecipe(w http.ResponseWriter, r *http.Request) {
 		recipeType = recipe.Type
 	}
 
-	stmt, err := db.Prepare(`
-		INSERT INTO recipes(name, url, createdAt, lastEditedAt,  type, sortOrder) VALUES(?,?,?,?,?,?)
-	`)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
 	now := time.Now()
-	result, err := stmt.Exec(name, url, now.Format("2006-01-02 15:04:05"), now.Format("2006-01-02 15:04:05"), recipeType, sortOrder)
+	result, err := q.Exec(`
+		INSERT INTO recipes(name, url, createdAt, lastEditedAt,  type, sortOrder, owner_id) VALUES(?,?,?,?,?,?,?)
+	`, name, url, now.Format("2006-01-02 15:04:05"), now.Format("2006-01-02 15:04:05"), recipeType, sortOrder, ownerId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return 0, err
 	}
 	recipeId, _ := result.LastInsertId()
-	json.NewEncoder(w).Encode(getRecipeById(int(recipeId)))
+	return int(recipeId), syncCourseTag(q, int(recipeId), ownerId, "", recipeType)
 }
 
 func updateRecipe(w http.ResponseWriter, r *http.Request) {
@@ -283,22 +462,55 @@ func updateRecipe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if getOwnedRecipe(id, currentUser(r).ID).ID == 0 {
+		http.Error(w, "Recipe not found", http.StatusNotFound)
+		return
+	}
+
 	var recipe Recipe
 	json.NewDecoder(r.Body).Decode(&recipe)
-	stmt, err := db.Prepare(`
-		UPDATE recipes
-		SET name = ?,
-			url = ?,
-			lastEditedAt = ?,
-			type = ?
-		WHERE id = ?
-	`)
+
+	err = saveRecipeDetails(db, id, recipe)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	publishRecipeEvent(id, eventRecipeUpdated)
+
+	recipe.Ingredients = getRecipeIngredients(id, "")
+	recipe.Methods = getRecipeMethods(id)
+	recipe.Times = recipeTimes(recipe.Methods)
+	recipe.Portion = getRecipePortion(id)
+	recipe.Image = getRecipeImage(id)
+	recipe.Dividers = getRecipeDividers(id)
+	recipe.Sections = recipeSections(recipe)
+	recipe.Tags = getRecipeTags(id)
+	recipe.Equipment = getRecipeEquipment(id)
+	recipe.Notes = getRecipeNotes(id)
+	recipe.Cooking = getCookingStats(id)
+	recipe.Allergens = classifyRecipe(id, recipe.Ingredients)
+	recipe.Cost = estimateCost(loadPriceBook(currentUser(r).ID), recipe).summary()
+
+	json.NewEncoder(w).Encode(recipe)
+}
+
+func saveRecipeDetails(q dbtx, id int, recipe Recipe) error {
+	var oldType string
+	var ownerId int
+	err := q.QueryRow("SELECT type, COALESCE(owner_id, 0) FROM recipes WHERE id = ?", id).Scan(&oldType, &ownerId)
+	if err != nil {
+		return err
+	}
 
-	_, err = stmt.Exec(
+	_, err = q.Exec(`
+		UPDATE recipes
+		SET name = ?,
+			url = ?,
+			lastEditedAt = ?,
+			type = ?,
+			version = version + 1
+		WHERE id = ?
+	`,
 		recipe.Name,
 		recipe.Url,
 		time.Now().Format("2006-01-02 15:04:05"),
@@ -306,28 +518,57 @@ func updateRecipe(w http.ResponseWriter, r *http.Request) {
 		id,
 	)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	recipe.Ingredients = getRecipeIngredients(id, "")
-	recipe.Methods = getRecipeMethods(id)
-	recipe.Portion = getRecipePortion(id)
-	recipe.Image = getRecipeImage(id)
-	recipe.Dividers = getRecipeDividers(id)
+	return syncCourseTag(q, id, ownerId, oldType, recipe.Type)
+}
 
-	json.NewEncoder(w).Encode(recipe)
+// ownsRecipeChild reports whether the row of a recipe child table belongs to a
+// recipe of the owner.
+func ownsRecipeChild(table string, id int, ownerId int) bool {
+	var exists int
+	err := db.QueryRow(fmt.Sprintf(`
+		SELECT 1 FROM %s t
+		JOIN recipes r ON r.id = t.recipe_id
+		WHERE t.id = ? AND r.owner_id = ?
+	`, table), id, ownerId).Scan(&exists)
+	return err == nil
+}
+
+// recipeChildRecipeId returns the recipe the row of a recipe child table
+// belongs to.
+func recipeChildRecipeId(table string, id int) int {
+	var recipeId int
+	db.QueryRow(fmt.Sprintf("SELECT recipe_id FROM %s WHERE id = ?", table), id).Scan(&recipeId)
+	return recipeId
 }
 
 func updateRecipeLastEdited(recipeId int) {
 	_, err := db.Exec(`
-		UPDATE recipes SET lastEditedAt = ? WHERE id = ?
+		UPDATE recipes SET lastEditedAt = ?, version = version + 1 WHERE id = ?
 	`, time.Now().Format("2006-01-02 15:04:05"), recipeId)
 	if err != nil {
 		fmt.Println(err.Error())
 	}
 }
 
+// recipeSaved brings what is derived from the ingredients and methods of the
+// recipe up to date after they were saved: the links of the ingredients to
+// the catalogue, the equipment detected in the methods and the rows notes are
+// pinned to.
+func recipeSaved(recipeId int) {
+	if err := linkRecipeIngredients(recipeId); err != nil {
+		fmt.Println("Error linking ingredients:", err)
+	}
+	if err := detectRecipeEquipment(recipeId); err != nil {
+		fmt.Println("Error detecting equipment:", err)
+	}
+	if err := reattachRecipeNotes(recipeId); err != nil {
+		fmt.Println("Error reattaching notes:", err)
+	}
+}
+
 func deleteRecipe(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	idStr, ok := params["id"]
@@ -342,13 +583,15 @@ func deleteRecipe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stmt, err := db.Prepare("DELETE FROM recipes WHERE id = ?")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if getOwnedRecipe(id, currentUser(r).ID).ID == 0 {
+		http.Error(w, "Recipe not found", http.StatusNotFound)
+		return
+	}
+	if !checkRecipeReferences(w, r, id) {
 		return
 	}
 
-	_, err = stmt.Exec(id)
+	err = removeRecipe(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -357,35 +600,132 @@ func deleteRecipe(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(recipes)
 }
 
+// removeRecipe deletes the recipe and what belongs to it, then tells the
+// devices of the owner and of cooking sessions of it.
+func removeRecipe(id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	notify, err := removeRecipeTx(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	notify()
+	return nil
+}
+
+// recipeDeletes remove a recipe and every row that belongs to it, children
+// before parents. Foreign keys are not enforced, so nothing cascades. Recipes
+// using it as an ingredient keep the ingredient, unlinked.
+var recipeDeletes = []string{
+	"DELETE FROM method_ingredients WHERE method_id IN (SELECT id FROM methods WHERE recipe_id = ?)",
+	"DELETE FROM method_durations WHERE method_id IN (SELECT id FROM methods WHERE recipe_id = ?)",
+	"DELETE FROM divider_methods WHERE method_id IN (SELECT id FROM methods WHERE recipe_id = ?)",
+	"DELETE FROM divider_methods WHERE divider_id IN (SELECT id FROM dividers WHERE recipe_id = ?)",
+	"DELETE FROM divider_ingredients WHERE ingredient_id IN (SELECT id FROM ingredients WHERE recipe_id = ?)",
+	"DELETE FROM divider_ingredients WHERE divider_id IN (SELECT id FROM dividers WHERE recipe_id = ?)",
+	"DELETE FROM ingredient_catalog_links WHERE ingredient_id IN (SELECT id FROM ingredients WHERE recipe_id = ?)",
+	"DELETE FROM ingredient_recipes WHERE ingredient_id IN (SELECT id FROM ingredients WHERE recipe_id = ?)",
+	"DELETE FROM ingredient_recipes WHERE recipe_id = ?",
+	"DELETE FROM recipe_tags WHERE recipe_id = ?",
+	"DELETE FROM recipe_allergen_overrides WHERE recipe_id = ?",
+	"DELETE FROM collection_recipes WHERE recipe_id = ?",
+	"DELETE FROM recipe_equipment WHERE recipe_id = ?",
+	"DELETE FROM recipe_notes WHERE recipe_id = ?",
+	"DELETE FROM shares WHERE recipe_id = ?",
+	"DELETE FROM portions WHERE recipe_id = ?",
+	"DELETE FROM images WHERE recipe_id = ?",
+	"DELETE FROM dividers WHERE recipe_id = ?",
+	"DELETE FROM methods WHERE recipe_id = ?",
+	"DELETE FROM ingredients WHERE recipe_id = ?",
+	"DELETE FROM recipes WHERE id = ?",
+}
+
+// removeRecipeTx deletes the recipe within tx. The returned notify publishes
+// the deletion and is to be called once tx is committed.
+func removeRecipeTx(tx *sql.Tx, id int) (notify func(), err error) {
+	var ownerId, version int
+	err = tx.QueryRow("SELECT COALESCE(owner_id, 0), version FROM recipes WHERE id = ?", id).Scan(&ownerId, &version)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, statement := range recipeDeletes {
+		if _, err := tx.Exec(statement, id); err != nil {
+			return nil, err
+		}
+	}
+	// variants stay, no longer tied to the deleted original
+	if _, err := tx.Exec("UPDATE recipes SET parent_recipe_id = NULL WHERE parent_recipe_id = ?", id); err != nil {
+		return nil, err
+	}
+	if err := removeCookLogTx(tx, "recipe_id", id); err != nil {
+		return nil, err
+	}
+	sessions, err := removeCookingSessionsTx(tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		for i := range sessions {
+			notifyCookingSession(&sessions[i])
+		}
+		publishEvent(Event{Type: eventRecipeDeleted, RecipeID: id, Version: version + 1, ownerId: ownerId})
+	}, nil
+}
+
 func reorderRecipes(w http.ResponseWriter, r *http.Request) {
 	var passedRecipes []Recipe
 	json.NewDecoder(r.Body).Decode(&passedRecipes)
 
-	var existingRecipes = getAllRecipes()
+	err := saveRecipeOrder(currentUser(r).ID, passedRecipes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(getAllRecipes(currentUser(r).ID))
+}
+
+// saveRecipeOrder sets sortOrder of each passed recipe to its position in the list.
+// Only the recipes that moved get a new version.
+func saveRecipeOrder(ownerId int, passedRecipes []Recipe) error {
+	var existingRecipes = getAllRecipes(ownerId)
 
 	if existingRecipes != nil {
 		for passedRecipeIndex, passedRecipe := range passedRecipes {
 			for _, existingRecipe := range existingRecipes {
 				if passedRecipe.ID == existingRecipe.ID {
 					sortOrder := passedRecipeIndex + 1
+					if sortOrder == existingRecipe.SortOrder {
+						break
+					}
 
-					_, err := db.Exec("UPDATE recipes SET sortOrder = ? WHERE id = ?", sortOrder, passedRecipe.ID)
+					_, err := db.Exec("UPDATE recipes SET sortOrder = ?, version = version + 1 WHERE id = ?", sortOrder, passedRecipe.ID)
 					if err != nil {
 						fmt.Println("Error updating recipe:", err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
+						return err
 					}
+					publishRecipeEvent(passedRecipe.ID, eventRecipeReordered)
 					break
 				}
 			}
 		}
 	}
 
-	json.NewEncoder(w).Encode(getAllRecipes())
+	return nil
 }
 
-func getAllRecipes() []Recipe {
-	rows, err := db.Query("SELECT * FROM recipes")
+func getAllRecipes(ownerId int) []Recipe {
+	rows, err := db.Query("SELECT "+recipeColumns+" FROM recipes WHERE owner_id = ?", ownerId)
 
 	if err != nil {
 		return nil
@@ -393,27 +733,28 @@ func getAllRecipes() []Recipe {
 
 	defer rows.Close()
 
+	book := loadPriceBook(ownerId)
 	var recipes []Recipe
 	for rows.Next() {
 		var recipe Recipe
 		recipe.Ingredients = []Ingredient{}
 		recipe.Methods = []Method{}
 
-		rows.Scan(
-			&recipe.ID,
-			&recipe.Name,
-			&recipe.Url,
-			&recipe.CreatedAt,
-			&recipe.LastEditedAt,
-			&recipe.Type,
-			&recipe.SortOrder,
-		)
+		scanRecipe(rows, &recipe)
 
 		recipe.Ingredients = getRecipeIngredients(recipe.ID, "")
 		recipe.Methods = getRecipeMethods(recipe.ID)
+		recipe.Times = recipeTimes(recipe.Methods)
 		recipe.Portion = getRecipePortion(recipe.ID)
 		recipe.Image = getRecipeImage(recipe.ID)
 		recipe.Dividers = getRecipeDividers(recipe.ID)
+		recipe.Sections = recipeSections(recipe)
+		recipe.Tags = getRecipeTags(recipe.ID)
+		recipe.Equipment = getRecipeEquipment(recipe.ID)
+		recipe.Notes = getRecipeNotes(recipe.ID)
+		recipe.Cooking = getCookingStats(recipe.ID)
+		recipe.Allergens = classifyRecipe(recipe.ID, recipe.Ingredients)
+		recipe.Cost = estimateCost(book, recipe).summary()
 
 		recipes = append(recipes, recipe)
 	}
@@ -451,7 +792,7 @@ func addPortion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	recipe := getRecipeById(recipeId)
+	recipe := getOwnedRecipe(recipeId, currentUser(r).ID)
 
 	if recipe.ID == 0 {
 		json.NewEncoder(w).Encode(nil)
@@ -461,29 +802,31 @@ func addPortion(w http.ResponseWriter, r *http.Request) {
 	var portion Portion
 	json.NewDecoder(r.Body).Decode(&portion)
 
+	err = savePortion(recipeId, portion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeChanged(recipeId, eventPortionUpdated)
+
+	json.NewEncoder(w).Encode(getRecipeById(recipeId))
+}
+
+func savePortion(recipeId int, portion Portion) error {
 	recipePortion := getRecipePortion(recipeId)
 
 	if recipePortion == nil {
 		_, err := db.Exec(`
 			INSERT INTO portions(value, measurement, recipe_id) VALUES(?,?,?)
 		`, portion.Value, portion.Measurement, recipeId)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	} else {
-		_, err := db.Exec(`
-			UPDATE portions SET value = ?, measurement = ? WHERE recipe_id = ?
-		`, portion.Value, portion.Measurement, recipeId)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		return err
 	}
 
-	updateRecipeLastEdited(recipeId)
-
-	json.NewEncoder(w).Encode(getRecipeById(recipeId))
+	_, err := db.Exec(`
+		UPDATE portions SET value = ?, measurement = ? WHERE recipe_id = ?
+	`, portion.Value, portion.Measurement, recipeId)
+	return err
 }
 
 func deletePortion(w http.ResponseWriter, r *http.Request) {
@@ -500,6 +843,12 @@ func deletePortion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !ownsRecipeChild("portions", id, currentUser(r).ID) {
+		http.Error(w, "Portion not found", http.StatusNotFound)
+		return
+	}
+	recipeId := recipeChildRecipeId("portions", id)
+
 	stmt, err := db.Prepare("DELETE FROM portions WHERE id = ?")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -511,12 +860,15 @@ func deletePortion(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	recipeChanged(recipeId, eventPortionDeleted)
 }
 
 func getPortions(w http.ResponseWriter, r *http.Request) {
 	rows, err := db.Query(`
-		SELECT * FROM portions
-	`)
+		SELECT p.* FROM portions p
+		JOIN recipes r ON r.id = p.recipe_id
+		WHERE r.owner_id = ?
+	`, currentUser(r).ID)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -539,10 +891,15 @@ func getPortions(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(portions)
 }
 
-func getIngredients(w http.ResponseWriter, r *http.Request) {
+// getLegacyIngredients lists every ingredient of the user's recipes, in the
+// shape the pre-v1 apps decode. /api/v1/ingredients lists catalogue entries
+// instead.
+func getLegacyIngredients(w http.ResponseWriter, r *http.Request) {
 	rows, err := db.Query(`
-		SELECT * FROM ingredients
-	`)
+		SELECT i.* FROM ingredients i
+		JOIN recipes r ON r.id = i.recipe_id
+		WHERE r.owner_id = ?
+	`, currentUser(r).ID)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -564,6 +921,46 @@ func getIngredients(w http.ResponseWriter, r *http.Request) {
 		ingredients = append(ingredients, ingredient)
 	}
 
+	queryParams := r.URL.Query()
+	if terms := splitIngredientTerms(queryParams.Get("ingredient")); len(terms) > 0 {
+		if queryParams.Get("expand") == "true" {
+			terms = expandIngredientTerms(terms)
+		}
+
+		var filtered []Ingredient
+		for _, ingredient := range ingredients {
+			name := normalizeIngredientName(ingredient.Name)
+			for _, term := range terms {
+				if nameContainsTerm(name, term) {
+					filtered = append(filtered, ingredient)
+					break
+				}
+			}
+		}
+		ingredients = filtered
+	}
+
+	// grouped=true returns the distinct names filed under the taxonomy tree
+	if queryParams.Get("grouped") == "true" {
+		seen := map[string]bool{}
+		var names []string
+		for _, ingredient := range ingredients {
+			key := normalizeIngredientName(ingredient.Name)
+			if key != "" && !seen[key] {
+				seen[key] = true
+				names = append(names, ingredient.Name)
+			}
+		}
+
+		tree, err := groupIngredientNames(names)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(tree)
+		return
+	}
+
 	json.NewEncoder(w).Encode(ingredients)
 }
 
@@ -606,10 +1003,19 @@ func getRecipeIngredients(recipeId int, searchString string) []Ingredient {
 
 		ingredients = append(ingredients, ingredient)
 	}
+	loadIngredientLinks(ingredients)
 
 	return ingredients
 }
 
+// loadIngredientLinks fills in the sub-recipe, divider and catalogue entry of
+// the ingredients, which live in tables of their own.
+func loadIngredientLinks(ingredients []Ingredient) {
+	loadSubRecipeIds(ingredients)
+	loadIngredientDividers(ingredients)
+	loadIngredientCatalogIds(ingredients)
+}
+
 func addIngredients(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	idStr := params["recipe_id"]
@@ -620,40 +1026,79 @@ func addIngredients(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	recipe := getRecipeById(recipeId)
+	recipe := getOwnedRecipe(recipeId, currentUser(r).ID)
 	if recipe.ID == 0 {
 		json.NewEncoder(w).Encode(nil)
 		return
 	}
 
-	var existingIngredients = getRecipeIngredients(recipeId, "")
 	var passedIngredients []Ingredient
 	json.NewDecoder(r.Body).Decode(&passedIngredients)
+	if !checkIngredientLinks(w, recipe, passedIngredients) {
+		return
+	}
+
+	err = saveIngredients(recipeId, passedIngredients)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeSaved(recipeId)
+	recipeChanged(recipeId, eventIngredientCreated)
+
+	json.NewEncoder(w).Encode(getRecipeById(recipeId))
+}
+
+// saveIngredients replaces the ingredient list of a recipe in one
+// transaction: passed ingredients are updated or inserted in the given order
+// and any others are removed. The sub-recipe, divider and catalogue entry of
+// an ingredient are set when passed, 0 unlinking them, and otherwise left as
+// they are; checkIngredientLinks validates them first.
+func saveIngredients(recipeId int, passedIngredients []Ingredient) error {
+	var existingIngredients = getRecipeIngredients(recipeId, "")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := saveIngredientsTx(tx, recipeId, passedIngredients, existingIngredients); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
 
+func saveIngredientsTx(tx *sql.Tx, recipeId int, passedIngredients []Ingredient, existingIngredients []Ingredient) error {
 	for passedIngredientIndex, passedIngredient := range passedIngredients {
-		found := false
+		var found *Ingredient
 		for _, existingIngredient := range existingIngredients {
 			if passedIngredient.ID == existingIngredient.ID {
 				sortOrder := passedIngredientIndex + 1
 
-				_, err := db.Exec("UPDATE ingredients SET name = ?, measurement = ?, value = ?, sortOrder = ? WHERE id = ?", passedIngredient.Name, passedIngredient.Measurement, passedIngredient.Value, sortOrder, passedIngredient.ID)
+				_, err := tx.Exec("UPDATE ingredients SET name = ?, measurement = ?, value = ?, sortOrder = ? WHERE id = ?", passedIngredient.Name, passedIngredient.Measurement, passedIngredient.Value, sortOrder, passedIngredient.ID)
 				if err != nil {
 					fmt.Println("Error updating ingredient:", err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
+					return err
 				}
-				found = true
+				found = &existingIngredient
 				break
 			}
 		}
-		if !found {
+		if found == nil {
 			sortOrder := passedIngredientIndex + 1 + len(existingIngredients)
-			_, err := db.Exec("INSERT INTO ingredients(name, measurement, value, sortOrder, recipe_id) VALUES(?,?,?,?,?)", passedIngredient.Name, passedIngredient.Measurement, passedIngredient.Value, sortOrder, recipeId)
+			result, err := tx.Exec("INSERT INTO ingredients(name, measurement, value, sortOrder, recipe_id) VALUES(?,?,?,?,?)", passedIngredient.Name, passedIngredient.Measurement, passedIngredient.Value, sortOrder, recipeId)
 			if err != nil {
 				fmt.Println("Error inserting ingredient:", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return err
 			}
+			id, _ := result.LastInsertId()
+			passedIngredient.ID = int(id)
+		}
+
+		passedIngredient.RecipeID = recipeId
+		if err := setIngredientLinks(tx, passedIngredient, found); err != nil {
+			return err
 		}
 	}
 
@@ -672,17 +1117,71 @@ func addIngredients(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(deleteIds) > 0 {
-		query := fmt.Sprintf("DELETE FROM ingredients WHERE id IN (%s)", strings.Join(deleteIds, ", "))
+		for _, table := range []string{"ingredients WHERE id", "ingredient_recipes WHERE ingredient_id", "divider_ingredients WHERE ingredient_id", "ingredient_catalog_links WHERE ingredient_id"} {
+			query := fmt.Sprintf("DELETE FROM %s IN (%s)", table, strings.Join(deleteIds, ", "))
 
-		_, err = db.Exec(query)
-		if err != nil {
-			fmt.Println("Error executing query:", err)
+			if _, err := tx.Exec(query); err != nil {
+				fmt.Println("Error executing query:", err)
+				return err
+			}
 		}
 	}
 
-	updateRecipeLastEdited(recipeId)
+	return nil
+}
 
-	json.NewEncoder(w).Encode(getRecipeById(recipeId))
+// setIngredientLinks sets the sub-recipe, divider and catalogue entry the
+// ingredient carries, and leaves alone those it does not or that are the same
+// as on the existing ingredient, so sending back a list as it was loaded
+// keeps an automatic catalogue link automatic.
+func setIngredientLinks(tx *sql.Tx, ingredient Ingredient, existing *Ingredient) error {
+	var current Ingredient
+	if existing != nil {
+		current = *existing
+	}
+
+	if changesLink(ingredient.SubRecipeID, current.SubRecipeID) {
+		if err := linkSubRecipe(tx, ingredient.ID, *ingredient.SubRecipeID); err != nil {
+			return err
+		}
+	}
+	if changesLink(ingredient.DividerID, current.DividerID) {
+		if err := ingredientSections.move(tx, ingredient.ID, *ingredient.DividerID); err != nil {
+			return err
+		}
+	}
+	if changesLink(ingredient.CatalogID, current.CatalogID) {
+		if err := setIngredientCatalog(tx, ingredient, *ingredient.CatalogID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changesLink reports whether a passed link id is set and differs from the
+// current one.
+func changesLink(passed *int, current *int) bool {
+	return passed != nil && (current == nil || *current != *passed)
+}
+
+// checkIngredientLinks writes an error response unless the sub-recipe,
+// divider and catalogue entry of every ingredient can be set on the recipe.
+func checkIngredientLinks(w http.ResponseWriter, recipe Recipe, ingredients []Ingredient) bool {
+	for _, ingredient := range ingredients {
+		if ingredient.SubRecipeID != nil {
+			if err := validateSubRecipe(recipe.ID, recipe.OwnerID, *ingredient.SubRecipeID); err != nil {
+				http.Error(w, err.Error(), subRecipeErrorStatus(err))
+				return false
+			}
+		}
+		if ingredient.DividerID != nil && !checkRecipeDivider(w, recipe, *ingredient.DividerID) {
+			return false
+		}
+		if ingredient.CatalogID != nil && !checkCatalogEntry(w, *ingredient.CatalogID) {
+			return false
+		}
+	}
+	return true
 }
 
 func addIngredient(w http.ResponseWriter, r *http.Request) {
@@ -695,16 +1194,31 @@ func addIngredient(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	recipe := getRecipeById(recipeId)
+	recipe := getOwnedRecipe(recipeId, currentUser(r).ID)
 	if recipe.ID == 0 {
 		json.NewEncoder(w).Encode(nil)
 		return
 	}
 
-	var existingIngredients = getRecipeIngredients(recipeId, "")
 	var passedIngredient Ingredient
 	json.NewDecoder(r.Body).Decode(&passedIngredient)
-	found := false
+
+	_, err = saveIngredient(recipeId, passedIngredient)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeSaved(recipeId)
+	recipeChanged(recipeId, eventIngredientCreated)
+
+	json.NewEncoder(w).Encode(getRecipeById(recipeId))
+}
+
+// saveIngredient updates the ingredient if it already belongs to the recipe,
+// otherwise appends it to the end of the list. It returns the ingredient ID.
+func saveIngredient(recipeId int, passedIngredient Ingredient) (int, error) {
+	var existingIngredients = getRecipeIngredients(recipeId, "")
 	for existingIngredientIndex, existingIngredient := range existingIngredients {
 		if passedIngredient.ID == existingIngredient.ID {
 			sortOrder := existingIngredientIndex + 1
@@ -712,27 +1226,21 @@ func addIngredient(w http.ResponseWriter, r *http.Request) {
 			_, err := db.Exec("UPDATE ingredients SET name = ?, measurement = ?, value = ?, sortOrder = ? WHERE id = ?", passedIngredient.Name, passedIngredient.Measurement, passedIngredient.Value, sortOrder, passedIngredient.ID)
 			if err != nil {
 				fmt.Println("Error updating ingredient:", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return 0, err
 			}
-			found = true
-			break
-		}
-	}
-	if !found {
-		sortOrder := 1 + len(existingIngredients)
-
-		_, err := db.Exec("INSERT INTO ingredients(name, measurement, value, sortOrder, recipe_id) VALUES(?,?,?,?,?)", passedIngredient.Name, passedIngredient.Measurement, passedIngredient.Value, sortOrder, recipeId)
-		if err != nil {
-			fmt.Println("Error inserting ingredient:", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return passedIngredient.ID, nil
 		}
 	}
 
-	updateRecipeLastEdited(recipeId)
+	sortOrder := 1 + len(existingIngredients)
 
-	json.NewEncoder(w).Encode(getRecipeById(recipeId))
+	result, err := db.Exec("INSERT INTO ingredients(name, measurement, value, sortOrder, recipe_id) VALUES(?,?,?,?,?)", passedIngredient.Name, passedIngredient.Measurement, passedIngredient.Value, sortOrder, recipeId)
+	if err != nil {
+		fmt.Println("Error inserting ingredient:", err)
+		return 0, err
+	}
+	lastId, _ := result.LastInsertId()
+	return int(lastId), nil
 }
 
 func deleteIngredient(w http.ResponseWriter, r *http.Request) {
@@ -749,24 +1257,66 @@ func deleteIngredient(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !ownsRecipeChild("ingredients", id, currentUser(r).ID) {
+		http.Error(w, "Ingredient not found", http.StatusNotFound)
+		return
+	}
+	recipeId := recipeChildRecipeId("ingredients", id)
+
+	err = removeIngredient(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recipeSaved(recipeId)
+	recipeChanged(recipeId, eventIngredientDeleted)
+}
+
+func removeIngredient(id int) error {
 	// Delete from divider_ingredients
-	_, err = db.Exec("DELETE FROM divider_ingredients WHERE ingredient_id = ?", id)
+	_, err := db.Exec("DELETE FROM divider_ingredients WHERE ingredient_id = ?", id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
+	}
+
+	for _, table := range []string{"ingredient_recipes", "ingredient_catalog_links"} {
+		if _, err := db.Exec("DELETE FROM "+table+" WHERE ingredient_id = ?", id); err != nil {
+			return err
+		}
 	}
 
 	stmt, err := db.Prepare("DELETE FROM ingredients WHERE id = ?")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	_, err = stmt.Exec(id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	return err
+}
+
+// getIngredientById returns nil when the ingredient does not exist.
+func getIngredientById(id int) *Ingredient {
+	row := db.QueryRow(`
+		SELECT * FROM ingredients WHERE id = ?
+	`, id)
+
+	var ingredient Ingredient
+	row.Scan(
+		&ingredient.ID,
+		&ingredient.Name,
+		&ingredient.Measurement,
+		&ingredient.Value,
+		&ingredient.SortOrder,
+		&ingredient.RecipeID,
+	)
+
+	if ingredient.ID == 0 {
+		return nil
 	}
+	ingredients := []Ingredient{ingredient}
+	loadIngredientLinks(ingredients)
+
+	return &ingredients[0]
 }
 
 func getRecipeMethods(recipeId int) []Method {
@@ -791,6 +1341,7 @@ func getRecipeMethods(recipeId int) []Method {
 			&method.SortOrder,
 			&method.RecipeID,
 		)
+		method.Durations = getMethodDurations(method.ID)
 
 		// Get ingredients for this method
 		ingredientRows, err := db.Query(`
@@ -821,6 +1372,7 @@ func getRecipeMethods(recipeId int) []Method {
 
 		methods = append(methods, method)
 	}
+	loadMethodDividers(methods)
 
 	return methods
 }
@@ -835,17 +1387,32 @@ func addMethods(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	recipe := getRecipeById(recipeId)
+	recipe := getOwnedRecipe(recipeId, currentUser(r).ID)
 	if recipe.ID == 0 {
 		json.NewEncoder(w).Encode(nil)
 		return
 	}
 
-	var existingMethods = getRecipeMethods(recipeId)
-
 	var passedMethods []Method
 	json.NewDecoder(r.Body).Decode(&passedMethods)
 
+	err = saveMethods(recipeId, passedMethods)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeSaved(recipeId)
+	recipeChanged(recipeId, eventMethodCreated)
+
+	json.NewEncoder(w).Encode(getRecipeById(recipeId))
+}
+
+// saveMethods replaces the method list of a recipe: passed methods are updated
+// or inserted in the given order and any others are removed.
+func saveMethods(recipeId int, passedMethods []Method) error {
+	var existingMethods = getRecipeMethods(recipeId)
+
 	for passedMethodIndex, passedMethod := range passedMethods {
 		found := false
 		var methodId = passedMethod.ID
@@ -856,8 +1423,10 @@ func addMethods(w http.ResponseWriter, r *http.Request) {
 			if passedMethod.ID == existingMethod.ID {
 				_, err := db.Exec("UPDATE methods SET value = ?, sortOrder = ? WHERE id = ?", passedMethod.Value, sortOrder, passedMethod.ID)
 				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
+					return err
+				}
+				if err := updateMethodDurations(passedMethod.ID, existingMethod.Value, passedMethod.Value); err != nil {
+					return err
 				}
 				found = true
 				break
@@ -868,29 +1437,18 @@ func addMethods(w http.ResponseWriter, r *http.Request) {
 			sortOrder := passedMethodIndex + 1 + len(existingMethods)
 			result, err := db.Exec("INSERT INTO methods(value, sortOrder, recipe_id) VALUES(?,?,?)", passedMethod.Value, sortOrder, recipeId)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return err
 			}
 			lastId, _ := result.LastInsertId()
 			methodId = int(lastId)
+			if err := updateMethodDurations(methodId, "", passedMethod.Value); err != nil {
+				return err
+			}
 		}
 
-		// Delete existing method-ingredient relationships
-		_, err = db.Exec("DELETE FROM method_ingredients WHERE method_id = ?", methodId)
+		err := setMethodIngredients(methodId, passedMethod.Ingredients)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		// Add new method-ingredient relationships
-		if len(passedMethod.Ingredients) > 0 {
-			for _, ingredient := range passedMethod.Ingredients {
-				_, err = db.Exec("INSERT INTO method_ingredients(method_id, ingredient_id) VALUES(?,?)", methodId, ingredient.ID)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-			}
+			return err
 		}
 	}
 
@@ -911,15 +1469,36 @@ func addMethods(w http.ResponseWriter, r *http.Request) {
 	if len(deleteIds) > 0 {
 		query := fmt.Sprintf("DELETE FROM methods WHERE id IN (%s)", strings.Join(deleteIds, ", "))
 
-		_, err = db.Exec(query)
+		_, err := db.Exec(query)
+		if err != nil {
+			fmt.Println("Error executing query:", err)
+		}
+
+		_, err = db.Exec(fmt.Sprintf("DELETE FROM method_durations WHERE method_id IN (%s)", strings.Join(deleteIds, ", ")))
 		if err != nil {
 			fmt.Println("Error executing query:", err)
 		}
 	}
 
-	updateRecipeLastEdited(recipeId)
+	return nil
+}
 
-	json.NewEncoder(w).Encode(getRecipeById(recipeId))
+func setMethodIngredients(methodId int, ingredients []Ingredient) error {
+	// Delete existing method-ingredient relationships
+	_, err := db.Exec("DELETE FROM method_ingredients WHERE method_id = ?", methodId)
+	if err != nil {
+		return err
+	}
+
+	// Add new method-ingredient relationships, skipping ingredients of other recipes
+	for _, ingredient := range ingredients {
+		_, err = db.Exec("INSERT INTO method_ingredients(method_id, ingredient_id) SELECT m.id, i.id FROM methods m JOIN ingredients i ON i.recipe_id = m.recipe_id WHERE m.id = ? AND i.id = ?", methodId, ingredient.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func addMethod(w http.ResponseWriter, r *http.Request) {
@@ -932,17 +1511,32 @@ func addMethod(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	recipe := getRecipeById(recipeId)
+	recipe := getOwnedRecipe(recipeId, currentUser(r).ID)
 	if recipe.ID == 0 {
 		json.NewEncoder(w).Encode(nil)
 		return
 	}
 
-	var existingMethods = getRecipeMethods(recipeId)
-
 	var passedMethod Method
 	json.NewDecoder(r.Body).Decode(&passedMethod)
 
+	_, err = saveMethod(recipeId, passedMethod)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeSaved(recipeId)
+	recipeChanged(recipeId, eventMethodCreated)
+
+	json.NewEncoder(w).Encode(getRecipeById(recipeId))
+}
+
+// saveMethod updates the method if it already belongs to the recipe, otherwise
+// appends it to the end of the list. It returns the method ID.
+func saveMethod(recipeId int, passedMethod Method) (int, error) {
+	var existingMethods = getRecipeMethods(recipeId)
+
 	found := false
 	var methodId int
 
@@ -952,8 +1546,10 @@ func addMethod(w http.ResponseWriter, r *http.Request) {
 		if passedMethod.ID == existingMethod.ID {
 			_, err := db.Exec("UPDATE methods SET value = ?, sortOrder = ? WHERE id = ?", passedMethod.Value, sortOrder, passedMethod.ID)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return 0, err
+			}
+			if err := updateMethodDurations(passedMethod.ID, existingMethod.Value, passedMethod.Value); err != nil {
+				return 0, err
 			}
 			methodId = passedMethod.ID
 			found = true
@@ -965,34 +1561,16 @@ func addMethod(w http.ResponseWriter, r *http.Request) {
 		sortOrder := 1 + len(existingMethods)
 		result, err := db.Exec("INSERT INTO methods(value, sortOrder, recipe_id) VALUES(?,?,?)", passedMethod.Value, sortOrder, recipeId)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return 0, err
 		}
 		lastId, _ := result.LastInsertId()
 		methodId = int(lastId)
-	}
-
-	// Delete existing method-ingredient relationships
-	_, err = db.Exec("DELETE FROM method_ingredients WHERE method_id = ?", methodId)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Add new method-ingredient relationships
-	if len(passedMethod.Ingredients) > 0 {
-		for _, ingredient := range passedMethod.Ingredients {
-			_, err = db.Exec("INSERT INTO method_ingredients(method_id, ingredient_id) VALUES(?,?)", methodId, ingredient.ID)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		if err := updateMethodDurations(methodId, "", passedMethod.Value); err != nil {
+			return 0, err
 		}
 	}
 
-	updateRecipeLastEdited(recipeId)
-
-	json.NewEncoder(w).Encode(getRecipeById(recipeId))
+	return methodId, setMethodIngredients(methodId, passedMethod.Ingredients)
 }
 
 func deleteMethod(w http.ResponseWriter, r *http.Request) {
@@ -1009,24 +1587,64 @@ func deleteMethod(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete from divider_methods
-	_, err = db.Exec("DELETE FROM divider_methods WHERE method_id = ?", id)
+	if !ownsRecipeChild("methods", id, currentUser(r).ID) {
+		http.Error(w, "Method not found", http.StatusNotFound)
+		return
+	}
+	recipeId := recipeChildRecipeId("methods", id)
+
+	err = removeMethod(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	recipeSaved(recipeId)
+	recipeChanged(recipeId, eventMethodDeleted)
+}
+
+func removeMethod(id int) error {
+	// Delete from divider_methods
+	_, err := db.Exec("DELETE FROM divider_methods WHERE method_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM method_durations WHERE method_id = ?", id)
+	if err != nil {
+		return err
+	}
 
 	stmt, err := db.Prepare("DELETE FROM methods WHERE id = ?")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	_, err = stmt.Exec(id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	return err
+}
+
+// getMethodById returns nil when the method does not exist.
+func getMethodById(id int) *Method {
+	row := db.QueryRow(`
+		SELECT * FROM methods WHERE id = ?
+	`, id)
+
+	var method Method
+	row.Scan(
+		&method.ID,
+		&method.Value,
+		&method.SortOrder,
+		&method.RecipeID,
+	)
+
+	if method.ID == 0 {
+		return nil
 	}
+	method.Durations = getMethodDurations(method.ID)
+	methods := []Method{method}
+	loadMethodDividers(methods)
+
+	return &methods[0]
 }
 
 func updateImage(w http.ResponseWriter, r *http.Request) {
@@ -1046,7 +1664,7 @@ func updateImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	recipe := getRecipeById(recipeId)
+	recipe := getOwnedRecipe(recipeId, currentUser(r).ID)
 
 	if recipe.ID == 0 {
 		json.NewEncoder(w).Encode(nil)
@@ -1065,7 +1683,7 @@ func updateImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	updateRecipeLastEdited(recipeId)
+	recipeChanged(recipeId, eventImageUpdated)
 
 	json.NewEncoder(w).Encode(getRecipeById(recipeId))
 }
@@ -1118,8 +1736,10 @@ func getRecipeImage(recipeId int) *Image {
 
 func getImages(w http.ResponseWriter, r *http.Request) {
 	rows, err := db.Query(`
-		SELECT * FROM images
-	`)
+		SELECT i.* FROM images i
+		JOIN recipes r ON r.id = i.recipe_id
+		WHERE r.owner_id = ?
+	`, currentUser(r).ID)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1143,7 +1763,7 @@ func getImages(w http.ResponseWriter, r *http.Request) {
 }
 
 func getRecipeDividers(recipeId int) []Divider {
-	rows, err := db.Query("SELECT * FROM dividers WHERE recipe_id = ?", recipeId)
+	rows, err := db.Query("SELECT * FROM dividers WHERE recipe_id = ? ORDER BY sortOrder, id", recipeId)
 	if err != nil {
 		return []Divider{}
 	}
@@ -1156,7 +1776,7 @@ func getRecipeDividers(recipeId int) []Divider {
 			return []Divider{}
 		}
 		// Populate ingredients for this divider
-		ingredientRows, err := db.Query("SELECT i.id, i.name, i.measurement, i.value, i.sortOrder, i.recipe_id FROM ingredients i JOIN divider_ingredients di ON i.id = di.ingredient_id WHERE di.divider_id = ?", divider.ID)
+		ingredientRows, err := db.Query("SELECT i.id, i.name, i.measurement, i.value, i.sortOrder, i.recipe_id FROM ingredients i JOIN divider_ingredients di ON i.id = di.ingredient_id WHERE di.divider_id = ? ORDER BY i.sortOrder, i.id", divider.ID)
 		if err == nil {
 			var ingredients []Ingredient
 			for ingredientRows.Next() {
@@ -1169,13 +1789,15 @@ func getRecipeDividers(recipeId int) []Divider {
 					&ingredient.SortOrder,
 					&ingredient.RecipeID,
 				)
+				ingredient.DividerID = &divider.ID
 				ingredients = append(ingredients, ingredient)
 			}
+			loadIngredientLinks(ingredients)
 			divider.Ingredients = ingredients
 			ingredientRows.Close()
 		}
 		// Populate methods for this divider
-		methodRows, err := db.Query("SELECT m.id, m.value, m.sortOrder, m.recipe_id FROM methods m JOIN divider_methods dm ON m.id = dm.method_id WHERE dm.divider_id = ?", divider.ID)
+		methodRows, err := db.Query("SELECT m.id, m.value, m.sortOrder, m.recipe_id FROM methods m JOIN divider_methods dm ON m.id = dm.method_id WHERE dm.divider_id = ? ORDER BY m.sortOrder, m.id", divider.ID)
 		if err == nil {
 			var methods []Method
 			for methodRows.Next() {
@@ -1186,6 +1808,8 @@ func getRecipeDividers(recipeId int) []Divider {
 					&method.SortOrder,
 					&method.RecipeID,
 				)
+				method.Durations = getMethodDurations(method.ID)
+				method.DividerID = &divider.ID
 				methods = append(methods, method)
 			}
 			divider.Methods = methods
@@ -1222,6 +1846,10 @@ func getDividers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	id, _ := strconv.Atoi(idStr)
+	if getOwnedRecipe(id, currentUser(r).ID).ID == 0 {
+		json.NewEncoder(w).Encode(nil)
+		return
+	}
 	dividers := getRecipeDividers(id)
 	json.NewEncoder(w).Encode(dividers)
 }
@@ -1242,39 +1870,65 @@ func addIngredientsToDivider(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !ownsRecipeChild("dividers", dividerID, currentUser(r).ID) || getDividerById(dividerID).RecipeID != recipeID {
+		http.Error(w, "Divider not found", http.StatusNotFound)
+		return
+	}
+
 	var ingredients []Ingredient
 	if err := json.NewDecoder(r.Body).Decode(&ingredients); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	for _, ingredient := range ingredients {
+		if ingredient.ID == 0 {
+			continue
+		}
+		if existing := getIngredientById(ingredient.ID); existing == nil || existing.RecipeID != recipeID {
+			http.Error(w, fmt.Sprintf("Ingredient %d not found", ingredient.ID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := addDividerIngredients(recipeID, dividerID, ingredients); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recipeSaved(recipeID)
+	recipeChanged(recipeID, eventDividerUpdated)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addDividerIngredients moves the ingredients into the divider in one
+// transaction, inserting any ingredient without an ID into the recipe first.
+// An ingredient is in one divider at most, so it leaves the one it was in.
+func addDividerIngredients(recipeID int, dividerID int, ingredients []Ingredient) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
 	for _, ingredient := range ingredients {
 		ingredientID := ingredient.ID
 		if ingredientID == 0 {
-			result, err := db.Exec("INSERT INTO ingredients(name, measurement, value, sortOrder, recipe_id) VALUES(?,?,?,?,?)", ingredient.Name, ingredient.Measurement, ingredient.Value, ingredient.SortOrder, recipeID)
+			result, err := tx.Exec("INSERT INTO ingredients(name, measurement, value, sortOrder, recipe_id) VALUES(?,?,?,?,?)", ingredient.Name, ingredient.Measurement, ingredient.Value, ingredient.SortOrder, recipeID)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				tx.Rollback()
+				return err
 			}
 			lastId, _ := result.LastInsertId()
 			ingredientID = int(lastId)
 		}
 
-		var exists int
-		err := db.QueryRow("SELECT 1 FROM divider_ingredients WHERE ingredient_id = ? AND divider_id = ?", ingredientID, dividerID).Scan(&exists)
-		if err == sql.ErrNoRows {
-			_, err := db.Exec("INSERT INTO divider_ingredients (ingredient_id, divider_id) VALUES (?, ?)", ingredientID, dividerID)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		} else if err != nil && err != sql.ErrNoRows {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		if err := ingredientSections.move(tx, ingredientID, dividerID); err != nil {
+			tx.Rollback()
+			return err
 		}
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	return tx.Commit()
 }
 
 func addMethodsToDivider(w http.ResponseWriter, r *http.Request) {
@@ -1287,24 +1941,34 @@ func addMethodsToDivider(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !ownsRecipeChild("dividers", req.DividerID, currentUser(r).ID) {
+		http.Error(w, "Divider not found", http.StatusNotFound)
+		return
+	}
+
+	recipeID := getDividerById(req.DividerID).RecipeID
 	for _, methodID := range req.MethodIDs {
-		var exists int
-		err := db.QueryRow("SELECT 1 FROM divider_methods WHERE method_id = ? AND divider_id = ?", methodID, req.DividerID).Scan(&exists)
-		if err == sql.ErrNoRows {
-			_, err := db.Exec("INSERT INTO divider_methods (method_id, divider_id) VALUES (?, ?)", methodID, req.DividerID)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		} else if err != nil && err != sql.ErrNoRows {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if method := getMethodById(methodID); method == nil || method.RecipeID != recipeID {
+			http.Error(w, fmt.Sprintf("Method %d not found", methodID), http.StatusBadRequest)
 			return
 		}
 	}
 
+	if err := addDividerMethods(req.DividerID, req.MethodIDs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recipeChanged(recipeID, eventDividerUpdated)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// addDividerMethods moves the methods into the divider in one transaction,
+// taking them out of the divider they were in.
+func addDividerMethods(dividerID int, methodIDs []int) error {
+	return moveToDivider(methodSections, methodIDs, dividerID)
+}
+
 func addDividerToRecipe(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	idStr := params["recipe_id"]
@@ -1315,18 +1979,31 @@ func addDividerToRecipe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	recipe := getRecipeById(recipeId)
+	recipe := getOwnedRecipe(recipeId, currentUser(r).ID)
 
 	if recipe.ID == 0 {
 		json.NewEncoder(w).Encode(nil)
 		return
 	}
 
-	var existingDividers = getRecipeDividers(recipeId)
 	var passedDivider Divider
 	json.NewDecoder(r.Body).Decode(&passedDivider)
-	found := false
-	dividerId := 0
+
+	dividerId, err := saveDivider(recipeId, passedDivider)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeChanged(recipeId, eventDividerCreated)
+
+	json.NewEncoder(w).Encode(getDividerById(dividerId))
+}
+
+// saveDivider updates the divider if it already belongs to the recipe,
+// otherwise appends a new one. It returns the divider ID.
+func saveDivider(recipeId int, passedDivider Divider) (int, error) {
+	var existingDividers = getRecipeDividers(recipeId)
 	for existingDividerIndex, existingDivider := range existingDividers {
 		if passedDivider.ID == existingDivider.ID {
 			sortOrder := existingDividerIndex + 1
@@ -1334,31 +2011,22 @@ func addDividerToRecipe(w http.ResponseWriter, r *http.Request) {
 			_, err := db.Exec("UPDATE dividers SET title = ?, sortOrder = ?, recipe_id = ? WHERE id = ?", passedDivider.Title, sortOrder, recipeId, passedDivider.ID)
 			if err != nil {
 				fmt.Println("Error updating divider:", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return 0, err
 			}
-			dividerId = passedDivider.ID
-			found = true
-			break
+			return passedDivider.ID, nil
 		}
 	}
-	if !found {
-		sortOrder := 1 + len(existingDividers)
 
-		result, err := db.Exec("INSERT INTO dividers(title, sortOrder, recipe_id) VALUES(?,?,?)", passedDivider.Title, sortOrder, recipeId)
-		if err != nil {
-			fmt.Println("Error inserting divider:", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	sortOrder := 1 + len(existingDividers)
 
-		lastId, _ := result.LastInsertId()
-		dividerId = int(lastId)
+	result, err := db.Exec("INSERT INTO dividers(title, sortOrder, recipe_id) VALUES(?,?,?)", passedDivider.Title, sortOrder, recipeId)
+	if err != nil {
+		fmt.Println("Error inserting divider:", err)
+		return 0, err
 	}
 
-	updateRecipeLastEdited(recipeId)
-
-	json.NewEncoder(w).Encode(getDividerById(dividerId))
+	lastId, _ := result.LastInsertId()
+	return int(lastId), nil
 }
 
 func deleteDividers(w http.ResponseWriter, r *http.Request) {
@@ -1375,6 +2043,11 @@ func deleteDividers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if getOwnedRecipe(recipeID, currentUser(r).ID).ID == 0 {
+		http.Error(w, "Recipe not found", http.StatusNotFound)
+		return
+	}
+
 	dividers := getRecipeDividers(recipeID)
 	if len(dividers) == 0 {
 		// Nothing to delete
@@ -1390,31 +2063,7 @@ func deleteDividers(w http.ResponseWriter, r *http.Request) {
 
 	// Iterate through all dividers for the recipe and remove associations and the divider rows
 	for _, divider := range dividers {
-		// Reassign any ingredients associated with this divider back to the recipe (safe no-op if already set)
-		rows, err := tx.Query("SELECT ingredient_id FROM divider_ingredients WHERE divider_id = ?", divider.ID)
-		if err == nil {
-			var ingredientID int
-			for rows.Next() {
-				if err := rows.Scan(&ingredientID); err == nil {
-					_, _ = tx.Exec("UPDATE ingredients SET recipe_id = ? WHERE id = ?", recipeID, ingredientID)
-				}
-			}
-			rows.Close()
-		}
-
-		if _, err := tx.Exec("DELETE FROM divider_ingredients WHERE divider_id = ?", divider.ID); err != nil {
-			tx.Rollback()
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if _, err := tx.Exec("DELETE FROM divider_methods WHERE divider_id = ?", divider.ID); err != nil {
-			tx.Rollback()
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if _, err := tx.Exec("DELETE FROM dividers WHERE id = ?", divider.ID); err != nil {
+		if err := removeDivider(tx, recipeID, divider.ID); err != nil {
 			tx.Rollback()
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -1427,11 +2076,67 @@ func deleteDividers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	updateRecipeLastEdited(recipeID)
+	recipeChanged(recipeID, eventDividerDeleted)
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// removeDivider deletes a divider and its ingredient and method links inside tx.
+// The ingredients and methods themselves stay on the recipe.
+func removeDivider(tx *sql.Tx, recipeID int, dividerID int) error {
+	// Reassign any ingredients associated with this divider back to the recipe (safe no-op if already set)
+	rows, err := tx.Query("SELECT ingredient_id FROM divider_ingredients WHERE divider_id = ?", dividerID)
+	if err == nil {
+		var ingredientIDs []int
+		var ingredientID int
+		for rows.Next() {
+			if err := rows.Scan(&ingredientID); err == nil {
+				ingredientIDs = append(ingredientIDs, ingredientID)
+			}
+		}
+		rows.Close()
+
+		for _, ingredientID := range ingredientIDs {
+			_, _ = tx.Exec("UPDATE ingredients SET recipe_id = ? WHERE id = ?", recipeID, ingredientID)
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM divider_ingredients WHERE divider_id = ?", dividerID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM divider_methods WHERE divider_id = ?", dividerID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM dividers WHERE id = ?", dividerID)
+	return err
+}
+
+// runMigration makes a one-time change of existing data, unless the
+// migrations table says it ran already. The change and the record of it are
+// one transaction.
+func runMigration(name string, migrate func(tx *sql.Tx) error) error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM migrations WHERE name = ?", name).Scan(&count); err != nil || count > 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := migrate(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO migrations(name, ranAt) VALUES(?,?)", name, time.Now().Format("2006-01-02 15:04:05")); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 func main() {
 	var err error
 	db, err = sql.Open("sqlite3", "./database/database.db")
@@ -1440,41 +2145,107 @@ func main() {
 	}
 	defer db.Close()
 
+	if err := bootstrapAdmin(); err != nil {
+		log.Fatal(err)
+	}
+	if err := seedTaxonomy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := runMigration("move peanuts and molluscs in the taxonomy", moveTaxonomyNodes); err != nil {
+		log.Fatal(err)
+	}
+	if err := migrateRecipeTypes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := seedAllergenRules(); err != nil {
+		log.Fatal(err)
+	}
+	if err := seedSubstitutions(); err != nil {
+		log.Fatal(err)
+	}
+	if err := seedIngredientCatalog(); err != nil {
+		log.Fatal(err)
+	}
+	if err := linkAllIngredients(); err != nil {
+		log.Fatal(err)
+	}
+	if err := seedEquipment(); err != nil {
+		log.Fatal(err)
+	}
+	if err := detectAllEquipment(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseAllMethodDurations(); err != nil {
+		log.Fatal(err)
+	}
+
+	go expireCookingSessions()
+	go deliverWebhooks()
+
 	router := mux.NewRouter().StrictSlash(true)
+	router.Use(authMiddleware)
+	registerAuthRoutes(router)
+	registerApiTokenRoutes(router)
+	registerTaxonomyRoutes(router)
+	registerTagRoutes(router)
+	registerAllergenRoutes(router)
+	registerNutritionRoutes(router)
+	registerCookLogRoutes(router)
+	registerCollectionRoutes(router)
+	registerDurationRoutes(router)
+	registerCookingSessionRoutes(router)
+	registerEventRoutes(router)
+	registerWebhookRoutes(router)
+	registerVariantRoutes(router)
+	registerDuplicateRoutes(router)
+	registerSubRecipeRoutes(router)
+	registerSectionRoutes(router)
+	registerCatalogRoutes(router)
+	registerSubstitutionRoutes(router)
+	registerCostRoutes(router)
+	registerEquipmentRoutes(router)
+	registerNoteRoutes(router)
+	registerExportRoutes(router)
+	registerCardRoutes(router)
+	registerShareRoutes(router)
+	registerV1Routes(router)
+
+	// Pre-v1 routes, kept so existing app builds keep working
 	// Recipe routes
-	router.HandleFunc("/recipes", getRecipes).Methods("GET")
-	router.HandleFunc("/recipe/{id}", getRecipe).Methods("GET")
-	router.HandleFunc("/recipe", createRecipe).Methods("POST")
-	router.HandleFunc("/recipe/{id}", updateRecipe).Methods("PUT")
-	router.HandleFunc("/recipe/{id}", deleteRecipe).Methods("DELETE")
-	router.HandleFunc("/recipes", reorderRecipes).Methods("PUT")
+	router.HandleFunc("/recipes", deprecated("/api/v1/recipes", getRecipes)).Methods("GET")
+	router.HandleFunc("/recipe/{id}", deprecated("/api/v1/recipes/{id}", getRecipe)).Methods("GET")
+	router.HandleFunc("/recipe", deprecated("/api/v1/recipes", createRecipe)).Methods("POST")
+	router.HandleFunc("/recipe/{id}", deprecated("/api/v1/recipes/{id}", updateRecipe)).Methods("PUT")
+	router.HandleFunc("/recipe/{id}", deprecated("/api/v1/recipes/{id}", deleteRecipe)).Methods("DELETE")
+	router.HandleFunc("/recipes", deprecated("/api/v1/recipes/order", reorderRecipes)).Methods("PUT")
 
 	// Portion routes
-	router.HandleFunc("/portion/{recipe_id}", addPortion).Methods("POST")
-	router.HandleFunc("/portion/{id}", deletePortion).Methods("DELETE")
-	router.HandleFunc("/portions", getPortions).Methods("GET")
+	router.HandleFunc("/portion/{recipe_id}", deprecated("/api/v1/recipes/{recipe_id}/portion", addPortion)).Methods("POST")
+	router.HandleFunc("/portion/{id}", deprecated("/api/v1/recipes/{recipe_id}/portion", deletePortion)).Methods("DELETE")
+	router.HandleFunc("/portions", deprecated("/api/v1/portions", getPortions)).Methods("GET")
 
 	// Ingredient routes
-	router.HandleFunc("/ingredients/{recipe_id}", addIngredients).Methods("POST")
-	router.HandleFunc("/ingredient/{recipe_id}", addIngredient).Methods("POST")
-	router.HandleFunc("/ingredient/{id}", deleteIngredient).Methods("DELETE")
-	router.HandleFunc("/ingredients", getIngredients).Methods("GET")
+	router.HandleFunc("/ingredients/{recipe_id}", deprecated("/api/v1/recipes/{recipe_id}/ingredients", addIngredients)).Methods("POST")
+	router.HandleFunc("/ingredient/{recipe_id}", deprecated("/api/v1/recipes/{recipe_id}/ingredients", addIngredient)).Methods("POST")
+	router.HandleFunc("/ingredient/{id}", deprecated("/api/v1/recipes/{recipe_id}/ingredients/{id}", deleteIngredient)).Methods("DELETE")
+	router.HandleFunc("/ingredients", deprecated("/api/v1/ingredients", getLegacyIngredients)).Methods("GET")
 
 	// Method routes
-	router.HandleFunc("/methods/{recipe_id}", addMethods).Methods("POST")
-	router.HandleFunc("/method/{recipe_id}", addMethod).Methods("POST")
-	router.HandleFunc("/method/{id}", deleteMethod).Methods("DELETE")
+	router.HandleFunc("/methods/{recipe_id}", deprecated("/api/v1/recipes/{recipe_id}/methods", addMethods)).Methods("POST")
+	router.HandleFunc("/method/{recipe_id}", deprecated("/api/v1/recipes/{recipe_id}/methods", addMethod)).Methods("POST")
+	router.HandleFunc("/method/{id}", deprecated("/api/v1/recipes/{recipe_id}/methods/{id}", deleteMethod)).Methods("DELETE")
 
 	// Image routes
-	router.HandleFunc("/image/{recipe_id}", updateImage).Methods("POST")
-	router.HandleFunc("/images", getImages).Methods("GET")
+	router.HandleFunc("/image/{recipe_id}", deprecated("/api/v1/recipes/{recipe_id}/image", updateImage)).Methods("POST")
+	router.HandleFunc("/images", deprecated("/api/v1/images", getImages)).Methods("GET")
 
 	// Divider routes
-	router.HandleFunc("/dividers/{recipe_id}", getDividers).Methods("GET")
-	router.HandleFunc("/divider/{recipe_id}", addDividerToRecipe).Methods("POST")
-	router.HandleFunc("/divider/{recipe_id}/{divider_id}/ingredients", addIngredientsToDivider).Methods("POST")
-	router.HandleFunc("/divider/methods", addMethodsToDivider).Methods("POST")
-	router.HandleFunc("/dividers/{recipe_id}", deleteDividers).Methods("DELETE")
+	router.HandleFunc("/dividers/{recipe_id}", deprecated("/api/v1/recipes/{recipe_id}/dividers", getDividers)).Methods("GET")
+	router.HandleFunc("/divider/{recipe_id}", deprecated("/api/v1/recipes/{recipe_id}/dividers", addDividerToRecipe)).Methods("POST")
+	router.HandleFunc("/divider/{recipe_id}/{divider_id}/ingredients", deprecated("/api/v1/recipes/{recipe_id}/dividers/{divider_id}/ingredients", addIngredientsToDivider)).Methods("POST")
+	router.HandleFunc("/divider/methods", deprecated("/api/v1/recipes/{recipe_id}/dividers/{divider_id}/methods", addMethodsToDivider)).Methods("POST")
+	router.HandleFunc("/dividers/{recipe_id}", deprecated("/api/v1/recipes/{recipe_id}/dividers/{divider_id}", deleteDividers)).Methods("DELETE")
+	router.HandleFunc("/divider/{divider_id}", deprecated("/api/v1/recipes/{recipe_id}/dividers/{divider_id}", deleteDivider)).Methods("DELETE")
 
 	fmt.Println("Starting server on :1009...")
 	http.ListenAndServe(":1009", router)
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	// schemaPattern finds the statements entrypoint.sh feeds to sqlite3.
+	schemaPattern = regexp.MustCompile(`(?s)<<EOF\n(.*?)\nEOF`)
+	// addColumnPattern finds the columns entrypoint.sh adds to existing tables.
+	addColumnPattern = regexp.MustCompile(`(?m)^add_column_if_missing (\w+) (\w+) "(.*)"$`)
+)
+
+// openSchemaDB points db at a new database with every table of
+// entrypoint.sh for the duration of the test.
+func openSchemaDB(t *testing.T) {
+	t.Helper()
+	entrypoint, err := os.ReadFile("entrypoint.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a file rather than :memory:, where every connection would get a
+	// database of its own, as reads nest inside one another
+	testDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "database.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, match := range schemaPattern.FindAllStringSubmatch(string(entrypoint), -1) {
+		if _, err := testDB.Exec(match[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, match := range addColumnPattern.FindAllStringSubmatch(string(entrypoint), -1) {
+		if _, err := testDB.Exec("ALTER TABLE " + match[1] + " ADD COLUMN " + match[2] + " " + match[3]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous := db
+	db = testDB
+	t.Cleanup(func() {
+		db = previous
+		testDB.Close()
+	})
+}
+
+func mustExec(t *testing.T, query string, args ...any) int {
+	t.Helper()
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	id, _ := result.LastInsertId()
+	return int(id)
+}
+
+func TestRemoveRecipeLeavesNoChildRows(t *testing.T) {
+	openSchemaDB(t)
+
+	userId := mustExec(t, "INSERT INTO users(username, password_hash) VALUES('cook', '')")
+	recipeId := mustExec(t, "INSERT INTO recipes(name, owner_id) VALUES('Pancakes', ?)", userId)
+	otherId := mustExec(t, "INSERT INTO recipes(name, owner_id) VALUES('Crepes', ?)", userId)
+
+	mustExec(t, "INSERT INTO portions(value, measurement, recipe_id) VALUES(4, 'people', ?)", recipeId)
+	mustExec(t, "INSERT INTO images(url, filename, recipe_id) VALUES('', 'a.png', ?)", recipeId)
+	ingredientId := mustExec(t, "INSERT INTO ingredients(name, recipe_id) VALUES('flour', ?)", recipeId)
+	methodId := mustExec(t, "INSERT INTO methods(value, recipe_id) VALUES('Mix for 5 minutes', ?)", recipeId)
+	dividerId := mustExec(t, "INSERT INTO dividers(title, recipe_id) VALUES('Batter', ?)", recipeId)
+	mustExec(t, "INSERT INTO divider_ingredients(ingredient_id, divider_id) VALUES(?, ?)", ingredientId, dividerId)
+	mustExec(t, "INSERT INTO divider_methods(method_id, divider_id) VALUES(?, ?)", methodId, dividerId)
+	mustExec(t, "INSERT INTO method_ingredients(method_id, ingredient_id) VALUES(?, ?)", methodId, ingredientId)
+	mustExec(t, "INSERT INTO method_durations(method_id, seconds, maxSeconds, kind, sortOrder) VALUES(?, 300, 300, 'active', 1)", methodId)
+	catalogId := mustExec(t, "INSERT INTO ingredient_catalog(name) VALUES('flour')")
+	mustExec(t, "INSERT INTO ingredient_catalog_links(ingredient_id, catalog_id, name) VALUES(?, ?, 'flour')", ingredientId, catalogId)
+	mustExec(t, "INSERT INTO ingredient_recipes(ingredient_id, recipe_id) VALUES(?, ?)", ingredientId, otherId)
+	otherIngredientId := mustExec(t, "INSERT INTO ingredients(name, recipe_id) VALUES('pancake batter', ?)", otherId)
+	mustExec(t, "INSERT INTO ingredient_recipes(ingredient_id, recipe_id) VALUES(?, ?)", otherIngredientId, recipeId)
+	mustExec(t, "INSERT INTO shares(recipe_id, token_hash, created_by) VALUES(?, 'hash', ?)", recipeId, userId)
+	mustExec(t, "INSERT INTO recipe_notes(recipe_id, author_id, text, ingredient_id) VALUES(?, ?, 'Sift it', ?)", recipeId, userId, ingredientId)
+
+	if err := removeRecipe(recipeId); err != nil {
+		t.Fatal(err)
+	}
+
+	var recipes int
+	if err := db.QueryRow("SELECT COUNT(*) FROM recipes WHERE id = ?", recipeId).Scan(&recipes); err != nil {
+		t.Fatal(err)
+	}
+	if recipes != 0 {
+		t.Error("the recipe is still there")
+	}
+	for _, table := range []string{"portions", "images", "ingredients", "methods", "dividers", "shares", "recipe_notes"} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE recipe_id = ?", recipeId).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("%d rows of %s are left", count, table)
+		}
+	}
+	for _, table := range []string{"divider_ingredients", "divider_methods", "method_ingredients", "method_durations", "ingredient_catalog_links", "ingredient_recipes"} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("%d rows of %s are left", count, table)
+		}
+	}
+
+	var left int
+	if err := db.QueryRow("SELECT COUNT(*) FROM ingredients WHERE recipe_id = ?", otherId).Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 1 {
+		t.Errorf("the recipe using the deleted one has %d ingredients, want its ingredient kept", left)
+	}
+}
+
+func TestDeprecatedLink(t *testing.T) {
+	router := mux.NewRouter()
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	router.HandleFunc("/divider/{recipe_id}/{divider_id}/ingredients", deprecated("/api/v1/recipes/{recipe_id}/dividers/{divider_id}/ingredients", noop)).Methods("POST")
+	router.HandleFunc("/ingredient/{id}", deprecated("/api/v1/recipes/{recipe_id}/ingredients/{id}", noop)).Methods("DELETE")
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("POST", "/divider/3/7/ingredients", nil))
+	if link := recorder.Header().Get("Link"); link != `</api/v1/recipes/3/dividers/7/ingredients>; rel="successor-version"` {
+		t.Errorf("Link = %q", link)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("DELETE", "/ingredient/5", nil))
+	if recorder.Header().Get("Deprecation") != "true" || recorder.Header().Get("Link") != "" {
+		t.Errorf("headers = %v, want Deprecation without a Link missing the recipe", recorder.Header())
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// normalizeIngredientName lowercases the name, drops punctuation and reduces
+// every word to its singular form so "Spring Onions," and "spring onion"
+// compare equal.
+func normalizeIngredientName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		words[i] = singularize(word)
+	}
+	return strings.Join(words, " ")
+}
+
+// singularize is a deliberately small English plural stripper, good enough
+// for ingredient names.
+func singularize(word string) string {
+	switch {
+	case len(word) <= 3:
+		return word
+	case strings.HasSuffix(word, "ies"):
+		return strings.TrimSuffix(word, "ies") + "y"
+	case strings.HasSuffix(word, "oes"), strings.HasSuffix(word, "ches"), strings.HasSuffix(word, "shes"), strings.HasSuffix(word, "sses"):
+		return strings.TrimSuffix(word, "es")
+	case strings.HasSuffix(word, "ss"), strings.HasSuffix(word, "us"):
+		return word
+	case strings.HasSuffix(word, "s"):
+		return strings.TrimSuffix(word, "s")
+	}
+	return word
+}
+
+// nameContainsTerm reports whether the normalized term appears in the
+// normalized name as whole words, e.g. "cheddar" in "mature cheddar cheese".
+func nameContainsTerm(name string, term string) bool {
+	if term == "" {
+		return false
+	}
+	return name == term || strings.Contains(" "+name+" ", " "+term+" ")
+}
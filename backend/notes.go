@@ -0,0 +1,399 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RecipeNote is a note kept beside a recipe rather than in its method. A
+// note with an ingredient or method id is pinned to that row; Detached is
+// set when the row is gone and no row like it could be found.
+type RecipeNote struct {
+	ID           int    `json:"id"`
+	RecipeID     int    `json:"recipe_id"`
+	Text         string `json:"text"`
+	IngredientID *int   `json:"ingredient_id,omitempty"`
+	MethodID     *int   `json:"method_id,omitempty"`
+	Detached     bool   `json:"detached,omitempty"`
+	AuthorID     int    `json:"author_id"`
+	Author       string `json:"author"`
+	CreatedAt    string `json:"createdAt"`
+	LastEditedAt string `json:"lastEditedAt"`
+}
+
+var errInvalidNote = errors.New("invalid note")
+
+func registerNoteRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/recipes/{id}/notes", getRecipeNotesHandler).Methods("GET")
+	api.HandleFunc("/recipes/{id}/notes", createRecipeNote).Methods("POST")
+	api.HandleFunc("/recipes/{id}/notes/{noteId}", updateRecipeNote).Methods("PATCH")
+	api.HandleFunc("/recipes/{id}/notes/{noteId}", deleteRecipeNote).Methods("DELETE")
+}
+
+// getRecipeNotes returns the notes of the recipe, oldest first.
+func getRecipeNotes(recipeId int) []RecipeNote {
+	notes := []RecipeNote{}
+
+	rows, err := db.Query(`
+		SELECT n.id, n.recipe_id, n.text, n.ingredient_id, n.method_id,
+			(n.ingredient_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM ingredients i WHERE i.id = n.ingredient_id AND i.recipe_id = n.recipe_id))
+			OR (n.method_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM methods m WHERE m.id = n.method_id AND m.recipe_id = n.recipe_id)),
+			COALESCE(n.author_id, 0), COALESCE(u.username, ''), n.createdAt, n.lastEditedAt
+		FROM recipe_notes n
+		LEFT JOIN users u ON u.id = n.author_id
+		WHERE n.recipe_id = ?
+		ORDER BY n.createdAt, n.id
+	`, recipeId)
+	if err != nil {
+		return notes
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var note RecipeNote
+		var ingredientId, methodId sql.NullInt64
+		err := rows.Scan(&note.ID, &note.RecipeID, &note.Text, &ingredientId, &methodId, &note.Detached,
+			&note.AuthorID, &note.Author, &note.CreatedAt, &note.LastEditedAt)
+		if err != nil {
+			continue
+		}
+		if ingredientId.Valid {
+			id := int(ingredientId.Int64)
+			note.IngredientID = &id
+		}
+		if methodId.Valid {
+			id := int(methodId.Int64)
+			note.MethodID = &id
+		}
+		notes = append(notes, note)
+	}
+	return notes
+}
+
+func getRecipeNote(recipeId int, noteId int) *RecipeNote {
+	for _, note := range getRecipeNotes(recipeId) {
+		if note.ID == noteId {
+			return &note
+		}
+	}
+	return nil
+}
+
+// noteAnchor returns what a note pinned to the row is matched on when the
+// row is replaced: the ingredient name or the method text.
+func noteAnchor(recipeId int, note RecipeNote) (string, error) {
+	var table, column string
+	var id int
+	switch {
+	case note.IngredientID != nil && note.MethodID != nil:
+		return "", fmt.Errorf("%w: a note is pinned to an ingredient or a method, not both", errInvalidNote)
+	case note.IngredientID != nil:
+		table, column, id = "ingredients", "name", *note.IngredientID
+	case note.MethodID != nil:
+		table, column, id = "methods", "value", *note.MethodID
+	default:
+		return "", nil
+	}
+
+	var text string
+	err := db.QueryRow("SELECT "+column+" FROM "+table+" WHERE id = ? AND recipe_id = ?", id, recipeId).Scan(&text)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("%w: %s %d is not part of the recipe", errInvalidNote, strings.TrimSuffix(table, "s"), id)
+	}
+	if err != nil {
+		return "", err
+	}
+	return normalizeIngredientName(text), nil
+}
+
+// reattachRecipeNotes keeps the pinned notes of the recipe on their rows.
+// A note whose row was replaced, as when the ingredients or methods are
+// saved again without their ids, moves to the row with the same name or
+// text. A note whose row was only edited takes the new text as its anchor.
+func reattachRecipeNotes(recipeId int) error {
+	ingredients := map[int]string{}
+	for _, ingredient := range getRecipeIngredients(recipeId, "") {
+		ingredients[ingredient.ID] = normalizeIngredientName(ingredient.Name)
+	}
+	methods := map[int]string{}
+	for _, method := range getRecipeMethods(recipeId) {
+		methods[method.ID] = normalizeIngredientName(method.Value)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, target := range []struct {
+		column string
+		rows   map[int]string
+	}{
+		{"ingredient_id", ingredients},
+		{"method_id", methods},
+	} {
+		if err := reattachNotesTx(tx, recipeId, target.column, target.rows); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// reattachNotesTx moves the notes pinned by column onto rows, the current
+// text of each row by its id.
+func reattachNotesTx(tx *sql.Tx, recipeId int, column string, rows map[int]string) error {
+	result, err := tx.Query("SELECT id, "+column+", anchor FROM recipe_notes WHERE recipe_id = ? AND "+column+" IS NOT NULL", recipeId)
+	if err != nil {
+		return err
+	}
+	type pinned struct {
+		id, rowId int
+		anchor    string
+	}
+	var notes []pinned
+	for result.Next() {
+		var note pinned
+		if result.Scan(&note.id, &note.rowId, &note.anchor) == nil {
+			notes = append(notes, note)
+		}
+	}
+	result.Close()
+
+	for _, note := range notes {
+		if text, ok := rows[note.rowId]; ok {
+			if text != note.anchor {
+				if _, err := tx.Exec("UPDATE recipe_notes SET anchor = ? WHERE id = ?", text, note.id); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		rowId := 0
+		for id, text := range rows {
+			if text == note.anchor && (rowId == 0 || id < rowId) {
+				rowId = id
+			}
+		}
+		if rowId == 0 {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE recipe_notes SET "+column+" = ? WHERE id = ?", rowId, note.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRecipeNotesTx copies the notes of a recipe to its copy, pinning them
+// to the copied rows.
+func copyRecipeNotesTx(tx *sql.Tx, fromId int, toId int, ingredientIds map[int]int, methodIds map[int]int) error {
+	rows, err := tx.Query("SELECT author_id, text, ingredient_id, method_id, anchor, createdAt, lastEditedAt FROM recipe_notes WHERE recipe_id = ? ORDER BY id", fromId)
+	if err != nil {
+		return err
+	}
+	type copied struct {
+		authorId, ingredientId, methodId sql.NullInt64
+		text, anchor                     string
+		createdAt, lastEditedAt          sql.NullString
+	}
+	var notes []copied
+	for rows.Next() {
+		var note copied
+		if err := rows.Scan(&note.authorId, &note.text, &note.ingredientId, &note.methodId, &note.anchor, &note.createdAt, &note.lastEditedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		notes = append(notes, note)
+	}
+	rows.Close()
+
+	for _, note := range notes {
+		if id, ok := ingredientIds[int(note.ingredientId.Int64)]; ok && note.ingredientId.Valid {
+			note.ingredientId.Int64 = int64(id)
+		}
+		if id, ok := methodIds[int(note.methodId.Int64)]; ok && note.methodId.Valid {
+			note.methodId.Int64 = int64(id)
+		}
+		_, err := tx.Exec(`
+			INSERT INTO recipe_notes(recipe_id, author_id, text, ingredient_id, method_id, anchor, createdAt, lastEditedAt)
+			VALUES(?,?,?,?,?,?,?,?)
+		`, toId, note.authorId, note.text, note.ingredientId, note.methodId, note.anchor, note.createdAt, note.lastEditedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getRecipeNotesHandler(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recipe.Notes)
+}
+
+// createRecipeNote adds a note by the current user. It is pinned when the
+// body names an ingredient_id or a method_id of the recipe.
+func createRecipeNote(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var note RecipeNote
+	if !decodeBody(w, r, &note) {
+		return
+	}
+	note.Text = strings.TrimSpace(note.Text)
+	if note.Text == "" {
+		http.Error(w, "Text is required", http.StatusBadRequest)
+		return
+	}
+
+	anchor, err := noteAnchor(recipe.ID, note)
+	if err != nil {
+		http.Error(w, err.Error(), noteErrorStatus(err))
+		return
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	result, err := db.Exec(`
+		INSERT INTO recipe_notes(recipe_id, author_id, text, ingredient_id, method_id, anchor, createdAt, lastEditedAt)
+		VALUES(?,?,?,?,?,?,?,?)
+	`, recipe.ID, currentUser(r).ID, note.Text, note.IngredientID, note.MethodID, anchor, now, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+	recipeChanged(recipe.ID, eventNoteCreated)
+
+	writeJSON(w, http.StatusCreated, getRecipeNote(recipe.ID, int(id)))
+}
+
+// updateRecipeNote changes the fields present in the body. Passing
+// ingredient_id or method_id pins the note to that row instead, and null
+// makes it a note on the whole recipe.
+func updateRecipeNote(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+	noteId, ok := pathID(w, r, "noteId")
+	if !ok {
+		return
+	}
+	note := getRecipeNote(recipe.ID, noteId)
+	if note == nil {
+		http.Error(w, "Note not found", http.StatusNotFound)
+		return
+	}
+
+	// the pins stay raw so that null (unpin) can be told apart from leaving
+	// them out
+	var patch struct {
+		Text         *string         `json:"text"`
+		IngredientID json.RawMessage `json:"ingredient_id"`
+		MethodID     json.RawMessage `json:"method_id"`
+	}
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	if patch.Text != nil {
+		note.Text = strings.TrimSpace(*patch.Text)
+		if note.Text == "" {
+			http.Error(w, "Text is required", http.StatusBadRequest)
+			return
+		}
+	}
+	repin := len(patch.IngredientID) > 0 || len(patch.MethodID) > 0
+	var anchor string
+	if repin {
+		note.IngredientID, note.MethodID = nil, nil
+		if len(patch.IngredientID) > 0 && json.Unmarshal(patch.IngredientID, &note.IngredientID) != nil {
+			http.Error(w, "Invalid ingredient_id", http.StatusBadRequest)
+			return
+		}
+		if len(patch.MethodID) > 0 && json.Unmarshal(patch.MethodID, &note.MethodID) != nil {
+			http.Error(w, "Invalid method_id", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if anchor, err = noteAnchor(recipe.ID, *note); err != nil {
+			http.Error(w, err.Error(), noteErrorStatus(err))
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if repin {
+		_, err = tx.Exec("UPDATE recipe_notes SET ingredient_id = ?, method_id = ?, anchor = ? WHERE id = ?", note.IngredientID, note.MethodID, anchor, note.ID)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	_, err = tx.Exec("UPDATE recipe_notes SET text = ?, lastEditedAt = ? WHERE id = ?", note.Text, time.Now().Format("2006-01-02 15:04:05"), note.ID)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recipeChanged(recipe.ID, eventNoteUpdated)
+
+	writeJSON(w, http.StatusOK, getRecipeNote(recipe.ID, note.ID))
+}
+
+func deleteRecipeNote(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+	noteId, ok := pathID(w, r, "noteId")
+	if !ok {
+		return
+	}
+	if getRecipeNote(recipe.ID, noteId) == nil {
+		http.Error(w, "Note not found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM recipe_notes WHERE id = ?", noteId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recipeChanged(recipe.ID, eventNoteDeleted)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func noteErrorStatus(err error) int {
+	if errors.Is(err, errInvalidNote) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// foodsCSV is the bundled food table. Nutrients are per 100 g, density is in
+// g/ml and portions lists the weight in grams of one piece, clove, can etc.
+// An alias starting with ~ is a stand-in: another ingredient, only close
+// enough to estimate its nutrition with.
+//
+//go:embed data/foods.csv
+var foodsCSV string
+
+// Nutrients are in grams, except calories in kcal and sodium, calcium, iron
+// and vitamin C in milligrams.
+type Nutrients struct {
+	Calories      float64 `json:"calories"`
+	Protein       float64 `json:"protein"`
+	Fat           float64 `json:"fat"`
+	SaturatedFat  float64 `json:"saturatedFat"`
+	Carbohydrates float64 `json:"carbohydrates"`
+	Sugar         float64 `json:"sugar"`
+	Fiber         float64 `json:"fiber"`
+	Sodium        float64 `json:"sodium"`
+	Calcium       float64 `json:"calcium"`
+	Iron          float64 `json:"iron"`
+	VitaminC      float64 `json:"vitaminC"`
+}
+
+// scaled returns the nutrients multiplied by factor, rounded to one decimal.
+func (n Nutrients) scaled(factor float64) Nutrients {
+	round := func(value float64) float64 {
+		return float64(int64(value*factor*10+0.5)) / 10
+	}
+	return Nutrients{
+		Calories:      round(n.Calories),
+		Protein:       round(n.Protein),
+		Fat:           round(n.Fat),
+		SaturatedFat:  round(n.SaturatedFat),
+		Carbohydrates: round(n.Carbohydrates),
+		Sugar:         round(n.Sugar),
+		Fiber:         round(n.Fiber),
+		Sodium:        round(n.Sodium),
+		Calcium:       round(n.Calcium),
+		Iron:          round(n.Iron),
+		VitaminC:      round(n.VitaminC),
+	}
+}
+
+func (n *Nutrients) add(other Nutrients) {
+	n.Calories += other.Calories
+	n.Protein += other.Protein
+	n.Fat += other.Fat
+	n.SaturatedFat += other.SaturatedFat
+	n.Carbohydrates += other.Carbohydrates
+	n.Sugar += other.Sugar
+	n.Fiber += other.Fiber
+	n.Sodium += other.Sodium
+	n.Calcium += other.Calcium
+	n.Iron += other.Iron
+	n.VitaminC += other.VitaminC
+}
+
+// Food is a row of the food table. Aliases include the StandIns, which are
+// not synonyms, so the ingredient catalogue leaves them out.
+type Food struct {
+	Name     string             `json:"name"`
+	Aliases  []string           `json:"aliases"`
+	StandIns []string           `json:"standIns"`
+	Per100g  Nutrients          `json:"per100g"`
+	Density  float64            `json:"density"`
+	Portions map[string]float64 `json:"portions"`
+}
+
+// NutritionReport is the estimate for a whole recipe. PerServing divides the
+// total by the portion value and is missing when the recipe has no portion.
+type NutritionReport struct {
+	RecipeID    int                   `json:"recipe_id"`
+	Servings    float32               `json:"servings"`
+	Total       Nutrients             `json:"total"`
+	PerServing  *Nutrients            `json:"perServing"`
+	Ingredients []IngredientNutrition `json:"ingredients"`
+	Unmatched   []UnmatchedIngredient `json:"unmatched"`
+}
+
+// IngredientNutrition is how one ingredient was matched and weighed. Match is
+// "exact", "contains", "fuzzy" or "confirmed" for a user's own mapping.
+type IngredientNutrition struct {
+	IngredientID int       `json:"ingredient_id"`
+	Name         string    `json:"name"`
+	Food         string    `json:"food"`
+	Match        string    `json:"match"`
+	Confidence   float64   `json:"confidence"`
+	Grams        float64   `json:"grams"`
+	Nutrients    Nutrients `json:"nutrients"`
+	SubRecipeID  *int      `json:"sub_recipe_id,omitempty"`
+}
+
+type UnmatchedIngredient struct {
+	IngredientID int    `json:"ingredient_id"`
+	Name         string `json:"name"`
+	Food         string `json:"food,omitempty"`
+	Reason       string `json:"reason"`
+}
+
+type NutritionMapping struct {
+	ID         int    `json:"id"`
+	Ingredient string `json:"ingredient"`
+	Food       string `json:"food"`
+}
+
+var foods, foodKeys = loadFoods()
+
+// foodKeysByLength lists the keys of foodKeys longest first, so the most
+// specific name wins when several match.
+var foodKeysByLength = sortedFoodKeys()
+
+func sortedFoodKeys() []string {
+	keys := make([]string, 0, len(foodKeys))
+	for key := range foodKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// loadFoods parses the bundled table, and indexes every food by its
+// normalized name and aliases.
+func loadFoods() ([]Food, map[string]int) {
+	records, err := csv.NewReader(strings.NewReader(foodsCSV)).ReadAll()
+	if err != nil {
+		log.Fatal("Error reading food table: ", err)
+	}
+
+	var foods []Food
+	keys := map[string]int{}
+	for _, record := range records[1:] {
+		number := func(i int) float64 {
+			value, err := strconv.ParseFloat(record[i], 64)
+			if err != nil {
+				log.Fatalf("Error reading food table: %s column %d: %v", record[0], i, err)
+			}
+			return value
+		}
+
+		food := Food{
+			Name:     record[0],
+			Aliases:  []string{},
+			StandIns: []string{},
+			Per100g: Nutrients{
+				Calories:      number(2),
+				Protein:       number(3),
+				Fat:           number(4),
+				SaturatedFat:  number(5),
+				Carbohydrates: number(6),
+				Sugar:         number(7),
+				Fiber:         number(8),
+				Sodium:        number(9),
+				Calcium:       number(10),
+				Iron:          number(11),
+				VitaminC:      number(12),
+			},
+			Density:  number(13),
+			Portions: map[string]float64{},
+		}
+		if record[1] != "" {
+			for _, alias := range strings.Split(record[1], "|") {
+				if standIn, ok := strings.CutPrefix(alias, "~"); ok {
+					alias = standIn
+					food.StandIns = append(food.StandIns, alias)
+				}
+				food.Aliases = append(food.Aliases, alias)
+			}
+		}
+		for _, portion := range strings.Split(record[14], "|") {
+			if unit, grams, found := strings.Cut(portion, "="); found {
+				food.Portions[unit], _ = strconv.ParseFloat(grams, 64)
+			}
+		}
+
+		for _, name := range append([]string{food.Name}, food.Aliases...) {
+			keys[normalizeIngredientName(name)] = len(foods)
+		}
+		foods = append(foods, food)
+	}
+
+	return foods, keys
+}
+
+func findFood(name string) *Food {
+	if index, ok := foodKeys[normalizeIngredientName(name)]; ok {
+		return &foods[index]
+	}
+	return nil
+}
+
+// massUnits and volumeUnits convert a measurement to grams and millilitres.
+// Cups are metric cups.
+var massUnits = map[string]float64{
+	"g": 1, "gram": 1, "gr": 1,
+	"kg": 1000, "kilogram": 1000,
+	"mg": 0.001,
+	"oz": 28.35, "ounce": 28.35,
+	"lb": 453.6, "pound": 453.6,
+}
+
+var volumeUnits = map[string]float64{
+	"ml": 1, "millilitre": 1, "milliliter": 1,
+	"cl": 10, "dl": 100,
+	"l": 1000, "litre": 1000, "liter": 1000,
+	"tsp": 4.93, "teaspoon": 4.93,
+	"tbsp": 14.79, "tbs": 14.79, "tablespoon": 14.79,
+	"cup":   250,
+	"fl oz": 29.57, "fluid ounce": 29.57,
+	"pint": 568,
+	"dash": 0.6,
+}
+
+// pieceUnits all mean one of the food, with a size factor.
+var pieceUnits = map[string]float64{
+	"": 1, "piece": 1, "pc": 1, "whole": 1, "each": 1, "unit": 1,
+	"medium": 1, "large": 1.25, "small": 0.75,
+}
+
+// convertUnit converts a value between two measurements of the same kind:
+// mass, volume or pieces. With a density in g/ml it also converts between
+// mass and volume.
+func convertUnit(value float64, from string, to string, density float64) (float64, bool) {
+	from, to = normalizeUnit(from), normalizeUnit(to)
+	switch {
+	case from == to:
+		return value, true
+	case massUnits[from] > 0 && massUnits[to] > 0:
+		return value * massUnits[from] / massUnits[to], true
+	case volumeUnits[from] > 0 && volumeUnits[to] > 0:
+		return value * volumeUnits[from] / volumeUnits[to], true
+	case pieceUnits[from] > 0 && pieceUnits[to] > 0:
+		return value * pieceUnits[from] / pieceUnits[to], true
+	case density <= 0:
+		return 0, false
+	case massUnits[from] > 0 && volumeUnits[to] > 0:
+		return value * massUnits[from] / density / volumeUnits[to], true
+	case volumeUnits[from] > 0 && massUnits[to] > 0:
+		return value * volumeUnits[from] * density / massUnits[to], true
+	}
+	return 0, false
+}
+
+// ingredientGrams turns the value and measurement of an ingredient into
+// grams of the food, or explains why it cannot.
+func ingredientGrams(ingredient Ingredient, food *Food) (float64, string) {
+	if ingredient.Value <= 0 {
+		return 0, "no quantity"
+	}
+	value := float64(ingredient.Value)
+
+	unit := strings.TrimSuffix(strings.TrimSpace(strings.ToLower(ingredient.Measurement)), ".")
+	if unit != "fl oz" {
+		unit = singularize(unit)
+	}
+
+	if grams, ok := massUnits[unit]; ok {
+		return value * grams, ""
+	}
+	if ml, ok := volumeUnits[unit]; ok {
+		return value * ml * food.Density, ""
+	}
+	if grams, ok := food.Portions[unit]; ok {
+		return value * grams, ""
+	}
+	if size, ok := pieceUnits[unit]; ok {
+		if grams, ok := food.Portions["piece"]; ok {
+			return value * grams * size, ""
+		}
+		return 0, fmt.Sprintf("no weight for one %s", food.Name)
+	}
+
+	return 0, fmt.Sprintf("unknown measurement %q for %s", ingredient.Measurement, food.Name)
+}
+
+// matchFood finds the food for an ingredient name: a user's confirmed
+// mapping first, then an exact name, then the longest food name contained in
+// the ingredient name, and last a fuzzy match that allows small typos.
+func matchFood(name string, mappings map[string]string) (*Food, string, float64) {
+	normalized := normalizeIngredientName(name)
+	if normalized == "" {
+		return nil, "", 0
+	}
+
+	if foodName, ok := mappings[normalized]; ok {
+		if food := findFood(foodName); food != nil {
+			return food, "confirmed", 1
+		}
+	}
+
+	if index, ok := foodKeys[normalized]; ok {
+		return &foods[index], "exact", 1
+	}
+
+	for _, key := range foodKeysByLength {
+		if nameContainsTerm(normalized, key) {
+			confidence := float64(len(strings.Fields(key))) / float64(len(strings.Fields(normalized)))
+			return &foods[foodKeys[key]], "contains", float64(int(confidence*100)) / 100
+		}
+	}
+
+	bestKey, bestScore := "", 0.0
+	for _, key := range foodKeysByLength {
+		if score := fuzzyNameScore(normalized, key); score > bestScore {
+			bestKey, bestScore = key, score
+		}
+	}
+	if bestScore >= 0.8 {
+		return &foods[foodKeys[bestKey]], "fuzzy", float64(int(bestScore*100)) / 100
+	}
+
+	return nil, "", 0
+}
+
+// fuzzyNameScore is the average similarity of every word of the food key to
+// its closest word in the name, or 0 when one of them has no close word.
+func fuzzyNameScore(name string, key string) float64 {
+	words := strings.Fields(name)
+	total := 0.0
+	for _, keyWord := range strings.Fields(key) {
+		best := 0.0
+		for _, word := range words {
+			best = max(best, wordSimilarity(word, keyWord))
+		}
+		if best < 0.75 {
+			return 0
+		}
+		total += best
+	}
+	return total / float64(len(strings.Fields(key)))
+}
+
+// wordSimilarity is one minus the edit distance relative to the longer word.
+func wordSimilarity(a string, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 || len(rb) == 0 {
+		return 0
+	}
+
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return 1 - float64(previous[len(rb)])/float64(max(len(ra), len(rb)))
+}
+
+func getNutritionMappings(ownerId int) []NutritionMapping {
+	mappings := []NutritionMapping{}
+
+	rows, err := db.Query("SELECT id, ingredient, food FROM nutrition_mappings WHERE owner_id = ? ORDER BY ingredient", ownerId)
+	if err != nil {
+		return mappings
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mapping NutritionMapping
+		if rows.Scan(&mapping.ID, &mapping.Ingredient, &mapping.Food) == nil {
+			mappings = append(mappings, mapping)
+		}
+	}
+	return mappings
+}
+
+// estimateNutrition adds up the nutrients of every ingredient that can be
+// matched to a food and weighed, and lists the rest as unmatched.
+func estimateNutrition(recipe Recipe) NutritionReport {
+	mappings := map[string]string{}
+	for _, mapping := range getNutritionMappings(recipe.OwnerID) {
+		mappings[mapping.Ingredient] = mapping.Food
+	}
+
+	ingredients, unmatched, total := weighIngredients(recipe.Ingredients, mappings, map[int]bool{recipe.ID: true})
+	report := NutritionReport{
+		RecipeID:    recipe.ID,
+		Total:       total.scaled(1),
+		Ingredients: ingredients,
+		Unmatched:   unmatched,
+	}
+	if recipe.Portion != nil && recipe.Portion.Value > 0 {
+		report.Servings = recipe.Portion.Value
+		perServing := total.scaled(1 / float64(recipe.Portion.Value))
+		report.PerServing = &perServing
+	}
+
+	return report
+}
+
+// weighIngredients works out the nutrients of every ingredient. A sub-recipe
+// adds its share of the nutrients of the sub-recipe, and is unmatched when
+// any ingredient of it is. path holds the recipes being weighed, as in
+// expandIngredients.
+func weighIngredients(ingredients []Ingredient, mappings map[string]string, path map[int]bool) ([]IngredientNutrition, []UnmatchedIngredient, Nutrients) {
+	weighed := []IngredientNutrition{}
+	unmatched := []UnmatchedIngredient{}
+	var total Nutrients
+
+	for _, ingredient := range ingredients {
+		skip := func(food string, reason string) {
+			unmatched = append(unmatched, UnmatchedIngredient{
+				IngredientID: ingredient.ID,
+				Name:         ingredient.Name,
+				Food:         food,
+				Reason:       reason,
+			})
+		}
+
+		if subRecipeId := ingredient.SubRecipeID; subRecipeId != nil {
+			if path[*subRecipeId] || len(path) >= maxSubRecipeDepth || !recipeExists(*subRecipeId) {
+				skip("", "the sub-recipe cannot be resolved")
+				continue
+			}
+
+			path[*subRecipeId] = true
+			_, subUnmatched, subTotal := weighIngredients(getRecipeIngredients(*subRecipeId, ""), mappings, path)
+			delete(path, *subRecipeId)
+			if len(subUnmatched) > 0 {
+				skip("", fmt.Sprintf("%d ingredients of the sub-recipe have no match", len(subUnmatched)))
+				continue
+			}
+
+			scale, _ := subRecipeScale(ingredient, getRecipePortion(*subRecipeId))
+			nutrients := subTotal.scaled(scale)
+			total.add(nutrients)
+			weighed = append(weighed, IngredientNutrition{
+				IngredientID: ingredient.ID,
+				Name:         ingredient.Name,
+				Nutrients:    nutrients,
+				SubRecipeID:  subRecipeId,
+			})
+			continue
+		}
+
+		food, match, confidence := matchFood(ingredient.Name, mappings)
+		if food == nil {
+			skip("", "no matching food")
+			continue
+		}
+
+		grams, reason := ingredientGrams(ingredient, food)
+		if reason != "" {
+			skip(food.Name, reason)
+			continue
+		}
+
+		nutrients := food.Per100g.scaled(grams / 100)
+		total.add(nutrients)
+		weighed = append(weighed, IngredientNutrition{
+			IngredientID: ingredient.ID,
+			Name:         ingredient.Name,
+			Food:         food.Name,
+			Match:        match,
+			Confidence:   confidence,
+			Grams:        float64(int64(grams*10+0.5)) / 10,
+			Nutrients:    nutrients,
+		})
+	}
+
+	return weighed, unmatched, total
+}
+
+func registerNutritionRoutes(router *mux.Router) {
+	router.HandleFunc("/recipe/{id}/nutrition", getRecipeNutrition).Methods("GET")
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/recipes/{id}/nutrition", getRecipeNutrition).Methods("GET")
+	api.HandleFunc("/foods", getFoods).Methods("GET")
+	api.HandleFunc("/nutrition/mappings", getNutritionMappingsHandler).Methods("GET")
+	api.HandleFunc("/nutrition/mappings", saveNutritionMapping).Methods("PUT")
+	api.HandleFunc("/nutrition/mappings/{id}", deleteNutritionMapping).Methods("DELETE")
+}
+
+func getRecipeNutrition(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, estimateNutrition(recipe))
+}
+
+// getFoods lists the bundled foods, or with search the ones whose name or
+// aliases contain it, for picking a mapping.
+func getFoods(w http.ResponseWriter, r *http.Request) {
+	search := normalizeIngredientName(r.URL.Query().Get("search"))
+
+	result := []Food{}
+	for _, food := range foods {
+		if search == "" {
+			result = append(result, food)
+			continue
+		}
+		for _, name := range append([]string{food.Name}, food.Aliases...) {
+			if strings.Contains(normalizeIngredientName(name), search) {
+				result = append(result, food)
+				break
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func getNutritionMappingsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, getNutritionMappings(currentUser(r).ID))
+}
+
+// saveNutritionMapping confirms which food an ingredient name is. It applies
+// to every recipe of the user with an ingredient of that name.
+func saveNutritionMapping(w http.ResponseWriter, r *http.Request) {
+	var mapping NutritionMapping
+	if !decodeBody(w, r, &mapping) {
+		return
+	}
+
+	mapping.Ingredient = normalizeIngredientName(mapping.Ingredient)
+	if mapping.Ingredient == "" {
+		http.Error(w, "Ingredient is required", http.StatusBadRequest)
+		return
+	}
+	food := findFood(mapping.Food)
+	if food == nil {
+		http.Error(w, fmt.Sprintf("Unknown food %q", mapping.Food), http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO nutrition_mappings(owner_id, ingredient, food) VALUES(?,?,?)
+		ON CONFLICT(owner_id, ingredient) DO UPDATE SET food = excluded.food
+	`, currentUser(r).ID, mapping.Ingredient, food.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, getNutritionMappings(currentUser(r).ID))
+}
+
+func deleteNutritionMapping(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM nutrition_mappings WHERE id = ? AND owner_id = ?", id, currentUser(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Mapping not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
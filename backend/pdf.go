@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A4 in points, the unit of every PDF coordinate.
+const (
+	pdfPageWidth  = 595.28
+	pdfPageHeight = 841.89
+)
+
+// pdfMaxImageSide is the longest side in pixels an image that has to be
+// re-encoded is scaled down to, which is plenty for print.
+const pdfMaxImageSide = 1600
+
+// pdfFont is one of the standard fonts every PDF reader has, so no font
+// has to be embedded.
+type pdfFont int
+
+const (
+	fontRegular pdfFont = iota
+	fontBold
+	fontItalic
+)
+
+var pdfFontNames = []string{"Helvetica", "Helvetica-Bold", "Helvetica-Oblique"}
+
+// textStyle is how text is drawn: its font, size in points and gray level
+// from 0 (black) to 1 (white).
+type textStyle struct {
+	font pdfFont
+	size float64
+	gray float64
+}
+
+// pdfDocument is a PDF being built page by page in memory.
+type pdfDocument struct {
+	title string
+	pages []*pdfPage
+}
+
+// pdfPage is the content stream of a page. Coordinates passed to its
+// methods have their origin in the top left corner.
+type pdfPage struct {
+	content bytes.Buffer
+	images  []*pdfImage
+	links   []pdfLink
+}
+
+// pdfLink makes a rectangle of the page jump to another page by index.
+type pdfLink struct {
+	x, y, width, height float64
+	page                int
+}
+
+// pdfImage is an image ready to be embedded: JPEG data as it is, anything
+// else as compressed RGB.
+type pdfImage struct {
+	width, height int
+	colorSpace    string
+	filter        string
+	data          []byte
+}
+
+func (doc *pdfDocument) addPage() *pdfPage {
+	page := &pdfPage{}
+	doc.pages = append(doc.pages, page)
+	return page
+}
+
+// text draws a single line with its baseline at y.
+func (page *pdfPage) text(x, y float64, style textStyle, text string) {
+	fmt.Fprintf(&page.content, "BT %s g /F%d %s Tf %s %s Td (%s) Tj ET\n",
+		pdfNumber(style.gray), style.font+1, pdfNumber(style.size), pdfNumber(x), pdfNumber(pdfPageHeight-y), pdfEscape(winAnsi(text)))
+}
+
+func (page *pdfPage) line(x1, y1, x2, y2, width, gray float64) {
+	fmt.Fprintf(&page.content, "%s G %s w %s %s m %s %s l S\n",
+		pdfNumber(gray), pdfNumber(width), pdfNumber(x1), pdfNumber(pdfPageHeight-y1), pdfNumber(x2), pdfNumber(pdfPageHeight-y2))
+}
+
+// image draws img with its top left corner at x, y.
+func (page *pdfPage) image(img *pdfImage, x, y, width, height float64) {
+	index := -1
+	for i, used := range page.images {
+		if used == img {
+			index = i
+		}
+	}
+	if index < 0 {
+		index = len(page.images)
+		page.images = append(page.images, img)
+	}
+	fmt.Fprintf(&page.content, "q %s 0 0 %s %s %s cm /Im%d Do Q\n",
+		pdfNumber(width), pdfNumber(height), pdfNumber(x), pdfNumber(pdfPageHeight-y-height), index+1)
+}
+
+func (page *pdfPage) link(x, y, width, height float64, target int) {
+	page.links = append(page.links, pdfLink{x, y, width, height, target})
+}
+
+// newPdfImage prepares an image file for embedding. JPEGs are embedded as
+// they are; other formats are decoded, put on white and scaled down.
+func newPdfImage(data []byte) (*pdfImage, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if format == "jpeg" && config.ColorModel != color.CMYKModel {
+		colorSpace := "DeviceRGB"
+		if config.ColorModel == color.GrayModel {
+			colorSpace = "DeviceGray"
+		}
+		return &pdfImage{config.Width, config.Height, colorSpace, "DCTDecode", data}, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if side := max(width, height); side > pdfMaxImageSide {
+		width = max(1, width*pdfMaxImageSide/side)
+		height = max(1, height*pdfMaxImageSide/side)
+	}
+
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	row := make([]byte, width*3)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, a := src.At(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height).RGBA()
+			row[x*3] = byte((r + 0xffff - a) >> 8)
+			row[x*3+1] = byte((g + 0xffff - a) >> 8)
+			row[x*3+2] = byte((b + 0xffff - a) >> 8)
+		}
+		writer.Write(row)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return &pdfImage{width, height, "DeviceRGB", "FlateDecode", compressed.Bytes()}, nil
+}
+
+// write serializes the document: the catalog, page tree, info and fonts,
+// then every image once, then each page with its content stream.
+func (doc *pdfDocument) write(w io.Writer) error {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	stream := func(dict string, data []byte) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n<< %s /Length %d >>\nstream\n", len(offsets), dict, len(data))
+		out.Write(data)
+		out.WriteString("\nendstream\nendobj\n")
+	}
+
+	imageIds := map[*pdfImage]int{}
+	var images []*pdfImage
+	for _, page := range doc.pages {
+		for _, img := range page.images {
+			if _, ok := imageIds[img]; !ok {
+				imageIds[img] = 4 + len(pdfFontNames) + len(images)
+				images = append(images, img)
+			}
+		}
+	}
+	firstPage := 4 + len(pdfFontNames) + len(images)
+	pageId := func(index int) int { return firstPage + index*2 }
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	kids := make([]string, len(doc.pages))
+	for i := range doc.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", pageId(i))
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(doc.pages)))
+	object(fmt.Sprintf("<< /Title (%s) /CreationDate (D:%s) >>", pdfEscape(winAnsi(doc.title)), time.Now().Format("20060102150405")))
+
+	var fonts strings.Builder
+	for i, name := range pdfFontNames {
+		object(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", name))
+		fmt.Fprintf(&fonts, "/F%d %d 0 R ", i+1, 4+i)
+	}
+
+	for _, img := range images {
+		stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /%s",
+			img.width, img.height, img.colorSpace, img.filter), img.data)
+	}
+
+	for i, page := range doc.pages {
+		var resources strings.Builder
+		fmt.Fprintf(&resources, "/Font << %s>>", fonts.String())
+		if len(page.images) > 0 {
+			resources.WriteString(" /XObject << ")
+			for j, img := range page.images {
+				fmt.Fprintf(&resources, "/Im%d %d 0 R ", j+1, imageIds[img])
+			}
+			resources.WriteString(">>")
+		}
+
+		var annots strings.Builder
+		for _, link := range page.links {
+			if link.page < 0 || link.page >= len(doc.pages) {
+				continue
+			}
+			fmt.Fprintf(&annots, "<< /Type /Annot /Subtype /Link /Border [0 0 0] /Rect [%s %s %s %s] /Dest [%d 0 R /XYZ null null null] >> ",
+				pdfNumber(link.x), pdfNumber(pdfPageHeight-link.y-link.height), pdfNumber(link.x+link.width), pdfNumber(pdfPageHeight-link.y), pageId(link.page))
+		}
+
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << %s >> /Contents %d 0 R /Annots [%s] >>",
+			pdfNumber(pdfPageWidth), pdfNumber(pdfPageHeight), resources.String(), pageId(i)+1, annots.String()))
+
+		var content bytes.Buffer
+		writer := zlib.NewWriter(&content)
+		writer.Write(page.content.Bytes())
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		stream("/Filter /FlateDecode", content.Bytes())
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 3 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+func pdfNumber(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 32)
+}
+
+// pdfEscape writes text as the inside of a PDF string literal.
+func pdfEscape(text []byte) string {
+	var escaped strings.Builder
+	for _, c := range text {
+		switch {
+		case c == '\\' || c == '(' || c == ')':
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		case c < 32 || c > 126:
+			fmt.Fprintf(&escaped, "\\%03o", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+// winAnsiSpecials are the characters WinAnsiEncoding puts between 128 and
+// 159. From 160 on it matches Latin-1.
+var winAnsiSpecials = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88,
+	'‰': 0x89, 'Š': 0x8a, '‹': 0x8b, 'Œ': 0x8c, 'Ž': 0x8e, '‘': 0x91, '’': 0x92, '“': 0x93,
+	'”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98, '™': 0x99, 'š': 0x9a, '›': 0x9b,
+	'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+}
+
+// winAnsi encodes text for the standard fonts. Characters they do not have
+// become a question mark.
+func winAnsi(text string) []byte {
+	encoded := make([]byte, 0, len(text))
+	for _, r := range text {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			encoded = append(encoded, ' ')
+		case r < 32:
+		case r < 127 || (r >= 160 && r <= 255):
+			encoded = append(encoded, byte(r))
+		case winAnsiSpecials[r] != 0:
+			encoded = append(encoded, winAnsiSpecials[r])
+		default:
+			encoded = append(encoded, '?')
+		}
+	}
+	return encoded
+}
+
+// helveticaWidths and helveticaBoldWidths are the widths of the printable
+// ASCII characters in thousandths of the font size. The oblique font has
+// the same widths as the regular one.
+var helveticaWidths = []int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+var helveticaBoldWidths = []int{
+	278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+	975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+	333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+	611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+}
+
+// textWidth measures text in points. Characters outside ASCII are counted
+// as wide as a digit, which is close enough for wrapping.
+func textWidth(style textStyle, text string) float64 {
+	widths := helveticaWidths
+	if style.font == fontBold {
+		widths = helveticaBoldWidths
+	}
+	total := 0
+	for _, c := range winAnsi(text) {
+		switch {
+		case c >= 32 && c < 127:
+			total += widths[c-32]
+		case c == 0x95:
+			total += 350
+		case c == 0x85 || c == 0x97 || c == 0x89:
+			total += 1000
+		default:
+			total += 556
+		}
+	}
+	return float64(total) * style.size / 1000
+}
+
+// wrapText breaks text into lines no wider than width, breaking words that
+// do not fit on a line of their own.
+func wrapText(style textStyle, text string, width float64) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if textWidth(style, candidate) <= width {
+			line = candidate
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		line = word
+		for textWidth(style, line) > width {
+			runes := []rune(line)
+			cut := len(runes) - 1
+			for cut > 1 && textWidth(style, string(runes[:cut])) > width {
+				cut--
+			}
+			lines = append(lines, string(runes[:cut]))
+			line = string(runes[cut:])
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// truncateText shortens text with an ellipsis until it fits in width.
+func truncateText(style textStyle, text string, width float64) string {
+	if textWidth(style, text) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && textWidth(style, string(runes)+"…") > width {
+		runes = runes[:len(runes)-1]
+	}
+	return strings.TrimSpace(string(runes)) + "…"
+}
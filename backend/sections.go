@@ -0,0 +1,372 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// RecipeSection is a titled group of ingredients and methods. Items outside
+// of any divider form the first, untitled section.
+type RecipeSection struct {
+	DividerID   int          `json:"divider_id,omitempty"`
+	Title       string       `json:"title"`
+	Ingredients []Ingredient `json:"ingredients"`
+	Methods     []Method     `json:"methods"`
+}
+
+// sectionLayout places ingredients and methods in a divider, or outside of
+// any divider when DividerID is 0, in the order they are listed.
+type sectionLayout struct {
+	DividerID   int   `json:"divider_id"`
+	Ingredients []int `json:"ingredients"`
+	Methods     []int `json:"methods"`
+}
+
+// sectionItems describes the rows that can be put in a divider: ingredients
+// or methods, and the table linking them to their divider.
+type sectionItems struct {
+	table  string
+	links  string
+	column string
+}
+
+var (
+	ingredientSections = sectionItems{"ingredients", "divider_ingredients", "ingredient_id"}
+	methodSections     = sectionItems{"methods", "divider_methods", "method_id"}
+)
+
+func registerSectionRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/recipes/{id}/sections", getSections).Methods("GET")
+	api.HandleFunc("/recipes/{id}/sections", replaceSections).Methods("PUT")
+}
+
+// recipeSections groups the ingredients and methods of the recipe by divider
+// in display order, starting with the items that are in no divider.
+func recipeSections(recipe Recipe) []RecipeSection {
+	sections := []RecipeSection{{Ingredients: []Ingredient{}, Methods: []Method{}}}
+	index := map[int]int{}
+	for _, divider := range recipe.Dividers {
+		index[divider.ID] = len(sections)
+		sections = append(sections, RecipeSection{
+			DividerID:   divider.ID,
+			Title:       divider.Title,
+			Ingredients: []Ingredient{},
+			Methods:     []Method{},
+		})
+	}
+
+	section := func(dividerId *int) *RecipeSection {
+		if dividerId != nil {
+			if i, ok := index[*dividerId]; ok {
+				return &sections[i]
+			}
+		}
+		return &sections[0]
+	}
+	for _, ingredient := range recipe.Ingredients {
+		s := section(ingredient.DividerID)
+		s.Ingredients = append(s.Ingredients, ingredient)
+	}
+	for _, method := range recipe.Methods {
+		s := section(method.DividerID)
+		s.Methods = append(s.Methods, method)
+	}
+
+	return sections
+}
+
+// dividerIds returns the divider of every item in one, by item id.
+func (items sectionItems) dividerIds(ids []int) map[int]int {
+	dividers := map[int]int{}
+	if len(ids) == 0 {
+		return dividers
+	}
+
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = strconv.Itoa(id)
+	}
+	rows, err := db.Query("SELECT " + items.column + ", divider_id FROM " + items.links + " WHERE " + items.column + " IN (" + strings.Join(values, ", ") + ")")
+	if err != nil {
+		fmt.Println("Error loading dividers:", err)
+		return dividers
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, dividerId int
+		if rows.Scan(&id, &dividerId) == nil {
+			dividers[id] = dividerId
+		}
+	}
+	return dividers
+}
+
+// loadIngredientDividers sets DividerID on the ingredients that are in a
+// divider.
+func loadIngredientDividers(ingredients []Ingredient) {
+	ids := make([]int, len(ingredients))
+	for i, ingredient := range ingredients {
+		ids[i] = ingredient.ID
+	}
+	dividers := ingredientSections.dividerIds(ids)
+	for i := range ingredients {
+		if dividerId, ok := dividers[ingredients[i].ID]; ok {
+			ingredients[i].DividerID = &dividerId
+		}
+	}
+}
+
+// loadMethodDividers sets DividerID on the methods that are in a divider.
+func loadMethodDividers(methods []Method) {
+	ids := make([]int, len(methods))
+	for i, method := range methods {
+		ids[i] = method.ID
+	}
+	dividers := methodSections.dividerIds(ids)
+	for i := range methods {
+		if dividerId, ok := dividers[methods[i].ID]; ok {
+			methods[i].DividerID = &dividerId
+		}
+	}
+}
+
+// move puts the item in the divider inside tx, taking it out of the one it
+// was in, or leaves it in no divider when dividerId is 0. An item is only
+// moved to a divider of its own recipe, and otherwise left where it is.
+func (items sectionItems) move(tx *sql.Tx, itemId int, dividerId int) error {
+	if dividerId == 0 {
+		_, err := tx.Exec("DELETE FROM "+items.links+" WHERE "+items.column+" = ?", itemId)
+		return err
+	}
+
+	_, err := tx.Exec(`
+		DELETE FROM `+items.links+` WHERE `+items.column+` = ? AND EXISTS (
+			SELECT 1 FROM `+items.table+` i JOIN dividers d ON d.recipe_id = i.recipe_id
+			WHERE i.id = ? AND d.id = ?
+		)
+	`, itemId, itemId, dividerId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO `+items.links+`(`+items.column+`, divider_id)
+		SELECT i.id, d.id FROM `+items.table+` i JOIN dividers d ON d.recipe_id = i.recipe_id
+		WHERE i.id = ? AND d.id = ?
+	`, itemId, dividerId)
+	return err
+}
+
+// moveToDivider moves the items into the divider in one transaction.
+func moveToDivider(items sectionItems, itemIds []int, dividerId int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, itemId := range itemIds {
+		if err := items.move(tx, itemId, dividerId); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// checkRecipeDivider writes a 400 response unless dividerId is 0 or a
+// divider of the recipe.
+func checkRecipeDivider(w http.ResponseWriter, recipe Recipe, dividerId int) bool {
+	if dividerId == 0 || getDividerById(dividerId).RecipeID == recipe.ID {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("Divider %d not found", dividerId), http.StatusBadRequest)
+	return false
+}
+
+func getSections(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recipe.Sections)
+}
+
+// replaceSections lays the recipe out in the given order: dividers are
+// ordered as listed, and every listed ingredient and method moves to its
+// section. Items that are not listed keep their divider and follow the listed
+// ones.
+func replaceSections(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var layout []sectionLayout
+	if !decodeBody(w, r, &layout) {
+		return
+	}
+
+	dividers := map[int]bool{}
+	for _, divider := range recipe.Dividers {
+		dividers[divider.ID] = true
+	}
+	ingredients := map[int]bool{}
+	for _, ingredient := range recipe.Ingredients {
+		ingredients[ingredient.ID] = true
+	}
+	methods := map[int]bool{}
+	for _, method := range recipe.Methods {
+		methods[method.ID] = true
+	}
+
+	listed := map[string]bool{}
+	check := func(kind string, known map[int]bool, id int) bool {
+		name := fmt.Sprintf("%s %d", kind, id)
+		if !known[id] {
+			http.Error(w, name+" not found", http.StatusBadRequest)
+			return false
+		}
+		if listed[name] {
+			http.Error(w, name+" is listed twice", http.StatusBadRequest)
+			return false
+		}
+		listed[name] = true
+		return true
+	}
+	for _, section := range layout {
+		if section.DividerID != 0 && !check("Divider", dividers, section.DividerID) {
+			return
+		}
+		for _, id := range section.Ingredients {
+			if !check("Ingredient", ingredients, id) {
+				return
+			}
+		}
+		for _, id := range section.Methods {
+			if !check("Method", methods, id) {
+				return
+			}
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := saveSectionsTx(tx, recipe, layout); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeChanged(recipe.ID, eventDividerUpdated)
+
+	writeJSON(w, http.StatusOK, getRecipeById(recipe.ID).Sections)
+}
+
+func saveSectionsTx(tx *sql.Tx, recipe Recipe, layout []sectionLayout) error {
+	var dividerIds, ingredientIds, methodIds []int
+	for _, section := range layout {
+		if section.DividerID != 0 {
+			dividerIds = append(dividerIds, section.DividerID)
+		}
+		for _, id := range section.Ingredients {
+			if err := ingredientSections.move(tx, id, section.DividerID); err != nil {
+				return err
+			}
+			ingredientIds = append(ingredientIds, id)
+		}
+		for _, id := range section.Methods {
+			if err := methodSections.move(tx, id, section.DividerID); err != nil {
+				return err
+			}
+			methodIds = append(methodIds, id)
+		}
+	}
+
+	// unlisted items follow in their current order
+	for _, divider := range recipe.Dividers {
+		if !slices.Contains(dividerIds, divider.ID) {
+			dividerIds = append(dividerIds, divider.ID)
+		}
+	}
+	for _, ingredient := range recipe.Ingredients {
+		if !slices.Contains(ingredientIds, ingredient.ID) {
+			ingredientIds = append(ingredientIds, ingredient.ID)
+		}
+	}
+	for _, method := range recipe.Methods {
+		if !slices.Contains(methodIds, method.ID) {
+			methodIds = append(methodIds, method.ID)
+		}
+	}
+
+	for _, table := range []struct {
+		name string
+		ids  []int
+	}{
+		{"dividers", dividerIds},
+		{"ingredients", ingredientIds},
+		{"methods", methodIds},
+	} {
+		for i, id := range table.ids {
+			if _, err := tx.Exec("UPDATE "+table.name+" SET sortOrder = ? WHERE id = ?", i+1, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteDivider removes a single divider. Its ingredients and methods stay on
+// the recipe, outside of any divider.
+func deleteDivider(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "divider_id")
+	if !ok {
+		return
+	}
+
+	if !ownsRecipeChild("dividers", id, currentUser(r).ID) {
+		http.Error(w, "Divider not found", http.StatusNotFound)
+		return
+	}
+	recipeId := recipeChildRecipeId("dividers", id)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := removeDivider(tx, recipeId, id); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recipeChanged(recipeId, eventDividerDeleted)
+
+	w.WriteHeader(http.StatusNoContent)
+}
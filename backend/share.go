@@ -0,0 +1,253 @@
+package main
+
+import (
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//go:embed templates
+var templateFiles embed.FS
+
+var templateFuncs = template.FuncMap{
+	"quantity": formatQuantity,
+}
+
+var shareTemplate = template.Must(template.New("share.html").Funcs(templateFuncs).ParseFS(templateFiles, "templates/share.html", "templates/recipe.html"))
+
+type Share struct {
+	ID           int     `json:"id"`
+	RecipeID     int     `json:"recipe_id,omitempty"`
+	CollectionID int     `json:"collection_id,omitempty"`
+	Token        string  `json:"token,omitempty"`
+	Url          string  `json:"url,omitempty"`
+	CreatedAt    string  `json:"createdAt"`
+	ExpiresAt    *string `json:"expiresAt"`
+	RevokedAt    *string `json:"revokedAt"`
+}
+
+type sharePage struct {
+	Recipe   Recipe
+	ImageURL template.URL
+	Sections []RecipeSection
+}
+
+func registerShareRoutes(router *mux.Router) {
+	router.HandleFunc("/s/{token}", viewShare).Methods("GET")
+	router.HandleFunc("/recipe/{id}/share", createShare).Methods("POST")
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/recipes/{id}/shares", createShare).Methods("POST")
+	api.HandleFunc("/recipes/{id}/shares", getRecipeShares).Methods("GET")
+	api.HandleFunc("/shares/{id}", revokeShare).Methods("DELETE")
+}
+
+func formatQuantity(value float32) string {
+	return strconv.FormatFloat(float64(value), 'f', -1, 32)
+}
+
+// createShare mints a new link for the recipe.
+func createShare(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+	insertShare(w, r, "recipe_id", recipe.ID)
+}
+
+// insertShare mints a link to the recipe or collection whose id is stored in
+// column. The token is only returned here; the database keeps its hash. An
+// optional expiresInHours limits how long the link works.
+func insertShare(w http.ResponseWriter, r *http.Request, column string, id int) {
+	var req struct {
+		ExpiresInHours float64 `json:"expiresInHours"`
+	}
+	if r.ContentLength != 0 && !decodeBody(w, r, &req) {
+		return
+	}
+	if req.ExpiresInHours < 0 {
+		http.Error(w, "expiresInHours must be positive", http.StatusBadRequest)
+		return
+	}
+
+	token := generateToken()
+	now := time.Now()
+
+	var expiresAt *string
+	if req.ExpiresInHours > 0 {
+		value := now.Add(time.Duration(req.ExpiresInHours * float64(time.Hour))).Format("2006-01-02 15:04:05")
+		expiresAt = &value
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO shares(`+column+`, token_hash, created_by, createdAt, expiresAt) VALUES(?,?,?,?,?)
+	`, id, hashToken(token), currentUser(r).ID, now.Format("2006-01-02 15:04:05"), expiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	shareId, _ := result.LastInsertId()
+	share := getShareById(int(shareId))
+	share.Token = token
+	share.Url = fmt.Sprintf("%s/s/%s", requestBaseURL(r), token)
+
+	writeJSON(w, http.StatusCreated, share)
+}
+
+// requestBaseURL is the scheme and host the client used to reach the server,
+// honouring a reverse proxy's X-Forwarded-Proto.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+const shareColumns = "id, COALESCE(recipe_id, 0), COALESCE(collection_id, 0), createdAt, expiresAt, revokedAt"
+
+func scanShare(row interface{ Scan(...any) error }, share *Share) error {
+	return row.Scan(&share.ID, &share.RecipeID, &share.CollectionID, &share.CreatedAt, &share.ExpiresAt, &share.RevokedAt)
+}
+
+func queryShares(query string, args ...any) ([]Share, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		var share Share
+		if err := scanShare(rows, &share); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+func getShareById(id int) *Share {
+	var share Share
+	if err := scanShare(db.QueryRow("SELECT "+shareColumns+" FROM shares WHERE id = ?", id), &share); err != nil {
+		return nil
+	}
+	return &share
+}
+
+func getRecipeShares(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	shares, err := queryShares("SELECT "+shareColumns+" FROM shares WHERE recipe_id = ? ORDER BY id DESC", recipe.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, shares)
+}
+
+func revokeShare(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var createdBy int
+	if err := db.QueryRow("SELECT created_by FROM shares WHERE id = ?", id).Scan(&createdBy); err != nil || createdBy != currentUser(r).ID {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	}
+
+	_, err := db.Exec("UPDATE shares SET revokedAt = ? WHERE id = ? AND revokedAt IS NULL", time.Now().Format("2006-01-02 15:04:05"), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getActiveShare looks the token up, ignoring revoked and expired links.
+func getActiveShare(token string) *Share {
+	var share Share
+	err := scanShare(db.QueryRow(`
+		SELECT `+shareColumns+` FROM shares
+		WHERE token_hash = ? AND revokedAt IS NULL AND (expiresAt IS NULL OR expiresAt > ?)
+	`, hashToken(token), time.Now().Format("2006-01-02 15:04:05")), &share)
+	if err != nil {
+		return nil
+	}
+	return &share
+}
+
+// viewShare renders the shared recipe or collection as a standalone page.
+// It needs no login.
+func viewShare(w http.ResponseWriter, r *http.Request) {
+	share := getActiveShare(mux.Vars(r)["token"])
+	if share == nil {
+		http.Error(w, "This link does not exist, has expired or was revoked.", http.StatusNotFound)
+		return
+	}
+
+	var tmpl *template.Template
+	var page any
+	if share.CollectionID != 0 {
+		collection := getCollectionById(share.CollectionID)
+		if collection == nil {
+			http.Error(w, "This collection no longer exists.", http.StatusNotFound)
+			return
+		}
+		tmpl, page = collectionTemplate, newCollectionPage(*collection)
+	} else {
+		recipe := getRecipeById(share.RecipeID)
+		if recipe.ID == 0 {
+			http.Error(w, "This recipe no longer exists.", http.StatusNotFound)
+			return
+		}
+		tmpl, page = shareTemplate, newSharePage(recipe)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	if err := tmpl.Execute(w, page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func newSharePage(recipe Recipe) sharePage {
+	return sharePage{
+		Recipe:   recipe,
+		ImageURL: imageDataURL(recipe.Image),
+		Sections: recipeSections(recipe),
+	}
+}
+
+// imageDataURL inlines the stored image so the page has no other requests.
+func imageDataURL(image *Image) template.URL {
+	if image == nil || image.Url == "" {
+		return ""
+	}
+
+	data, err := base64.StdEncoding.DecodeString(image.Url)
+	if err != nil {
+		return ""
+	}
+
+	return template.URL("data:" + http.DetectContentType(data) + ";base64," + image.Url)
+}
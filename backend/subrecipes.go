@@ -0,0 +1,390 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// SubRecipe is a recipe used as an ingredient of another one, inlined with
+// ?expand=true. Its ingredients are scaled by Scale, the quantity the
+// ingredient asks for against the sub-recipe's portion.
+type SubRecipe struct {
+	RecipeID    int          `json:"recipe_id"`
+	Name        string       `json:"name"`
+	Scale       float64      `json:"scale"`
+	Note        string       `json:"note,omitempty"`
+	Ingredients []Ingredient `json:"ingredients"`
+	Methods     []Method     `json:"methods"`
+}
+
+// FlatIngredient is an ingredient of the flattened list, where the
+// ingredients of every sub-recipe are added up with those of the recipe.
+type FlatIngredient struct {
+	Name        string  `json:"name"`
+	Measurement string  `json:"measurement"`
+	Value       float32 `json:"value"`
+	RecipeIDs   []int   `json:"recipe_ids"`
+}
+
+// RecipeReference is a recipe that uses another one as an ingredient.
+type RecipeReference struct {
+	RecipeID     int    `json:"recipe_id"`
+	Name         string `json:"name"`
+	IngredientID int    `json:"ingredient_id"`
+}
+
+// maxSubRecipeDepth stops expanding sub-recipes of sub-recipes at some point.
+const maxSubRecipeDepth = 10
+
+var (
+	errSubRecipeCycle = errors.New("sub-recipe cycle")
+	// errSubRecipeNotFound is a sub_recipe_id that is not one of the owner's
+	// recipes. It is a bad request body rather than a missing resource, so
+	// it is answered with 400 and not 404.
+	errSubRecipeNotFound = errors.New("sub-recipe not found")
+)
+
+func registerSubRecipeRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/recipes/{id}/ingredients/flat", getFlatIngredients).Methods("GET")
+	api.HandleFunc("/recipes/{id}/references", getRecipeReferencesHandler).Methods("GET")
+}
+
+// loadSubRecipeIds sets SubRecipeID on the ingredients that point at another
+// recipe.
+func loadSubRecipeIds(ingredients []Ingredient) {
+	if len(ingredients) == 0 {
+		return
+	}
+
+	ids := make([]string, len(ingredients))
+	for i, ingredient := range ingredients {
+		ids[i] = fmt.Sprint(ingredient.ID)
+	}
+	rows, err := db.Query("SELECT ingredient_id, recipe_id FROM ingredient_recipes WHERE ingredient_id IN (" + strings.Join(ids, ", ") + ")")
+	if err != nil {
+		fmt.Println("Error loading sub-recipes:", err)
+		return
+	}
+	defer rows.Close()
+
+	links := map[int]int{}
+	for rows.Next() {
+		var ingredientId, recipeId int
+		if rows.Scan(&ingredientId, &recipeId) == nil {
+			links[ingredientId] = recipeId
+		}
+	}
+	for i := range ingredients {
+		if recipeId, ok := links[ingredients[i].ID]; ok {
+			ingredients[i].SubRecipeID = &recipeId
+		}
+	}
+}
+
+// queryer is the database or a transaction, to see what is not committed yet.
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// execer is the database or a transaction, to write within it.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// dbtx is the database or a transaction, to read and write within it.
+type dbtx interface {
+	queryer
+	execer
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// getSubRecipeIds returns the recipes the recipe uses as ingredients.
+func getSubRecipeIds(q queryer, recipeId int) []int {
+	rows, err := q.Query(`
+		SELECT DISTINCT ir.recipe_id FROM ingredient_recipes ir
+		JOIN ingredients i ON i.id = ir.ingredient_id
+		WHERE i.recipe_id = ?
+	`, recipeId)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// usesRecipe reports whether the recipe uses the other one, directly or
+// through one of its sub-recipes.
+func usesRecipe(q queryer, recipeId int, otherId int, seen map[int]bool) bool {
+	if recipeId == otherId {
+		return true
+	}
+	if seen[recipeId] {
+		return false
+	}
+	seen[recipeId] = true
+	for _, id := range getSubRecipeIds(q, recipeId) {
+		if usesRecipe(q, id, otherId, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSubRecipe checks that an ingredient of the recipe may point at the
+// sub-recipe: it has to belong to the same owner and must not use the recipe
+// itself, directly or through its own sub-recipes.
+func validateSubRecipe(recipeId int, ownerId int, subRecipeId int) error {
+	if subRecipeId == 0 {
+		return nil
+	}
+	if getOwnedRecipe(subRecipeId, ownerId).ID == 0 {
+		return fmt.Errorf("%w: recipe %d is not one of your recipes", errSubRecipeNotFound, subRecipeId)
+	}
+	if usesRecipe(db, subRecipeId, recipeId, map[int]bool{}) {
+		return fmt.Errorf("%w: recipe %d uses this recipe already", errSubRecipeCycle, subRecipeId)
+	}
+	return nil
+}
+
+// recipeExists reports whether the recipe is still there, as a sub-recipe
+// link can outlive it in an older database.
+func recipeExists(recipeId int) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM recipes WHERE id = ?", recipeId).Scan(&count)
+	return count > 0
+}
+
+// linkSubRecipe points the ingredient at the sub-recipe, or unlinks it when
+// subRecipeId is 0.
+func linkSubRecipe(e execer, ingredientId int, subRecipeId int) error {
+	if subRecipeId == 0 {
+		_, err := e.Exec("DELETE FROM ingredient_recipes WHERE ingredient_id = ?", ingredientId)
+		return err
+	}
+
+	_, err := e.Exec(`
+		INSERT INTO ingredient_recipes(ingredient_id, recipe_id) VALUES(?,?)
+		ON CONFLICT(ingredient_id) DO UPDATE SET recipe_id = excluded.recipe_id
+	`, ingredientId, subRecipeId)
+	return err
+}
+
+// subRecipeErrorStatus is the response status for an error of
+// validateSubRecipe.
+func subRecipeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errSubRecipeCycle):
+		return http.StatusConflict
+	case errors.Is(err, errSubRecipeNotFound):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// subRecipeScale is how many batches of the sub-recipe the ingredient asks
+// for: its quantity against the sub-recipe's portion, converting between
+// mass or volume units. Without a portion to compare with, the value of the
+// ingredient is the number of batches.
+func subRecipeScale(ingredient Ingredient, portion *Portion) (float64, string) {
+	value := float64(ingredient.Value)
+	if portion == nil || portion.Value <= 0 {
+		if value > 0 && ingredient.Measurement == "" {
+			return value, ""
+		}
+		return 1, "the sub-recipe has no portion, using one batch"
+	}
+	if value <= 0 {
+		return 1, "the ingredient has no quantity, using one batch"
+	}
+
+	if normalizeUnit(ingredient.Measurement) == "" {
+		return value / float64(portion.Value), ""
+	}
+	if converted, ok := convertUnit(value, ingredient.Measurement, portion.Measurement, 0); ok {
+		return converted / float64(portion.Value), ""
+	}
+	return 1, fmt.Sprintf("cannot compare %s with %s, using one batch", ingredient.Measurement, portion.Measurement)
+}
+
+// normalizeUnit lowercases a measurement and makes it singular, as
+// ingredientGrams does.
+func normalizeUnit(measurement string) string {
+	unit := strings.TrimSuffix(strings.TrimSpace(strings.ToLower(measurement)), ".")
+	if unit != "fl oz" {
+		unit = singularize(unit)
+	}
+	return unit
+}
+
+// expandIngredients inlines the sub-recipe of every ingredient that has one.
+// path holds the recipes being expanded, so a cycle that slipped into the
+// database cannot recurse forever.
+func expandIngredients(ingredients []Ingredient, path map[int]bool) {
+	if len(path) >= maxSubRecipeDepth {
+		return
+	}
+
+	for i := range ingredients {
+		subRecipeId := ingredients[i].SubRecipeID
+		if subRecipeId == nil || path[*subRecipeId] {
+			continue
+		}
+
+		recipe := getRecipeById(*subRecipeId)
+		if recipe.ID == 0 {
+			continue
+		}
+
+		scale, note := subRecipeScale(ingredients[i], recipe.Portion)
+		subRecipe := &SubRecipe{
+			RecipeID:    recipe.ID,
+			Name:        recipe.Name,
+			Scale:       scale,
+			Note:        note,
+			Ingredients: scaleIngredients(recipe.Ingredients, scale),
+			Methods:     recipe.Methods,
+		}
+		if subRecipe.Methods == nil {
+			subRecipe.Methods = []Method{}
+		}
+
+		path[recipe.ID] = true
+		expandIngredients(subRecipe.Ingredients, path)
+		delete(path, recipe.ID)
+
+		ingredients[i].SubRecipe = subRecipe
+	}
+}
+
+func scaleIngredients(ingredients []Ingredient, scale float64) []Ingredient {
+	scaled := make([]Ingredient, len(ingredients))
+	for i, ingredient := range ingredients {
+		ingredient.Value = float32(float64(ingredient.Value) * scale)
+		scaled[i] = ingredient
+	}
+	return scaled
+}
+
+// expandRecipe inlines the sub-recipes of the recipe's ingredients.
+func expandRecipe(recipe *Recipe) {
+	expandIngredients(recipe.Ingredients, map[int]bool{recipe.ID: true})
+	recipe.Sections = recipeSections(*recipe)
+}
+
+// flattenIngredients lists what is needed to cook the recipe and all of its
+// sub-recipes: an ingredient that is a sub-recipe is replaced by the
+// ingredients of it, and the same ingredient in the same unit is added up.
+func flattenIngredients(recipe Recipe) []FlatIngredient {
+	ingredients := append([]Ingredient(nil), recipe.Ingredients...)
+	expandIngredients(ingredients, map[int]bool{recipe.ID: true})
+
+	flat := []FlatIngredient{}
+	index := map[string]int{}
+	var add func(ingredients []Ingredient)
+	add = func(ingredients []Ingredient) {
+		for _, ingredient := range ingredients {
+			if ingredient.SubRecipe != nil {
+				add(ingredient.SubRecipe.Ingredients)
+				continue
+			}
+
+			key := normalizeIngredientName(ingredient.Name) + "|" + normalizeUnit(ingredient.Measurement)
+			i, ok := index[key]
+			if !ok {
+				i = len(flat)
+				index[key] = i
+				flat = append(flat, FlatIngredient{Name: ingredient.Name, Measurement: ingredient.Measurement, RecipeIDs: []int{}})
+			}
+			flat[i].Value += ingredient.Value
+			if !slices.Contains(flat[i].RecipeIDs, ingredient.RecipeID) {
+				flat[i].RecipeIDs = append(flat[i].RecipeIDs, ingredient.RecipeID)
+			}
+		}
+	}
+	add(ingredients)
+
+	sort.SliceStable(flat, func(i, j int) bool {
+		return strings.ToLower(flat[i].Name) < strings.ToLower(flat[j].Name)
+	})
+	return flat
+}
+
+func getFlatIngredients(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, flattenIngredients(recipe))
+}
+
+// getRecipeReferences lists the recipes that use the recipe as an
+// ingredient.
+func getRecipeReferences(recipeId int) []RecipeReference {
+	references := []RecipeReference{}
+	rows, err := db.Query(`
+		SELECT r.id, r.name, i.id FROM ingredient_recipes ir
+		JOIN ingredients i ON i.id = ir.ingredient_id
+		JOIN recipes r ON r.id = i.recipe_id
+		WHERE ir.recipe_id = ?
+		ORDER BY r.id, i.sortOrder
+	`, recipeId)
+	if err != nil {
+		fmt.Println("Error loading recipe references:", err)
+		return references
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var reference RecipeReference
+		if rows.Scan(&reference.RecipeID, &reference.Name, &reference.IngredientID) == nil {
+			references = append(references, reference)
+		}
+	}
+	return references
+}
+
+func getRecipeReferencesHandler(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, getRecipeReferences(recipe.ID))
+}
+
+// checkRecipeReferences blocks deleting a recipe that other recipes use as
+// an ingredient, unless ?force=true. It writes a 409 response listing them.
+func checkRecipeReferences(w http.ResponseWriter, r *http.Request, recipeId int) bool {
+	if r.URL.Query().Get("force") == "true" {
+		return true
+	}
+
+	references := getRecipeReferences(recipeId)
+	if len(references) == 0 {
+		return true
+	}
+
+	names := make([]string, len(references))
+	for i, reference := range references {
+		names[i] = reference.Name
+	}
+	http.Error(w, fmt.Sprintf("The recipe is used as an ingredient of %s, delete with ?force=true to unlink it", strings.Join(names, ", ")), http.StatusConflict)
+	return false
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Substitution says what can replace an amount of an ingredient, e.g. 1 cup
+// buttermilk is 1 cup milk and 1 tbsp lemon juice. Built-in substitutions
+// are shared by everyone and only admins can change them. Users add their
+// own on top.
+type Substitution struct {
+	ID          int                `json:"id"`
+	Ingredient  string             `json:"ingredient"`
+	Value       float64            `json:"value"`
+	Measurement string             `json:"measurement"`
+	Lines       []SubstitutionLine `json:"lines"`
+	Note        string             `json:"note"`
+	BuiltIn     bool               `json:"builtIn"`
+}
+
+type SubstitutionLine struct {
+	Name        string  `json:"name"`
+	Value       float64 `json:"value"`
+	Measurement string  `json:"measurement"`
+}
+
+// SubstitutionReport lists the ingredients of a recipe that need replacing,
+// because they are missing or contain an allergen to avoid, with their
+// substitutions scaled to the recipe. Unmatched holds the missing names that
+// are not ingredients of the recipe.
+type SubstitutionReport struct {
+	RecipeID    int                       `json:"recipe_id"`
+	Ingredients []IngredientSubstitutions `json:"ingredients"`
+	Unmatched   []string                  `json:"unmatched"`
+}
+
+// IngredientSubstitutions is why an ingredient needs replacing, "missing" or
+// "contains egg", and what it can be replaced with.
+type IngredientSubstitutions struct {
+	IngredientID  int                     `json:"ingredient_id"`
+	Name          string                  `json:"name"`
+	Measurement   string                  `json:"measurement"`
+	Value         float32                 `json:"value"`
+	Reasons       []string                `json:"reasons"`
+	Substitutions []SuggestedSubstitution `json:"substitutions"`
+}
+
+// SuggestedSubstitution is a substitution multiplied by Scale to match the
+// ingredient. When the quantities cannot be compared Scale is 1 and Warning
+// says so.
+type SuggestedSubstitution struct {
+	SubstitutionID int                `json:"substitution_id"`
+	Scale          float64            `json:"scale"`
+	Lines          []SubstitutionLine `json:"lines"`
+	Text           string             `json:"text"`
+	Note           string             `json:"note"`
+	Warning        string             `json:"warning,omitempty"`
+}
+
+// defaultSubstitutions is seeded as the built-in substitutions.
+var defaultSubstitutions = []Substitution{
+	{Ingredient: "buttermilk", Value: 1, Measurement: "cup", Lines: []SubstitutionLine{{"milk", 1, "cup"}, {"lemon juice", 1, "tbsp"}}, Note: "stir and leave for 5 minutes"},
+	{Ingredient: "buttermilk", Value: 1, Measurement: "cup", Lines: []SubstitutionLine{{"yogurt", 0.75, "cup"}, {"milk", 0.25, "cup"}}},
+	{Ingredient: "egg", Value: 1, Lines: []SubstitutionLine{{"ground flaxseed", 1, "tbsp"}, {"water", 3, "tbsp"}}, Note: "leave for 5 minutes to thicken, binds but does not rise"},
+	{Ingredient: "egg", Value: 1, Lines: []SubstitutionLine{{"aquafaba", 3, "tbsp"}}, Note: "whips like egg white"},
+	{Ingredient: "egg", Value: 1, Lines: []SubstitutionLine{{"apple sauce", 60, "g"}}, Note: "for cakes and muffins"},
+	{Ingredient: "milk", Value: 1, Measurement: "cup", Lines: []SubstitutionLine{{"oat milk", 1, "cup"}}},
+	{Ingredient: "milk", Value: 1, Measurement: "cup", Lines: []SubstitutionLine{{"soy milk", 1, "cup"}}},
+	{Ingredient: "butter", Value: 100, Measurement: "g", Lines: []SubstitutionLine{{"vegetable oil", 80, "g"}}, Note: "for cakes and muffins"},
+	{Ingredient: "butter", Value: 100, Measurement: "g", Lines: []SubstitutionLine{{"coconut oil", 100, "g"}}},
+	{Ingredient: "cream", Value: 1, Measurement: "cup", Lines: []SubstitutionLine{{"coconut cream", 1, "cup"}}},
+	{Ingredient: "sour cream", Value: 1, Measurement: "cup", Lines: []SubstitutionLine{{"greek yogurt", 1, "cup"}}},
+	{Ingredient: "yogurt", Value: 1, Measurement: "cup", Lines: []SubstitutionLine{{"coconut yogurt", 1, "cup"}}},
+	{Ingredient: "parmesan", Value: 30, Measurement: "g", Lines: []SubstitutionLine{{"nutritional yeast", 2, "tbsp"}}},
+	{Ingredient: "self raising flour", Value: 1, Measurement: "cup", Lines: []SubstitutionLine{{"flour", 1, "cup"}, {"baking powder", 1.5, "tsp"}, {"salt", 0.25, "tsp"}}},
+	{Ingredient: "flour", Value: 100, Measurement: "g", Lines: []SubstitutionLine{{"gluten free flour", 100, "g"}}},
+	{Ingredient: "breadcrumbs", Value: 1, Measurement: "cup", Lines: []SubstitutionLine{{"ground almonds", 1, "cup"}}},
+	{Ingredient: "soy sauce", Value: 1, Measurement: "tbsp", Lines: []SubstitutionLine{{"coconut aminos", 1, "tbsp"}}},
+	{Ingredient: "fish sauce", Value: 1, Measurement: "tbsp", Lines: []SubstitutionLine{{"soy sauce", 1, "tbsp"}}},
+	{Ingredient: "honey", Value: 1, Measurement: "tbsp", Lines: []SubstitutionLine{{"maple syrup", 1, "tbsp"}}},
+	{Ingredient: "brown sugar", Value: 1, Measurement: "cup", Lines: []SubstitutionLine{{"sugar", 1, "cup"}, {"molasses", 1, "tbsp"}}},
+	{Ingredient: "baking powder", Value: 1, Measurement: "tsp", Lines: []SubstitutionLine{{"baking soda", 0.25, "tsp"}, {"cream of tartar", 0.5, "tsp"}}},
+	{Ingredient: "cornstarch", Value: 1, Measurement: "tbsp", Lines: []SubstitutionLine{{"flour", 2, "tbsp"}}, Note: "for thickening"},
+	{Ingredient: "lemon juice", Value: 1, Measurement: "tbsp", Lines: []SubstitutionLine{{"lime juice", 1, "tbsp"}}},
+	{Ingredient: "lemon juice", Value: 1, Measurement: "tbsp", Lines: []SubstitutionLine{{"white wine vinegar", 0.5, "tbsp"}}},
+	{Ingredient: "red wine", Value: 1, Measurement: "cup", Lines: []SubstitutionLine{{"beef stock", 1, "cup"}, {"red wine vinegar", 1, "tbsp"}}},
+	{Ingredient: "white wine", Value: 1, Measurement: "cup", Lines: []SubstitutionLine{{"vegetable stock", 1, "cup"}, {"white wine vinegar", 1, "tbsp"}}},
+	{Ingredient: "gelatine", Value: 1, Measurement: "tbsp", Lines: []SubstitutionLine{{"agar agar", 1, "tsp"}}, Note: "bring to the boil to set"},
+	{Ingredient: "garlic", Value: 1, Measurement: "clove", Lines: []SubstitutionLine{{"garlic powder", 0.125, "tsp"}}},
+	{Ingredient: "peanut butter", Value: 1, Measurement: "tbsp", Lines: []SubstitutionLine{{"sunflower seed butter", 1, "tbsp"}}},
+	{Ingredient: "mayonnaise", Value: 1, Measurement: "cup", Lines: []SubstitutionLine{{"greek yogurt", 1, "cup"}}},
+}
+
+func registerSubstitutionRoutes(router *mux.Router) {
+	router.HandleFunc("/recipe/{id}/substitutions", getRecipeSubstitutions).Methods("GET")
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/recipes/{id}/substitutions", getRecipeSubstitutions).Methods("GET")
+	api.HandleFunc("/substitutions", getSubstitutionsHandler).Methods("GET")
+	api.HandleFunc("/substitutions", createSubstitution).Methods("POST")
+	api.HandleFunc("/substitutions/{id}", getSubstitutionHandler).Methods("GET")
+	api.HandleFunc("/substitutions/{id}", updateSubstitution).Methods("PATCH")
+	api.HandleFunc("/substitutions/{id}", deleteSubstitution).Methods("DELETE")
+}
+
+// seedSubstitutions adds defaultSubstitutions when there are no built-in
+// substitutions yet.
+func seedSubstitutions() error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM substitutions WHERE owner_id IS NULL").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	for _, substitution := range defaultSubstitutions {
+		if message := validateSubstitution(&substitution); message != "" {
+			return fmt.Errorf("substitution for %s: %s", substitution.Ingredient, message)
+		}
+		if _, err := saveSubstitution(substitution, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getSubstitutions returns the built-in substitutions and the user's own,
+// the user's first.
+func getSubstitutions(ownerId int) ([]Substitution, error) {
+	rows, err := db.Query(`
+		SELECT id, ingredient, value, measurement, note, owner_id IS NULL FROM substitutions
+		WHERE owner_id IS NULL OR owner_id = ?
+		ORDER BY ingredient, owner_id IS NULL, id
+	`, ownerId)
+	if err != nil {
+		return nil, err
+	}
+
+	substitutions := []Substitution{}
+	index := map[int]int{}
+	for rows.Next() {
+		var substitution Substitution
+		if err := rows.Scan(&substitution.ID, &substitution.Ingredient, &substitution.Value, &substitution.Measurement, &substitution.Note, &substitution.BuiltIn); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		substitution.Lines = []SubstitutionLine{}
+		index[substitution.ID] = len(substitutions)
+		substitutions = append(substitutions, substitution)
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT substitution_id, name, value, measurement FROM substitution_lines ORDER BY substitution_id, sortOrder")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var line SubstitutionLine
+		if rows.Scan(&id, &line.Name, &line.Value, &line.Measurement) == nil {
+			if i, ok := index[id]; ok {
+				substitutions[i].Lines = append(substitutions[i].Lines, line)
+			}
+		}
+	}
+
+	return substitutions, nil
+}
+
+func getSubstitution(id int, ownerId int) *Substitution {
+	substitutions, err := getSubstitutions(ownerId)
+	if err != nil {
+		return nil
+	}
+	for _, substitution := range substitutions {
+		if substitution.ID == id {
+			return &substitution
+		}
+	}
+	return nil
+}
+
+// matchSubstitutions returns the substitutions for an ingredient name. When
+// several terms match, only the longest counts, so "sour cream" does not get
+// the substitutions of "cream".
+func matchSubstitutions(name string, substitutions []Substitution) []Substitution {
+	name = normalizeIngredientName(name)
+
+	term := ""
+	for _, substitution := range substitutions {
+		if len(substitution.Ingredient) > len(term) && nameContainsTerm(name, substitution.Ingredient) {
+			term = substitution.Ingredient
+		}
+	}
+
+	var matched []Substitution
+	for _, substitution := range substitutions {
+		if term != "" && substitution.Ingredient == term {
+			matched = append(matched, substitution)
+		}
+	}
+	return matched
+}
+
+// suggestSubstitution scales the substitution to the quantity of the
+// ingredient.
+func suggestSubstitution(ingredient Ingredient, substitution Substitution) SuggestedSubstitution {
+	suggestion := SuggestedSubstitution{
+		SubstitutionID: substitution.ID,
+		Scale:          1,
+		Lines:          []SubstitutionLine{},
+		Note:           substitution.Note,
+	}
+
+	if ingredient.Value <= 0 {
+		suggestion.Warning = fmt.Sprintf("the ingredient has no quantity, showing %s", formatAmount(substitution.Value, substitution.Measurement, substitution.Ingredient))
+	} else if value, ok := convertUnit(float64(ingredient.Value), ingredient.Measurement, substitution.Measurement, ingredientDensity(ingredient)); ok {
+		suggestion.Scale = roundTo(value/substitution.Value, 100)
+	} else {
+		suggestion.Warning = fmt.Sprintf("cannot compare %s with %s, showing %s", ingredient.Measurement, substitution.Measurement, formatAmount(substitution.Value, substitution.Measurement, substitution.Ingredient))
+	}
+
+	parts := make([]string, len(substitution.Lines))
+	for i, line := range substitution.Lines {
+		line.Value = roundTo(line.Value*suggestion.Scale, 100)
+		suggestion.Lines = append(suggestion.Lines, line)
+		parts[i] = formatAmount(line.Value, line.Measurement, line.Name)
+	}
+	suggestion.Text = strings.Join(parts, " + ")
+
+	return suggestion
+}
+
+// formatAmount writes a quantity as "1.5 cup milk", or "2 egg" without a
+// measurement.
+func formatAmount(value float64, measurement string, name string) string {
+	return strings.Join(strings.Fields(strconv.FormatFloat(value, 'f', -1, 64)+" "+measurement+" "+name), " ")
+}
+
+func roundTo(value float64, precision float64) float64 {
+	return float64(int64(value*precision+0.5)) / precision
+}
+
+// substitutionQuery holds the missing and avoid query parameters.
+type substitutionQuery struct {
+	missing []string
+	avoid   []string
+}
+
+func parseSubstitutionQuery(queryParams map[string][]string) (substitutionQuery, error) {
+	query := substitutionQuery{
+		missing: splitIngredientTerms(strings.Join(queryParams["missing"], ",")),
+		avoid:   splitList(strings.Join(queryParams["avoid"], ",")),
+	}
+
+	if len(query.avoid) > 0 {
+		_, allergens := loadAllergenRules()
+		for _, allergen := range query.avoid {
+			if !slices.Contains(allergens, allergen) {
+				return query, fmt.Errorf("%w: unknown allergen %q", errInvalidQuery, allergen)
+			}
+		}
+	}
+	return query, nil
+}
+
+// containsAllergen reports which of the allergens the name contains or may
+// contain.
+func containsAllergen(name string, allergens []string, rules []compiledAllergenRule) []string {
+	var found []string
+	for allergen, status := range classifyIngredient(name, rules) {
+		if status != allergenFreeFrom && slices.Contains(allergens, allergen) {
+			found = append(found, allergen)
+		}
+	}
+	slices.Sort(found)
+	return found
+}
+
+// suggestSubstitutions works out which ingredients of the recipe need
+// replacing and how. Without missing or avoid every ingredient that has a
+// substitution is listed. Substitutions that contain an allergen to avoid
+// are left out.
+func suggestSubstitutions(recipe Recipe, query substitutionQuery) (*SubstitutionReport, error) {
+	substitutions, err := getSubstitutions(recipe.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	rules, _ := loadAllergenRules()
+
+	report := &SubstitutionReport{
+		RecipeID:    recipe.ID,
+		Ingredients: []IngredientSubstitutions{},
+		Unmatched:   []string{},
+	}
+
+	found := map[string]bool{}
+	for _, ingredient := range recipe.Ingredients {
+		name := normalizeIngredientName(ingredient.Name)
+
+		reasons := []string{}
+		for _, term := range query.missing {
+			if nameContainsTerm(name, term) {
+				found[term] = true
+				if !slices.Contains(reasons, "missing") {
+					reasons = append(reasons, "missing")
+				}
+			}
+		}
+		for _, allergen := range containsAllergen(ingredient.Name, query.avoid, rules) {
+			reasons = append(reasons, "contains "+allergen)
+		}
+
+		matched := matchSubstitutions(ingredient.Name, substitutions)
+		if len(reasons) == 0 && (len(query.missing) > 0 || len(query.avoid) > 0 || len(matched) == 0) {
+			continue
+		}
+
+		suggestions := []SuggestedSubstitution{}
+		for _, substitution := range matched {
+			safe := true
+			for _, line := range substitution.Lines {
+				if len(containsAllergen(line.Name, query.avoid, rules)) > 0 {
+					safe = false
+				}
+			}
+			if safe {
+				suggestions = append(suggestions, suggestSubstitution(ingredient, substitution))
+			}
+		}
+
+		report.Ingredients = append(report.Ingredients, IngredientSubstitutions{
+			IngredientID:  ingredient.ID,
+			Name:          ingredient.Name,
+			Measurement:   ingredient.Measurement,
+			Value:         ingredient.Value,
+			Reasons:       reasons,
+			Substitutions: suggestions,
+		})
+	}
+
+	for _, term := range query.missing {
+		if !found[term] {
+			report.Unmatched = append(report.Unmatched, term)
+		}
+	}
+
+	return report, nil
+}
+
+func getRecipeSubstitutions(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	query, err := parseSubstitutionQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := suggestSubstitutions(recipe, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// getSubstitutionsHandler lists the substitutions the user can use, or with
+// ?ingredient= the ones that apply to that ingredient.
+func getSubstitutionsHandler(w http.ResponseWriter, r *http.Request) {
+	substitutions, err := getSubstitutions(currentUser(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if ingredient := r.URL.Query().Get("ingredient"); ingredient != "" {
+		substitutions = matchSubstitutions(ingredient, substitutions)
+		if substitutions == nil {
+			substitutions = []Substitution{}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, substitutions)
+}
+
+func getSubstitutionHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	substitution := getSubstitution(id, currentUser(r).ID)
+	if substitution == nil {
+		http.Error(w, "Substitution not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, substitution)
+}
+
+// validateSubstitution tidies the substitution up and returns what is wrong
+// with it.
+func validateSubstitution(substitution *Substitution) string {
+	substitution.Ingredient = normalizeIngredientName(substitution.Ingredient)
+	substitution.Measurement = strings.TrimSpace(substitution.Measurement)
+	substitution.Note = strings.TrimSpace(substitution.Note)
+	switch {
+	case substitution.Ingredient == "":
+		return "Ingredient is required"
+	case substitution.Value <= 0:
+		return "Value must be greater than 0"
+	case len(substitution.Lines) == 0:
+		return "At least one line is required"
+	}
+
+	for i := range substitution.Lines {
+		line := &substitution.Lines[i]
+		line.Name = strings.TrimSpace(line.Name)
+		line.Measurement = strings.TrimSpace(line.Measurement)
+		if line.Name == "" {
+			return fmt.Sprintf("Line %d needs a name", i+1)
+		}
+		if line.Value < 0 {
+			return fmt.Sprintf("Line %d has a negative value", i+1)
+		}
+	}
+	return ""
+}
+
+// saveSubstitution inserts the substitution when it has no ID, or updates it,
+// and replaces its lines, all in one transaction. A new substitution belongs
+// to ownerId, or is built in when it is 0.
+func saveSubstitution(substitution Substitution, ownerId int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var owner any
+	if ownerId != 0 {
+		owner = ownerId
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	if substitution.ID == 0 {
+		result, err := tx.Exec(`
+			INSERT INTO substitutions(owner_id, ingredient, value, measurement, note, createdAt, lastEditedAt) VALUES(?,?,?,?,?,?,?)
+		`, owner, substitution.Ingredient, substitution.Value, substitution.Measurement, substitution.Note, now, now)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		id, _ := result.LastInsertId()
+		substitution.ID = int(id)
+	} else {
+		_, err := tx.Exec(`
+			UPDATE substitutions SET ingredient = ?, value = ?, measurement = ?, note = ?, lastEditedAt = ? WHERE id = ?
+		`, substitution.Ingredient, substitution.Value, substitution.Measurement, substitution.Note, now, substitution.ID)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if err := saveSubstitutionLines(tx, substitution); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return substitution.ID, tx.Commit()
+}
+
+func saveSubstitutionLines(tx *sql.Tx, substitution Substitution) error {
+	if _, err := tx.Exec("DELETE FROM substitution_lines WHERE substitution_id = ?", substitution.ID); err != nil {
+		return err
+	}
+	for i, line := range substitution.Lines {
+		_, err := tx.Exec(`
+			INSERT INTO substitution_lines(substitution_id, name, value, measurement, sortOrder) VALUES(?,?,?,?,?)
+		`, substitution.ID, line.Name, line.Value, line.Measurement, i+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// editableSubstitution returns the substitution when the user may change it:
+// their own, or a built-in one for admins. It writes the error response
+// otherwise.
+func editableSubstitution(w http.ResponseWriter, r *http.Request) *Substitution {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return nil
+	}
+
+	user := currentUser(r)
+	substitution := getSubstitution(id, user.ID)
+	if substitution == nil {
+		http.Error(w, "Substitution not found", http.StatusNotFound)
+		return nil
+	}
+	if substitution.BuiltIn && (!user.IsAdmin || !user.hasScope(scopeAdmin)) {
+		http.Error(w, "Admin access required to change a built-in substitution", http.StatusForbidden)
+		return nil
+	}
+	return substitution
+}
+
+func createSubstitution(w http.ResponseWriter, r *http.Request) {
+	var substitution Substitution
+	if !decodeBody(w, r, &substitution) {
+		return
+	}
+	substitution.ID = 0
+	if message := validateSubstitution(&substitution); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	id, err := saveSubstitution(substitution, currentUser(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, getSubstitution(id, currentUser(r).ID))
+}
+
+// updateSubstitution changes the fields present in the body. lines replaces
+// the whole list.
+func updateSubstitution(w http.ResponseWriter, r *http.Request) {
+	substitution := editableSubstitution(w, r)
+	if substitution == nil {
+		return
+	}
+
+	var patch struct {
+		Ingredient  *string             `json:"ingredient"`
+		Value       *float64            `json:"value"`
+		Measurement *string             `json:"measurement"`
+		Lines       *[]SubstitutionLine `json:"lines"`
+		Note        *string             `json:"note"`
+	}
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	if patch.Ingredient != nil {
+		substitution.Ingredient = *patch.Ingredient
+	}
+	if patch.Value != nil {
+		substitution.Value = *patch.Value
+	}
+	if patch.Measurement != nil {
+		substitution.Measurement = *patch.Measurement
+	}
+	if patch.Lines != nil {
+		substitution.Lines = *patch.Lines
+	}
+	if patch.Note != nil {
+		substitution.Note = *patch.Note
+	}
+	if message := validateSubstitution(substitution); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := saveSubstitution(*substitution, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, getSubstitution(substitution.ID, currentUser(r).ID))
+}
+
+func deleteSubstitution(w http.ResponseWriter, r *http.Request) {
+	substitution := editableSubstitution(w, r)
+	if substitution == nil {
+		return
+	}
+
+	for _, table := range []string{"substitution_lines WHERE substitution_id", "substitutions WHERE id"} {
+		if _, err := db.Exec("DELETE FROM "+table+" = ?", substitution.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,883 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// Tag labels recipes by course, cuisine, diet, occasion or technique. Tags
+// belong to a user and a recipe can carry any number of them.
+type Tag struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Kind        string `json:"kind"`
+	RecipeCount int    `json:"recipeCount"`
+}
+
+const tagKindCourse = "course"
+
+var tagKinds = []string{tagKindCourse, "cuisine", "diet", "occasion", "technique"}
+
+// errInvalidTags marks tags in a request that do not exist or are malformed.
+var errInvalidTags = errors.New("invalid tags")
+
+func registerTagRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/tags", getTags).Methods("GET")
+	api.HandleFunc("/tags", createTag).Methods("POST")
+	api.HandleFunc("/tags/{id}", updateTag).Methods("PATCH")
+	api.HandleFunc("/tags/{id}", deleteTag).Methods("DELETE")
+	api.HandleFunc("/tags/{id}/merge", mergeTag).Methods("POST")
+
+	api.HandleFunc("/recipes/{id}/tags", getRecipeTagsHandler).Methods("GET")
+	api.HandleFunc("/recipes/{id}/tags", replaceRecipeTags).Methods("PUT")
+	api.HandleFunc("/recipes/{id}/tags", addRecipeTag).Methods("POST")
+	api.HandleFunc("/recipes/{id}/tags/{tagId}", removeRecipeTag).Methods("DELETE")
+}
+
+// migrateRecipeTypes turns the type of every recipe into a course tag. It
+// only adds what is missing, so it is safe to run on every start.
+func migrateRecipeTypes() error {
+	rows, err := db.Query(`
+		SELECT id, type, owner_id FROM recipes
+		WHERE type != '' AND owner_id IS NOT NULL
+	`)
+	if err != nil {
+		return err
+	}
+
+	type typedRecipe struct {
+		id, ownerId int
+		recipeType  string
+	}
+	var typed []typedRecipe
+	for rows.Next() {
+		var recipe typedRecipe
+		if err := rows.Scan(&recipe.id, &recipe.recipeType, &recipe.ownerId); err != nil {
+			rows.Close()
+			return err
+		}
+		typed = append(typed, recipe)
+	}
+	rows.Close()
+
+	for _, recipe := range typed {
+		tagId, err := findOrCreateTag(db, recipe.ownerId, recipe.recipeType, tagKindCourse)
+		if err != nil {
+			return err
+		}
+		if err := linkRecipeTag(db, recipe.id, tagId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func normalizeTagName(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+func validTagKind(kind string) bool {
+	return slices.Contains(tagKinds, kind)
+}
+
+const tagColumns = `t.id, t.name, t.kind,
+	(SELECT COUNT(*) FROM recipe_tags rt JOIN recipes r ON r.id = rt.recipe_id WHERE rt.tag_id = t.id)`
+
+func scanTag(row interface{ Scan(...any) error }, tag *Tag) error {
+	return row.Scan(&tag.ID, &tag.Name, &tag.Kind, &tag.RecipeCount)
+}
+
+func queryTags(query string, args ...any) ([]Tag, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var tag Tag
+		if err := scanTag(rows, &tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func getRecipeTags(recipeId int) []Tag {
+	tags, err := queryTags(`
+		SELECT `+tagColumns+` FROM tags t
+		JOIN recipe_tags rt ON rt.tag_id = t.id
+		WHERE rt.recipe_id = ?
+		ORDER BY t.kind, t.name
+	`, recipeId)
+	if err != nil {
+		fmt.Println("Error getting tags:", err)
+		return []Tag{}
+	}
+	return tags
+}
+
+// getOwnedTag returns the tag when it exists and belongs to the owner.
+func getOwnedTag(id int, ownerId int) *Tag {
+	var tag Tag
+	err := scanTag(db.QueryRow("SELECT "+tagColumns+" FROM tags t WHERE t.id = ? AND t.owner_id = ?", id, ownerId), &tag)
+	if err != nil {
+		return nil
+	}
+	return &tag
+}
+
+// findOrCreateTag returns the id of the owner's tag with this name and kind,
+// creating it first when there is none.
+func findOrCreateTag(q dbtx, ownerId int, name string, kind string) (int, error) {
+	name = normalizeTagName(name)
+
+	var id int
+	err := q.QueryRow("SELECT id FROM tags WHERE owner_id = ? AND name = ? AND kind = ?", ownerId, name, kind).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+
+	result, err := q.Exec("INSERT INTO tags(owner_id, name, kind) VALUES(?,?,?)", ownerId, name, kind)
+	if err != nil {
+		return 0, err
+	}
+	tagId, _ := result.LastInsertId()
+	return int(tagId), nil
+}
+
+func linkRecipeTag(e execer, recipeId int, tagId int) error {
+	_, err := e.Exec("INSERT OR IGNORE INTO recipe_tags(recipe_id, tag_id) VALUES(?,?)", recipeId, tagId)
+	return err
+}
+
+// syncCourseTag keeps the course tags in step with a type written by an older
+// client: the tag of the old type is dropped and the new type is tagged.
+func syncCourseTag(q dbtx, recipeId int, ownerId int, oldType string, newType string) error {
+	if normalizeTagName(oldType) == normalizeTagName(newType) {
+		return nil
+	}
+
+	if oldType != "" {
+		_, err := q.Exec(`
+			DELETE FROM recipe_tags WHERE recipe_id = ? AND tag_id IN (
+				SELECT id FROM tags WHERE owner_id = ? AND kind = ? AND name = ?
+			)
+		`, recipeId, ownerId, tagKindCourse, normalizeTagName(oldType))
+		if err != nil {
+			return err
+		}
+	}
+
+	if newType == "" {
+		return nil
+	}
+
+	tagId, err := findOrCreateTag(q, ownerId, newType, tagKindCourse)
+	if err != nil {
+		return err
+	}
+	return linkRecipeTag(q, recipeId, tagId)
+}
+
+// syncRecipeType fills in the type of the recipe for older clients. It stays
+// as it is while it still names one of the recipe's course tags, and becomes
+// the first course tag otherwise.
+func syncRecipeType(q dbtx, recipeId int) error {
+	var recipeType string
+	if err := q.QueryRow("SELECT type FROM recipes WHERE id = ?", recipeId).Scan(&recipeType); err != nil {
+		return err
+	}
+
+	rows, err := q.Query(`
+		SELECT t.name FROM tags t
+		JOIN recipe_tags rt ON rt.tag_id = t.id
+		WHERE rt.recipe_id = ? AND t.kind = ?
+		ORDER BY t.name
+	`, recipeId, tagKindCourse)
+	if err != nil {
+		return err
+	}
+	var courses []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		courses = append(courses, name)
+	}
+	rows.Close()
+
+	if slices.Contains(courses, normalizeTagName(recipeType)) {
+		return nil
+	}
+
+	recipeType = ""
+	if len(courses) > 0 {
+		recipeType = courses[0]
+	}
+
+	_, err = q.Exec("UPDATE recipes SET type = ? WHERE id = ?", recipeType, recipeId)
+	return err
+}
+
+// syncTaggedRecipeTypes runs syncRecipeType for every recipe in the list.
+func syncTaggedRecipeTypes(recipeIds []int) error {
+	for _, recipeId := range recipeIds {
+		if err := syncRecipeType(db, recipeId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getTagRecipeIds(tagId int) ([]int, error) {
+	rows, err := db.Query("SELECT recipe_id FROM recipe_tags WHERE tag_id = ?", tagId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// validateTags checks tags passed by id exist and tags passed by name have a
+// name and a valid kind, without creating any.
+func validateTags(ownerId int, tags []Tag) error {
+	for _, tag := range tags {
+		if tag.ID != 0 {
+			if getOwnedTag(tag.ID, ownerId) == nil {
+				return fmt.Errorf("tag %d not found", tag.ID)
+			}
+			continue
+		}
+
+		if normalizeTagName(tag.Name) == "" {
+			return fmt.Errorf("tag name is required")
+		}
+		if !validTagKind(tag.Kind) {
+			return fmt.Errorf("tag kind must be one of %s", strings.Join(tagKinds, ", "))
+		}
+	}
+	return nil
+}
+
+// resolveTags turns tags passed by id, or by name and kind, into ids of the
+// owner's tags. Tags passed by name are created when they do not exist yet,
+// and only once all the tags are valid.
+func resolveTags(q dbtx, ownerId int, tags []Tag) ([]int, error) {
+	if err := validateTags(ownerId, tags); err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, tag := range tags {
+		if tag.ID != 0 {
+			ids = append(ids, tag.ID)
+			continue
+		}
+
+		id, err := findOrCreateTag(q, ownerId, tag.Name, tag.Kind)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// setRecipeTags replaces the tags of the recipe.
+func setRecipeTags(q dbtx, recipeId int, tagIds []int) error {
+	if _, err := q.Exec("DELETE FROM recipe_tags WHERE recipe_id = ?", recipeId); err != nil {
+		return err
+	}
+	for _, tagId := range tagIds {
+		if err := linkRecipeTag(q, recipeId, tagId); err != nil {
+			return err
+		}
+	}
+	return syncRecipeType(q, recipeId)
+}
+
+// validateRecipeTags checks the tags passed along with a whole recipe, so a
+// recipe with a bad tag is rejected before anything of it is saved.
+func validateRecipeTags(ownerId int, recipe Recipe) error {
+	if err := validateTags(ownerId, recipe.Tags); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidTags, err)
+	}
+	return nil
+}
+
+// applyRecipeTags sets the tags passed along with a whole recipe. A recipe
+// passed without tags keeps its tags, and its type is always kept as a
+// course tag.
+func applyRecipeTags(q dbtx, recipeId int, ownerId int, recipe Recipe) error {
+	if recipe.Tags == nil {
+		return nil
+	}
+
+	tags := recipe.Tags
+	if recipe.Type != "" {
+		tags = append(tags, Tag{Name: recipe.Type, Kind: tagKindCourse})
+	}
+
+	tagIds, err := resolveTags(q, ownerId, tags)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidTags, err)
+	}
+	return setRecipeTags(q, recipeId, tagIds)
+}
+
+func getTags(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT " + tagColumns + " FROM tags t WHERE t.owner_id = ?"
+	args := []any{currentUser(r).ID}
+
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		if !validTagKind(kind) {
+			http.Error(w, fmt.Sprintf("kind must be one of %s", strings.Join(tagKinds, ", ")), http.StatusBadRequest)
+			return
+		}
+		query += " AND t.kind = ?"
+		args = append(args, kind)
+	}
+
+	tags, err := queryTags(query+" ORDER BY t.kind, t.name", args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tags)
+}
+
+func createTag(w http.ResponseWriter, r *http.Request) {
+	var tag Tag
+	if !decodeBody(w, r, &tag) {
+		return
+	}
+
+	tag.Name = normalizeTagName(tag.Name)
+	if tag.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if !validTagKind(tag.Kind) {
+		http.Error(w, fmt.Sprintf("Kind must be one of %s", strings.Join(tagKinds, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("INSERT INTO tags(owner_id, name, kind) VALUES(?,?,?)", currentUser(r).ID, tag.Name, tag.Kind)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	writeJSON(w, http.StatusCreated, getOwnedTag(int(id), currentUser(r).ID))
+}
+
+// updateTag renames the tag or changes its kind. Renaming onto an existing
+// tag is a conflict; merge the two instead.
+func updateTag(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	ownerId := currentUser(r).ID
+	tag := getOwnedTag(id, ownerId)
+	if tag == nil {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	var patch struct {
+		Name *string `json:"name"`
+		Kind *string `json:"kind"`
+	}
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	updated := *tag
+	if patch.Name != nil {
+		updated.Name = normalizeTagName(*patch.Name)
+		if updated.Name == "" {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
+	}
+	if patch.Kind != nil {
+		updated.Kind = *patch.Kind
+		if !validTagKind(updated.Kind) {
+			http.Error(w, fmt.Sprintf("Kind must be one of %s", strings.Join(tagKinds, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	_, err := db.Exec("UPDATE tags SET name = ?, kind = ? WHERE id = ?", updated.Name, updated.Kind, id)
+	if err != nil {
+		http.Error(w, "A tag with this name and kind already exists, merge them instead", http.StatusConflict)
+		return
+	}
+
+	if tag.Kind == tagKindCourse || updated.Kind == tagKindCourse {
+		if err := renameRecipeTypes(id, tag.Name, updated.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, getOwnedTag(id, ownerId))
+}
+
+// renameRecipeTypes follows a renamed or merged course tag in the type of
+// the recipes tagged with tagId.
+func renameRecipeTypes(tagId int, oldName string, newName string) error {
+	recipeIds, err := getTagRecipeIds(tagId)
+	if err != nil {
+		return err
+	}
+
+	for _, recipeId := range recipeIds {
+		_, err := db.Exec("UPDATE recipes SET type = ? WHERE id = ? AND LOWER(type) = ?", newName, recipeId, oldName)
+		if err != nil {
+			return err
+		}
+	}
+	return syncTaggedRecipeTypes(recipeIds)
+}
+
+func deleteTag(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	if getOwnedTag(id, currentUser(r).ID) == nil {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	recipeIds, err := getTagRecipeIds(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM recipe_tags WHERE tag_id = ?", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM tags WHERE id = ?", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := syncTaggedRecipeTypes(recipeIds); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mergeTag moves every recipe of the tag over to the tag passed as "into"
+// and deletes it.
+func mergeTag(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	ownerId := currentUser(r).ID
+	source := getOwnedTag(id, ownerId)
+	if source == nil {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Into int `json:"into"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	target := getOwnedTag(req.Into, ownerId)
+	if target == nil {
+		http.Error(w, "Target tag not found", http.StatusBadRequest)
+		return
+	}
+	if target.ID == source.ID {
+		http.Error(w, "A tag cannot be merged into itself", http.StatusBadRequest)
+		return
+	}
+
+	recipeIds, err := getTagRecipeIds(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{"INSERT OR IGNORE INTO recipe_tags(recipe_id, tag_id) SELECT recipe_id, ? FROM recipe_tags WHERE tag_id = ?", []any{target.ID, id}},
+		{"DELETE FROM recipe_tags WHERE tag_id = ?", []any{id}},
+		{"DELETE FROM tags WHERE id = ?", []any{id}},
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if source.Kind == tagKindCourse {
+		for _, recipeId := range recipeIds {
+			_, err := db.Exec("UPDATE recipes SET type = ? WHERE id = ? AND LOWER(type) = ?", target.Name, recipeId, source.Name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if err := syncTaggedRecipeTypes(recipeIds); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, getOwnedTag(target.ID, ownerId))
+}
+
+func getRecipeTagsHandler(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recipe.Tags)
+}
+
+// replaceRecipeTags sets the tags of the recipe to the passed list. Each tag
+// is given by id, or by name and kind.
+func replaceRecipeTags(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var tags []Tag
+	if !decodeBody(w, r, &tags) {
+		return
+	}
+
+	tagIds, err := resolveTags(db, recipe.OwnerID, tags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := setRecipeTags(db, recipe.ID, tagIds); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recipeChanged(recipe.ID, eventTagsUpdated)
+
+	writeJSON(w, http.StatusOK, getRecipeTags(recipe.ID))
+}
+
+func addRecipeTag(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var tag Tag
+	if !decodeBody(w, r, &tag) {
+		return
+	}
+
+	tagIds, err := resolveTags(db, recipe.OwnerID, []Tag{tag})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := linkRecipeTag(db, recipe.ID, tagIds[0]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := syncRecipeType(db, recipe.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recipeChanged(recipe.ID, eventTagsUpdated)
+
+	writeJSON(w, http.StatusCreated, getRecipeTags(recipe.ID))
+}
+
+func removeRecipeTag(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	tagId, ok := pathID(w, r, "tagId")
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM recipe_tags WHERE recipe_id = ? AND tag_id = ?", recipe.ID, tagId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Tag not found on this recipe", http.StatusNotFound)
+		return
+	}
+
+	if err := syncRecipeType(db, recipe.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recipeChanged(recipe.ID, eventTagsUpdated)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tagExpr is a parsed tag filter such as "dinner AND (thai OR vietnamese)
+// AND NOT diet:vegan".
+type tagExpr struct {
+	op          string // "tag", "and", "or" or "not"
+	kind, name  string
+	left, right *tagExpr
+}
+
+// matches reports whether a recipe with these tags satisfies the expression.
+func (expr *tagExpr) matches(tags []Tag) bool {
+	switch expr.op {
+	case "and":
+		return expr.left.matches(tags) && expr.right.matches(tags)
+	case "or":
+		return expr.left.matches(tags) || expr.right.matches(tags)
+	case "not":
+		return !expr.left.matches(tags)
+	}
+	for _, tag := range tags {
+		if tag.Name == expr.name && (expr.kind == "" || tag.Kind == expr.kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenizeTagExpression splits the expression into parentheses, operators
+// and tag names. Consecutive words form one name, so "stir fry" needs no
+// quotes, and quoted names may contain operator words.
+func tokenizeTagExpression(input string) ([]string, error) {
+	var tokens []string
+	var words []string
+	flush := func() {
+		if len(words) > 0 {
+			tokens = append(tokens, strings.Join(words, " "))
+			words = nil
+		}
+	}
+
+	for i := 0; i < len(input); {
+		switch c := input[i]; {
+		case c == '(' || c == ')':
+			flush()
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := strings.IndexByte(input[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated quote in tags", errInvalidQuery)
+			}
+			words = append(words, "\""+input[i+1:i+1+end])
+			i += end + 2
+		case unicode.IsSpace(rune(c)):
+			i++
+		default:
+			end := strings.IndexFunc(input[i:], func(r rune) bool {
+				return unicode.IsSpace(r) || r == '(' || r == ')' || r == '"'
+			})
+			if end < 0 {
+				end = len(input) - i
+			}
+			word := input[i : i+end]
+			if operator := strings.ToUpper(word); operator == "AND" || operator == "OR" || operator == "NOT" {
+				flush()
+				tokens = append(tokens, operator)
+			} else {
+				words = append(words, word)
+			}
+			i += end
+		}
+	}
+	flush()
+
+	return tokens, nil
+}
+
+type tagExprParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseTagExpression parses a tag filter. NOT binds tighter than AND, which
+// binds tighter than OR. A tag is a name, optionally prefixed by its kind as
+// in "cuisine:thai".
+func parseTagExpression(input string) (*tagExpr, error) {
+	tokens, err := tokenizeTagExpression(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	parser := &tagExprParser{tokens: tokens}
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q in tags", errInvalidQuery, tokens[parser.pos])
+	}
+	return expr, nil
+}
+
+func (p *tagExprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *tagExprParser) parseOr() (*tagExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "OR" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &tagExpr{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *tagExprParser) parseAnd() (*tagExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "AND" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &tagExpr{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *tagExprParser) parseNot() (*tagExpr, error) {
+	switch token := p.peek(); token {
+	case "NOT":
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &tagExpr{op: "not", left: operand}, nil
+	case "(":
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("%w: missing ) in tags", errInvalidQuery)
+		}
+		p.pos++
+		return expr, nil
+	case "", ")", "AND", "OR":
+		return nil, fmt.Errorf("%w: expected a tag in tags", errInvalidQuery)
+	default:
+		p.pos++
+		term := newTagTerm(token)
+		if term.name == "" {
+			return nil, fmt.Errorf("%w: empty tag name in tags", errInvalidQuery)
+		}
+		return term, nil
+	}
+}
+
+// newTagTerm reads "kind:name" or a bare name. Quoted parts keep their
+// text as is, so "cuisine:thai" in quotes is a name with a colon.
+func newTagTerm(token string) *tagExpr {
+	quoted := strings.Contains(token, "\"")
+	token = strings.ReplaceAll(token, "\"", "")
+
+	if !quoted {
+		if kind, name, found := strings.Cut(token, ":"); found && validTagKind(strings.ToLower(kind)) {
+			return &tagExpr{op: "tag", kind: strings.ToLower(kind), name: normalizeTagName(name)}
+		}
+	}
+	return &tagExpr{op: "tag", name: normalizeTagName(token)}
+}
+
+// filterRecipesByTags keeps the recipes whose tags satisfy the expression.
+func filterRecipesByTags(recipes []Recipe, expr *tagExpr) []Recipe {
+	var filtered []Recipe
+	for _, recipe := range recipes {
+		if expr.matches(recipe.Tags) {
+			filtered = append(filtered, recipe)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestTagExpressions(t *testing.T) {
+	recipes := []Recipe{
+		{ID: 1, Tags: []Tag{{Name: "thai", Kind: "cuisine"}, {Name: "dinner", Kind: "course"}, {Name: "stir fry", Kind: "technique"}}},
+		{ID: 2, Tags: []Tag{{Name: "italian", Kind: "cuisine"}, {Name: "dinner", Kind: "course"}, {Name: "vegetarian", Kind: "diet"}}},
+		{ID: 3, Tags: []Tag{{Name: "christmas", Kind: "occasion"}, {Name: "and or", Kind: "occasion"}, {Name: "cuisine:thai", Kind: "occasion"}, {Name: "thai", Kind: "diet"}}},
+		{ID: 4},
+	}
+
+	tests := []struct {
+		expression string
+		want       []int
+	}{
+		{"thai", []int{1, 3}},
+		{"cuisine:thai", []int{1}},
+		{"Cuisine:THAI", []int{1}},
+		{`"cuisine:thai"`, []int{3}},
+		{"unknown:thai", nil},
+		{"stir fry", []int{1}},
+		{"  stir   fry ", []int{1}},
+		{`"and or"`, []int{3}},
+		{"dinner AND NOT thai", []int{2}},
+		{"dinner and not thai", []int{2}},
+		{"NOT NOT dinner", []int{1, 2}},
+		{"NOT dinner", []int{3, 4}},
+		{"italian OR christmas", []int{2, 3}},
+		{"thai OR italian AND vegetarian", []int{1, 2, 3}},
+		{"(thai OR italian) AND vegetarian", []int{2}},
+		{"((dinner)) AND NOT (cuisine:thai OR diet:vegetarian)", nil},
+		{"course:dinner AND (stir fry OR vegetarian)", []int{1, 2}},
+	}
+
+	for _, test := range tests {
+		expr, err := parseTagExpression(test.expression)
+		if err != nil {
+			t.Errorf("parseTagExpression(%q): %v", test.expression, err)
+			continue
+		}
+		var got []int
+		for _, recipe := range filterRecipesByTags(recipes, expr) {
+			got = append(got, recipe.ID)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%q matches %v, want %v", test.expression, got, test.want)
+		}
+	}
+}
+
+func TestEmptyTagExpression(t *testing.T) {
+	for _, expression := range []string{"", "   "} {
+		if expr, err := parseTagExpression(expression); expr != nil || err != nil {
+			t.Errorf("parseTagExpression(%q) = %v, %v, want no filter", expression, expr, err)
+		}
+	}
+}
+
+func TestInvalidTagExpressions(t *testing.T) {
+	for _, expression := range []string{
+		"NOT",
+		"()",
+		"a AND",
+		"AND a",
+		"thai OR",
+		"a NOT b",
+		"(thai",
+		"thai)",
+		"(thai OR italian",
+		`"thai`,
+		`thai AND "stir fry`,
+		`""`,
+		"course:",
+	} {
+		if _, err := parseTagExpression(expression); !errors.Is(err, errInvalidQuery) {
+			t.Errorf("parseTagExpression(%q) = %v, want errInvalidQuery", expression, err)
+		}
+	}
+}
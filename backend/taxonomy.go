@@ -0,0 +1,628 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// TaxonomyNode is one entry of the ingredient taxonomy. A node is-a kind of
+// its parent, so "cheddar" under "cheese" under "dairy".
+type TaxonomyNode struct {
+	ID          int            `json:"id"`
+	Name        string         `json:"name"`
+	ParentID    *int           `json:"parent_id"`
+	Children    []TaxonomyNode `json:"children,omitempty"`
+	Ingredients []string       `json:"ingredients,omitempty"`
+}
+
+// defaultTaxonomy is seeded into an empty taxonomy table as name, parent
+// pairs. Parents always come before their children.
+var defaultTaxonomy = [][2]string{
+	{"dairy", ""},
+	{"cheese", "dairy"},
+	{"cheddar", "cheese"},
+	{"feta", "cheese"},
+	{"mozzarella", "cheese"},
+	{"parmesan", "cheese"},
+	{"halloumi", "cheese"},
+	{"brie", "cheese"},
+	{"gouda", "cheese"},
+	{"ricotta", "cheese"},
+	{"mascarpone", "cheese"},
+	{"cream cheese", "cheese"},
+	{"goat cheese", "cheese"},
+	{"blue cheese", "cheese"},
+	{"milk", "dairy"},
+	{"buttermilk", "milk"},
+	{"cream", "dairy"},
+	{"sour cream", "cream"},
+	{"double cream", "cream"},
+	{"cooking cream", "cream"},
+	{"butter", "dairy"},
+	{"yoghurt", "dairy"},
+	{"greek yoghurt", "yoghurt"},
+
+	{"nuts", ""},
+	{"almonds", "nuts"},
+	{"walnuts", "nuts"},
+	{"cashews", "nuts"},
+	{"pecans", "nuts"},
+	{"hazelnuts", "nuts"},
+	{"pistachios", "nuts"},
+	{"macadamias", "nuts"},
+	{"pine nuts", "nuts"},
+
+	{"meat", ""},
+	{"poultry", "meat"},
+	{"chicken", "poultry"},
+	{"turkey", "poultry"},
+	{"duck", "poultry"},
+	{"beef", "meat"},
+	{"steak", "beef"},
+	{"beef mince", "beef"},
+	{"pork", "meat"},
+	{"bacon", "pork"},
+	{"ham", "pork"},
+	{"chorizo", "pork"},
+	{"sausage", "meat"},
+	{"lamb", "meat"},
+
+	{"seafood", ""},
+	{"fish", "seafood"},
+	{"salmon", "fish"},
+	{"tuna", "fish"},
+	{"cod", "fish"},
+	{"anchovies", "fish"},
+	{"shellfish", "seafood"},
+	{"prawns", "shellfish"},
+	{"shrimp", "shellfish"},
+	{"crab", "shellfish"},
+	{"molluscs", "shellfish"},
+	{"mussels", "molluscs"},
+	{"squid", "molluscs"},
+	{"octopus", "molluscs"},
+
+	{"eggs", ""},
+
+	{"vegetables", ""},
+	{"onions", "vegetables"},
+	{"red onion", "onions"},
+	{"spring onion", "onions"},
+	{"shallots", "onions"},
+	{"leek", "onions"},
+	{"garlic", "vegetables"},
+	{"potatoes", "vegetables"},
+	{"sweet potatoes", "vegetables"},
+	{"carrots", "vegetables"},
+	{"tomatoes", "vegetables"},
+	{"cherry tomatoes", "tomatoes"},
+	{"peppers", "vegetables"},
+	{"chillies", "peppers"},
+	{"leafy greens", "vegetables"},
+	{"spinach", "leafy greens"},
+	{"kale", "leafy greens"},
+	{"lettuce", "leafy greens"},
+	{"cabbage", "leafy greens"},
+	{"mushrooms", "vegetables"},
+	{"broccoli", "vegetables"},
+	{"zucchini", "vegetables"},
+	{"eggplant", "vegetables"},
+	{"pumpkin", "vegetables"},
+
+	{"fruit", ""},
+	{"citrus", "fruit"},
+	{"lemon", "citrus"},
+	{"lime", "citrus"},
+	{"orange", "citrus"},
+	{"berries", "fruit"},
+	{"strawberries", "berries"},
+	{"blueberries", "berries"},
+	{"raspberries", "berries"},
+	{"apples", "fruit"},
+	{"bananas", "fruit"},
+
+	{"legumes", ""},
+	{"beans", "legumes"},
+	{"black beans", "beans"},
+	{"kidney beans", "beans"},
+	{"chickpeas", "legumes"},
+	{"lentils", "legumes"},
+	{"tofu", "legumes"},
+	// peanuts are legumes, and an allergen of their own rather than nuts
+	{"peanuts", "legumes"},
+
+	{"grains", ""},
+	{"rice", "grains"},
+	{"basmati rice", "rice"},
+	{"arborio rice", "rice"},
+	{"pasta", "grains"},
+	{"spaghetti", "pasta"},
+	{"penne", "pasta"},
+	{"noodles", "grains"},
+	{"flour", "grains"},
+	{"plain flour", "flour"},
+	{"self-raising flour", "flour"},
+	{"bread", "grains"},
+	{"oats", "grains"},
+
+	{"herbs", ""},
+	{"basil", "herbs"},
+	{"parsley", "herbs"},
+	{"coriander", "herbs"},
+	{"mint", "herbs"},
+	{"thyme", "herbs"},
+	{"rosemary", "herbs"},
+
+	{"spices", ""},
+	{"cumin", "spices"},
+	{"paprika", "spices"},
+	{"cinnamon", "spices"},
+	{"turmeric", "spices"},
+	{"chilli flakes", "spices"},
+
+	{"sweeteners", ""},
+	{"sugar", "sweeteners"},
+	{"brown sugar", "sugar"},
+	{"honey", "sweeteners"},
+	{"maple syrup", "sweeteners"},
+
+	{"oils", ""},
+	{"olive oil", "oils"},
+	{"vegetable oil", "oils"},
+	{"sesame oil", "oils"},
+}
+
+func registerTaxonomyRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/taxonomy", getTaxonomy).Methods("GET")
+	api.HandleFunc("/taxonomy", requireAdmin(createTaxonomyNode)).Methods("POST")
+	api.HandleFunc("/taxonomy/{id}", requireAdmin(updateTaxonomyNode)).Methods("PATCH")
+	api.HandleFunc("/taxonomy/{id}", requireAdmin(deleteTaxonomyNode)).Methods("DELETE")
+}
+
+// seedTaxonomy fills an empty taxonomy table with defaultTaxonomy.
+func seedTaxonomy() error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM ingredient_taxonomy").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	ids := map[string]int64{}
+	for _, entry := range defaultTaxonomy {
+		var parentId any
+		if entry[1] != "" {
+			parentId = ids[entry[1]]
+		}
+
+		result, err := db.Exec("INSERT INTO ingredient_taxonomy(name, parent_id) VALUES(?,?)", entry[0], parentId)
+		if err != nil {
+			return err
+		}
+		ids[entry[0]], _ = result.LastInsertId()
+	}
+
+	return nil
+}
+
+// taxonomyMoves are the nodes of defaultTaxonomy that moved since it was
+// first seeded, as name, old parent, new parent. moveTaxonomyNodes moves them
+// in existing trees, unless they were moved by hand already.
+var taxonomyMoves = [][3]string{
+	{"peanuts", "nuts", "legumes"},
+	{"mussels", "shellfish", "molluscs"},
+	{"squid", "seafood", "molluscs"},
+}
+
+// moveTaxonomyNodes adds the molluscs under shellfish to a tree seeded
+// without them, and applies taxonomyMoves.
+func moveTaxonomyNodes(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		INSERT INTO ingredient_taxonomy(name, parent_id)
+		SELECT 'molluscs', id FROM ingredient_taxonomy
+		WHERE name = 'shellfish' AND NOT EXISTS (SELECT 1 FROM ingredient_taxonomy WHERE name = 'molluscs')
+	`)
+	if err != nil {
+		return err
+	}
+
+	for _, move := range taxonomyMoves {
+		_, err := tx.Exec(`
+			UPDATE ingredient_taxonomy SET parent_id = (SELECT id FROM ingredient_taxonomy WHERE name = ?)
+			WHERE name = ? AND parent_id = (SELECT id FROM ingredient_taxonomy WHERE name = ?)
+				AND EXISTS (SELECT 1 FROM ingredient_taxonomy WHERE name = ?)
+		`, move[2], move[0], move[1], move[2])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getTaxonomyNodes() ([]TaxonomyNode, error) {
+	rows, err := db.Query("SELECT id, name, parent_id FROM ingredient_taxonomy ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []TaxonomyNode
+	for rows.Next() {
+		var node TaxonomyNode
+		var parentId sql.NullInt64
+		if err := rows.Scan(&node.ID, &node.Name, &parentId); err != nil {
+			return nil, err
+		}
+		if parentId.Valid {
+			id := int(parentId.Int64)
+			node.ParentID = &id
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+// buildTaxonomyTree nests the flat node list under the node with parentId,
+// or under the roots when parentId is nil.
+func buildTaxonomyTree(nodes []TaxonomyNode, parentId *int) []TaxonomyNode {
+	tree := []TaxonomyNode{}
+	for _, node := range nodes {
+		if (parentId == nil && node.ParentID == nil) || (parentId != nil && node.ParentID != nil && *node.ParentID == *parentId) {
+			id := node.ID
+			node.Children = buildTaxonomyTree(nodes, &id)
+			tree = append(tree, node)
+		}
+	}
+	return tree
+}
+
+// expandIngredientTerms returns the normalized terms together with the names
+// of every taxonomy node below them, so "cheese" also yields "cheddar".
+func expandIngredientTerms(terms []string) []string {
+	nodes, err := getTaxonomyNodes()
+	if err != nil {
+		return terms
+	}
+
+	children := map[int][]TaxonomyNode{}
+	for _, node := range nodes {
+		if node.ParentID != nil {
+			children[*node.ParentID] = append(children[*node.ParentID], node)
+		}
+	}
+
+	seen := map[string]bool{}
+	var expanded []string
+	var add func(node TaxonomyNode)
+	add = func(node TaxonomyNode) {
+		name := normalizeIngredientName(node.Name)
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		expanded = append(expanded, name)
+		for _, child := range children[node.ID] {
+			add(child)
+		}
+	}
+
+	for _, term := range terms {
+		found := false
+		for _, node := range nodes {
+			if normalizeIngredientName(node.Name) == term {
+				add(node)
+				found = true
+			}
+		}
+		if !found && !seen[term] {
+			seen[term] = true
+			expanded = append(expanded, term)
+		}
+	}
+
+	return expanded
+}
+
+// filterRecipesByIngredientTerms keeps the recipes with at least one
+// ingredient whose name contains one of the normalized terms. ingredients
+// holds all the ingredients of each recipe by its id.
+func filterRecipesByIngredientTerms(recipes []Recipe, ingredients map[int][]Ingredient, terms []string) []Recipe {
+	var filtered []Recipe
+	for _, recipe := range recipes {
+		if hasIngredientTerm(ingredients[recipe.ID], terms) {
+			filtered = append(filtered, recipe)
+		}
+	}
+	return filtered
+}
+
+func hasIngredientTerm(ingredients []Ingredient, terms []string) bool {
+	for _, ingredient := range ingredients {
+		name := normalizeIngredientName(ingredient.Name)
+		for _, term := range terms {
+			if nameContainsTerm(name, term) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitIngredientTerms turns a comma separated query value into normalized
+// terms, dropping empty entries.
+func splitIngredientTerms(value string) []string {
+	var terms []string
+	for _, part := range strings.Split(value, ",") {
+		if term := normalizeIngredientName(part); term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// groupIngredientNames files every ingredient name under the most specific
+// taxonomy node it matches and returns the taxonomy tree pruned to the
+// branches that have ingredients. Names that match nothing go under "other".
+func groupIngredientNames(names []string) ([]TaxonomyNode, error) {
+	nodes, err := getTaxonomyNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	depth := taxonomyDepths(nodes)
+	grouped := map[int][]string{}
+	var other []string
+	for _, name := range names {
+		best := matchTaxonomyNode(nodes, depth, normalizeIngredientName(name))
+		if best == 0 {
+			other = append(other, name)
+		} else {
+			grouped[best] = append(grouped[best], name)
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Ingredients = grouped[nodes[i].ID]
+		sort.Strings(nodes[i].Ingredients)
+	}
+
+	tree := pruneTaxonomyTree(buildTaxonomyTree(nodes, nil))
+	if len(other) > 0 {
+		sort.Strings(other)
+		tree = append(tree, TaxonomyNode{Name: "other", Ingredients: other})
+	}
+
+	return tree, nil
+}
+
+// taxonomyDepths returns how many ancestors every node has.
+func taxonomyDepths(nodes []TaxonomyNode) map[int]int {
+	depth := map[int]int{}
+	parents := map[int]*int{}
+	for _, node := range nodes {
+		parents[node.ID] = node.ParentID
+	}
+	for _, node := range nodes {
+		for parent := node.ParentID; parent != nil; parent = parents[*parent] {
+			depth[node.ID]++
+			if depth[node.ID] > len(nodes) {
+				break
+			}
+		}
+	}
+	return depth
+}
+
+// matchTaxonomyNode returns the most specific node the normalized ingredient
+// name contains, or 0 when it matches none.
+func matchTaxonomyNode(nodes []TaxonomyNode, depth map[int]int, normalized string) int {
+	best, bestDepth, bestLength := 0, -1, 0
+	for _, node := range nodes {
+		term := normalizeIngredientName(node.Name)
+		if !nameContainsTerm(normalized, term) {
+			continue
+		}
+		// Prefer the deepest node, then the longest name on the same level
+		if depth[node.ID] > bestDepth || (depth[node.ID] == bestDepth && len(term) > bestLength) {
+			best, bestDepth, bestLength = node.ID, depth[node.ID], len(term)
+		}
+	}
+	return best
+}
+
+// pruneTaxonomyTree drops the branches without any ingredients.
+func pruneTaxonomyTree(tree []TaxonomyNode) []TaxonomyNode {
+	pruned := []TaxonomyNode{}
+	for _, node := range tree {
+		node.Children = pruneTaxonomyTree(node.Children)
+		if len(node.Ingredients) > 0 || len(node.Children) > 0 {
+			if len(node.Children) == 0 {
+				node.Children = nil
+			}
+			pruned = append(pruned, node)
+		}
+	}
+	return pruned
+}
+
+func getTaxonomy(w http.ResponseWriter, r *http.Request) {
+	nodes, err := getTaxonomyNodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, buildTaxonomyTree(nodes, nil))
+}
+
+// isTaxonomyDescendant reports whether the node is id itself or lies below it.
+func isTaxonomyDescendant(nodeId int, id int) bool {
+	seen := map[int]bool{}
+	for current := nodeId; current != 0 && !seen[current]; {
+		if current == id {
+			return true
+		}
+		seen[current] = true
+
+		var parentId sql.NullInt64
+		if err := db.QueryRow("SELECT parent_id FROM ingredient_taxonomy WHERE id = ?", current).Scan(&parentId); err != nil {
+			return false
+		}
+		current = int(parentId.Int64)
+	}
+	return false
+}
+
+func taxonomyNodeExists(id int) bool {
+	var exists int
+	return db.QueryRow("SELECT 1 FROM ingredient_taxonomy WHERE id = ?", id).Scan(&exists) == nil
+}
+
+func getTaxonomyNodeById(id int) *TaxonomyNode {
+	nodes, err := getTaxonomyNodes()
+	if err != nil {
+		return nil
+	}
+	for _, node := range nodes {
+		if node.ID == id {
+			node.Children = buildTaxonomyTree(nodes, &id)
+			return &node
+		}
+	}
+	return nil
+}
+
+func createTaxonomyNode(w http.ResponseWriter, r *http.Request) {
+	var node TaxonomyNode
+	if !decodeBody(w, r, &node) {
+		return
+	}
+
+	node.Name = strings.TrimSpace(strings.ToLower(node.Name))
+	if node.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if node.ParentID != nil && !taxonomyNodeExists(*node.ParentID) {
+		http.Error(w, "Parent not found", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("INSERT INTO ingredient_taxonomy(name, parent_id) VALUES(?,?)", node.Name, node.ParentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	invalidateAllergenRules()
+
+	id, _ := result.LastInsertId()
+	writeJSON(w, http.StatusCreated, getTaxonomyNodeById(int(id)))
+}
+
+func updateTaxonomyNode(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	node := getTaxonomyNodeById(id)
+	if node == nil {
+		http.Error(w, "Taxonomy node not found", http.StatusNotFound)
+		return
+	}
+
+	// parent_id stays raw so that null (make it a root) can be told apart
+	// from leaving it out
+	var patch struct {
+		Name     *string         `json:"name"`
+		ParentID json.RawMessage `json:"parent_id"`
+	}
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	if patch.Name != nil {
+		node.Name = strings.TrimSpace(strings.ToLower(*patch.Name))
+		if node.Name == "" {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
+	}
+	if len(patch.ParentID) > 0 {
+		node.ParentID = nil
+		if err := json.Unmarshal(patch.ParentID, &node.ParentID); err != nil {
+			http.Error(w, "Invalid parent_id", http.StatusBadRequest)
+			return
+		}
+		if node.ParentID != nil {
+			if !taxonomyNodeExists(*node.ParentID) {
+				http.Error(w, "Parent not found", http.StatusBadRequest)
+				return
+			}
+			if isTaxonomyDescendant(*node.ParentID, id) {
+				http.Error(w, "A node cannot be moved below itself", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	_, err := db.Exec("UPDATE ingredient_taxonomy SET name = ?, parent_id = ? WHERE id = ?", node.Name, node.ParentID, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	invalidateAllergenRules()
+
+	writeJSON(w, http.StatusOK, getTaxonomyNodeById(id))
+}
+
+// deleteTaxonomyNode removes the node and moves its children up to its parent.
+func deleteTaxonomyNode(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	node := getTaxonomyNodeById(id)
+	if node == nil {
+		http.Error(w, "Taxonomy node not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE ingredient_taxonomy SET parent_id = ? WHERE parent_id = ?", node.ParentID, id); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM ingredient_taxonomy WHERE id = ?", id); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	invalidateAllergenRules()
+
+	w.WriteHeader(http.StatusNoContent)
+}
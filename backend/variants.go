@@ -0,0 +1,446 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RecipeVariant is a copy of a recipe together with what changed since.
+type RecipeVariant struct {
+	Recipe Recipe     `json:"recipe"`
+	Diff   RecipeDiff `json:"diff"`
+}
+
+// RecipeDiff lists what differs from one recipe to another. Ingredients are
+// matched by their normalized name and methods by their text, so a step
+// inserted in the middle does not show every later step as changed.
+type RecipeDiff struct {
+	Fields      []FieldChange  `json:"fields"`
+	Ingredients IngredientDiff `json:"ingredients"`
+	Methods     MethodDiff     `json:"methods"`
+}
+
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type IngredientDiff struct {
+	Added   []Ingredient       `json:"added"`
+	Removed []Ingredient       `json:"removed"`
+	Changed []IngredientChange `json:"changed"`
+}
+
+type IngredientChange struct {
+	From Ingredient `json:"from"`
+	To   Ingredient `json:"to"`
+}
+
+type MethodDiff struct {
+	Added   []Method       `json:"added"`
+	Removed []Method       `json:"removed"`
+	Changed []MethodChange `json:"changed"`
+}
+
+type MethodChange struct {
+	From Method `json:"from"`
+	To   Method `json:"to"`
+}
+
+func registerVariantRoutes(router *mux.Router) {
+	router.HandleFunc("/recipe/{id}/duplicate", duplicateRecipe).Methods("POST")
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/recipes/{id}/duplicate", duplicateRecipe).Methods("POST")
+	api.HandleFunc("/recipes/{id}/variants", getRecipeVariants).Methods("GET")
+	api.HandleFunc("/recipes/{id}/diff", getRecipeDiff).Methods("GET")
+}
+
+// duplicateRecipe copies the recipe with everything in it as a variant of
+// it, named after the original unless a name is passed.
+func duplicateRecipe(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if r.ContentLength != 0 && !decodeBody(w, r, &req) {
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = recipe.Name + " (copy)"
+	}
+
+	copyId, err := copyRecipe(recipe.ID, recipe.OwnerID, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	publishRecipeEvent(copyId, eventRecipeCreated)
+	writeJSON(w, http.StatusCreated, getRecipeById(copyId))
+}
+
+// copyRecipe deep-copies a recipe: its portion, ingredients, methods with
+// their ingredients and durations, image, dividers with their ingredients
+// and methods, tags and allergen overrides. The copy is added at the end of
+// the owner's recipes and records the original as its parent.
+func copyRecipe(id int, ownerId int, name string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	copyId, err := copyRecipeTx(tx, id, ownerId, name)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return copyId, tx.Commit()
+}
+
+func copyRecipeTx(tx *sql.Tx, id int, ownerId int, name string) (int, error) {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	result, err := tx.Exec(`
+		INSERT INTO recipes(name, url, createdAt, lastEditedAt, type, sortOrder, owner_id, parent_recipe_id)
+		SELECT ?, url, ?, ?, type, (SELECT COALESCE(MAX(sortOrder), 0) + 1 FROM recipes WHERE owner_id = ?), owner_id, id
+		FROM recipes WHERE id = ?
+	`, name, now, now, ownerId, id)
+	if err != nil {
+		return 0, err
+	}
+	lastId, _ := result.LastInsertId()
+	copyId := int(lastId)
+
+	for _, table := range []struct{ name, columns string }{
+		{"portions", "value, measurement"},
+		{"images", "url, filename"},
+	} {
+		if _, err := copyRecipeRows(tx, table.name, table.columns, id, copyId); err != nil {
+			return 0, err
+		}
+	}
+
+	ingredientIds, err := copyRecipeRows(tx, "ingredients", "name, measurement, value, sortOrder", id, copyId)
+	if err != nil {
+		return 0, err
+	}
+	methodIds, err := copyRecipeRows(tx, "methods", "value, sortOrder", id, copyId)
+	if err != nil {
+		return 0, err
+	}
+	dividerIds, err := copyRecipeRows(tx, "dividers", "title, sortOrder", id, copyId)
+	if err != nil {
+		return 0, err
+	}
+
+	links := []struct {
+		table       string
+		left, right string
+		leftIds     map[int]int
+		rightIds    map[int]int
+	}{
+		{"method_ingredients", "method_id", "ingredient_id", methodIds, ingredientIds},
+		{"divider_ingredients", "divider_id", "ingredient_id", dividerIds, ingredientIds},
+		{"divider_methods", "divider_id", "method_id", dividerIds, methodIds},
+	}
+	for _, link := range links {
+		if err := copyLinkRows(tx, link.table, link.left, link.right, link.leftIds, link.rightIds); err != nil {
+			return 0, err
+		}
+	}
+
+	for oldId, newId := range ingredientIds {
+		for _, table := range []struct{ name, columns string }{
+			{"ingredient_recipes", "recipe_id"},
+			{"ingredient_catalog_links", "catalog_id, name, manual"},
+		} {
+			_, err := tx.Exec("INSERT INTO "+table.name+"(ingredient_id, "+table.columns+") SELECT ?, "+table.columns+" FROM "+table.name+" WHERE ingredient_id = ?", newId, oldId)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	for oldId, newId := range methodIds {
+		_, err := tx.Exec(`
+			INSERT INTO method_durations(method_id, seconds, maxSeconds, kind, text, sortOrder)
+			SELECT ?, seconds, maxSeconds, kind, text, sortOrder FROM method_durations WHERE method_id = ?
+		`, newId, oldId)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, table := range []struct{ name, columns string }{
+		{"recipe_tags", "tag_id"},
+		{"recipe_allergen_overrides", "allergen, status"},
+		{"recipe_equipment", "equipment_id, source"},
+	} {
+		_, err := tx.Exec("INSERT INTO "+table.name+"(recipe_id, "+table.columns+") SELECT ?, "+table.columns+" FROM "+table.name+" WHERE recipe_id = ?", copyId, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := copyRecipeNotesTx(tx, id, copyId, ingredientIds, methodIds); err != nil {
+		return 0, err
+	}
+
+	return copyId, nil
+}
+
+// copyRecipeRows copies the rows of a recipe child table to another recipe
+// and returns the new id of every copied row by its old id.
+func copyRecipeRows(tx *sql.Tx, table string, columns string, fromId int, toId int) (map[int]int, error) {
+	rows, err := tx.Query("SELECT id FROM "+table+" WHERE recipe_id = ? ORDER BY id", fromId)
+	if err != nil {
+		return nil, err
+	}
+	var oldIds []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		oldIds = append(oldIds, id)
+	}
+	rows.Close()
+
+	ids := map[int]int{}
+	for _, oldId := range oldIds {
+		result, err := tx.Exec("INSERT INTO "+table+"("+columns+", recipe_id) SELECT "+columns+", ? FROM "+table+" WHERE id = ?", toId, oldId)
+		if err != nil {
+			return nil, err
+		}
+		newId, _ := result.LastInsertId()
+		ids[oldId] = int(newId)
+	}
+	return ids, nil
+}
+
+// copyLinkRows copies the rows of a join table between two copied tables,
+// pointing them at the copies.
+func copyLinkRows(tx *sql.Tx, table string, left string, right string, leftIds map[int]int, rightIds map[int]int) error {
+	for oldLeft, newLeft := range leftIds {
+		rows, err := tx.Query("SELECT "+right+" FROM "+table+" WHERE "+left+" = ?", oldLeft)
+		if err != nil {
+			return err
+		}
+		var newRights []int
+		for rows.Next() {
+			var oldRight int
+			if rows.Scan(&oldRight) == nil {
+				if newRight, ok := rightIds[oldRight]; ok {
+					newRights = append(newRights, newRight)
+				}
+			}
+		}
+		rows.Close()
+
+		for _, newRight := range newRights {
+			if _, err := tx.Exec("INSERT INTO "+table+"("+left+", "+right+") VALUES(?,?)", newLeft, newRight); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getRecipeVariants lists the recipes copied from this one, each with what
+// changed against it.
+func getRecipeVariants(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query("SELECT id FROM recipes WHERE parent_recipe_id = ? AND owner_id = ? ORDER BY id", recipe.ID, recipe.OwnerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	variants := []RecipeVariant{}
+	for _, id := range ids {
+		variant := getRecipeById(id)
+		variants = append(variants, RecipeVariant{Recipe: variant, Diff: diffRecipes(recipe, variant)})
+	}
+
+	writeJSON(w, http.StatusOK, variants)
+}
+
+// getRecipeDiff compares the recipe with ?against= another recipe, or with
+// the recipe it was copied from.
+func getRecipeDiff(w http.ResponseWriter, r *http.Request) {
+	recipe, ok := pathRecipe(w, r)
+	if !ok {
+		return
+	}
+
+	var againstId int
+	if value := r.URL.Query().Get("against"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "against must be a recipe id", http.StatusBadRequest)
+			return
+		}
+		againstId = id
+	} else if recipe.ParentRecipeID != nil {
+		againstId = *recipe.ParentRecipeID
+	} else {
+		http.Error(w, "The recipe is not a copy, pass ?against= a recipe id", http.StatusBadRequest)
+		return
+	}
+
+	against := getOwnedRecipe(againstId, recipe.OwnerID)
+	if against.ID == 0 {
+		http.Error(w, "Recipe to compare against not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, diffRecipes(against, recipe))
+}
+
+// diffRecipes lists what changed from one recipe to the other.
+func diffRecipes(from Recipe, to Recipe) RecipeDiff {
+	diff := RecipeDiff{Fields: []FieldChange{}}
+
+	fields := []struct{ name, from, to string }{
+		{"name", from.Name, to.Name},
+		{"url", from.Url, to.Url},
+		{"type", from.Type, to.Type},
+		{"portion", formatPortion(from.Portion), formatPortion(to.Portion)},
+	}
+	for _, field := range fields {
+		if field.from != field.to {
+			diff.Fields = append(diff.Fields, FieldChange{Field: field.name, From: field.from, To: field.to})
+		}
+	}
+
+	diff.Ingredients = diffIngredients(from.Ingredients, to.Ingredients)
+	diff.Methods = diffMethods(from.Methods, to.Methods)
+	return diff
+}
+
+func formatPortion(portion *Portion) string {
+	if portion == nil {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprintf("%g %s", portion.Value, portion.Measurement))
+}
+
+// diffIngredients matches ingredients by their normalized name. A matched
+// ingredient with another quantity or unit is changed.
+func diffIngredients(from []Ingredient, to []Ingredient) IngredientDiff {
+	diff := IngredientDiff{Added: []Ingredient{}, Removed: []Ingredient{}, Changed: []IngredientChange{}}
+
+	unmatched := map[string][]int{}
+	for i, ingredient := range from {
+		key := normalizeIngredientName(ingredient.Name)
+		unmatched[key] = append(unmatched[key], i)
+	}
+
+	matched := make([]bool, len(from))
+	for _, ingredient := range to {
+		key := normalizeIngredientName(ingredient.Name)
+		if len(unmatched[key]) == 0 {
+			diff.Added = append(diff.Added, ingredient)
+			continue
+		}
+		i := unmatched[key][0]
+		unmatched[key] = unmatched[key][1:]
+		matched[i] = true
+
+		original := from[i]
+		if original.Value != ingredient.Value || original.Measurement != ingredient.Measurement || original.Name != ingredient.Name {
+			diff.Changed = append(diff.Changed, IngredientChange{From: original, To: ingredient})
+		}
+	}
+
+	for i, ingredient := range from {
+		if !matched[i] {
+			diff.Removed = append(diff.Removed, ingredient)
+		}
+	}
+	return diff
+}
+
+// diffMethods keeps the longest run of unchanged steps in order. Between
+// two unchanged steps, removed and added steps are paired up as changed and
+// whatever is left over is removed or added.
+func diffMethods(from []Method, to []Method) MethodDiff {
+	diff := MethodDiff{Added: []Method{}, Removed: []Method{}, Changed: []MethodChange{}}
+
+	same := func(i, j int) bool {
+		return strings.TrimSpace(from[i].Value) == strings.TrimSpace(to[j].Value)
+	}
+
+	// common[i][j] is the length of the longest common run of from[i:] and to[j:]
+	common := make([][]int, len(from)+1)
+	for i := range common {
+		common[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			if same(i, j) {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	var removed, added []Method
+	flush := func() {
+		paired := min(len(removed), len(added))
+		for k := 0; k < paired; k++ {
+			diff.Changed = append(diff.Changed, MethodChange{From: removed[k], To: added[k]})
+		}
+		diff.Removed = append(diff.Removed, removed[paired:]...)
+		diff.Added = append(diff.Added, added[paired:]...)
+		removed, added = nil, nil
+	}
+
+	i, j := 0, 0
+	for i < len(from) && j < len(to) {
+		switch {
+		case same(i, j):
+			flush()
+			i++
+			j++
+		case common[i+1][j] >= common[i][j+1]:
+			removed = append(removed, from[i])
+			i++
+		default:
+			added = append(added, to[j])
+			j++
+		}
+	}
+	removed = append(removed, from[i:]...)
+	added = append(added, to[j:]...)
+	flush()
+
+	return diff
+}
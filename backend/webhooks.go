@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Webhook posts the events of the owner's recipes to a URL of their own,
+// such as a chat bot or a kitchen display. Events lists the event types it
+// wants: "recipe.created", every event of a resource with "recipe.*", or
+// everything with "*".
+type Webhook struct {
+	ID           int      `json:"id"`
+	Url          string   `json:"url"`
+	Events       []string `json:"events"`
+	Secret       string   `json:"secret,omitempty"`
+	Active       bool     `json:"active"`
+	CreatedAt    string   `json:"createdAt"`
+	LastEditedAt string   `json:"lastEditedAt"`
+}
+
+// WebhookDelivery is one event queued for a webhook, together with the
+// outcome of its latest attempt.
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	WebhookID      int             `json:"webhook_id"`
+	Event          string          `json:"event"`
+	RecipeID       int             `json:"recipe_id"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *string         `json:"nextAttemptAt"`
+	LastAttemptAt  *string         `json:"lastAttemptAt"`
+	ResponseStatus *int            `json:"responseStatus"`
+	Error          *string         `json:"error"`
+	ReplayOf       *int            `json:"replay_of"`
+	CreatedAt      string          `json:"createdAt"`
+	DeliveredAt    *string         `json:"deliveredAt"`
+}
+
+// WebhookPayload is the JSON body posted to the webhook. Recipe is left out
+// once the recipe is deleted.
+type WebhookPayload struct {
+	Event    string  `json:"event"`
+	Resource string  `json:"resource"`
+	RecipeID int     `json:"recipe_id"`
+	Version  int     `json:"version"`
+	Time     string  `json:"time"`
+	Recipe   *Recipe `json:"recipe,omitempty"`
+}
+
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+)
+
+var webhookStatuses = []string{webhookPending, webhookDelivered, webhookFailed}
+
+// webhookEventTypes are the event types a webhook can subscribe to.
+var webhookEventTypes = []string{
+	eventRecipeCreated, eventRecipeUpdated, eventRecipeDeleted, eventRecipeReordered,
+	eventPortionUpdated, eventPortionDeleted,
+	eventIngredientCreated, eventIngredientUpdated, eventIngredientDeleted,
+	eventMethodCreated, eventMethodUpdated, eventMethodDeleted,
+	eventImageUpdated, eventImageDeleted,
+	eventDividerCreated, eventDividerUpdated, eventDividerDeleted,
+	eventTagsUpdated, eventAllergensUpdated, eventEquipmentUpdated,
+	eventNoteCreated, eventNoteUpdated, eventNoteDeleted,
+}
+
+const (
+	// webhookMaxAttempts is how many times a delivery is tried before it is
+	// marked failed. With the backoff below that spans about a day.
+	webhookMaxAttempts = 10
+	webhookFirstRetry  = 30 * time.Second
+	webhookMaxRetry    = 6 * time.Hour
+	webhookTimeout     = 10 * time.Second
+	webhookPoll        = 15 * time.Second
+	// webhookWorkers is how many deliveries are sent at once, so a slow
+	// endpoint holds up one worker rather than every other subscriber.
+	webhookWorkers = 4
+	// webhookErrorLength caps how much of a failed response is kept.
+	webhookErrorLength = 1024
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// webhookWake tells the delivery worker that something was queued.
+var webhookWake = make(chan struct{}, 1)
+
+func registerWebhookRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/webhooks", getWebhooks).Methods("GET")
+	api.HandleFunc("/webhooks", createWebhook).Methods("POST")
+	api.HandleFunc("/webhooks/{id}", getWebhook).Methods("GET")
+	api.HandleFunc("/webhooks/{id}", updateWebhook).Methods("PATCH")
+	api.HandleFunc("/webhooks/{id}", deleteWebhook).Methods("DELETE")
+	api.HandleFunc("/webhooks/{id}/deliveries", getWebhookDeliveries).Methods("GET")
+	api.HandleFunc("/webhooks/{id}/deliveries/{deliveryId}", getWebhookDelivery).Methods("GET")
+	api.HandleFunc("/webhooks/{id}/deliveries/{deliveryId}/replay", replayWebhookDelivery).Methods("POST")
+}
+
+const webhookColumns = "id, url, events, active, createdAt, lastEditedAt"
+
+func scanWebhook(row interface{ Scan(...any) error }, webhook *Webhook) error {
+	var events string
+	err := row.Scan(&webhook.ID, &webhook.Url, &events, &webhook.Active, &webhook.CreatedAt, &webhook.LastEditedAt)
+	webhook.Events = strings.Split(events, ",")
+	return err
+}
+
+const webhookDeliveryColumns = `id, webhook_id, event, recipe_id, payload, status, attempts, nextAttemptAt,
+	lastAttemptAt, responseStatus, error, replayOf, createdAt, deliveredAt`
+
+func scanWebhookDelivery(row interface{ Scan(...any) error }, delivery *WebhookDelivery) error {
+	var payload string
+	err := row.Scan(&delivery.ID, &delivery.WebhookID, &delivery.Event, &delivery.RecipeID, &payload, &delivery.Status,
+		&delivery.Attempts, &delivery.NextAttemptAt, &delivery.LastAttemptAt, &delivery.ResponseStatus, &delivery.Error,
+		&delivery.ReplayOf, &delivery.CreatedAt, &delivery.DeliveredAt)
+	delivery.Payload = json.RawMessage(payload)
+	return err
+}
+
+func pathWebhook(w http.ResponseWriter, r *http.Request) (*Webhook, bool) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return nil, false
+	}
+
+	var webhook Webhook
+	err := scanWebhook(db.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = ? AND owner_id = ?", id, currentUser(r).ID), &webhook)
+	if err != nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return nil, false
+	}
+	return &webhook, true
+}
+
+// validateWebhook checks the URL and event types of a webhook.
+func validateWebhook(webhook Webhook) error {
+	parsed, err := url.Parse(webhook.Url)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+
+	if len(webhook.Events) == 0 {
+		return fmt.Errorf("at least one event is required, such as recipe.created, recipe.* or *")
+	}
+	for _, event := range webhook.Events {
+		resource, change, _ := strings.Cut(event, ".")
+		switch {
+		case event == "*":
+		case change == "*" && slices.Contains(eventResources, resource):
+		case slices.Contains(webhookEventTypes, event):
+		default:
+			return fmt.Errorf("unknown event %q, expected one of %s", event, strings.Join(webhookEventTypes, ", "))
+		}
+	}
+	return nil
+}
+
+// webhookWants reports whether the event types of a webhook match the event.
+func webhookWants(events []string, event Event) bool {
+	for _, pattern := range events {
+		if pattern == "*" || pattern == event.Type || pattern == event.Resource+".*" {
+			return true
+		}
+	}
+	return false
+}
+
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT "+webhookColumns+" FROM webhooks WHERE owner_id = ? ORDER BY id", currentUser(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		scanWebhook(rows, &webhook)
+		webhooks = append(webhooks, webhook)
+	}
+
+	writeJSON(w, http.StatusOK, webhooks)
+}
+
+func getWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := pathWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, webhook)
+}
+
+// createWebhook adds a webhook. A secret is generated when none is passed;
+// like API tokens it is only returned in this response.
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook := Webhook{Active: true}
+	if !decodeBody(w, r, &webhook) {
+		return
+	}
+
+	webhook.Url = strings.TrimSpace(webhook.Url)
+	if err := validateWebhook(webhook); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if webhook.Secret == "" {
+		webhook.Secret = generateToken()
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	result, err := db.Exec(`
+		INSERT INTO webhooks(owner_id, url, events, secret, active, createdAt, lastEditedAt) VALUES(?,?,?,?,?,?,?)
+	`, currentUser(r).ID, webhook.Url, strings.Join(webhook.Events, ","), webhook.Secret, webhook.Active, now, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	var created Webhook
+	if err := scanWebhook(db.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = ?", id), &created); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	created.Secret = webhook.Secret
+
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// updateWebhook changes the url, events, secret or active flag. Pending
+// deliveries of an inactive webhook wait until it is active again.
+func updateWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := pathWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	var patch struct {
+		Url    *string  `json:"url"`
+		Events []string `json:"events"`
+		Secret *string  `json:"secret"`
+		Active *bool    `json:"active"`
+	}
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	if patch.Url != nil {
+		webhook.Url = strings.TrimSpace(*patch.Url)
+	}
+	if patch.Events != nil {
+		webhook.Events = patch.Events
+	}
+	if patch.Active != nil {
+		webhook.Active = *patch.Active
+	}
+	if err := validateWebhook(*webhook); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if patch.Secret != nil && *patch.Secret == "" {
+		http.Error(w, "secret cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	_, err := db.Exec(`
+		UPDATE webhooks SET url = ?, events = ?, active = ?, lastEditedAt = ? WHERE id = ?
+	`, webhook.Url, strings.Join(webhook.Events, ","), webhook.Active, now, webhook.ID)
+	if err == nil && patch.Secret != nil {
+		_, err = db.Exec("UPDATE webhooks SET secret = ? WHERE id = ?", *patch.Secret, webhook.ID)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	webhook.LastEditedAt = now
+
+	wakeWebhookWorker()
+	writeJSON(w, http.StatusOK, webhook)
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := pathWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	if err := removeWebhooks("id", webhook.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeWebhooks deletes the webhooks matching the column, e.g. "owner_id",
+// together with their delivery log.
+func removeWebhooks(column string, id int) error {
+	_, err := db.Exec("DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE "+column+" = ?)", id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM webhooks WHERE "+column+" = ?", id)
+	return err
+}
+
+// getWebhookDeliveries lists the delivery log of a webhook, newest first,
+// optionally only those with ?status=pending, delivered or failed.
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := pathWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries WHERE webhook_id = ?"
+	args := []any{webhook.ID}
+	if status := r.URL.Query().Get("status"); status != "" {
+		if !slices.Contains(webhookStatuses, status) {
+			http.Error(w, fmt.Sprintf("status must be one of %s", strings.Join(webhookStatuses, ", ")), http.StatusBadRequest)
+			return
+		}
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+
+	rows, err := db.Query(query+" ORDER BY id DESC LIMIT 100", args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		scanWebhookDelivery(rows, &delivery)
+		deliveries = append(deliveries, delivery)
+	}
+
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+func pathWebhookDelivery(w http.ResponseWriter, r *http.Request) (*WebhookDelivery, bool) {
+	webhook, ok := pathWebhook(w, r)
+	if !ok {
+		return nil, false
+	}
+	deliveryId, ok := pathID(w, r, "deliveryId")
+	if !ok {
+		return nil, false
+	}
+
+	var delivery WebhookDelivery
+	err := scanWebhookDelivery(db.QueryRow("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = ? AND webhook_id = ?", deliveryId, webhook.ID), &delivery)
+	if err != nil {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return nil, false
+	}
+	return &delivery, true
+}
+
+func getWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := pathWebhookDelivery(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, delivery)
+}
+
+// replayWebhookDelivery queues the payload of a past delivery again as a new
+// delivery, leaving the log of the original as it was.
+func replayWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := pathWebhookDelivery(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := insertWebhookDelivery(db, delivery.WebhookID, delivery.Event, delivery.RecipeID, string(delivery.Payload), &delivery.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wakeWebhookWorker()
+
+	var replay WebhookDelivery
+	if err := scanWebhookDelivery(db.QueryRow("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = ?", id), &replay); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, replay)
+}
+
+func insertWebhookDelivery(e execer, webhookId int, event string, recipeId int, payload string, replayOf *int) (int, error) {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	result, err := e.Exec(`
+		INSERT INTO webhook_deliveries(webhook_id, event, recipe_id, payload, status, attempts, nextAttemptAt, replayOf, createdAt)
+		VALUES(?,?,?,?,?,0,?,?,?)
+	`, webhookId, event, recipeId, payload, webhookPending, now, replayOf, now)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := result.LastInsertId()
+	return int(id), nil
+}
+
+// queueWebhookDeliveries stores a delivery of the event for every active
+// webhook of the owner that wants it, before the request that published the
+// event returns, so it survives a restart. The payload is built once, so a
+// later replay sends the recipe as it was at the time of the event. Only the
+// sending is left to deliverWebhooks.
+func queueWebhookDeliveries(event Event) {
+	rows, err := db.Query("SELECT "+webhookColumns+" FROM webhooks WHERE owner_id = ? AND active = 1", event.ownerId)
+	if err != nil {
+		fmt.Println("Error queueing webhooks:", err)
+		return
+	}
+
+	var webhookIds []int
+	for rows.Next() {
+		var webhook Webhook
+		if scanWebhook(rows, &webhook) == nil && webhookWants(webhook.Events, event) {
+			webhookIds = append(webhookIds, webhook.ID)
+		}
+	}
+	rows.Close()
+	if len(webhookIds) == 0 {
+		return
+	}
+
+	payload := WebhookPayload{Event: event.Type, Resource: event.Resource, RecipeID: event.RecipeID, Version: event.Version, Time: event.Time}
+	if event.Type != eventRecipeDeleted {
+		if recipe := getRecipeById(event.RecipeID); recipe.ID != 0 {
+			payload.Recipe = &recipe
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Println("Error queueing webhooks:", err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("Error queueing webhooks:", err)
+		return
+	}
+	for _, webhookId := range webhookIds {
+		if _, err := insertWebhookDelivery(tx, webhookId, event.Type, event.RecipeID, string(body), nil); err != nil {
+			tx.Rollback()
+			fmt.Println("Error queueing webhooks:", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println("Error queueing webhooks:", err)
+		return
+	}
+	wakeWebhookWorker()
+}
+
+func wakeWebhookWorker() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverWebhooks sends the queued deliveries that are due, whenever
+// something is queued and otherwise every webhookPoll. Deliveries survive a
+// restart since they are only ever read from the database.
+func deliverWebhooks() {
+	ticker := time.NewTicker(webhookPoll)
+	defer ticker.Stop()
+
+	for {
+		for deliverDueWebhooks() {
+		}
+
+		select {
+		case <-webhookWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverDueWebhooks sends one batch of due deliveries, webhookWorkers at a
+// time, and reports whether there may be more.
+func deliverDueWebhooks() bool {
+	const batchSize = 20
+
+	rows, err := db.Query(`
+		SELECT d.id, d.event, d.payload, d.attempts, w.url, w.secret FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = ? AND d.nextAttemptAt <= ? AND w.active = 1
+		ORDER BY d.nextAttemptAt, d.id LIMIT ?
+	`, webhookPending, time.Now().Format("2006-01-02 15:04:05"), batchSize)
+	if err != nil {
+		fmt.Println("Error loading webhook deliveries:", err)
+		return false
+	}
+
+	type due struct {
+		id       int
+		event    string
+		payload  string
+		attempts int
+		url      string
+		secret   string
+	}
+	var deliveries []due
+	for rows.Next() {
+		var d due
+		if rows.Scan(&d.id, &d.event, &d.payload, &d.attempts, &d.url, &d.secret) == nil {
+			deliveries = append(deliveries, d)
+		}
+	}
+	rows.Close()
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, webhookWorkers)
+	for _, d := range deliveries {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func() {
+			defer wg.Done()
+			status, err := sendWebhook(d.url, d.secret, d.id, d.event, []byte(d.payload))
+			recordWebhookAttempt(d.id, d.attempts+1, status, err)
+			<-workers
+		}()
+	}
+	wg.Wait()
+	return len(deliveries) == batchSize
+}
+
+// signWebhook returns the X-RecipeMe-Signature of a payload: the hex
+// HMAC-SHA256 of the body keyed with the webhook secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook posts the payload and returns the response status. Any status
+// outside 2xx is an error.
+func sendWebhook(target string, secret string, deliveryId int, event string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "RecipeMe-Webhook")
+	req.Header.Set("X-RecipeMe-Event", event)
+	req.Header.Set("X-RecipeMe-Delivery", fmt.Sprint(deliveryId))
+	req.Header.Set("X-RecipeMe-Signature", signWebhook(secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, webhookErrorLength))
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// webhookBackoff is the wait before the next attempt, doubling from
+// webhookFirstRetry up to webhookMaxRetry.
+func webhookBackoff(attempts int) time.Duration {
+	wait := webhookFirstRetry
+	for i := 1; i < attempts && wait < webhookMaxRetry; i++ {
+		wait *= 2
+	}
+	return min(wait, webhookMaxRetry)
+}
+
+func recordWebhookAttempt(id int, attempts int, status int, sendErr error) {
+	now := time.Now()
+	var responseStatus *int
+	if status != 0 {
+		responseStatus = &status
+	}
+
+	var err error
+	switch {
+	case sendErr == nil:
+		_, err = db.Exec(`
+			UPDATE webhook_deliveries SET status = ?, attempts = ?, lastAttemptAt = ?, responseStatus = ?, error = NULL,
+				nextAttemptAt = NULL, deliveredAt = ? WHERE id = ?
+		`, webhookDelivered, attempts, now.Format("2006-01-02 15:04:05"), responseStatus, now.Format("2006-01-02 15:04:05"), id)
+	case attempts >= webhookMaxAttempts:
+		_, err = db.Exec(`
+			UPDATE webhook_deliveries SET status = ?, attempts = ?, lastAttemptAt = ?, responseStatus = ?, error = ?,
+				nextAttemptAt = NULL WHERE id = ?
+		`, webhookFailed, attempts, now.Format("2006-01-02 15:04:05"), responseStatus, sendErr.Error(), id)
+	default:
+		_, err = db.Exec(`
+			UPDATE webhook_deliveries SET attempts = ?, lastAttemptAt = ?, responseStatus = ?, error = ?,
+				nextAttemptAt = ? WHERE id = ?
+		`, attempts, now.Format("2006-01-02 15:04:05"), responseStatus, sendErr.Error(),
+			now.Add(webhookBackoff(attempts)).Format("2006-01-02 15:04:05"), id)
+	}
+	if err != nil {
+		fmt.Println("Error recording webhook delivery:", err)
+	}
+}
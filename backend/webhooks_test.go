@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func insertTestWebhook(t *testing.T, ownerId int, target string, secret string) int {
+	t.Helper()
+	result, err := db.Exec(`
+		INSERT INTO webhooks(owner_id, url, events, secret, active, createdAt, lastEditedAt) VALUES(?,?,'*',?,1,'','')
+	`, ownerId, target, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	return int(id)
+}
+
+func loadDelivery(t *testing.T, id int) WebhookDelivery {
+	t.Helper()
+	var delivery WebhookDelivery
+	if err := scanWebhookDelivery(db.QueryRow("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = ?", id), &delivery); err != nil {
+		t.Fatal(err)
+	}
+	return delivery
+}
+
+// webhookReceiver records the requests it gets and answers with the next of
+// statuses, then 200.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func startWebhookReceiver(t *testing.T, statuses ...int) (*webhookReceiver, *httptest.Server) {
+	t.Helper()
+	receiver := &webhookReceiver{statuses: statuses}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		receiver.requests = append(receiver.requests, r)
+		receiver.bodies = append(receiver.bodies, body)
+
+		status := http.StatusOK
+		if len(receiver.statuses) > 0 {
+			status, receiver.statuses = receiver.statuses[0], receiver.statuses[1:]
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, http.StatusText(status))
+	}))
+	t.Cleanup(server.Close)
+	return receiver, server
+}
+
+func TestSendWebhookSignature(t *testing.T) {
+	receiver, server := startWebhookReceiver(t)
+	body := []byte(`{"event":"recipe.created","recipe_id":3}`)
+
+	status, err := sendWebhook(server.URL, "s3cret", 42, eventRecipeCreated, body)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("sendWebhook = %d, %v, want 200", status, err)
+	}
+
+	request := receiver.requests[0]
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(receiver.bodies[0])
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); request.Header.Get("X-RecipeMe-Signature") != want {
+		t.Errorf("X-RecipeMe-Signature = %q, want %q", request.Header.Get("X-RecipeMe-Signature"), want)
+	}
+	if string(receiver.bodies[0]) != string(body) {
+		t.Errorf("body = %s, want %s", receiver.bodies[0], body)
+	}
+	if request.Header.Get("X-RecipeMe-Event") != eventRecipeCreated || request.Header.Get("X-RecipeMe-Delivery") != "42" {
+		t.Errorf("headers = %v", request.Header)
+	}
+}
+
+func TestSendWebhookFailure(t *testing.T) {
+	_, server := startWebhookReceiver(t, http.StatusServiceUnavailable)
+
+	status, err := sendWebhook(server.URL, "s3cret", 1, eventRecipeCreated, []byte("{}"))
+	if status != http.StatusServiceUnavailable || err == nil || !strings.Contains(err.Error(), "Service Unavailable") {
+		t.Fatalf("sendWebhook = %d, %v, want 503 with the response as error", status, err)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		7:  32 * time.Minute,
+		10: 4*time.Hour + 16*time.Minute,
+		11: webhookMaxRetry,
+		50: webhookMaxRetry,
+	} {
+		if got := webhookBackoff(attempts); got != want {
+			t.Errorf("webhookBackoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	openSchemaDB(t)
+	receiver, server := startWebhookReceiver(t, http.StatusInternalServerError)
+	webhookId := insertTestWebhook(t, 1, server.URL, "s3cret")
+	id, err := insertWebhookDelivery(db, webhookId, eventRecipeUpdated, 3, `{"event":"recipe.updated"}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliverDueWebhooks()
+	delivery := loadDelivery(t, id)
+	if delivery.Status != webhookPending || delivery.Attempts != 1 || *delivery.ResponseStatus != http.StatusInternalServerError {
+		t.Fatalf("after a failed attempt got %+v", delivery)
+	}
+	retryAt, _ := time.ParseInLocation("2006-01-02 15:04:05", *delivery.NextAttemptAt, time.Local)
+	if wait := time.Until(retryAt); wait < webhookFirstRetry-2*time.Second || wait > webhookFirstRetry {
+		t.Errorf("next attempt in %s, want %s", wait, webhookFirstRetry)
+	}
+
+	// not due yet
+	deliverDueWebhooks()
+	if len(receiver.requests) != 1 {
+		t.Fatalf("retried %d times before the backoff passed", len(receiver.requests)-1)
+	}
+
+	db.Exec("UPDATE webhook_deliveries SET nextAttemptAt = '2000-01-01 00:00:00' WHERE id = ?", id)
+	deliverDueWebhooks()
+	delivery = loadDelivery(t, id)
+	if delivery.Status != webhookDelivered || delivery.Attempts != 2 || delivery.DeliveredAt == nil || delivery.NextAttemptAt != nil || delivery.Error != nil {
+		t.Fatalf("after a successful retry got %+v", delivery)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	openSchemaDB(t)
+	webhookId := insertTestWebhook(t, 1, "http://127.0.0.1:0", "s3cret")
+	id, err := insertWebhookDelivery(db, webhookId, eventRecipeUpdated, 3, "{}", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recordWebhookAttempt(id, webhookMaxAttempts-1, 0, fmt.Errorf("connection refused"))
+	if delivery := loadDelivery(t, id); delivery.Status != webhookPending || delivery.NextAttemptAt == nil || delivery.ResponseStatus != nil {
+		t.Fatalf("before the last attempt got %+v", delivery)
+	}
+
+	recordWebhookAttempt(id, webhookMaxAttempts, http.StatusBadGateway, fmt.Errorf("502 Bad Gateway"))
+	delivery := loadDelivery(t, id)
+	if delivery.Status != webhookFailed || delivery.NextAttemptAt != nil || *delivery.Error != "502 Bad Gateway" || *delivery.ResponseStatus != http.StatusBadGateway {
+		t.Fatalf("after the last attempt got %+v", delivery)
+	}
+}
+
+func TestPublishQueuesWebhookDeliveries(t *testing.T) {
+	openSchemaDB(t)
+	webhookId := insertTestWebhook(t, 1, "http://127.0.0.1:0", "s3cret")
+
+	publishEvent(Event{Type: eventRecipeDeleted, RecipeID: 3, Version: 4, ownerId: 1})
+
+	var payload string
+	if err := db.QueryRow("SELECT payload FROM webhook_deliveries WHERE webhook_id = ?", webhookId).Scan(&payload); err != nil {
+		t.Fatalf("no delivery was stored when the event was published: %v", err)
+	}
+	if !strings.Contains(payload, `"version":4`) {
+		t.Errorf("payload = %s, want the version of the event", payload)
+	}
+}
+
+func TestSlowWebhookDoesNotHoldUpOthers(t *testing.T) {
+	openSchemaDB(t)
+	fast, fastServer := startWebhookReceiver(t)
+	delivered := make(chan struct{})
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-delivered:
+		case <-time.After(2 * time.Second):
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+	}))
+	t.Cleanup(slowServer.Close)
+
+	slowId, _ := insertWebhookDelivery(db, insertTestWebhook(t, 1, slowServer.URL, "s3cret"), eventRecipeUpdated, 3, "{}", nil)
+	fastId, _ := insertWebhookDelivery(db, insertTestWebhook(t, 1, fastServer.URL, "s3cret"), eventRecipeUpdated, 3, "{}", nil)
+	go func() {
+		for {
+			fast.mu.Lock()
+			got := len(fast.requests)
+			fast.mu.Unlock()
+			if got > 0 {
+				close(delivered)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	deliverDueWebhooks()
+	if delivery := loadDelivery(t, fastId); delivery.Status != webhookDelivered {
+		t.Fatalf("fast delivery = %+v", delivery)
+	}
+	if delivery := loadDelivery(t, slowId); delivery.Status != webhookDelivered {
+		t.Errorf("slow delivery = %+v, want it answered once the fast one went out", delivery)
+	}
+}
+
+// serveWebhookRoutes serves the webhook routes as the user.
+func serveWebhookRoutes(userId int, request *http.Request) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	registerWebhookRoutes(router)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request.WithContext(context.WithValue(request.Context(), userContextKey, &User{ID: userId})))
+	return recorder
+}
+
+func TestReplayWebhookDelivery(t *testing.T) {
+	openSchemaDB(t)
+	receiver, server := startWebhookReceiver(t)
+	webhookId := insertTestWebhook(t, 1, server.URL, "s3cret")
+	payload := `{"event":"recipe.updated","recipe_id":3,"version":2}`
+	id, _ := insertWebhookDelivery(db, webhookId, eventRecipeUpdated, 3, payload, nil)
+	deliverDueWebhooks()
+	original := loadDelivery(t, id)
+
+	path := fmt.Sprintf("/api/v1/webhooks/%d/deliveries/%d/replay", webhookId, id)
+	if recorder := serveWebhookRoutes(2, httptest.NewRequest("POST", path, nil)); recorder.Code != http.StatusNotFound {
+		t.Fatalf("replay of another user's delivery = %d, want 404", recorder.Code)
+	}
+
+	recorder := serveWebhookRoutes(1, httptest.NewRequest("POST", path, nil))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("replay = %d %s, want 201", recorder.Code, recorder.Body)
+	}
+	var replay WebhookDelivery
+	json.NewDecoder(recorder.Body).Decode(&replay)
+	if replay.ID == id || replay.ReplayOf == nil || *replay.ReplayOf != id || replay.Status != webhookPending || replay.Attempts != 0 {
+		t.Fatalf("replay = %+v", replay)
+	}
+	if string(replay.Payload) != payload {
+		t.Errorf("replay payload = %s, want %s", replay.Payload, payload)
+	}
+	if after := loadDelivery(t, id); after.Status != original.Status || after.Attempts != original.Attempts || *after.DeliveredAt != *original.DeliveredAt {
+		t.Errorf("replay changed the original delivery to %+v", after)
+	}
+
+	deliverDueWebhooks()
+	if len(receiver.bodies) != 2 || string(receiver.bodies[1]) != payload {
+		t.Fatalf("receiver got %d deliveries, want the payload twice", len(receiver.bodies))
+	}
+	if delivery := loadDelivery(t, replay.ID); delivery.Status != webhookDelivered {
+		t.Errorf("replay status = %s, want delivered", delivery.Status)
+	}
+}